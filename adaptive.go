@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With --adaptive-budget, the budget in bytes per second, or zero.
+var adaptiveBudgetRate float64
+
+// About how many bytes a ping adds to each direction on the wire beyond its
+// payload: the SSH channel data message with its padding and MAC, and TCP/IP
+// headers.
+const pingOverheadBytes = 92
+
+// How many recent samples the volatility of latency is judged over.
+const adaptiveWindow = 20
+
+// The volatility, as the median absolute deviation relative to the median, at
+// which pings are sent at the rate the budget allows. More volatile latency
+// brings them closer together, and calmer latency further apart, by up to
+// adaptiveRange times.
+const adaptiveCalm = 0.1
+
+const adaptiveRange = 4
+
+// How many pings' worth of unspent budget can be saved up while latency is
+// calm, to spend when it becomes volatile.
+const adaptiveBurst = 100
+
+// parseBandwidth parses a bandwidth like "200B/s", "10KB/m", or "1MB/h",
+// returning it in bytes per second.
+func parseBandwidth(s string) (bytesPerSecond float64, err error) {
+	amount, unit, ok := strings.Cut(s, "/")
+	number := strings.TrimSuffix(amount, "B")
+	scale := 1.0
+	if strings.HasSuffix(number, "K") {
+		scale = 1e3
+	} else if strings.HasSuffix(number, "M") {
+		scale = 1e6
+	}
+
+	n, parseErr := strconv.ParseFloat(strings.TrimRight(number, "KM"), 64)
+	if !ok || number == amount || parseErr != nil || n <= 0 {
+		err = fmt.Errorf("%q isn't a bandwidth like 200B/s or 10KB/m", s)
+		return
+	}
+
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		err = fmt.Errorf("%q: unit must be s, m, or h", s)
+		return
+	}
+
+	bytesPerSecond = n * scale / per.Seconds()
+	return
+}
+
+// An adaptivePacer schedules pings for --adaptive-budget. Unspent budget
+// accrues as credit, which pings spend, so that over time they use no more
+// than the budget. Within that, the gap between pings shrinks when latency is
+// volatile, to catch spikes in detail, and grows when it's calm.
+type adaptivePacer struct {
+	// The budget in bytes per second, and the cost of a ping in bytes.
+	budget float64
+	cost   float64
+
+	// Unspent budget in bytes as of updated.
+	credit  float64
+	updated time.Time
+
+	// The most recent samples.
+	recent []time.Duration
+
+	// For the report: when the first ping was sent, how many have been, and
+	// the shortest and longest gaps chosen.
+	started           time.Time
+	pings             int
+	shortest, longest time.Duration
+}
+
+func newAdaptivePacer(budget float64, payloadSize int) *adaptivePacer {
+	cost := float64(2 * (payloadSize + pingOverheadBytes))
+	return &adaptivePacer{budget: budget, cost: cost, credit: cost}
+}
+
+// period returns the gap between pings that spends exactly the budget.
+func (p *adaptivePacer) period() time.Duration {
+	return time.Duration(p.cost / p.budget * float64(time.Second))
+}
+
+// next records a ping, returning how long to wait before sending the next.
+func (p *adaptivePacer) next(t pingTimes) (wait time.Duration) {
+	now := time.Now()
+	if p.pings == 0 {
+		p.started = t.sent
+		p.updated = t.sent
+	}
+
+	p.pings++
+	p.credit += now.Sub(p.updated).Seconds() * p.budget
+	if limit := adaptiveBurst * p.cost; p.credit > limit {
+		p.credit = limit
+	}
+
+	p.credit -= p.cost
+	p.updated = now
+
+	p.recent = append(p.recent, t.rtt())
+	if len(p.recent) > adaptiveWindow {
+		p.recent = p.recent[1:]
+	}
+
+	// Choose the gap from this ping to the next by how volatile latency has
+	// been, once there are enough samples to tell. The median absolute
+	// deviation shrugs off an isolated spike, so also treat a sample of more
+	// than twice the median as a sign to look closer.
+	gap := p.period()
+	if len(p.recent) >= adaptiveWindow/4 {
+		scale := float64(adaptiveRange)
+		if m := median(p.recent); m > 0 {
+			if v := float64(medianAbsDeviation(p.recent)) / float64(m); v > 0 {
+				scale = adaptiveCalm / v
+			}
+
+			if t.rtt() > 2*m {
+				scale = 0
+			}
+		}
+
+		if scale < 1.0/adaptiveRange {
+			scale = 1.0 / adaptiveRange
+		} else if scale > adaptiveRange {
+			scale = adaptiveRange
+		}
+
+		gap = time.Duration(float64(gap) * scale)
+	}
+
+	// Never send a ping before there's credit to pay for it.
+	wait = gap - now.Sub(t.sent)
+	if need := time.Duration(-p.credit / p.budget * float64(time.Second)); wait < need {
+		wait = need
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+
+	gap = now.Add(wait).Sub(t.sent)
+	if p.pings == 1 || gap < p.shortest {
+		p.shortest = gap
+	}
+
+	if gap > p.longest {
+		p.longest = gap
+	}
+
+	return
+}
+
+// print reports how the pacer spent the budget.
+func (p *adaptivePacer) print() {
+	if p.pings < 2 {
+		return
+	}
+
+	elapsed := time.Since(p.started)
+	fmt.Printf(
+		"Adaptive sampling: %d pings %s to %s apart, about %.0f B/s of a %.0f B/s budget.\n",
+		p.pings,
+		strings.TrimSpace(formatLatency(p.shortest)),
+		strings.TrimSpace(formatLatency(p.longest)),
+		float64(p.pings)*p.cost/elapsed.Seconds(),
+		p.budget)
+}
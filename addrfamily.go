@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// addressFamily returns "4" or "6" if -4 or -6 is set, and "" otherwise.
+func addressFamily() string {
+	switch {
+	case *ipv4:
+		return "4"
+	case *ipv6:
+		return "6"
+	}
+
+	return ""
+}
+
+// compareAddressFamilies resolves the host's IPv4 and IPv6 addresses and
+// measures over each family in turn, printing a table comparing them.
+func compareAddressFamilies(ctx context.Context) (err error) {
+	if *ipv4 || *ipv6 {
+		err = fmt.Errorf("--compare-af can't be used with -4 or -6")
+		return
+	}
+
+	hostname, _, err := sshEndpoint(*host)
+	if err != nil {
+		return
+	}
+
+	ips, err := lookupHost(hostname)
+	if err != nil {
+		return
+	}
+
+	var v4, v6 net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip
+			}
+		} else if v6 == nil {
+			v6 = ip
+		}
+	}
+
+	var variants []variant
+	if v4 != nil {
+		variants = append(variants, variant{"IPv4 (" + v4.String() + ")", transportOptions{addressFamily: "4"}})
+	} else {
+		fmt.Printf("%s has no IPv4 address.\n", hostname)
+	}
+
+	if v6 != nil {
+		variants = append(variants, variant{"IPv6 (" + v6.String() + ")", transportOptions{addressFamily: "6"}})
+	} else {
+		fmt.Printf("%s has no IPv6 address.\n", hostname)
+	}
+
+	if len(variants) == 0 {
+		err = fmt.Errorf("no addresses found for %s", hostname)
+		return
+	}
+
+	err = compareVariants(ctx, "Address family", variants)
+	return
+}
+
+// addressOptions returns transport options for connecting to the given IP
+// address of the host, while still checking host keys against its name.
+// hostname and port are as returned by sshEndpoint.
+func addressOptions(ip net.IP, hostname, port string) (opts transportOptions) {
+	if *transportKind == "native" {
+		opts.address = ip.String()
+		return
+	}
+
+	alias := hostname
+	if port != "22" {
+		alias = "[" + hostname + "]:" + port
+	}
+
+	opts.sshArgs = []string{"-o", "HostName=" + ip.String(), "-o", "HostKeyAlias=" + alias}
+	return
+}
+
+// measurePerAddress resolves all of the host's addresses and measures each
+// in turn, printing a table of the results. This shows up a bad backend
+// behind a name with several addresses.
+func measurePerAddress(ctx context.Context) (err error) {
+	hostname, port, err := sshEndpoint(*host)
+	if err != nil {
+		return
+	}
+
+	// Report where an alias leads, since that's often the name of the
+	// load balancer or pool.
+	if cname, err := net.DefaultResolver.LookupCNAME(ctx, hostname); err == nil &&
+		strings.TrimSuffix(cname, ".") != strings.TrimSuffix(hostname, ".") {
+		fmt.Printf("%s is an alias for %s.\n", hostname, strings.TrimSuffix(cname, "."))
+	}
+
+	ips, err := lookupHost(hostname)
+	if err != nil {
+		return
+	}
+
+	var filtered []net.IP
+	for _, ip := range ips {
+		if (*ipv4 && ip.To4() == nil) || (*ipv6 && ip.To4() != nil) {
+			continue
+		}
+
+		filtered = append(filtered, ip)
+	}
+
+	if len(filtered) == 0 {
+		err = fmt.Errorf("no addresses found for %s", hostname)
+		return
+	}
+
+	results := make([]distribution, len(filtered))
+	errs := make([]error, len(filtered))
+	for i, ip := range filtered {
+		fmt.Printf("Measuring %s...\n", ip)
+		var r run
+		r, errs[i] = measure(ctx, addressOptions(ip, hostname, port))
+		results[i] = r.distribution()
+	}
+
+	// Flag addresses that are much slower than is typical for the host.
+	var medians []time.Duration
+	for i := range filtered {
+		if errs[i] == nil {
+			medians = append(medians, results[i].percentile(50))
+		}
+	}
+
+	var typical time.Duration
+	if len(medians) != 0 {
+		typical = median(medians)
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("%-40s %8s %8s %8s %8s %8s\n", "Address", "Samples", "p05", "p50", "p95", "Max")
+	for i, ip := range filtered {
+		if errs[i] != nil {
+			fmt.Printf("%-40s %v\n", ip, errs[i])
+			continue
+		}
+
+		s := results[i]
+		note := ""
+		if len(medians) > 1 && s.percentile(50) > typical*3/2 {
+			note = "  slow"
+		}
+
+		fmt.Printf(
+			"%-40s %8d %8s %8s %8s %8s%s\n",
+			ip,
+			s.count(),
+			formatLatency(s.percentile(5)),
+			formatLatency(s.percentile(50)),
+			formatLatency(s.percentile(95)),
+			formatLatency(s.max()),
+			note)
+	}
+
+	return
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Limits on typical latency (p50), jitter (p95 minus p50), and loss (the
+// fraction of pings that timed out) for a workload to feel a certain way.
+type experienceLimits struct {
+	p50    time.Duration
+	jitter time.Duration
+	loss   float64
+}
+
+// A workload whose experience --advise predicts: fine within the fine limits,
+// noticeable within the tolerable ones, and painful beyond them. The limits
+// are rules of thumb for how people perceive delay in each.
+type workload struct {
+	name      string
+	fine      experienceLimits
+	tolerable experienceLimits
+}
+
+var workloads = []workload{
+	{
+		name:      "Interactive shell",
+		fine:      experienceLimits{100 * time.Millisecond, 50 * time.Millisecond, 0.01},
+		tolerable: experienceLimits{250 * time.Millisecond, 150 * time.Millisecond, 0.05},
+	},
+	{
+		// Scrolling and cursor movement redraw the screen on every keystroke,
+		// so delay and its variation are felt more than at a prompt.
+		name:      "vim over ssh",
+		fine:      experienceLimits{50 * time.Millisecond, 20 * time.Millisecond, 0.005},
+		tolerable: experienceLimits{150 * time.Millisecond, 60 * time.Millisecond, 0.02},
+	},
+	{
+		// Tunnelled over TCP, a lost packet stalls the whole display until
+		// it's retransmitted, so loss hurts most here.
+		name:      "Port-forwarded RDP",
+		fine:      experienceLimits{60 * time.Millisecond, 20 * time.Millisecond, 0.001},
+		tolerable: experienceLimits{150 * time.Millisecond, 50 * time.Millisecond, 0.01},
+	},
+}
+
+// How long a transfer of --advise-transfer-gb can take and still be fine, or
+// tolerable.
+const (
+	transferFine      = 10 * time.Minute
+	transferTolerable = time.Hour
+)
+
+// exceeds returns a description of the first of the limits that the measured
+// values exceed, or the empty string if they exceed none.
+func (l experienceLimits) exceeds(p50, jitter time.Duration, loss float64) string {
+	switch {
+	case p50 > l.p50:
+		return fmt.Sprintf("p50 of %s is over %s", strings.TrimSpace(formatLatency(p50)), strings.TrimSpace(formatLatency(l.p50)))
+	case jitter > l.jitter:
+		return fmt.Sprintf("jitter of %s is over %s", strings.TrimSpace(formatLatency(jitter)), strings.TrimSpace(formatLatency(l.jitter)))
+	case loss > l.loss:
+		return fmt.Sprintf("loss of %.1f%% is over %.1f%%", 100*loss, 100*l.loss)
+	}
+
+	return ""
+}
+
+// printAdvice prints how the latency, jitter, and loss measured in the run
+// are expected to feel for common workloads.
+func printAdvice(r run) {
+	d := r.distribution()
+	if d.count() == 0 {
+		return
+	}
+
+	p50 := d.percentile(50)
+	jitter := d.percentile(95) - p50
+	timeouts := r.timeouts()
+	loss := float64(timeouts) / float64(d.count()+timeouts)
+
+	fmt.Printf(
+		"Expected experience (p50 %s, jitter %s, loss %.1f%%):\n",
+		strings.TrimSpace(formatLatency(p50)),
+		strings.TrimSpace(formatLatency(jitter)),
+		100*loss)
+
+	for _, w := range workloads {
+		verdict, why := "fine", "within limits"
+		if reason := w.fine.exceeds(p50, jitter, loss); reason != "" {
+			verdict, why = "noticeable", reason
+			if reason := w.tolerable.exceeds(p50, jitter, loss); reason != "" {
+				verdict, why = "painful", reason
+			}
+		}
+
+		fmt.Printf("  %-24s %-11s %s\n", w.name, verdict, why)
+	}
+
+	// A single channel can't move data faster than its window per round trip,
+	// so that bounds scp however fast the link is.
+	size := *adviseTransferGB * 1e9
+	best := time.Duration(size / (sshChannelWindow / p50.Seconds()) * float64(time.Second))
+	verdict := "fine"
+	switch {
+	case best > transferTolerable:
+		verdict = "painful"
+	case best > transferFine:
+		verdict = "noticeable"
+	}
+
+	fmt.Printf(
+		"  %-24s %-11s at least %v, as the SSH channel window allows at most %.1f MB/s\n",
+		fmt.Sprintf("scp of %g GB", *adviseTransferGB),
+		verdict,
+		best.Round(time.Second),
+		sshChannelWindow/p50.Seconds()/1e6)
+
+	if *pingTimeout == 0 {
+		fmt.Printf("Loss is only measured with --ping-timeout.\n")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The remote echo agent is the program in the agent directory, built for the
+// remote host by buildAgent. It echoes each newline-terminated ping back,
+// followed by the times at which it received the ping and sent the echo
+// according to the remote clock, as two zero-padded decimal Unix nanosecond
+// timestamps. With --response-size, the echo is padded with that many bytes
+// before the timestamps:
+//
+//	<ping><padding>00000000000000000000 00000000000000000000\n
+const agentTimestampsLen = 42
+
+// The agent's source, built for each platform it's deployed to.
+//
+//go:embed agent/main.go
+var agentSource []byte
+
+// writeAgentEcho writes the echo of a ping received at the given time, in the
+// agent's format, for pings sent by the agent with --reverse.
+func writeAgentEcho(w io.Writer, ping []byte, padding []byte, received time.Time) {
+	w.Write(ping)
+	w.Write(padding)
+	fmt.Fprintf(w, "%020d %020d\n", received.UnixNano(), time.Now().UnixNano())
+}
+
+func parseAgentTimestamps(b []byte) (received, sent time.Time, err error) {
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		err = fmt.Errorf("malformed agent timestamps: %q", b)
+		return
+	}
+
+	var ns [2]int64
+	for i, f := range fields {
+		ns[i], err = strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("malformed agent timestamps: %q", b)
+			return
+		}
+	}
+
+	received = time.Unix(0, ns[0])
+	sent = time.Unix(0, ns[1])
+	return
+}
+
+// remotePlatform returns the operating system and architecture of the remote
+// host in the form used by runtime.GOOS and runtime.GOARCH.
+func remotePlatform(ctx context.Context, t transport) (goos, goarch string, err error) {
+	out, err := runCommand(ctx, t, "uname -s -m", nil)
+	if err != nil {
+		err = fmt.Errorf("uname: %w", err)
+		return
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		err = fmt.Errorf("unexpected uname output: %q", out)
+		return
+	}
+
+	goos = strings.ToLower(fields[0])
+	goarch = fields[1]
+	switch goarch {
+	case "x86_64":
+		goarch = "amd64"
+	case "aarch64", "arm64":
+		goarch = "arm64"
+	case "i386", "i686":
+		goarch = "386"
+	case "armv6l", "armv7l":
+		goarch = "arm"
+	}
+
+	return
+}
+
+// buildAgent builds the agent for the given platform, with cgo disabled so
+// that it doesn't depend on the remote host's libraries, and returns the path
+// to the executable. Builds are cached, keyed by the agent's source, so Go is
+// only needed on the PATH the first time an agent is deployed to each
+// platform.
+func buildAgent(ctx context.Context, goos, goarch string) (path string, err error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(agentSource)
+	dir := filepath.Join(cache, "ssh_ping")
+	path = filepath.Join(dir, fmt.Sprintf("agent-%x-%s-%s", sum[:8], goos, goarch))
+	if _, err = os.Stat(path); err == nil {
+		return
+	}
+
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		err = fmt.Errorf("building the agent for %s/%s needs Go on the PATH: %w", goos, goarch, err)
+		return
+	}
+
+	src, err := os.MkdirTemp("", "ssh_ping_agent")
+	if err != nil {
+		return
+	}
+
+	defer os.RemoveAll(src)
+
+	if err = os.WriteFile(filepath.Join(src, "main.go"), agentSource, 0644); err != nil {
+		return
+	}
+
+	if err = os.WriteFile(filepath.Join(src, "go.mod"), []byte("module agent\n\ngo 1.21\n"), 0644); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	// Build to a temporary name and rename, so that concurrent runs never see
+	// a partial executable.
+	tmp := fmt.Sprintf("%s.%d", path, os.Getpid())
+	cmd := exec.CommandContext(ctx, goTool, "build", "-trimpath", "-ldflags=-s -w", "-o", tmp, ".")
+	cmd.Dir = src
+	cmd.Env = append(
+		os.Environ(),
+		"CGO_ENABLED=0",
+		"GOOS="+goos,
+		"GOARCH="+goarch,
+		"GOFLAGS=",
+		"GOWORK=off")
+
+	// Run on any ARM host, not just the newest.
+	if goarch == "arm" {
+		cmd.Env = append(cmd.Env, "GOARM=6")
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("building the agent for %s/%s: %w\n%s", goos, goarch, err, out)
+	}
+
+	err = os.Rename(tmp, path)
+	return
+}
+
+// deployRemoteAgent builds the agent for the remote host's platform, copies
+// it to a temporary file there, and returns its path. The caller should
+// remove it with cleanUpRemoteAgent when done. Agents left behind by runs
+// that exited uncleanly are removed once they are a day old.
+func deployRemoteAgent(ctx context.Context, t transport) (path string, err error) {
+	goos, goarch, err := remotePlatform(ctx, t)
+	if err != nil {
+		return
+	}
+
+	local, err := buildAgent(ctx, goos, goarch)
+	if err != nil {
+		return
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	out, err := runCommand(
+		ctx,
+		t,
+		`find /tmp -maxdepth 1 -name 'ssh_ping_agent.*' -mmin +1440 -exec rm -f {} + 2>/dev/null; `+
+			`f=$(mktemp /tmp/ssh_ping_agent.XXXXXX) && cat > "$f" && chmod +x "$f" && echo "$f"`,
+		f)
+
+	if err != nil {
+		err = fmt.Errorf("copying agent: %w", err)
+		return
+	}
+
+	path = string(bytes.TrimSpace(out))
+	return
+}
+
+// cleanUpRemoteAgent removes the agent deployed at the given path.
+func cleanUpRemoteAgent(ctx context.Context, t transport, path string) (err error) {
+	_, err = runCommand(ctx, t, "rm -f "+path, nil)
+	return
+}
+
+// printRemoteProcessing prints statistics about how long the agent took
+// between receiving each ping and sending its echo.
+func printRemoteProcessing(times []pingTimes) {
+	if len(times) == 0 {
+		fmt.Printf("Remote processing: no samples with remote timestamps.\n")
+		return
+	}
+
+	processing := make([]time.Duration, 0, len(times))
+	for _, t := range times {
+		processing = append(processing, t.remoteSent.Sub(t.remoteReceived))
+	}
+
+	fmt.Printf("Remote processing:\n")
+	fmt.Printf("p50:      %s\n", formatLatency(median(processing)))
+	fmt.Printf("p95:      %s\n", formatLatency(percentile(95, processing)))
+	fmt.Printf("Max:      %s\n", formatLatency(max(processing)))
+}
@@ -0,0 +1,174 @@
+// Command agent is the remote echo agent for ssh_ping --deploy-agent, which
+// builds it for the remote host's platform, with cgo disabled so that it
+// runs there whatever libraries are installed, and copies it over. It
+// depends on nothing but the standard library, so that it stays small.
+//
+// By default, it echoes each newline-terminated ping on stdin back on
+// stdout, followed by the times at which it received the ping and sent the
+// echo according to the remote clock, as two zero-padded decimal Unix
+// nanosecond timestamps. With --response-size, the echo is padded with that
+// many bytes before the timestamps:
+//
+//	<ping><padding>00000000000000000000 00000000000000000000\n
+//
+// With --ping, it's the remote end of --reverse: it sends pings of
+// --payload-size bytes on stdout for the other end to echo in the format
+// above, for --duration, and then writes the line "ssh_ping reverse
+// results", followed by a line for each ping giving the times at which it
+// was sent and its echo received according to the remote clock, and the
+// times at which it was received and echoed according to the other end's,
+// as zero-padded decimal Unix nanosecond timestamps.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var responseSize = flag.Int("response-size", 0, "Extra bytes to follow each echo with.")
+var ping = flag.Bool("ping", false, "Send pings to be echoed rather than echoing them.")
+var duration = flag.Duration("duration", 10*time.Second, "With --ping, how long to send pings for.")
+var payloadSize = flag.Int("payload-size", 4, "With --ping, the size of each ping.")
+var interval = flag.Duration("interval", 0, "With --ping, how long to wait between pings.")
+
+// The length of the timestamps following each echo.
+const timestampsLen = 42
+
+const resultsHeader = "ssh_ping reverse results"
+
+func main() {
+	log.SetFlags(0)
+	flag.Parse()
+
+	run := echo
+	if *ping {
+		run = sendPings
+	}
+
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// echo echoes pings on stdin and stdout until stdin is closed.
+func echo() (err error) {
+	r := bufio.NewReader(os.Stdin)
+	w := bufio.NewWriter(os.Stdout)
+	padding := bytes.Repeat([]byte{'.'}, *responseSize)
+	for {
+		var line []byte
+		line, err = r.ReadBytes('\n')
+		received := time.Now()
+		if err != nil {
+			// EOF is a clean shutdown.
+			if len(line) == 0 {
+				err = nil
+			}
+
+			return
+		}
+
+		w.Write(line)
+		w.Write(padding)
+		fmt.Fprintf(w, "%020d %020d\n", received.UnixNano(), time.Now().UnixNano())
+		if err = w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// times records when a ping sent with --ping passed each point on its round
+// trip.
+type times struct {
+	sent, received         time.Time
+	echoReceived, echoSent int64
+}
+
+// sendPings sends pings on stdout to be echoed back on stdin, and then writes
+// the results.
+func sendPings() (err error) {
+	if *payloadSize < 1 {
+		err = fmt.Errorf("--payload-size must be at least 1")
+		return
+	}
+
+	payload := bytes.Repeat([]byte("foo "), *payloadSize/4+1)[:*payloadSize]
+	payload[len(payload)-1] = '\n'
+	r := bufio.NewReader(os.Stdin)
+
+	// The first few pings probably incur some startup cost. Throw them away.
+	for i := 0; i < 3; i++ {
+		if _, err = sendPing(payload, r); err != nil {
+			return
+		}
+	}
+
+	var all []times
+	start := time.Now()
+	for i := 1; time.Since(start) < *duration; i++ {
+		var t times
+		if t, err = sendPing(payload, r); err != nil {
+			return
+		}
+
+		all = append(all, t)
+		if *interval > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(i) * *interval)))
+		}
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(w, "%s\n", resultsHeader)
+	for _, t := range all {
+		fmt.Fprintf(
+			w,
+			"%020d %020d %020d %020d\n",
+			t.sent.UnixNano(),
+			t.received.UnixNano(),
+			t.echoReceived,
+			t.echoSent)
+	}
+
+	err = w.Flush()
+	return
+}
+
+// sendPing sends a ping on stdout and reads its echo from r.
+func sendPing(payload []byte, r io.Reader) (t times, err error) {
+	t.sent = time.Now()
+	if _, err = os.Stdout.Write(payload); err != nil {
+		return
+	}
+
+	buf := make([]byte, len(payload)+timestampsLen)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+
+	t.received = time.Now()
+	if !bytes.Equal(buf[:len(payload)], payload) {
+		err = fmt.Errorf("bad reply: %q", buf[:len(payload)])
+		return
+	}
+
+	fields := strings.Fields(string(buf[len(payload):]))
+	if len(fields) != 2 {
+		err = fmt.Errorf("malformed timestamps: %q", buf[len(payload):])
+		return
+	}
+
+	if t.echoReceived, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return
+	}
+
+	t.echoSent, err = strconv.ParseInt(fields[1], 10, 64)
+	return
+}
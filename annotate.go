@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// annotations collects notes like "switched to 5GHz now" typed on standard
+// input with --annotate or sent to the --annotate-socket during a run, each
+// recorded as a "note" event at the time it arrived.
+type annotations struct {
+	// Called with each note as it arrives, if non-nil.
+	onNote func(event)
+
+	listener net.Listener
+
+	mu      sync.Mutex
+	notes   []event
+	stopped bool
+}
+
+// startAnnotations starts accepting annotations from the sources selected by
+// flags. The caller must call stop when the run is over.
+func startAnnotations(onNote func(event)) (a *annotations, err error) {
+	a = &annotations{onNote: onNote}
+	if *annotateSocket != "" {
+		if a.listener, err = net.Listen("unix", *annotateSocket); err != nil {
+			err = fmt.Errorf("--annotate-socket: %w", err)
+			return
+		}
+
+		go a.accept()
+	}
+
+	if *annotate {
+		fmt.Fprintf(os.Stderr, "Type a line and press enter to annotate the run at that moment.\n")
+		go a.read(os.Stdin, true)
+	}
+
+	return
+}
+
+// accept reads annotations from each connection to the socket until it is
+// closed.
+func (a *annotations) accept() {
+	for {
+		c, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer c.Close()
+			a.read(c, false)
+		}()
+	}
+}
+
+// read records each non-empty line from r as an annotation, confirming it on
+// stderr if requested.
+func (a *annotations) read(r io.Reader, confirm bool) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		if a.note(text) && confirm {
+			fmt.Fprintf(os.Stderr, "Noted at %s.\n", time.Now().Format("15:04:05.000"))
+		}
+	}
+}
+
+// note records an annotation made now, returning false if the run is over.
+func (a *annotations) note(text string) bool {
+	e := event{kind: "note", start: time.Now(), reason: text}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stopped {
+		return false
+	}
+
+	a.notes = append(a.notes, e)
+	if a.onNote != nil {
+		a.onNote(e)
+	}
+
+	return true
+}
+
+// stop stops accepting annotations, returning those made.
+func (a *annotations) stop() []event {
+	if a.listener != nil {
+		a.listener.Close()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stopped = true
+	return a.notes
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// appendSummary appends a line summarizing the run to the file named by
+// --append, in logfmt with the fields always in the same order:
+//
+//	time=2024-05-01T12:00:00Z host="example.com" samples=294 p50_ms=13.012 p95_ms=21.104 max_ms=26.017 loss=0.000
+//
+// The host is always quoted, as a Go string, since fleet target names may
+// contain spaces. The file is opened afresh and locked for each line, so that it can be
+// rotated, and shared by runs for different hosts at once.
+func appendSummary(path string, target string, started time.Time, r run) (err error) {
+	d := r.distribution()
+	timeouts := r.timeouts()
+	var loss float64
+	if n := d.count() + timeouts; n > 0 {
+		loss = float64(timeouts) / float64(n)
+	}
+
+	line := fmt.Sprintf(
+		"time=%s host=%q samples=%d p50_ms=%.3f p95_ms=%.3f max_ms=%.3f loss=%.3f\n",
+		started.UTC().Format(time.RFC3339),
+		target,
+		d.count(),
+		millis(d.percentile(50)),
+		millis(d.percentile(95)),
+		millis(d.max()),
+		loss)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	if err = lockFile(f); err != nil {
+		return
+	}
+
+	_, err = f.WriteString(line)
+	return
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often to probe when measuring a baseline.
+const baselineInterval = 200 * time.Millisecond
+
+// sshEndpoint returns the host name and port that ssh will actually connect
+// to for the given host, taking ~/.ssh/config into account for the exec
+// transport.
+func sshEndpoint(host string) (hostname, port string, err error) {
+	if *simulate != "" {
+		err = fmt.Errorf("there's no network endpoint when simulating")
+		return
+	}
+
+	if *transportKind == "native" {
+		_, addr := parseTarget(host)
+		hostname, port, err = net.SplitHostPort(addr)
+		return
+	}
+
+	if execClient.plink {
+		err = fmt.Errorf("plink can't say which host name and port it would connect to")
+		return
+	}
+
+	out, err := exec.Command(execClient.path, "-G", host).Output()
+	if err != nil {
+		err = fmt.Errorf("ssh -G: %w", err)
+		return
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		switch key {
+		case "hostname":
+			hostname = value
+		case "port":
+			port = value
+		}
+	}
+
+	if hostname == "" || port == "" {
+		err = fmt.Errorf("ssh -G didn't report a host name and port")
+	}
+
+	return
+}
+
+// runBaseline probes the raw network round trip time to the host, using TCP
+// connections to the SSH port or ICMP echo according to method, until the
+// context is done. It returns a description of what was probed along with the
+// samples.
+func runBaseline(ctx context.Context, method string) (desc string, samples []time.Duration, err error) {
+	hostname, port, err := sshEndpoint(*host)
+	if err != nil {
+		return
+	}
+
+	if ip, ok := pinnedAddress(hostname); ok {
+		hostname = ip.String()
+	}
+
+	switch method {
+	case "tcp":
+		addr := net.JoinHostPort(hostname, port)
+		desc = "TCP connect to " + addr
+		samples, err = runTCPBaseline(ctx, addr)
+
+	case "icmp":
+		desc = "ICMP echo to " + hostname
+		samples, err = runICMPBaseline(ctx, hostname)
+
+	default:
+		err = fmt.Errorf("unknown baseline method %q", method)
+	}
+
+	return
+}
+
+func runTCPBaseline(ctx context.Context, addr string) (samples []time.Duration, err error) {
+	ticker := time.NewTicker(baselineInterval)
+	defer ticker.Stop()
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	for {
+		start := time.Now()
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp"+addressFamily(), addr)
+		if ctx.Err() != nil {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		samples = append(samples, time.Since(start))
+		conn.Close()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var pingTimeRegexp = regexp.MustCompile(`time=([0-9.]+) ms`)
+
+// runICMPBaseline runs the system's ping command, since sending ICMP echo
+// requests directly needs privileges we probably don't have.
+func runICMPBaseline(ctx context.Context, hostname string) (samples []time.Duration, err error) {
+	args := []string{"-n", "-i", strconv.FormatFloat(baselineInterval.Seconds(), 'f', -1, 64)}
+	if af := addressFamily(); af != "" {
+		args = append(args, "-"+af)
+	}
+
+	cmd := exec.CommandContext(ctx, "ping", append(args, hostname)...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		m := pingTimeRegexp.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+
+		ms, _ := strconv.ParseFloat(m[1], 64)
+		samples = append(samples, time.Duration(ms*float64(time.Millisecond)))
+	}
+
+	cmd.Wait()
+	if len(samples) == 0 {
+		err = fmt.Errorf("ping reported no replies from %s", hostname)
+	}
+
+	return
+}
+
+// printBaseline prints the baseline samples and how much SSH adds to them.
+func printBaseline(desc string, baseline []time.Duration, samples distribution) {
+	fmt.Printf("Baseline (%s, %d samples):\n", desc, len(baseline))
+	fmt.Printf("p50:      %s\n", formatLatency(median(baseline)))
+	fmt.Printf("p95:      %s\n", formatLatency(percentile(95, baseline)))
+	fmt.Printf("\n")
+	fmt.Printf(
+		"SSH overhead: %s at p50, %s at p95\n",
+		formatDelta(samples.percentile(50)-median(baseline)),
+		formatDelta(samples.percentile(95)-percentile(95, baseline)))
+}
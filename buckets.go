@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A bucket holds the samples sent during one --bucket interval of a run.
+type bucket struct {
+	start   time.Time
+	samples []time.Duration
+
+	// The number of echoes that timed out.
+	lost int
+}
+
+// splitBuckets divides a run's samples into consecutive buckets of the given
+// width, starting at the first sample. Timeouts count as losses in the bucket
+// in which the abandoned echo was waited for.
+func splitBuckets(r run, width time.Duration) (buckets []bucket) {
+	if len(r.sent) == 0 {
+		return
+	}
+
+	t0 := r.sent[0]
+	at := func(t time.Time) *bucket {
+		i := int(t.Sub(t0) / width)
+		if i < 0 {
+			i = 0
+		}
+
+		for len(buckets) <= i {
+			buckets = append(buckets, bucket{start: t0.Add(time.Duration(len(buckets)) * width)})
+		}
+
+		return &buckets[i]
+	}
+
+	for i, rtt := range r.samples {
+		b := at(r.sent[i])
+		b.samples = append(b.samples, rtt)
+	}
+
+	for _, e := range r.events {
+		if e.kind == "timeout" {
+			at(e.start).lost++
+		}
+	}
+
+	return
+}
+
+// printBuckets prints a row of statistics for each --bucket interval of the
+// run, showing how latency evolved over its course.
+func printBuckets(r run) {
+	buckets := splitBuckets(r, *bucketWidth)
+	if len(buckets) == 0 {
+		return
+	}
+
+	fmt.Printf("%-12s %8s %8s %8s %8s %8s\n", "Time", "Samples", "p50", "p95", "Max", "Loss")
+	for _, b := range buckets {
+		loss := "-"
+		if b.lost > 0 {
+			loss = fmt.Sprintf("%.1f%%", 100*float64(b.lost)/float64(b.lost+len(b.samples)))
+		}
+
+		if len(b.samples) == 0 {
+			fmt.Printf("%-12s %8d %8s %8s %8s %8s\n", b.start.Format("15:04:05"), 0, "-", "-", "-", loss)
+			continue
+		}
+
+		fmt.Printf(
+			"%-12s %8d %8s %8s %8s %8s\n",
+			b.start.Format("15:04:05"),
+			len(b.samples),
+			formatLatency(median(b.samples)),
+			formatLatency(percentile(95, b.samples)),
+			formatLatency(max(b.samples)),
+			loss)
+	}
+}
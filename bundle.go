@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// writeBundle writes a gzipped tar archive of everything needed to look at a
+// run again or reproduce it elsewhere:
+//
+//	summary.json      the summary, as for --format=json
+//	samples.txt       each sample, as for --samples-out
+//	events.txt        spikes, timeouts, and reconnects
+//	flags.txt         every flag's effective value
+//	environment.txt   this machine, the build, and the local ssh
+//	plot.svg          the plot, as for --plot
+func writeBundle(
+	ctx context.Context,
+	path string,
+	target string,
+	started time.Time,
+	r run,
+	results []thresholdResult) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	add := func(name string, data []byte) {
+		if err != nil {
+			return
+		}
+
+		err = tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: started,
+		})
+
+		if err == nil {
+			_, err = tw.Write(data)
+		}
+	}
+
+	summary, err := json.MarshalIndent(newJSONReport(newSummaryReport(target, r, results)), "", "  ")
+	if err != nil {
+		return
+	}
+
+	var samples bytes.Buffer
+	for _, s := range r.samples {
+		fmt.Fprintln(&samples, s)
+	}
+
+	var events bytes.Buffer
+	for _, e := range r.events {
+		fmt.Fprintf(&events, "%s %s %v %s\n", e.start.Format(time.RFC3339Nano), e.kind, e.duration, e.reason)
+	}
+
+	var flags bytes.Buffer
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&flags, "--%s=%s\n", f.Name, f.Value)
+	})
+
+	var plot bytes.Buffer
+	if len(r.samples) != 0 {
+		writeSVGPlot(&plot, r)
+	}
+
+	add("summary.json", append(summary, '\n'))
+	add("samples.txt", samples.Bytes())
+	add("events.txt", events.Bytes())
+	add("flags.txt", flags.Bytes())
+	add("environment.txt", bundleEnvironment(ctx, target, started))
+	if plot.Len() != 0 {
+		add("plot.svg", plot.Bytes())
+	}
+
+	if err != nil {
+		return
+	}
+
+	if err = tw.Close(); err != nil {
+		return
+	}
+
+	err = gz.Close()
+	return
+}
+
+// bundleEnvironment describes where and how a run was made.
+func bundleEnvironment(ctx context.Context, target string, started time.Time) []byte {
+	var b bytes.Buffer
+	hostname, _ := os.Hostname()
+	fmt.Fprintf(&b, "started:   %s\n", started.Format(time.RFC3339))
+	fmt.Fprintf(&b, "target:    %s\n", target)
+	fmt.Fprintf(&b, "command:   %s\n", strings.Join(os.Args, " "))
+	fmt.Fprintf(&b, "hostname:  %s\n", hostname)
+	fmt.Fprintf(&b, "platform:  %s/%s, %d CPUs\n", runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+	fmt.Fprintf(&b, "go:        %s\n", runtime.Version())
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		fmt.Fprintf(&b, "ssh_ping:  %s\n", info.Main.Version)
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				fmt.Fprintf(&b, "revision:  %s\n", s.Value)
+			}
+		}
+	}
+
+	if *transportKind == "exec" {
+		// ssh -V prints to stderr.
+		out, err := exec.CommandContext(ctx, execClient.path, "-V").CombinedOutput()
+		if err != nil {
+			out = []byte(err.Error())
+		}
+
+		fmt.Fprintf(&b, "ssh:       %s\n", strings.TrimSpace(string(out)))
+	}
+
+	return b.Bytes()
+}
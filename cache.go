@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostState is what the state cache records about a host.
+type hostState struct {
+	// The host's addresses, and when they were looked up.
+	Addresses []string  `json:"addresses,omitempty"`
+	Resolved  time.Time `json:"resolved"`
+
+	// The SHA256 fingerprint of the host key seen by the native transport,
+	// and when it was last seen.
+	HostKey     string    `json:"host_key,omitempty"`
+	HostKeySeen time.Time `json:"host_key_seen"`
+}
+
+// stateCache holds hostState across runs, in a JSON file in the user's cache
+// directory. It is only used if --cache-ttl is set.
+var stateCache struct {
+	once  sync.Once
+	mu    sync.Mutex
+	path  string
+	hosts map[string]*hostState
+}
+
+// cachedHost returns the cached state for the given host, loading the cache
+// if necessary, or nil if caching is disabled. The caller must hold
+// stateCache.mu.
+func cachedHost(name string) *hostState {
+	if *cacheTTL <= 0 {
+		return nil
+	}
+
+	stateCache.once.Do(loadStateCache)
+	h := stateCache.hosts[name]
+	if h == nil {
+		h = &hostState{}
+		stateCache.hosts[name] = h
+	}
+
+	return h
+}
+
+func loadStateCache() {
+	stateCache.hosts = make(map[string]*hostState)
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		log.Printf("State cache disabled: %v", err)
+		return
+	}
+
+	stateCache.path = filepath.Join(dir, "ssh_ping", "state.json")
+	data, err := os.ReadFile(stateCache.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	if err == nil {
+		err = json.Unmarshal(data, &stateCache.hosts)
+	}
+
+	if err != nil {
+		log.Printf("Ignoring state cache %s: %v", stateCache.path, err)
+		stateCache.hosts = make(map[string]*hostState)
+	}
+}
+
+// saveStateCache writes the cache back to disk, replacing the file
+// atomically. The caller must hold stateCache.mu.
+func saveStateCache() {
+	if stateCache.path == "" {
+		return
+	}
+
+	err := func() (err error) {
+		data, err := json.MarshalIndent(stateCache.hosts, "", "  ")
+		if err != nil {
+			return
+		}
+
+		if err = os.MkdirAll(filepath.Dir(stateCache.path), 0700); err != nil {
+			return
+		}
+
+		tmp := stateCache.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err != nil {
+			return
+		}
+
+		err = os.Rename(tmp, stateCache.path)
+		return
+	}()
+
+	if err != nil {
+		log.Printf("Saving state cache: %v", err)
+	}
+}
+
+// lookupHost resolves a host name, honouring --resolve and using the state
+// cache if its entry is younger than --cache-ttl. When a fresh lookup finds
+// that the host's addresses have changed since they were cached, a warning is
+// logged.
+func lookupHost(name string) (ips []net.IP, err error) {
+	if ip := net.ParseIP(name); ip != nil {
+		ips = []net.IP{ip}
+		return
+	}
+
+	if ip, ok := pinnedAddress(name); ok {
+		ips = []net.IP{ip}
+		return
+	}
+
+	stateCache.mu.Lock()
+	defer stateCache.mu.Unlock()
+
+	h := cachedHost(name)
+	if h != nil && len(h.Addresses) != 0 && time.Since(h.Resolved) < *cacheTTL {
+		for _, a := range h.Addresses {
+			ips = append(ips, net.ParseIP(a))
+		}
+
+		return
+	}
+
+	ips, err = net.LookupIP(name)
+	if err != nil || h == nil {
+		return
+	}
+
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+
+	sort.Strings(addrs)
+	if len(h.Addresses) != 0 && strings.Join(addrs, ",") != strings.Join(h.Addresses, ",") {
+		log.Printf(
+			"Warning: addresses of %s changed since %s: was %s, now %s",
+			name,
+			h.Resolved.Format(time.RFC3339),
+			strings.Join(h.Addresses, ", "),
+			strings.Join(addrs, ", "))
+	}
+
+	h.Addresses = addrs
+	h.Resolved = time.Now()
+	saveStateCache()
+	return
+}
+
+// cachedDialAddr resolves the host in addr using lookupHost, returning the
+// address of its first IP in the given family ("4", "6", or "" for either).
+func cachedDialAddr(addr string, family string) (dialAddr string, err error) {
+	hostname, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+
+	ips, err := lookupHost(hostname)
+	if err != nil {
+		return
+	}
+
+	for _, ip := range ips {
+		if (family == "4" && ip.To4() == nil) || (family == "6" && ip.To4() != nil) {
+			continue
+		}
+
+		dialAddr = net.JoinHostPort(ip.String(), port)
+		return
+	}
+
+	err = fmt.Errorf("no suitable address for %s", hostname)
+	return
+}
+
+// noteHostKey records the key presented by a host in the state cache, logging
+// a warning if it differs from the one seen on an earlier run.
+func noteHostKey(hostname string, key ssh.PublicKey) {
+	stateCache.mu.Lock()
+	defer stateCache.mu.Unlock()
+
+	h := cachedHost(hostname)
+	if h == nil {
+		return
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	if h.HostKey != "" && h.HostKey != fingerprint {
+		log.Printf(
+			"Warning: host key of %s changed since %s: was %s, now %s",
+			hostname,
+			h.HostKeySeen.Format(time.RFC3339),
+			h.HostKey,
+			fingerprint)
+	}
+
+	h.HostKey = fingerprint
+	h.HostKeySeen = time.Now()
+	saveStateCache()
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Groups of top-level flags, for subcommands that take only some of them.
+var (
+	// How to connect to a host, other than which one.
+	connectionFlags = []string{
+		"transport", "strict-host-key-checking", "interactive", "ssh-command", "proxy",
+		"resolve", "4", "6", "cache-ttl", "constrained", "mptcp", "netns", "bind-device",
+		"tcp-nodelay", "tos", "dscp", "tcp-keepalive", "echo", "remote-command",
+		"simulate", "inject-faults", "seed",
+	}
+
+	// How pings are sent and timed.
+	pingFlags = []string{
+		"payload-size", "interval", "ping-timeout", "retries", "spike-threshold",
+		"reconnect-every", "streams",
+	}
+
+	// How latencies are printed.
+	outputFlags = []string{"units", "no-color", "levels"}
+
+	// The comparisons that compare chooses with its KIND.
+	comparisonFlags = []string{
+		"compare-ciphers", "compare-macs", "compare-kex", "compare-paths", "compare-hosts", "per-address", "compare-af",
+		"compare-multiplexing", "under-load", "compare-compression", "compare-pty",
+	}
+
+	// Other ways of measuring a host once than timing echoes.
+	modeFlags = []string{"probe-sessions", "idle-gaps", "keepalive-intervals", "mode"}
+
+	// What monitor measures, and when.
+	monitorFlags = []string{"config", "schedule", "listen", "windows", "daily-report"}
+)
+
+// The flag sets made by newSubcommandFlagSet, for flagWasSet.
+var subcommandFlagSets []*flag.FlagSet
+
+// newSubcommandFlagSet returns a flag set for a subcommand, including the
+// top-level flags in the given groups, so that options like --transport
+// apply to the subcommand too.
+func newSubcommandFlagSet(name string, groups ...[]string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	subcommandFlagSets = append(subcommandFlagSets, fs)
+	for _, group := range groups {
+		for _, n := range group {
+			if fs.Lookup(n) != nil {
+				continue
+			}
+
+			f := flag.Lookup(n)
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	}
+
+	return fs
+}
+
+// flagWasSet reports whether the named top-level flag was set on the command
+// line, either before or after a subcommand, rather than left at its default.
+func flagWasSet(name string) (set bool) {
+	visit := func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	}
+
+	flag.Visit(visit)
+	for _, fs := range subcommandFlagSets {
+		fs.Visit(visit)
+	}
+
+	return
+}
+
+// topLevelFlags returns the names of the top-level flags, except those in
+// the given groups.
+func topLevelFlags(except ...[]string) (names []string) {
+	excluded := make(map[string]bool)
+	for _, group := range except {
+		for _, n := range group {
+			excluded[n] = true
+		}
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if !excluded[f.Name] {
+			names = append(names, f.Name)
+		}
+	})
+
+	return
+}
+
+// runMeasurement measures and reports according to the flags already parsed,
+// then exits: with status 1 if a threshold was breached, and 130 if
+// interrupted. With --schedule, it instead measures repeatedly until stopped.
+func runMeasurement(ctx context.Context) {
+	checkFlags()
+	if *schedule != "" {
+		runScheduled(ctx)
+		return
+	}
+
+	breached, err := measureAndReport(ctx)
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Interrupted.\n")
+		os.Exit(130)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if breached {
+		os.Exit(1)
+	}
+}
+
+// runRun implements the run subcommand, which is like running without one: a
+// single measurement of --host. Comparisons and monitoring are left to their
+// own subcommands.
+func runRun(ctx context.Context, args []string) {
+	fs := newSubcommandFlagSet("run", topLevelFlags(comparisonFlags, monitorFlags))
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		os.Exit(1)
+	}
+
+	runMeasurement(ctx)
+}
+
+// A comparison is a kind of the compare subcommand. Each is a front end for a
+// top-level flag selecting the same mode.
+type comparison struct {
+	// The flag the comparison sets.
+	flag string
+
+	// If non-empty, the comparison takes an argument, described by this, as
+	// the flag's value. Otherwise the flag is boolean.
+	arg string
+
+	desc string
+}
+
+var comparisons = map[string]comparison{
+	"addresses":        {"per-address", "", "each address the host name resolves to"},
+	"address-families": {"compare-af", "", "IPv4 with IPv6"},
+	"ciphers":          {"compare-ciphers", "CIPHER,CIPHER,...", "each of the listed ciphers"},
+	"compression":      {"compare-compression", "", "with and without SSH compression"},
+	"kex":              {"compare-kex", "KEX,KEX,...", "each of the listed key exchange algorithms"},
+	"macs":             {"compare-macs", "MAC,MAC,...", "each of the listed MACs"},
+	"hosts":            {"compare-hosts", "HOST,HOST", "two hosts, with a test of significance"},
+	"load":             {"under-load", "", "an idle connection with one saturated by a bulk transfer"},
+	"multiplexing":     {"compare-multiplexing", "", "sessions over a ControlMaster with cold connections"},
+	"paths":            {"compare-paths", "IFACE,IFACE", "two local interfaces, live"},
+	"pty":              {"compare-pty", "", "with and without a pseudo-terminal"},
+}
+
+// runCompare implements the compare subcommand, which measures several
+// variants of the connection to the host and prints a comparison.
+func runCompare(ctx context.Context, args []string) {
+	fs := newSubcommandFlagSet("compare", topLevelFlags(comparisonFlags, modeFlags, monitorFlags))
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s compare KIND [ARG] [flags]\n", os.Args[0])
+		fmt.Fprintf(out, "\n")
+		fmt.Fprintf(out, "Kinds:\n")
+		var names []string
+		for name := range comparisons {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+		for _, name := range names {
+			c := comparisons[name]
+			fmt.Fprintf(out, "  %-35s Compare %s.\n", strings.TrimSpace(name+" "+c.arg), c.desc)
+		}
+
+		fmt.Fprintf(out, "\n")
+		fmt.Fprintf(out, "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	kind := args[0]
+	c, ok := comparisons[kind]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown comparison %q.\n", kind)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	args = args[1:]
+	value := "true"
+	if c.arg != "" {
+		if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+			fmt.Fprintf(os.Stderr, "compare %s needs an argument: %s\n", kind, c.arg)
+			os.Exit(2)
+		}
+
+		value, args = args[0], args[1:]
+	}
+
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		os.Exit(1)
+	}
+
+	if err := flag.Set(c.flag, value); err != nil {
+		log.Fatal(err)
+	}
+
+	runMeasurement(ctx)
+}
+
+// The schedule monitor measures on if --schedule isn't set: every minute.
+const defaultMonitorSchedule = "* * * * *"
+
+// runMonitor implements the monitor subcommand, which measures --host, or the
+// targets in --config, repeatedly until stopped, on --schedule or else every
+// minute. It's a front end for --schedule, so only takes the flags that apply
+// to that.
+func runMonitor(ctx context.Context, args []string) {
+	fs := newSubcommandFlagSet("monitor", topLevelFlags(comparisonFlags, modeFlags))
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		os.Exit(1)
+	}
+
+	if *schedule == "" {
+		*schedule = defaultMonitorSchedule
+	}
+
+	runMeasurement(ctx)
+}
+
+// runReport implements the report subcommand, which reports on the results of
+// earlier runs.
+func runReport(ctx context.Context, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s report history|rollup|sla|diff [flags]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "history":
+		runHistory(ctx, args[1:])
+	case "rollup":
+		runRollup(ctx, args[1:])
+	case "sla":
+		runSLA(ctx, args[1:])
+	case "diff":
+		runDiff(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown report %q; want history, rollup, sla, or diff.\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// usage prints the top-level usage message, including subcommands.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage:\n")
+	fmt.Fprintf(out, "  %s [run] [flags]\n", os.Args[0])
+	fmt.Fprintf(out, "  %s compare KIND [ARG] [flags]          (see %s compare --help)\n", os.Args[0], os.Args[0])
+	fmt.Fprintf(out, "  %s monitor [flags] [--schedule '*/5 * * * *']\n", os.Args[0])
+	fmt.Fprintf(out, "  %s gate [flags] --p95-under 80ms --retries 10\n", os.Args[0])
+	fmt.Fprintf(out, "  %s pick [flags] --hosts-file bastions.txt --criteria p95\n", os.Args[0])
+	fmt.Fprintf(out, "  %s survey [flags] --hosts-file fleet.txt --per-host 10s --max-concurrent 30\n", os.Args[0])
+	fmt.Fprintf(out, "  %s scan [flags] --hosts-file hosts.txt --concurrency 20\n", os.Args[0])
+	fmt.Fprintf(out, "  %s report history [flags] --db results.db [--host example.com]\n", os.Args[0])
+	fmt.Fprintf(out, "  %s report rollup [flags] --db results.db [--period week|month]\n", os.Args[0])
+	fmt.Fprintf(out, "  %s report sla --db results.db [--since 2006-01-01 --until 2006-02-01]\n", os.Args[0])
+	fmt.Fprintf(out, "  %s report diff [--html diff.html] before.txt after.txt\n", os.Args[0])
+	fmt.Fprintf(out, "  %s generate-dashboard --sink prometheus > dashboard.json\n", os.Args[0])
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Flags:\n")
+	flag.PrintDefaults()
+}
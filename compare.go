@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// A variant is one configuration of ssh to be measured in a comparison.
+type variant struct {
+	name string
+	opts transportOptions
+}
+
+// compareVariants runs the measurement once for each variant and prints a
+// table comparing the results, followed by the difference in median latency
+// between each variant and the first.
+func compareVariants(ctx context.Context, title string, variants []variant) (err error) {
+	runs, err := measureVariants(ctx, title, variants)
+	if err != nil {
+		return
+	}
+
+	results := make([]distribution, len(runs))
+	for i, r := range runs {
+		results[i] = r.distribution()
+	}
+
+	fmt.Printf("\n")
+	printComparison(title, variantNames(variants), results)
+	return
+}
+
+// measureVariants runs the measurement once for each variant.
+func measureVariants(ctx context.Context, title string, variants []variant) (runs []run, err error) {
+	for _, v := range variants {
+		fmt.Printf("Measuring with %s %s...\n", strings.ToLower(title), v.name)
+		var r run
+		r, err = measure(ctx, v.opts)
+		if err != nil {
+			err = fmt.Errorf("%s %s: %w", title, v.name, err)
+			return
+		}
+
+		runs = append(runs, r)
+	}
+
+	return
+}
+
+func variantNames(variants []variant) []string {
+	names := make([]string, len(variants))
+	for i, v := range variants {
+		names[i] = v.name
+	}
+
+	return names
+}
+
+// printComparison prints a table comparing the named results, followed by
+// the difference in median latency between each and the first.
+func printComparison(title string, names []string, results []distribution) {
+	fmt.Printf("%-32s %8s %8s %8s %8s %8s\n", title, "Samples", "p05", "p50", "p95", "Mean")
+	for i, name := range names {
+		s := results[i]
+		fmt.Printf(
+			"%-32s %8d %8s %8s %8s %8s\n",
+			name,
+			s.count(),
+			formatLatency(s.percentile(5)),
+			formatLatency(s.percentile(50)),
+			formatLatency(s.percentile(95)),
+			formatLatency(s.mean()))
+	}
+
+	if len(names) < 2 {
+		return
+	}
+
+	fmt.Printf("\n")
+	base := results[0].percentile(50)
+	for i, name := range names[1:] {
+		fmt.Printf(
+			"p50 with %s %s: %s relative to %s\n",
+			strings.ToLower(title),
+			name,
+			formatDelta(results[i+1].percentile(50)-base),
+			names[0])
+	}
+}
+
+// compareCiphers runs the measurement once for each of the supplied ciphers,
+// pinning it for the connection, and prints a table comparing the results.
+func compareCiphers(ctx context.Context, ciphers []string) (err error) {
+	variants := make([]variant, 0, len(ciphers))
+	for _, c := range ciphers {
+		variants = append(variants, variant{c, transportOptions{ciphers: []string{c}}})
+	}
+
+	err = compareVariants(ctx, "Cipher", variants)
+	return
+}
+
+// The cipher pinned when comparing MACs, which AEAD ciphers like
+// aes128-gcm@openssh.com and chacha20-poly1305@openssh.com don't use.
+const macComparisonCipher = "aes128-ctr"
+
+// compareMACs runs the measurement once for each of the supplied MACs,
+// pinning it and a cipher that uses it for the connection, and prints a
+// table comparing the results.
+func compareMACs(ctx context.Context, macs []string) (err error) {
+	variants := make([]variant, 0, len(macs))
+	for _, m := range macs {
+		variants = append(variants, variant{m, transportOptions{
+			ciphers: []string{macComparisonCipher},
+			macs:    []string{m},
+		}})
+	}
+
+	err = compareVariants(ctx, "MAC", variants)
+	return
+}
+
+// compareKeyExchanges runs the measurement once for each of the supplied key
+// exchange algorithms, pinning it for the connection, and prints tables
+// comparing the results. The key exchange mostly affects connection setup,
+// so that's compared too.
+func compareKeyExchanges(ctx context.Context, kexes []string) (err error) {
+	variants := make([]variant, 0, len(kexes))
+	for _, k := range kexes {
+		variants = append(variants, variant{k, transportOptions{keyExchanges: []string{k}}})
+	}
+
+	runs, err := measureVariants(ctx, "Key exchange", variants)
+	if err != nil {
+		return
+	}
+
+	echoes := make([]distribution, len(runs))
+	setups := make([]distribution, len(runs))
+	for i, r := range runs {
+		echoes[i] = r.distribution()
+		setups[i] = sampleSet(r.setup)
+	}
+
+	names := variantNames(variants)
+	fmt.Printf("\n")
+	printComparison("Key exchange", names, echoes)
+	fmt.Printf("\nConnection setup:\n")
+	printComparison("Key exchange", names, setups)
+	return
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestPinnedAlgorithms(t *testing.T) {
+	opts := transportOptions{
+		ciphers:      []string{"aes128-ctr"},
+		macs:         []string{"hmac-sha2-512-etm@openssh.com"},
+		keyExchanges: []string{"ecdh-sha2-nistp256"},
+	}
+
+	t.Run("native", func(t *testing.T) {
+		s, err := startTestServer(testServerOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+
+		setFlags(t, map[string]string{
+			"transport":                "native",
+			"host":                     "test@" + s.addr(),
+			"strict-host-key-checking": "no",
+		})
+
+		tr, err := newTransport(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = tr.Dial(context.Background()); err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+
+		defer tr.Close()
+
+		got := tr.(*nativeTransport).meta
+		if got.Cipher != "aes128-ctr" || got.MAC != "hmac-sha2-512-etm@openssh.com" || got.KeyExchange != "ecdh-sha2-nistp256" {
+			t.Errorf("negotiated %+v; want the pinned algorithms", got)
+		}
+	})
+
+	t.Run("exec", func(t *testing.T) {
+		setFlags(t, map[string]string{"transport": "exec", "host": "example.com", "constrained": "true"})
+		args := (&execTransport{opts: opts}).args()
+
+		// ssh takes the first value given for an option, so the pinned ones
+		// must come before --constrained's.
+		want := []string{"-c", "aes128-ctr", "-o", "MACs=hmac-sha2-512-etm@openssh.com", "-o", "KexAlgorithms=ecdh-sha2-nistp256"}
+		if i := slices.Index(args, "-c"); i < 0 || i+len(want) > len(args) || !reflect.DeepEqual(args[i:i+len(want)], want) {
+			t.Fatalf("args = %q; want %q", args, want)
+		}
+
+		if i := slices.Index(args, "KexAlgorithms=ecdh-sha2-nistp256"); i > slices.Index(args, constrainedSSHArgs[1]) {
+			t.Errorf("args = %q; the pinned key exchange should come before --constrained's", args)
+		}
+	})
+}
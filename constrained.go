@@ -0,0 +1,44 @@
+package main
+
+import "time"
+
+// With --constrained, the --ping-timeout used if none is set, so that a device
+// that stops echoing is reconnected to rather than waited on forever.
+const constrainedPingTimeout = 10 * time.Second
+
+// With --constrained and --transport=native, the key exchanges and ciphers
+// offered: golang.org/x/crypto/ssh's defaults followed by the older ones that
+// some dropbear builds are limited to.
+var (
+	constrainedKeyExchanges = []string{
+		"curve25519-sha256",
+		"curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256",
+		"ecdh-sha2-nistp384",
+		"ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256",
+		"diffie-hellman-group14-sha1",
+		"diffie-hellman-group1-sha1",
+	}
+
+	constrainedCiphers = []string{
+		"aes128-gcm@openssh.com",
+		"aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr",
+		"aes192-ctr",
+		"aes256-ctr",
+		"aes128-cbc",
+		"3des-cbc",
+	}
+)
+
+// With --constrained and --transport=exec, options passed to ssh to the same
+// end. The + adds to ssh's defaults rather than replacing them.
+var constrainedSSHArgs = []string{
+	"-o", "KexAlgorithms=+diffie-hellman-group14-sha1,diffie-hellman-group1-sha1",
+	"-o", "Ciphers=+aes128-cbc,3des-cbc",
+	"-o", "HostKeyAlgorithms=+ssh-rsa",
+	"-o", "PubkeyAcceptedKeyTypes=+ssh-rsa",
+	"-o", "ConnectTimeout=30",
+}
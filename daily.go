@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dailyReports accumulates the runs made with --schedule into a report for
+// each day, written to --daily-report. It's nil if that isn't set.
+var dailyReports *dailyDigests
+
+// dailyDigests holds the days, in local time, that haven't been written yet.
+// There's usually only one, but a run may span midnight.
+type dailyDigests struct {
+	dir string
+
+	mu   sync.Mutex
+	days map[string]*dailyDigest
+}
+
+type dailyDigest struct {
+	// Like 2006-01-02.
+	date  string
+	hosts map[string]*hostDay
+}
+
+// A hostDay is what happened to a host in a day.
+type hostDay struct {
+	hours     [24]histogram
+	timeouts  [24]int
+	incidents []incident
+}
+
+func newDailyDigests(dir string) *dailyDigests {
+	return &dailyDigests{dir: dir, days: make(map[string]*dailyDigest)}
+}
+
+func (d *dailyDigests) host(t time.Time, target string) *hostDay {
+	date := t.Format("2006-01-02")
+	day := d.days[date]
+	if day == nil {
+		day = &dailyDigest{date: date, hosts: make(map[string]*hostDay)}
+		d.days[date] = day
+	}
+
+	h := day.hosts[target]
+	if h == nil {
+		h = &hostDay{}
+		day.hosts[target] = h
+	}
+
+	return h
+}
+
+// record adds a run of the target to the days it spans, then writes the
+// reports for days before today, which are complete.
+func (d *dailyDigests) record(target string, r run) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if r.hist != nil {
+		// There are no times for individual samples, so the run is counted in
+		// the hour it ended.
+		end := r.meta.Ended.Local()
+		d.host(end, target).hours[end.Hour()].merge(r.hist)
+	}
+
+	for i, rtt := range r.samples {
+		sent := r.sent[i].Local()
+		d.host(sent, target).hours[sent.Hour()].record(rtt)
+	}
+
+	for _, e := range r.events {
+		if e.kind == "timeout" {
+			start := e.start.Local()
+			d.host(start, target).timeouts[start.Hour()]++
+		}
+	}
+
+	for _, i := range incidents(target, r.events) {
+		h := d.host(i.Start.Local(), target)
+		h.incidents = append(h.incidents, i)
+	}
+
+	today := time.Now().Format("2006-01-02")
+	for date, day := range d.days {
+		if date >= today {
+			continue
+		}
+
+		if err = day.write(d.dir); err != nil {
+			return
+		}
+
+		delete(d.days, date)
+	}
+
+	return
+}
+
+// flush writes the reports for every day so far, including today's
+// incomplete one.
+func (d *dailyDigests) flush() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, day := range d.days {
+		if err = day.write(d.dir); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// A dailyReport is a day's report as written to ssh_ping-DATE.json, and
+// rendered in ssh_ping-DATE.html.
+type dailyReport struct {
+	Date      string            `json:"date"`
+	Generated time.Time         `json:"generated"`
+	Hosts     []dailyHostReport `json:"hosts"`
+}
+
+type dailyHostReport struct {
+	Host string `json:"host"`
+
+	// For the whole day.
+	dailyStats
+
+	// Only hours with samples or timeouts.
+	Hours []dailyHourReport `json:"hours"`
+
+	Incidents []incident `json:"incidents"`
+}
+
+type dailyHourReport struct {
+	Hour time.Time `json:"hour"`
+	dailyStats
+}
+
+type dailyStats struct {
+	Samples  int     `json:"samples"`
+	Timeouts int     `json:"timeouts"`
+	P50Ms    float64 `json:"p50_ms"`
+	P95Ms    float64 `json:"p95_ms"`
+	P99Ms    float64 `json:"p99_ms"`
+	MaxMs    float64 `json:"max_ms"`
+}
+
+func newDailyStats(h *histogram, timeouts int) (s dailyStats) {
+	s = dailyStats{Samples: h.count(), Timeouts: timeouts}
+	if h.count() == 0 {
+		return
+	}
+
+	s.P50Ms = millis(h.percentile(50))
+	s.P95Ms = millis(h.percentile(95))
+	s.P99Ms = millis(h.percentile(99))
+	s.MaxMs = millis(h.max())
+	return
+}
+
+func (day *dailyDigest) report() (rep dailyReport) {
+	rep = dailyReport{Date: day.date, Generated: time.Now()}
+	midnight, _ := time.ParseInLocation("2006-01-02", day.date, time.Local)
+
+	var targets []string
+	for target := range day.hosts {
+		targets = append(targets, target)
+	}
+
+	sort.Strings(targets)
+	for _, target := range targets {
+		h := day.hosts[target]
+		hr := dailyHostReport{Host: target, Hours: []dailyHourReport{}, Incidents: h.incidents}
+		if hr.Incidents == nil {
+			hr.Incidents = []incident{}
+		}
+
+		var all histogram
+		var timeouts int
+		for hour := range h.hours {
+			all.merge(&h.hours[hour])
+			timeouts += h.timeouts[hour]
+			if h.hours[hour].count() == 0 && h.timeouts[hour] == 0 {
+				continue
+			}
+
+			hr.Hours = append(hr.Hours, dailyHourReport{
+				// Not midnight.Add, which is wrong on days when clocks change.
+				Hour:       time.Date(midnight.Year(), midnight.Month(), midnight.Day(), hour, 0, 0, 0, time.Local),
+				dailyStats: newDailyStats(&h.hours[hour], h.timeouts[hour]),
+			})
+		}
+
+		hr.dailyStats = newDailyStats(&all, timeouts)
+		rep.Hosts = append(rep.Hosts, hr)
+	}
+
+	return
+}
+
+// write writes the day's report to ssh_ping-DATE.json and ssh_ping-DATE.html
+// in the directory.
+func (day *dailyDigest) write(dir string) (err error) {
+	rep := day.report()
+	base := filepath.Join(dir, "ssh_ping-"+day.date)
+
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return
+	}
+
+	if err = os.WriteFile(base+".json", append(data, '\n'), 0644); err != nil {
+		return
+	}
+
+	var b bytes.Buffer
+	if err = dailyTemplate.Execute(&b, rep); err != nil {
+		return
+	}
+
+	err = os.WriteFile(base+".html", b.Bytes(), 0644)
+	return
+}
+
+var dailyTemplate = template.Must(template.New("daily").Funcs(template.FuncMap{
+	"ms": func(ms float64) string {
+		return strings.TrimSpace(formatLatency(time.Duration(ms * float64(time.Millisecond))))
+	},
+	"clock": func(t time.Time) string { return t.Local().Format("15:04:05") },
+	"hour":  func(t time.Time) string { return fmt.Sprintf("%02d:00", t.Hour()) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ssh_ping: {{.Date}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { padding: 0.2em 0.8em; text-align: right; border-bottom: 1px solid #ddd; }
+th:first-child, td:first-child { text-align: left; }
+td.timeouts { color: #c0392b; }
+</style>
+</head>
+<body>
+<h1>ssh_ping: {{.Date}}</h1>
+{{range .Hosts}}
+<h2>{{.Host}}</h2>
+<p>{{.Samples}} samples, {{.Timeouts}} timeouts{{if .Samples}}; p50 {{ms .P50Ms}}, p95 {{ms .P95Ms}}, p99 {{ms .P99Ms}}, max {{ms .MaxMs}}{{end}}.</p>
+<table>
+<tr><th>Hour</th><th>Samples</th><th>p50</th><th>p95</th><th>p99</th><th>Max</th><th>Timeouts</th></tr>
+{{range .Hours}}
+<tr>
+<td>{{hour .Hour}}</td><td>{{.Samples}}</td>
+{{if .Samples}}<td>{{ms .P50Ms}}</td><td>{{ms .P95Ms}}</td><td>{{ms .P99Ms}}</td><td>{{ms .MaxMs}}</td>{{else}}<td></td><td></td><td></td><td></td>{{end}}
+<td{{if .Timeouts}} class="timeouts"{{end}}>{{.Timeouts}}</td>
+</tr>
+{{end}}
+</table>
+{{if .Incidents}}
+<h3>Incidents</h3>
+<ul>
+{{range .Incidents}}
+<li>{{clock .Start}}–{{clock .End}}: {{.Kind}}{{if .PeakMs}}, peaking at {{ms .PeakMs}}{{end}}{{if .Detail}} ({{.Detail}}){{end}}</li>
+{{end}}
+</ul>
+{{end}}
+{{else}}
+<p>Nothing was measured.</p>
+{{end}}
+<p>Generated {{.Generated.Format "2006-01-02 15:04:05"}}.</p>
+</body>
+</html>
+`))
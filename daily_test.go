@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDailyReport(t *testing.T) {
+	dir := t.TempDir()
+	d := newDailyDigests(dir)
+
+	// A run spanning midnight, with a timeout in its last minute.
+	start := time.Date(2024, 5, 1, 23, 59, 0, 0, time.Local)
+	var r run
+	for i := 0; i < 120; i++ {
+		r.add(start.Add(time.Duration(i)*time.Second), time.Duration(10+i%10)*time.Millisecond)
+	}
+
+	r.events = append(r.events, event{kind: "timeout", start: start.Add(100 * time.Second), duration: 5 * time.Second})
+	r.meta.Ended = start.Add(2 * time.Minute)
+
+	// Both days are over, so are written straight away.
+	if err := d.record("bastion", r); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(date string) (rep dailyReport) {
+		data, err := os.ReadFile(filepath.Join(dir, "ssh_ping-"+date+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := json.Unmarshal(data, &rep); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	first := read("2024-05-01")
+	if len(first.Hosts) != 1 || first.Hosts[0].Samples != 60 || first.Hosts[0].Timeouts != 0 {
+		t.Fatalf("2024-05-01 = %+v; want 60 samples of bastion", first)
+	}
+
+	if hours := first.Hosts[0].Hours; len(hours) != 1 || hours[0].Hour.Hour() != 23 || hours[0].P50Ms < 14 || hours[0].P50Ms > 15 {
+		t.Errorf("2024-05-01 hours = %+v; want 23:00, with a p50 of 14 ms", hours)
+	}
+
+	second := read("2024-05-02")
+	if len(second.Hosts) != 1 || second.Hosts[0].Samples != 60 || second.Hosts[0].Timeouts != 1 {
+		t.Fatalf("2024-05-02 = %+v; want 60 samples of bastion and a timeout", second)
+	}
+
+	if is := second.Hosts[0].Incidents; len(is) != 1 || is[0].Kind != "timeout" {
+		t.Errorf("2024-05-02 incidents = %+v; want the timeout", is)
+	}
+
+	html, err := os.ReadFile(filepath.Join(dir, "ssh_ping-2024-05-02.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(html), "bastion") || !strings.Contains(string(html), "00:00") {
+		t.Errorf("HTML report doesn't show bastion at 00:00:\n%s", html)
+	}
+
+	// Today's report is written only when flushed.
+	today := time.Now()
+	d.record("bastion", run{samples: []time.Duration{time.Millisecond}, sent: []time.Time{today}})
+	path := filepath.Join(dir, "ssh_ping-"+today.Format("2006-01-02")+".json")
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("today's report written before flush")
+	}
+
+	if err := d.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("today's report not written by flush: %v", err)
+	}
+}
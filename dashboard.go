@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// The name Prometheus gives the ssh_ping.rtt histogram exported by
+// --otlp-endpoint, with its unit appended, and the label it gives the host.
+const (
+	prometheusRTTMetric = "ssh_ping_rtt_milliseconds"
+	prometheusHostLabel = "server_address"
+)
+
+// A Grafana dashboard in the form exported for sharing, which prompts for a
+// data source on import.
+type grafanaDashboard struct {
+	Inputs        []grafanaInput     `json:"__inputs"`
+	Title         string             `json:"title"`
+	UID           string             `json:"uid"`
+	SchemaVersion int                `json:"schemaVersion"`
+	Refresh       string             `json:"refresh"`
+	Time          grafanaTimeRange   `json:"time"`
+	Tags          []string           `json:"tags"`
+	Templating    grafanaTemplating  `json:"templating"`
+	Annotations   grafanaAnnotations `json:"annotations"`
+	Panels        []grafanaPanel     `json:"panels"`
+}
+
+type grafanaInput struct {
+	Name       string `json:"name"`
+	Label      string `json:"label"`
+	Type       string `json:"type"`
+	PluginID   string `json:"pluginId"`
+	PluginName string `json:"pluginName"`
+}
+
+type grafanaTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaTemplating struct {
+	List []grafanaVariable `json:"list"`
+}
+
+type grafanaVariable struct {
+	Name       string             `json:"name"`
+	Label      string             `json:"label"`
+	Type       string             `json:"type"`
+	Datasource *grafanaDatasource `json:"datasource,omitempty"`
+	Query      string             `json:"query"`
+	Refresh    int                `json:"refresh"`
+	Multi      bool               `json:"multi"`
+	IncludeAll bool               `json:"includeAll"`
+	AllValue   string             `json:"allValue,omitempty"`
+}
+
+type grafanaAnnotations struct {
+	List []grafanaAnnotationQuery `json:"list"`
+}
+
+type grafanaAnnotationQuery struct {
+	Name       string                  `json:"name"`
+	Datasource grafanaDatasource       `json:"datasource"`
+	Enable     bool                    `json:"enable"`
+	IconColor  string                  `json:"iconColor"`
+	Target     grafanaAnnotationTarget `json:"target"`
+}
+
+type grafanaAnnotationTarget struct {
+	Type     string   `json:"type"`
+	Tags     []string `json:"tags"`
+	MatchAny bool     `json:"matchAny"`
+	Limit    int      `json:"limit"`
+}
+
+type grafanaPanel struct {
+	ID          int                `json:"id"`
+	Type        string             `json:"type"`
+	Title       string             `json:"title"`
+	Datasource  grafanaDatasource  `json:"datasource"`
+	GridPos     grafanaGridPos     `json:"gridPos"`
+	FieldConfig grafanaFieldConfig `json:"fieldConfig"`
+	Targets     []grafanaTarget    `json:"targets"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaFieldConfig struct {
+	Defaults  grafanaFieldDefaults `json:"defaults"`
+	Overrides []struct{}           `json:"overrides"`
+}
+
+type grafanaFieldDefaults struct {
+	Unit string `json:"unit,omitempty"`
+}
+
+type grafanaTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	Format       string `json:"format,omitempty"`
+}
+
+// prometheusDashboard returns a dashboard of the latency histogram exported by
+// --otlp-endpoint, as stored by Prometheus, with a variable selecting hosts
+// and the annotations pushed by --grafana-url.
+func prometheusDashboard() grafanaDashboard {
+	ds := grafanaDatasource{Type: "prometheus", UID: "${DS_PROMETHEUS}"}
+	selector := fmt.Sprintf(`{%s=~"$host"}`, prometheusHostLabel)
+	rate := func(suffix string) string {
+		return fmt.Sprintf("rate(%s_%s%s[$__rate_interval])", prometheusRTTMetric, suffix, selector)
+	}
+
+	quantile := func(refID string, q float64) grafanaTarget {
+		return grafanaTarget{
+			RefID:        refID,
+			Expr:         fmt.Sprintf("histogram_quantile(%g, sum by (le, %s) (%s))", q, prometheusHostLabel, rate("bucket")),
+			LegendFormat: fmt.Sprintf("{{%s}} p%g", prometheusHostLabel, q*100),
+		}
+	}
+
+	panel := func(id int, typ, title, unit string, pos grafanaGridPos, targets ...grafanaTarget) grafanaPanel {
+		return grafanaPanel{
+			ID:          id,
+			Type:        typ,
+			Title:       title,
+			Datasource:  ds,
+			GridPos:     pos,
+			FieldConfig: grafanaFieldConfig{Defaults: grafanaFieldDefaults{Unit: unit}, Overrides: []struct{}{}},
+			Targets:     targets,
+		}
+	}
+
+	d := grafanaDashboard{
+		Inputs: []grafanaInput{{
+			Name:       "DS_PROMETHEUS",
+			Label:      "Prometheus",
+			Type:       "datasource",
+			PluginID:   "prometheus",
+			PluginName: "Prometheus",
+		}},
+		Title:         "SSH latency",
+		UID:           "ssh-ping",
+		SchemaVersion: 39,
+		Refresh:       "1m",
+		Time:          grafanaTimeRange{From: "now-24h", To: "now"},
+		Tags:          []string{"ssh_ping"},
+		Templating: grafanaTemplating{List: []grafanaVariable{{
+			Name:       "host",
+			Label:      "Host",
+			Type:       "query",
+			Datasource: &ds,
+			Query:      fmt.Sprintf("label_values(%s_count, %s)", prometheusRTTMetric, prometheusHostLabel),
+			Refresh:    2,
+			Multi:      true,
+			IncludeAll: true,
+			AllValue:   ".*",
+		}}},
+		Annotations: grafanaAnnotations{List: []grafanaAnnotationQuery{{
+			Name:       "Incidents",
+			Datasource: grafanaDatasource{Type: "grafana", UID: "-- Grafana --"},
+			Enable:     true,
+			IconColor:  "red",
+			Target:     grafanaAnnotationTarget{Type: "tags", Tags: []string{"ssh_ping"}, MatchAny: true, Limit: 100},
+		}}},
+	}
+
+	d.Panels = []grafanaPanel{
+		panel(
+			1, "timeseries", "Round trip time", "ms",
+			grafanaGridPos{H: 9, W: 24, X: 0, Y: 0},
+			quantile("A", 0.5),
+			quantile("B", 0.95),
+			quantile("C", 0.99)),
+		panel(
+			2, "timeseries", "Mean round trip time", "ms",
+			grafanaGridPos{H: 8, W: 12, X: 0, Y: 9},
+			grafanaTarget{
+				RefID: "A",
+				Expr: fmt.Sprintf(
+					"sum by (%[1]s) (%[2]s) / sum by (%[1]s) (%[3]s)",
+					prometheusHostLabel,
+					rate("sum"),
+					rate("count")),
+				LegendFormat: fmt.Sprintf("{{%s}}", prometheusHostLabel),
+			}),
+		panel(
+			3, "timeseries", "Pings", "pps",
+			grafanaGridPos{H: 8, W: 12, X: 12, Y: 9},
+			grafanaTarget{
+				RefID:        "A",
+				Expr:         fmt.Sprintf("sum by (%s) (%s)", prometheusHostLabel, rate("count")),
+				LegendFormat: fmt.Sprintf("{{%s}}", prometheusHostLabel),
+			}),
+		panel(
+			4, "heatmap", "Distribution", "ms",
+			grafanaGridPos{H: 9, W: 24, X: 0, Y: 17},
+			grafanaTarget{
+				RefID:        "A",
+				Expr:         fmt.Sprintf("sum by (le) (increase(%s_bucket%s[$__rate_interval]))", prometheusRTTMetric, selector),
+				LegendFormat: "{{le}}",
+				Format:       "heatmap",
+			}),
+	}
+
+	return d
+}
+
+// runGenerateDashboard implements the generate-dashboard subcommand, which
+// writes a Grafana dashboard for the metrics exported by --otlp-endpoint to
+// stdout, ready to import.
+func runGenerateDashboard(args []string) {
+	fs := newSubcommandFlagSet("generate-dashboard")
+	sink := fs.String(
+		"sink",
+		"",
+		"Where the metrics are stored. Only prometheus is supported, for metrics received "+
+			"through an OpenTelemetry Collector or Prometheus's own OTLP receiver.")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		os.Exit(1)
+	}
+
+	if *sink != "prometheus" {
+		fmt.Fprintf(os.Stderr, "--sink must be prometheus.\n")
+		os.Exit(1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(prometheusDashboard()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setDeathSignal arranges for the command to be sent SIGTERM if this process
+// dies without cleaning up after it, e.g. from a second interrupt, so that
+// no ssh processes are left behind.
+func setDeathSignal(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
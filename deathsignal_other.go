@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// setDeathSignal does nothing where there's no way to have a process
+// signalled when its parent dies.
+func setDeathSignal(cmd *exec.Cmd) {}
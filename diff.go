@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The percentiles compared in the diff subcommand's table.
+var diffPercentiles = []float64{5, 25, 50, 75, 90, 95, 99, 99.9}
+
+const (
+	diffChartWidth  = 720
+	diffChartHeight = 300
+	diffMargin      = 50
+)
+
+// A diffSide is one of the two runs being compared.
+type diffSide struct {
+	Name    string
+	Color   string
+	samples []time.Duration
+	sorted  []time.Duration
+}
+
+type diffRow struct {
+	Label          string
+	Before, After  string
+	Delta, Percent string
+	Worse          bool
+}
+
+// runDiff implements the diff subcommand, which compares two sets of samples
+// written by --samples-out (e.g. from before and after a network change) and
+// writes the comparison as a self-contained HTML page.
+func runDiff(args []string) {
+	fs := newSubcommandFlagSet("diff", outputFlags)
+	out := fs.String("html", "diff.html", "File to write the HTML comparison to.")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [--html FILE] BEFORE AFTER\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	var sides [2]*diffSide
+	for i, path := range fs.Args() {
+		samples, err := readSamples(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sorted := append([]time.Duration(nil), samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		sides[i] = &diffSide{Name: filepath.Base(path), samples: samples, sorted: sorted}
+	}
+
+	sides[0].Color = "#3182bd"
+	sides[1].Color = "#e6550d"
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := bufio.NewWriter(f)
+	err = writeDiffHTML(w, sides[0], sides[1])
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Wrote %s.\n", *out)
+	fmt.Printf("\n")
+	printSignificance(sides[0].Name, sides[1].Name, sides[0].samples, sides[1].samples)
+}
+
+func writeDiffHTML(w io.Writer, before, after *diffSide) (err error) {
+	var rows []diffRow
+	for _, p := range diffPercentiles {
+		label := fmt.Sprintf("p%g", p)
+		if p < 10 {
+			label = fmt.Sprintf("p0%g", p)
+		}
+
+		b := percentile(p, before.samples)
+		a := percentile(p, after.samples)
+		rows = append(rows, diffRow{
+			Label:   label,
+			Before:  formatLatency(b),
+			After:   formatLatency(a),
+			Delta:   formatDelta(a - b),
+			Percent: fmt.Sprintf("%+.1f%%", 100*(float64(a)/float64(b)-1)),
+			Worse:   a > b,
+		})
+	}
+
+	ks, ksAt := maxCDFDivergence(before.samples, after.samples)
+
+	// Both charts share a latency scale, which ignores the extreme tail so
+	// that it doesn't flatten everything else.
+	top := percentile(99.9, before.samples)
+	if t := percentile(99.9, after.samples); t > top {
+		top = t
+	}
+
+	top = niceCeiling(top)
+
+	data := struct {
+		Before, After *diffSide
+		Rows          []diffRow
+		KS            string
+		Significance  string
+		CDF           template.HTML
+		Timelines     template.HTML
+		TopMs         float64
+		Width, Margin int
+
+		// Each run's CDF at diffReadoutSteps+1 evenly spaced latencies up to
+		// TopMs, for the pointer readout.
+		BeforeCDF, AfterCDF []float64
+	}{
+		Before: before,
+		After:  after,
+		Rows:   rows,
+		KS: fmt.Sprintf(
+			"The CDFs are furthest apart at %s, where they differ by %.1f percentage points.",
+			strings.TrimSpace(formatLatency(ksAt)),
+			100*abs(ks)),
+		Significance: mannWhitney(before.samples, after.samples).String(),
+		CDF:          template.HTML(diffCDFChart(before, after, top)),
+		Timelines:    template.HTML(diffTimelines(before, after, top)),
+		TopMs:        millis(top),
+		Width:        diffChartWidth,
+		Margin:       diffMargin,
+		BeforeCDF:    cdfSteps(before.sorted, top),
+		AfterCDF:     cdfSteps(after.sorted, top),
+	}
+
+	err = diffTemplate.Execute(w, data)
+	return
+}
+
+// How finely the pointer readout on the CDF chart resolves latency.
+const diffReadoutSteps = 200
+
+// cdfSteps returns the CDF of the sorted samples at diffReadoutSteps+1 evenly
+// spaced latencies from zero to top, as percentages.
+func cdfSteps(sorted []time.Duration, top time.Duration) (steps []float64) {
+	for i := 0; i <= diffReadoutSteps; i++ {
+		f := cdf(sorted, top*time.Duration(i)/diffReadoutSteps)
+		steps = append(steps, math.Round(1000*f)/10)
+	}
+
+	return
+}
+
+// diffCDFChart returns an SVG chart overlaying the empirical CDFs of the two
+// runs, up to the given latency.
+func diffCDFChart(before, after *diffSide, top time.Duration) string {
+	var b strings.Builder
+	plotW := float64(diffChartWidth - 2*diffMargin)
+	plotH := float64(diffChartHeight - 2*diffMargin)
+	x := func(d time.Duration) float64 { return diffMargin + plotW*float64(d)/float64(top) }
+	y := func(f float64) float64 { return diffMargin + plotH*(1-f) }
+
+	fmt.Fprintf(&b, `<svg id="cdf" width="%d" height="%d">`, diffChartWidth, diffChartHeight)
+	diffAxes(&b, top, true, func(i int) (float64, string) {
+		return y(float64(i) / 5), fmt.Sprintf("%d%%", 20*i)
+	})
+
+	for _, s := range []*diffSide{before, after} {
+		var points []string
+		for i, d := range s.sorted {
+			if d > top {
+				break
+			}
+
+			// Thin out long runs; the curve doesn't need every step.
+			if i%((len(s.sorted)+999)/1000) != 0 && i != len(s.sorted)-1 {
+				continue
+			}
+
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(d), y(float64(i+1)/float64(len(s.sorted)))))
+		}
+
+		fmt.Fprintf(
+			&b,
+			`<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`,
+			strings.Join(points, " "),
+			s.Color)
+	}
+
+	fmt.Fprintf(&b, `<line id="cursor" y1="%d" y2="%d" stroke="#999" visibility="hidden"/>`, diffMargin, diffChartHeight-diffMargin)
+	fmt.Fprintf(&b, `</svg>`)
+	return b.String()
+}
+
+// diffTimelines returns an SVG chart for each run plotting its samples in the
+// order they were taken, on the same scales so that they line up.
+func diffTimelines(before, after *diffSide, top time.Duration) string {
+	var b strings.Builder
+	n := len(before.samples)
+	if len(after.samples) > n {
+		n = len(after.samples)
+	}
+
+	plotW := float64(diffChartWidth - 2*diffMargin)
+	plotH := float64(diffChartHeight/2 - diffMargin)
+	for _, s := range []*diffSide{before, after} {
+		x := func(i int) float64 { return diffMargin + plotW*float64(i)/float64(n) }
+		y := func(d time.Duration) float64 {
+			if d > top {
+				d = top
+			}
+
+			return diffMargin/2 + plotH*(1-float64(d)/float64(top))
+		}
+
+		fmt.Fprintf(&b, `<h3>%s</h3>`, template.HTMLEscapeString(s.Name))
+		fmt.Fprintf(&b, `<svg width="%d" height="%d">`, diffChartWidth, diffChartHeight/2)
+		diffAxes(&b, top, false, func(i int) (float64, string) {
+			d := top * time.Duration(i) / 5
+			return y(d), strings.TrimSpace(formatLatency(d))
+		})
+
+		stride := (len(s.samples) + plotMaxPoints - 1) / plotMaxPoints
+		for i := 0; i < len(s.samples); i += stride {
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="1.2" fill="%s"/>`, x(i), y(s.samples[i]), s.Color)
+		}
+
+		fmt.Fprintf(&b, `</svg>`)
+	}
+
+	return b.String()
+}
+
+// diffAxes draws horizontal gridlines with labels given by tick, and if
+// latencyAxis is set, latency labels up to top along the bottom.
+func diffAxes(
+	b *strings.Builder,
+	top time.Duration,
+	latencyAxis bool,
+	tick func(i int) (y float64, label string)) {
+	for i := 0; i <= 5; i++ {
+		y, label := tick(i)
+		fmt.Fprintf(
+			b,
+			`<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/><text x="%d" y="%.1f" text-anchor="end" dominant-baseline="middle">%s</text>`,
+			diffMargin,
+			y,
+			diffChartWidth-diffMargin,
+			y,
+			diffMargin-5,
+			y,
+			label)
+	}
+
+	if !latencyAxis {
+		return
+	}
+
+	for i := 0; i <= 5; i++ {
+		d := top * time.Duration(i) / 5
+		fmt.Fprintf(
+			b,
+			`<text x="%.1f" y="%d" text-anchor="middle">%s</text>`,
+			diffMargin+float64(diffChartWidth-2*diffMargin)*float64(i)/5,
+			diffChartHeight-diffMargin+15,
+			strings.TrimSpace(formatLatency(d)))
+	}
+}
+
+var diffTemplate = template.Must(template.New("diff").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ssh_ping: {{.Before.Name}} vs {{.After.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+svg { font-size: 11px; display: block; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; text-align: right; }
+tr.worse td.delta { color: #c00; }
+tr:not(.worse) td.delta { color: #080; }
+.key span { display: inline-block; width: 1em; height: 0.6em; margin: 0 0.3em 0 1em; }
+</style>
+</head>
+<body>
+<h1>{{.Before.Name}} vs {{.After.Name}}</h1>
+<p class="key">
+<span style="background: {{.Before.Color}}"></span>{{.Before.Name}} (before)
+<span style="background: {{.After.Color}}"></span>{{.After.Name}} (after)
+</p>
+
+<h2>Percentiles</h2>
+<table>
+<tr><th></th><th>Before</th><th>After</th><th>Delta</th><th></th></tr>
+{{range .Rows}}<tr{{if .Worse}} class="worse"{{end}}><td>{{.Label}}</td><td>{{.Before}}</td><td>{{.After}}</td><td class="delta">{{.Delta}}</td><td class="delta">{{.Percent}}</td></tr>
+{{end}}</table>
+
+<h2>Distribution</h2>
+<p>After vs before: {{.Significance}}</p>
+<p>{{.KS}} <span id="readout"></span></p>
+{{.CDF}}
+
+<h2>Samples in order</h2>
+{{.Timelines}}
+
+<script>
+// Show the latency under the pointer on the CDF chart.
+(function() {
+  var svg = document.getElementById("cdf");
+  var cursor = document.getElementById("cursor");
+  var readout = document.getElementById("readout");
+  var width = {{.Width}}, margin = {{.Margin}}, topMs = {{.TopMs}};
+  var before = {{.BeforeCDF}}, after = {{.AfterCDF}}, steps = before.length - 1;
+  svg.addEventListener("mousemove", function(e) {
+    var x = e.clientX - svg.getBoundingClientRect().left;
+    if (x < margin || x > width - margin) {
+      cursor.setAttribute("visibility", "hidden");
+      readout.textContent = "";
+      return;
+    }
+    cursor.setAttribute("x1", x);
+    cursor.setAttribute("x2", x);
+    cursor.setAttribute("visibility", "visible");
+    var f = (x - margin) / (width - 2 * margin);
+    var i = Math.round(f * steps);
+    readout.textContent = "At " + (f * topMs).toFixed(1) + " ms: " +
+        before[i] + "% of before and " + after[i] + "% of after.";
+  });
+})();
+</script>
+</body>
+</html>
+`))
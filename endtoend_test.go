@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An endToEndCheck is a check made by TestEndToEnd: a measurement with the
+// native transport against a testServer, and what must be true of it.
+type endToEndCheck struct {
+	name   string
+	server testServerOptions
+
+	// Flags to set for the measurement, besides those selecting the server.
+	flags map[string]string
+
+	check func(r run, s *testServer) error
+}
+
+var endToEndChecks = []endToEndCheck{
+	{
+		name:   "echo",
+		server: testServerOptions{delay: 5 * time.Millisecond},
+		check: func(r run, s *testServer) error {
+			d := r.distribution()
+			if d.count() == 0 {
+				return errors.New("no samples")
+			}
+
+			if p50 := d.percentile(50); p50 < 5*time.Millisecond || p50 > 50*time.Millisecond {
+				return fmt.Errorf("p50 is %v; want a little over 5ms", p50)
+			}
+
+			return nil
+		},
+	},
+	{
+		name:   "jitter",
+		server: testServerOptions{delay: 10 * time.Millisecond, jitter: 5 * time.Millisecond},
+		check: func(r run, s *testServer) error {
+			d := r.distribution()
+			if spread := d.max() - d.min(); spread < 3*time.Millisecond {
+				return fmt.Errorf("samples span only %v", spread)
+			}
+
+			return nil
+		},
+	},
+	{
+		name:   "reconnect",
+		server: testServerOptions{delay: time.Millisecond},
+		flags:  map[string]string{"reconnect-every": "300ms"},
+		check: func(r run, s *testServer) error {
+			if len(r.setup) < 3 {
+				return fmt.Errorf("made %d connections; want at least 3", len(r.setup))
+			}
+
+			if n := s.connections(); n != len(r.setup) {
+				return fmt.Errorf("recorded %d connections, but the server accepted %d", len(r.setup), n)
+			}
+
+			return nil
+		},
+	},
+	{
+		name: "timeouts",
+
+		// Without --retries, the run fails if the first connection doesn't
+		// echo, so spare the pings that get each connection going.
+		server: testServerOptions{delay: time.Millisecond, dropRate: 0.05, spared: 3},
+		flags:  map[string]string{"ping-timeout": "200ms", "duration": "2s"},
+		check: func(r run, s *testServer) error {
+			if r.timeouts() == 0 {
+				return errors.New("no timeouts recorded")
+			}
+
+			if r.distribution().count() == 0 {
+				return errors.New("no samples")
+			}
+
+			return nil
+		},
+	},
+	{
+		name:   "retries",
+		server: testServerOptions{delay: time.Millisecond, dropRate: 0.05},
+		flags:  map[string]string{"ping-timeout": "200ms", "retries": "5", "duration": "2s"},
+		check: func(r run, s *testServer) error {
+			if r.retried.afterTimeout == 0 {
+				return errors.New("no retries recorded")
+			}
+
+			if r.retried.afterTimeout != r.timeouts() {
+				return fmt.Errorf("%d retries after %d timeouts", r.retried.afterTimeout, r.timeouts())
+			}
+
+			return nil
+		},
+	},
+	{
+		name:   "report",
+		server: testServerOptions{delay: 2 * time.Millisecond},
+		check: func(r run, s *testServer) error {
+			rep := newSummaryReport("test", r, nil)
+
+			var buf bytes.Buffer
+			if err := (jsonRenderer{}).render(&buf, rep); err != nil {
+				return fmt.Errorf("json: %w", err)
+			}
+
+			var decoded jsonReport
+			if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				return fmt.Errorf("json: %w", err)
+			}
+
+			if decoded.Samples != r.distribution().count() || len(decoded.Stats) != len(rep.stats) {
+				return fmt.Errorf("json: unexpected report %s", bytes.TrimSpace(buf.Bytes()))
+			}
+
+			buf.Reset()
+			if err := (csvRenderer{}).render(&buf, rep); err != nil {
+				return fmt.Errorf("csv: %w", err)
+			}
+
+			rows, err := csv.NewReader(&buf).ReadAll()
+			if err != nil {
+				return fmt.Errorf("csv: %w", err)
+			}
+
+			if len(rows) != len(rep.stats)+1 {
+				return fmt.Errorf("csv: %d rows for %d statistics", len(rows), len(rep.stats))
+			}
+
+			buf.Reset()
+			if err := (textRenderer{}).render(&buf, rep); err != nil {
+				return fmt.Errorf("text: %w", err)
+			}
+
+			if !strings.Contains(buf.String(), "p50") {
+				return fmt.Errorf("text: no p50 in %q", buf.String())
+			}
+
+			return nil
+		},
+	},
+}
+
+// TestEndToEnd makes each of endToEndChecks against an in-process SSH server.
+// Unlike integration/run.sh, it needs nothing but this package.
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures for several seconds")
+	}
+
+	saved := progressOutput
+	progressOutput = io.Discard
+	defer func() { progressOutput = saved }()
+
+	for _, c := range endToEndChecks {
+		t.Run(c.name, func(t *testing.T) {
+			if err := runEndToEndCheck(t, c); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// runEndToEndCheck makes a check against a server of its own.
+func runEndToEndCheck(t *testing.T, c endToEndCheck) (err error) {
+	s, err := startTestServer(c.server)
+	if err != nil {
+		return
+	}
+
+	defer s.Close()
+
+	flags := map[string]string{
+		"transport":                "native",
+		"host":                     "test@" + s.addr(),
+		"strict-host-key-checking": "no",
+		"duration":                 "1s",
+	}
+
+	for name, value := range c.flags {
+		flags[name] = value
+	}
+
+	setFlags(t, flags)
+	r, err := measure(context.Background(), transportOptions{})
+	if err != nil {
+		return
+	}
+
+	err = c.check(r, s)
+	return
+}
+
+// setFlags sets the flags, checks them as main does, and restores every flag
+// when the test finishes.
+func setFlags(t *testing.T, flags map[string]string) {
+	saved := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) { saved[f.Name] = f.Value.String() })
+	t.Cleanup(func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			if v := saved[f.Name]; f.Value.String() != v {
+				f.Value.Set(v)
+			}
+		})
+	})
+
+	for name, value := range flags {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatalf("--%s: %v", name, err)
+		}
+	}
+
+	checkFlags()
+}
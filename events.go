@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// An event is something notable that happened during a run, which summary
+// statistics would hide.
+type event struct {
+	// "spike", "timeout", "bad reply", "reconnect", or "note" for an
+	// annotation.
+	kind string
+
+	start    time.Time
+	duration time.Duration
+
+	// For spikes, the number of consecutive samples above --spike-threshold
+	// and the worst of them.
+	samples int
+	worst   time.Duration
+
+	// Why a reconnect happened, how a reply was bad, or an annotation's text.
+	reason string
+}
+
+// noteSpike records a sample in the run's events if it exceeds
+// --spike-threshold, extending the current spike if the previous sample did
+// too.
+func (r *run) noteSpike(sent time.Time, rtt time.Duration) {
+	if *spikeThreshold <= 0 || rtt < *spikeThreshold {
+		r.inSpike = false
+		return
+	}
+
+	if !r.inSpike {
+		r.events = append(r.events, event{kind: "spike", start: sent})
+		r.inSpike = true
+	}
+
+	e := &r.events[len(r.events)-1]
+	end := e.start.Add(e.duration)
+	if sent.Before(e.start) {
+		e.start = sent
+	}
+
+	if sent.Add(rtt).After(end) {
+		end = sent.Add(rtt)
+	}
+
+	e.duration = end.Sub(e.start)
+	e.samples++
+	if rtt > e.worst {
+		e.worst = rtt
+	}
+}
+
+// timeouts returns how many times the run timed out waiting for an echo.
+func (r run) timeouts() (n int) {
+	for _, e := range r.events {
+		if e.kind == "timeout" {
+			n++
+		}
+	}
+
+	return
+}
+
+// mergeEvents adds the events from runs collected concurrently to the run,
+// keeping them in time order.
+func (r *run) mergeEvents(streams []run) {
+	for _, s := range streams {
+		r.events = append(r.events, s.events...)
+	}
+
+	sort.SliceStable(r.events, func(i, j int) bool { return r.events[i].start.Before(r.events[j].start) })
+}
+
+// errEchoTimeout is returned when no echo data arrives within --ping-timeout.
+var errEchoTimeout = errors.New("echo timed out")
+
+// timeoutStream wraps a stream, abandoning its connection if a read or write
+// blocks for longer than --ping-timeout.
+type timeoutStream struct {
+	stream
+
+	// Cancels the context the connection was made with.
+	abandon context.CancelFunc
+
+	timedOut *int32
+}
+
+func (s timeoutStream) Write(p []byte) (n int, err error) {
+	err = s.guard(func() (err error) {
+		n, err = s.stream.Write(p)
+		return
+	})
+
+	return
+}
+
+func (s timeoutStream) Read(p []byte) (n int, err error) {
+	err = s.guard(func() (err error) {
+		n, err = s.stream.Read(p)
+		return
+	})
+
+	return
+}
+
+// guard calls f, abandoning the connection if it doesn't return within
+// --ping-timeout.
+func (s timeoutStream) guard(f func() error) (err error) {
+	timer := time.AfterFunc(*pingTimeout, func() {
+		atomic.StoreInt32(s.timedOut, 1)
+		s.abandon()
+	})
+
+	err = f()
+	if !timer.Stop() || atomic.LoadInt32(s.timedOut) != 0 {
+		err = errEchoTimeout
+	}
+
+	return
+}
+
+// printEvents prints a timeline of the run's events, if there were any.
+func printEvents(events []event) {
+	if len(events) == 0 {
+		return
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("Events:\n")
+	for _, e := range events {
+		var detail string
+		switch e.kind {
+		case "spike":
+			detail = fmt.Sprintf("worst %s", formatLatency(e.worst))
+			if e.samples > 1 {
+				detail = fmt.Sprintf("%d samples, %s", e.samples, detail)
+			}
+		case "timeout":
+			detail = "connection abandoned"
+		case "reconnect", "bad reply", "note":
+			detail = e.reason
+		}
+
+		fmt.Printf(
+			"  %s  %-9s  %10s  %s\n",
+			e.start.Format("15:04:05.000"),
+			e.kind,
+			formatLatency(e.duration),
+			detail)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// With --failover-gap, the --ping-timeout used if none is set. It's long
+// enough for TCP to ride out a brief blackout on the same connection, as on a
+// bonded link, and short enough to move on quickly when the connection is
+// gone for good, as after a WAN failover that changes the source address.
+const failoverPingTimeout = time.Second
+
+// With --failover-gap, how long to wait for a connection attempt, which may
+// otherwise hang for minutes if it started during an outage.
+const failoverConnectTimeout = 3 * time.Second
+
+// With --failover-gap, how long to wait before trying again after a
+// connection fails or can't be made.
+const failoverRetryDelay = 100 * time.Millisecond
+
+// A gap is a period in which no echoes arrived.
+type gap struct {
+	// When the last echo before the gap arrived, and how long it was until the
+	// next one did.
+	start    time.Time
+	duration time.Duration
+
+	// Whether the gap was still open when the run ended.
+	unrecovered bool
+
+	// How many times a connection failed or couldn't be made during the gap.
+	failures int
+
+	// If a new connection ended the gap, how long it took from starting it to
+	// its first echo. This is how long recovery took once the path was back,
+	// give or take the wait before the attempt.
+	reconnected bool
+	recovery    time.Duration
+}
+
+// findGaps returns the periods of at least minGap between echoes in a run
+// that ended at the given time.
+func findGaps(r run, minGap time.Duration, end time.Time) (gaps []gap) {
+	var arrivals []time.Time
+	for i, rtt := range r.samples {
+		arrivals = append(arrivals, r.sent[i].Add(rtt))
+	}
+
+	// A reconnect's first echo is thrown away as warm-up, but it still shows
+	// that the path was back.
+	for _, e := range r.events {
+		if e.kind == "reconnect" {
+			arrivals = append(arrivals, e.start.Add(e.duration))
+		}
+	}
+
+	sort.Slice(arrivals, func(i, j int) bool { return arrivals[i].Before(arrivals[j]) })
+	arrivals = append(arrivals, end)
+	for i := 1; i < len(arrivals); i++ {
+		from, to := arrivals[i-1], arrivals[i]
+		if to.Sub(from) < minGap {
+			continue
+		}
+
+		g := gap{
+			start:       from,
+			duration:    to.Sub(from),
+			unrecovered: i == len(arrivals)-1,
+		}
+
+		for _, t := range r.failures {
+			if t.After(from) && !t.After(to) {
+				g.failures++
+			}
+		}
+
+		for _, e := range r.events {
+			if e.kind == "reconnect" && e.start.After(from) && e.start.Before(to) {
+				g.reconnected = true
+				g.recovery = e.duration
+			}
+		}
+
+		gaps = append(gaps, g)
+	}
+
+	return
+}
+
+// printGaps prints the gaps in connectivity of at least minGap found by
+// findGaps, and the availability they leave over the run.
+func printGaps(r run, minGap time.Duration, start, end time.Time) {
+	gaps := findGaps(r, minGap, end)
+	var total, longest time.Duration
+	for _, g := range gaps {
+		total += g.duration
+		if g.duration > longest {
+			longest = g.duration
+		}
+	}
+
+	fmt.Printf(
+		"Connectivity gaps of at least %s: %d, totalling %s (%.3f%% available).\n",
+		strings.TrimSpace(formatLatency(minGap)),
+		len(gaps),
+		strings.TrimSpace(formatLatency(total)),
+		100*(1-total.Seconds()/end.Sub(start).Seconds()))
+
+	if len(gaps) == 0 {
+		return
+	}
+
+	fmt.Printf("Longest gap: %s.\n", strings.TrimSpace(formatLatency(longest)))
+	fmt.Printf("\n")
+	fmt.Printf("%-12s  %10s  %9s  %s\n", "Start", "Duration", "Failures", "Recovery")
+	for _, g := range gaps {
+		recovery := "same connection"
+		switch {
+		case g.unrecovered:
+			recovery = "not recovered by end of run"
+		case g.reconnected:
+			recovery = "reconnected in " + strings.TrimSpace(formatLatency(g.recovery))
+		}
+
+		fmt.Printf(
+			"%-12s  %10s  %9d  %s\n",
+			g.start.Format("15:04:05.000"),
+			formatLatency(g.duration),
+			g.failures,
+			recovery)
+	}
+}
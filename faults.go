@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// faultPlan describes faults to inject into the stream to the echo process,
+// as parsed from a string like
+//
+//	delay(10%,50ms)+drop(1%)+disconnect(30s)
+//
+// The supported terms are:
+//
+//	delay(p%,d)    Hold each write for d with probability p.
+//	drop(p%)       Discard each write with probability p, so that it's never
+//	               echoed, as if lost on a path that never delivered it.
+//	disconnect(d)  Break the stream d after it is started.
+type faultPlan struct {
+	delayProb     float64
+	delay         time.Duration
+	dropProb      float64
+	disconnectAge time.Duration
+}
+
+// With --inject-faults, the faults to inject.
+var injectedFaults faultPlan
+
+// With a drop fault, the --ping-timeout used if none is set, without which a
+// dropped ping would be waited on forever.
+const dropPingTimeout = 5 * time.Second
+
+func parseFaultPlan(s string) (p faultPlan, err error) {
+	terms, err := parseTerms(s)
+	if err != nil {
+		return
+	}
+
+	for _, t := range terms {
+		switch {
+		case t.name == "delay" && len(t.args) == 2:
+			if p.delayProb, err = parsePercent(t.args[0]); err != nil {
+				break
+			}
+
+			p.delay, err = time.ParseDuration(t.args[1])
+
+		case t.name == "drop" && len(t.args) == 1:
+			p.dropProb, err = parsePercent(t.args[0])
+
+		case t.name == "disconnect" && len(t.args) == 1:
+			p.disconnectAge, err = time.ParseDuration(t.args[0])
+
+		default:
+			err = errors.New("unknown fault or wrong number of arguments")
+		}
+
+		if err != nil {
+			err = fmt.Errorf("%s: %w", t, err)
+			return
+		}
+	}
+
+	return
+}
+
+// With --inject-faults, where each faulty echo's seed comes from. Set from
+// --seed by checkFlags, so that a run is reproducible while each stream,
+// including those made by reconnecting, draws its faults afresh rather than
+// repeating the first's.
+var (
+	faultSeedsMu sync.Mutex
+	faultSeeds   *rand.Rand
+)
+
+// newFaultRand returns a source of randomness for a new faulty echo.
+func newFaultRand() *rand.Rand {
+	faultSeedsMu.Lock()
+	defer faultSeedsMu.Unlock()
+
+	if faultSeeds == nil {
+		faultSeeds = newRand()
+	}
+
+	return rand.New(rand.NewSource(faultSeeds.Int63()))
+}
+
+var errInjectedDisconnect = errors.New("injected disconnect")
+
+// faultyEcho wraps a stream to an echo process, injecting the faults
+// described by a plan. Injected delays end early if the context is
+// cancelled, as it is when the connection is abandoned.
+type faultyEcho struct {
+	ctx     context.Context
+	plan    faultPlan
+	rand    *rand.Rand
+	started time.Time
+
+	wrapped stream
+}
+
+func newFaultyEcho(ctx context.Context, plan faultPlan, r *rand.Rand, s stream) *faultyEcho {
+	return &faultyEcho{
+		ctx:     ctx,
+		plan:    plan,
+		rand:    r,
+		started: time.Now(),
+		wrapped: s,
+	}
+}
+
+func (e *faultyEcho) disconnected() bool {
+	return e.plan.disconnectAge > 0 && time.Since(e.started) >= e.plan.disconnectAge
+}
+
+func (e *faultyEcho) Write(p []byte) (n int, err error) {
+	if e.disconnected() {
+		err = errInjectedDisconnect
+		return
+	}
+
+	if e.rand.Float64() < e.plan.delayProb {
+		timer := time.NewTimer(e.plan.delay)
+		select {
+		case <-timer.C:
+		case <-e.ctx.Done():
+			timer.Stop()
+			err = e.ctx.Err()
+			return
+		}
+	}
+
+	// Drawing only when drops are planned keeps the other faults where a
+	// seed put them before.
+	if e.plan.dropProb > 0 && e.rand.Float64() < e.plan.dropProb {
+		n = len(p)
+		return
+	}
+
+	n, err = e.wrapped.Write(p)
+	return
+}
+
+func (e *faultyEcho) Read(p []byte) (n int, err error) {
+	if e.disconnected() {
+		err = errInjectedDisconnect
+		return
+	}
+
+	n, err = e.wrapped.Read(p)
+	return
+}
+
+func (e *faultyEcho) CloseWrite() error {
+	return e.wrapped.CloseWrite()
+}
+
+func (e *faultyEcho) Close() error {
+	return e.wrapped.Close()
+}
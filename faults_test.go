@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFaultPlan(t *testing.T) {
+	p, err := parseFaultPlan("delay(10%,50ms)+drop(2.5%)+disconnect(30s)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := faultPlan{delayProb: 0.1, delay: 50 * time.Millisecond, dropProb: 0.025, disconnectAge: 30 * time.Second}
+	if p != want {
+		t.Errorf("parsed %+v; want %+v", p, want)
+	}
+
+	for _, bad := range []string{"drop(5)", "drop(150%)", "drop(1%,2%)", "jitter(1ms)"} {
+		if _, err := parseFaultPlan(bad); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestDropSetsPingTimeout(t *testing.T) {
+	setFlags(t, map[string]string{"simulate": "constant(1ms)", "inject-faults": "drop(1%)"})
+	if *pingTimeout != dropPingTimeout {
+		t.Errorf("--ping-timeout = %v; want %v", *pingTimeout, dropPingTimeout)
+	}
+}
+
+// A writeCounter is a stream that counts the writes that reach it.
+type writeCounter struct {
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) { w.writes++; return len(p), nil }
+func (w *writeCounter) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (w *writeCounter) CloseWrite() error           { return nil }
+func (w *writeCounter) Close() error                { return nil }
+
+// firstDrop returns which write to a new faulty echo, counting from one, is
+// the first that the plan drops.
+func firstDrop(plan faultPlan) int {
+	var w writeCounter
+	e := newFaultyEcho(context.Background(), plan, newFaultRand(), &w)
+	for i := 1; ; i++ {
+		e.Write([]byte("ping\n"))
+		if w.writes < i {
+			return i
+		}
+	}
+}
+
+func TestFaultSeeds(t *testing.T) {
+	setFlags(t, map[string]string{"simulate": "constant(1ms)", "inject-faults": "drop(10%)", "seed": "1"})
+
+	// Each stream draws its faults afresh, but the same --seed gives the same
+	// faults again.
+	var drops []int
+	for i := 0; i < 5; i++ {
+		drops = append(drops, firstDrop(injectedFaults))
+	}
+
+	if !slices.ContainsFunc(drops, func(k int) bool { return k != drops[0] }) {
+		t.Errorf("every stream first drops write %d", drops[0])
+	}
+
+	faultSeeds = newRand()
+	for i, want := range drops {
+		if k := firstDrop(injectedFaults); k != want {
+			t.Errorf("with the same seed, stream %d first drops write %d; want %d", i, k, want)
+		}
+	}
+}
+
+func TestFaultDelayCancelled(t *testing.T) {
+	plan, err := parseFaultPlan("delay(100%,1h)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	var w writeCounter
+	e := newFaultyEcho(ctx, plan, newFaultRand(), &w)
+	start := time.Now()
+	if _, err := e.Write([]byte("ping\n")); err != context.DeadlineExceeded {
+		t.Errorf("Write returned %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second || w.writes != 0 {
+		t.Errorf("Write took %v and made %d writes; want it cut short", elapsed, w.writes)
+	}
+}
+
+// The timeout, loss, and reconnection accounting, run against simulated
+// echoes with injected faults.
+func TestMeasureWithFaults(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures for several seconds")
+	}
+
+	saved := progressOutput
+	progressOutput = io.Discard
+	defer func() { progressOutput = saved }()
+
+	t.Run("drop", func(t *testing.T) {
+		setFlags(t, map[string]string{
+			"simulate":      "constant(1ms)",
+			"inject-faults": "drop(5%)",
+			"ping-timeout":  "100ms",
+			"duration":      "1s",
+			"seed":          "1",
+		})
+
+		// With this seed, the first ping isn't dropped, which would fail the
+		// run before it started.
+		r, err := measure(context.Background(), transportOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every connection but perhaps the last, cut short by --duration,
+		// ends by timing out on a dropped ping.
+		timeouts, connections, samples := r.timeouts(), len(r.setup), r.distribution().count()
+		if timeouts < 2 {
+			t.Fatalf("%d timeouts; want several", timeouts)
+		}
+
+		if connections != timeouts && connections != timeouts+1 {
+			t.Errorf("%d connections for %d timeouts", connections, timeouts)
+		}
+
+		// Each connection drops pings afresh, so collects a different number
+		// of samples before its timeout.
+		perConnection := make(map[int]bool)
+		for i := 0; i+1 < connections; i++ {
+			var n int
+			for _, sent := range r.sent {
+				if !sent.Before(r.setupStarted[i]) && sent.Before(r.setupStarted[i+1]) {
+					n++
+				}
+			}
+
+			perConnection[n] = true
+		}
+
+		if len(perConnection) < 2 {
+			t.Errorf("every connection collected the same number of samples: %v", perConnection)
+		}
+
+		var reconnects int
+		for _, e := range r.events {
+			if e.kind == "reconnect" && e.reason == "after timeout" {
+				reconnects++
+			}
+		}
+
+		if reconnects != connections-1 {
+			t.Errorf("%d reconnections after timeouts for %d connections", reconnects, connections)
+		}
+
+		path := filepath.Join(t.TempDir(), "summary.log")
+		if err := appendSummary(path, "simulated", r.setupStarted[0], r); err != nil {
+			t.Fatal(err)
+		}
+
+		line, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := fmt.Sprintf("loss=%.3f\n", float64(timeouts)/float64(samples+timeouts))
+		if !strings.HasSuffix(string(line), want) {
+			t.Errorf("summary %q; want it to end with %q", line, want)
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		setFlags(t, map[string]string{
+			"simulate":      "constant(1ms)",
+			"inject-faults": "disconnect(200ms)",
+			"retries":       "3",
+			"duration":      "1s",
+			"seed":          "1",
+		})
+
+		// The connection breaks after 200ms, and the run is over by the time
+		// the retry would be made.
+		r, err := measure(context.Background(), transportOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.retried.afterError != 1 || r.retried.afterTimeout != 0 {
+			t.Errorf("retries: %+v; want one after a connection error", r.retried)
+		}
+
+		if len(r.setup) != 1 || r.timeouts() != 0 {
+			t.Errorf("%d connections and %d timeouts; want 1 and 0", len(r.setup), r.timeouts())
+		}
+
+		if last := r.sent[len(r.sent)-1]; last.Sub(r.setupStarted[0]) > 250*time.Millisecond {
+			t.Errorf("sample sent %v into the connection; want none after the disconnect", last.Sub(r.setupStarted[0]))
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The values a sample filter can refer to.
+type filterVars struct {
+	// The sample's round trip time.
+	latency time.Duration
+
+	// When the sample was sent, relative to the start of its run.
+	elapsed time.Duration
+}
+
+// A sampleFilter reports whether a sample should be kept.
+type sampleFilter func(v filterVars) bool
+
+// parseFilter parses a filter expression like
+//
+//	latency > 100ms && elapsed < 2m
+//
+// Comparisons of latency or elapsed with a duration, using <, <=, >, >=, ==,
+// or !=, can be combined with &&, ||, !, and parentheses.
+func parseFilter(s string) (f sampleFilter, err error) {
+	p := &filterParser{s: s}
+	f, err = p.parseOr()
+	if err == nil && p.peek() != "" {
+		err = fmt.Errorf("unexpected %q", p.peek())
+	}
+
+	if err != nil {
+		err = fmt.Errorf("filter %q: %w", s, err)
+	}
+
+	return
+}
+
+type filterParser struct {
+	s   string
+	pos int
+}
+
+// peek returns the next token without consuming it, or "" at the end.
+func (p *filterParser) peek() string {
+	rest := strings.TrimLeftFunc(p.s[p.pos:], unicode.IsSpace)
+	if rest == "" {
+		return ""
+	}
+
+	for _, op := range []string{"&&", "||", "<=", ">=", "==", "!=", "<", ">", "!", "(", ")"} {
+		if strings.HasPrefix(rest, op) {
+			return op
+		}
+	}
+
+	end := strings.IndexFunc(rest, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune("&|<>=!()", r)
+	})
+
+	if end < 0 {
+		end = len(rest)
+	}
+
+	return rest[:end]
+}
+
+func (p *filterParser) next() string {
+	tok := p.peek()
+	p.pos = len(p.s) - len(strings.TrimLeftFunc(p.s[p.pos:], unicode.IsSpace)) + len(tok)
+	return tok
+}
+
+func (p *filterParser) parseOr() (f sampleFilter, err error) {
+	if f, err = p.parseAnd(); err != nil {
+		return
+	}
+
+	for p.peek() == "||" {
+		p.next()
+		var g sampleFilter
+		if g, err = p.parseAnd(); err != nil {
+			return
+		}
+
+		lhs := f
+		f = func(v filterVars) bool { return lhs(v) || g(v) }
+	}
+
+	return
+}
+
+func (p *filterParser) parseAnd() (f sampleFilter, err error) {
+	if f, err = p.parseUnary(); err != nil {
+		return
+	}
+
+	for p.peek() == "&&" {
+		p.next()
+		var g sampleFilter
+		if g, err = p.parseUnary(); err != nil {
+			return
+		}
+
+		lhs := f
+		f = func(v filterVars) bool { return lhs(v) && g(v) }
+	}
+
+	return
+}
+
+func (p *filterParser) parseUnary() (f sampleFilter, err error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		var g sampleFilter
+		if g, err = p.parseUnary(); err != nil {
+			return
+		}
+
+		f = func(v filterVars) bool { return !g(v) }
+		return
+
+	case "(":
+		p.next()
+		if f, err = p.parseOr(); err != nil {
+			return
+		}
+
+		if tok := p.next(); tok != ")" {
+			err = fmt.Errorf("expected ) but found %q", tok)
+		}
+
+		return
+	}
+
+	f, err = p.parseComparison()
+	return
+}
+
+func (p *filterParser) parseComparison() (f sampleFilter, err error) {
+	var get func(v filterVars) time.Duration
+	switch name := p.next(); name {
+	case "latency":
+		get = func(v filterVars) time.Duration { return v.latency }
+	case "elapsed":
+		get = func(v filterVars) time.Duration { return v.elapsed }
+	case "":
+		err = fmt.Errorf("unexpected end")
+		return
+	default:
+		err = fmt.Errorf("unknown value %q; want latency or elapsed", name)
+		return
+	}
+
+	op := p.next()
+	var cmp func(a, b time.Duration) bool
+	switch op {
+	case "<":
+		cmp = func(a, b time.Duration) bool { return a < b }
+	case "<=":
+		cmp = func(a, b time.Duration) bool { return a <= b }
+	case ">":
+		cmp = func(a, b time.Duration) bool { return a > b }
+	case ">=":
+		cmp = func(a, b time.Duration) bool { return a >= b }
+	case "==":
+		cmp = func(a, b time.Duration) bool { return a == b }
+	case "!=":
+		cmp = func(a, b time.Duration) bool { return a != b }
+	default:
+		err = fmt.Errorf("expected a comparison but found %q", op)
+		return
+	}
+
+	limit, err := time.ParseDuration(p.next())
+	if err != nil {
+		return
+	}
+
+	f = func(v filterVars) bool { return cmp(get(v), limit) }
+	return
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fleetConfig is the format of the file named by --config, e.g.
+//
+//	defaults:
+//	  duration: 10s
+//	  thresholds: ["p95<80ms"]
+//	targets:
+//	  - host: bastion1.example.com
+//	  - name: eu
+//	    host: admin@bastion2.example.com
+//	    port: 2222
+//	    jump: gw.example.com
+//	    interval: 500ms
+//	    labels: {region: eu-west, provider: hetzner}
+//
+// Options missing from a target are taken from defaults, and then from the
+// corresponding flags. Labels are merged with those in defaults.
+type fleetConfig struct {
+	Defaults fleetTarget   `yaml:"defaults"`
+	Targets  []fleetTarget `yaml:"targets"`
+}
+
+type fleetTarget struct {
+	// How the target is labelled in output. Defaults to the host.
+	Name string `yaml:"name"`
+
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+
+	// A host to connect through, as for ssh -J.
+	Jump string `yaml:"jump"`
+
+	Interval   time.Duration `yaml:"interval"`
+	Duration   time.Duration `yaml:"duration"`
+	Thresholds []string      `yaml:"thresholds"`
+
+	// Groups the target belongs to, like region: eu-west, which text output
+	// summarizes together.
+	Labels map[string]string `yaml:"labels"`
+}
+
+// readFleetConfig reads and validates a --config file, applying its defaults
+// to each target.
+func readFleetConfig(path string) (targets []fleetTarget, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	var c fleetConfig
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err = dec.Decode(&c); err != nil {
+		err = fmt.Errorf("%s: %w", path, err)
+		return
+	}
+
+	if len(c.Targets) == 0 {
+		err = fmt.Errorf("%s: no targets", path)
+		return
+	}
+
+	d := c.Defaults
+	for i, t := range c.Targets {
+		if t.Host == "" {
+			err = fmt.Errorf("%s: target %d has no host", path, i+1)
+			return
+		}
+
+		if t.Name == "" {
+			t.Name = t.Host
+		}
+
+		if t.Port == 0 {
+			t.Port = d.Port
+		}
+
+		if t.Jump == "" {
+			t.Jump = d.Jump
+		}
+
+		if t.Interval == 0 {
+			t.Interval = d.Interval
+		}
+
+		if t.Duration == 0 {
+			t.Duration = d.Duration
+		}
+
+		if t.Thresholds == nil {
+			t.Thresholds = d.Thresholds
+		}
+
+		if len(d.Labels) != 0 {
+			labels := maps.Clone(d.Labels)
+			maps.Copy(labels, t.Labels)
+			t.Labels = labels
+		}
+
+		if t.Jump != "" && *transportKind == "native" {
+			err = fmt.Errorf("%s: target %s: jump hosts need --transport=exec", path, t.Name)
+			return
+		}
+
+		for _, s := range t.Thresholds {
+			var th threshold
+			if th, err = parseThreshold(s); err != nil {
+				err = fmt.Errorf("%s: target %s: %w", path, t.Name, err)
+				return
+			}
+
+			if reason := phaseUnavailable(th.phase); reason != "" {
+				err = fmt.Errorf("%s: target %s: threshold %s %s", path, t.Name, th, reason)
+				return
+			}
+		}
+
+		targets = append(targets, t)
+	}
+
+	return
+}
+
+// options returns the transport options for connecting to the target.
+func (t fleetTarget) options() (opts transportOptions) {
+	opts.host = t.Host
+	if t.Port != 0 {
+		if *transportKind == "native" {
+			user, hostname := "", t.Host
+			if i := strings.LastIndex(t.Host, "@"); i >= 0 {
+				user, hostname = t.Host[:i+1], t.Host[i+1:]
+			}
+
+			opts.host = user + net.JoinHostPort(hostname, strconv.Itoa(t.Port))
+		} else {
+			opts.sshArgs = append(opts.sshArgs, "-p", strconv.Itoa(t.Port))
+		}
+	}
+
+	if t.Jump != "" {
+		opts.sshArgs = append(opts.sshArgs, "-J", t.Jump)
+	}
+
+	return
+}
+
+// measureFleet measures each of the targets in a --config file in turn,
+// reporting on and recording each as a run of a single host would be. In
+// text, it finishes with a table of the results and whether each met its
+// thresholds, which are its own and those set by --threshold. Targets that
+// couldn't be measured count as breaching them.
+func measureFleet(ctx context.Context, path string) (thresholdsBreached bool, err error) {
+	targets, err := readFleetConfig(path)
+	if err != nil {
+		return
+	}
+
+	results := make([]fleetResult, len(targets))
+
+	// Per-target options are applied by setting the flags they override for
+	// the duration of the target's measurement.
+	defaultInterval, defaultDuration := *interval, *duration
+	defer func() {
+		*interval, *duration = defaultInterval, defaultDuration
+	}()
+
+	text := *format == "text" || *format == "github"
+	for i, t := range targets {
+		*interval, *duration = defaultInterval, defaultDuration
+		if t.Interval != 0 {
+			*interval = t.Interval
+		}
+
+		if t.Duration != 0 {
+			*duration = t.Duration
+		}
+
+		var ts []threshold
+		for _, s := range t.Thresholds {
+			// Validated by readFleetConfig.
+			th, _ := parseThreshold(s)
+			ts = append(ts, th)
+		}
+
+		if text {
+			fmt.Printf("\n=== %s\n\n", t.Name)
+		} else {
+			fmt.Fprintf(progressOutput, "Measuring %s...\n", t.Name)
+		}
+
+		var r run
+		opts := t.options()
+		if results[i].err = prepareEcho(ctx, opts); results[i].err == nil {
+			r, results[i].checks, results[i].err = measureTarget(ctx, t.Name, opts, ts, nil, "")
+		}
+
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+
+		if results[i].err != nil {
+			if !text {
+				log.Printf("%s: %v", t.Name, results[i].err)
+			}
+
+			continue
+		}
+
+		results[i].d = r.distribution()
+	}
+
+	for _, res := range results {
+		if res.err != nil || anyBreached(res.checks) {
+			thresholdsBreached = true
+		}
+	}
+
+	if !text {
+		return
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("%-30s %8s %8s %8s %8s  %s\n", "Target", "Samples", "p50", "p95", "Max", "Thresholds")
+	for i, t := range targets {
+		res := results[i]
+		if res.err != nil {
+			fmt.Printf("%-30s %v\n", t.Name, res.err)
+			continue
+		}
+
+		verdict := "-"
+		if len(res.checks) != 0 {
+			verdict = "pass"
+		}
+
+		var failed []string
+		for _, c := range res.checks {
+			if !c.passed() {
+				failed = append(failed, fmt.Sprintf("%s (%s)", c.threshold, strings.TrimSpace(formatLatency(c.value))))
+			}
+		}
+
+		if len(failed) != 0 {
+			verdict = "FAIL " + strings.Join(failed, ", ")
+		}
+
+		fmt.Printf(
+			"%-30s %8d %8s %8s %8s  %s\n",
+			t.Name,
+			res.d.count(),
+			formatLatency(res.d.percentile(50)),
+			formatLatency(res.d.percentile(95)),
+			formatLatency(res.d.max()),
+			verdict)
+	}
+
+	printLabelRollups(targets, results)
+	return
+}
+
+// A fleetResult is what measuring a target in a --config file found.
+type fleetResult struct {
+	d      distribution
+	checks []thresholdResult
+	err    error
+}
+
+// printLabelRollups prints a table for each label used by the targets,
+// summarizing together the targets with each of its values. Their samples
+// are merged, so that a group's percentiles are those of all its samples.
+func printLabelRollups(targets []fleetTarget, results []fleetResult) {
+	var names []string
+	for _, t := range targets {
+		for name := range t.Labels {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		type group struct {
+			targets, failed int
+			h               histogram
+		}
+
+		var values []string
+		groups := make(map[string]*group)
+		for i, t := range targets {
+			value, ok := t.Labels[name]
+			if !ok {
+				continue
+			}
+
+			g := groups[value]
+			if g == nil {
+				g = &group{}
+				groups[value] = g
+				values = append(values, value)
+			}
+
+			g.targets++
+			res := results[i]
+			if res.err != nil {
+				g.failed++
+				continue
+			}
+
+			switch d := res.d.(type) {
+			case *histogram:
+				g.h.merge(d)
+			case sampleSet:
+				for _, rtt := range d {
+					g.h.record(rtt)
+				}
+			}
+		}
+
+		sort.Strings(values)
+		fmt.Printf("\n")
+		fmt.Printf("%-30s %8s %8s %8s %8s %8s %8s\n", name, "Targets", "Failed", "Samples", "p50", "p95", "Max")
+		for _, value := range values {
+			g := groups[value]
+			if g.h.count() == 0 {
+				fmt.Printf("%-30s %8d %8d %8d %8s %8s %8s\n", value, g.targets, g.failed, 0, "-", "-", "-")
+				continue
+			}
+
+			fmt.Printf(
+				"%-30s %8d %8d %8d %8s %8s %8s\n",
+				value,
+				g.targets,
+				g.failed,
+				g.h.count(),
+				formatLatency(g.h.percentile(50)),
+				formatLatency(g.h.percentile(95)),
+				formatLatency(g.h.max()))
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+)
+
+// Exit statuses for the gate subcommand.
+const (
+	gatePass        = 0
+	gateFail        = 1
+	gateUnreachable = 2
+)
+
+// gateVerdict is printed as JSON on stdout by the gate subcommand.
+type gateVerdict struct {
+	Verdict  string  `json:"verdict"`
+	Host     string  `json:"host"`
+	Attempts int     `json:"attempts"`
+	Samples  int     `json:"samples,omitempty"`
+	P95Ms    float64 `json:"p95_ms,omitempty"`
+	Error    string  `json:"error,omitempty"`
+
+	Thresholds []gateThreshold `json:"thresholds,omitempty"`
+}
+
+type gateThreshold struct {
+	Threshold string  `json:"threshold"`
+	ValueMs   float64 `json:"value_ms"`
+	Passed    bool    `json:"passed"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// waitForSSH repeatedly tries to connect and get an echo back, up to the
+// given number of attempts, returning the number of attempts made.
+func waitForSSH(ctx context.Context, attempts int, retryInterval time.Duration) (n int, err error) {
+	payload := makePayload(*payloadSize)
+	for n = 1; ; n++ {
+		err = func() (err error) {
+			t, err := newTransport(transportOptions{})
+			if err != nil {
+				return
+			}
+
+			if err = t.Dial(ctx); err != nil {
+				return
+			}
+
+			defer t.Close()
+
+			s, err := startEcho(ctx, t)
+			if err != nil {
+				return
+			}
+
+			defer s.Close()
+
+			_, err = runPing(payload, s, s)
+			return
+		}()
+
+		if err == nil || n >= attempts {
+			return
+		}
+
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+
+		log.Printf("Attempt %d: %v", n, err)
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// runGate implements the gate subcommand, which waits for the host to accept
+// SSH connections, checks its latency against thresholds, and prints a JSON
+// verdict. The exit status is gatePass, gateFail, or gateUnreachable.
+func runGate(ctx context.Context, args []string) {
+	fs := newSubcommandFlagSet("gate", []string{"host", "duration", "threshold"}, connectionFlags, pingFlags)
+	p95Under := fs.Duration("p95-under", 0, "Fail unless p95 latency is below this.")
+	retryInterval := fs.Duration("retry-interval", 5*time.Second, "How long to wait between connection attempts.")
+	fs.Parse(args)
+
+	// --retries is also how many times to try connecting before giving up,
+	// and that's 10 if it isn't set.
+	attempts := 10
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "retries" {
+			attempts = *retries
+		}
+	})
+
+	// The verdict is the only thing on stdout.
+	progressOutput = os.Stderr
+	checkFlags()
+
+	if *p95Under > 0 {
+		thresholds = append(thresholds, threshold{metric: "p95", limit: *p95Under})
+	}
+
+	v := gateVerdict{Host: *host}
+	exit := func(status int) {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.Encode(v)
+		os.Exit(status)
+	}
+
+	var err error
+	v.Attempts, err = waitForSSH(ctx, attempts, *retryInterval)
+	if err != nil {
+		v.Verdict = "unreachable"
+		v.Error = err.Error()
+		exit(gateUnreachable)
+	}
+
+	r, err := measure(ctx, transportOptions{})
+	if err != nil {
+		v.Verdict = "unreachable"
+		v.Error = err.Error()
+		exit(gateUnreachable)
+	}
+
+	d := r.distribution()
+	v.Samples = d.count()
+	v.P95Ms = millis(d.percentile(95))
+	v.Verdict = "pass"
+	for _, res := range checkThresholds(thresholds, r) {
+		v.Thresholds = append(v.Thresholds, gateThreshold{
+			Threshold: res.threshold.String(),
+			ValueMs:   millis(res.value),
+			Passed:    res.passed(),
+		})
+
+		if !res.passed() {
+			v.Verdict = "fail"
+		}
+	}
+
+	if v.Verdict == "fail" {
+		exit(gateFail)
+	}
+
+	exit(gatePass)
+}
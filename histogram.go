@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// A distribution summarizes a set of samples, either exactly from the samples
+// themselves or approximately from a histogram.
+type distribution interface {
+	count() int
+	min() time.Duration
+	max() time.Duration
+	mean() time.Duration
+	stdDev() time.Duration
+	percentile(p float64) time.Duration
+}
+
+// sampleSet is a distribution computed exactly from raw samples.
+type sampleSet []time.Duration
+
+func (s sampleSet) count() int                         { return len(s) }
+func (s sampleSet) min() time.Duration                 { return min(s) }
+func (s sampleSet) max() time.Duration                 { return max(s) }
+func (s sampleSet) mean() time.Duration                { return mean(s) }
+func (s sampleSet) stdDev() time.Duration              { return stdDev(s) }
+func (s sampleSet) percentile(p float64) time.Duration { return percentile(p, s) }
+
+const (
+	// Samples at or below this fall in the histogram's first bucket.
+	histogramMin = time.Microsecond
+
+	// The ratio between the bounds of successive histogram buckets, which
+	// bounds the relative error of percentiles read from it.
+	histogramGrowth = 1.01
+)
+
+// A histogram accumulates samples in logarithmically sized buckets, using
+// memory that depends only on the range of the samples rather than their
+// number. The min, max, mean, and standard deviation are exact; percentiles
+// are accurate to within about 1%.
+type histogram struct {
+	counts []uint64
+	n      int
+
+	lo, hi time.Duration
+
+	// In seconds.
+	sum        float64
+	sumSquares float64
+}
+
+func histogramBucket(d time.Duration) int {
+	if d <= histogramMin {
+		return 0
+	}
+
+	return 1 + int(math.Log(float64(d)/float64(histogramMin))/math.Log(histogramGrowth))
+}
+
+// histogramValue returns the value representing the given bucket: the
+// geometric midpoint of its bounds.
+func histogramValue(i int) time.Duration {
+	if i == 0 {
+		return histogramMin
+	}
+
+	return time.Duration(float64(histogramMin) * math.Pow(histogramGrowth, float64(i)-0.5))
+}
+
+func (h *histogram) record(d time.Duration) {
+	i := histogramBucket(d)
+	for len(h.counts) <= i {
+		h.counts = append(h.counts, 0)
+	}
+
+	h.counts[i]++
+	if h.n == 0 || d < h.lo {
+		h.lo = d
+	}
+
+	if h.n == 0 || d > h.hi {
+		h.hi = d
+	}
+
+	h.n++
+	s := d.Seconds()
+	h.sum += s
+	h.sumSquares += s * s
+}
+
+// merge adds the samples from another histogram to this one.
+func (h *histogram) merge(o *histogram) {
+	if o.n == 0 {
+		return
+	}
+
+	for len(h.counts) < len(o.counts) {
+		h.counts = append(h.counts, 0)
+	}
+
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+
+	if h.n == 0 || o.lo < h.lo {
+		h.lo = o.lo
+	}
+
+	if h.n == 0 || o.hi > h.hi {
+		h.hi = o.hi
+	}
+
+	h.n += o.n
+	h.sum += o.sum
+	h.sumSquares += o.sumSquares
+}
+
+func (h *histogram) count() int          { return h.n }
+func (h *histogram) min() time.Duration  { return h.lo }
+func (h *histogram) max() time.Duration  { return h.hi }
+func (h *histogram) mean() time.Duration { return seconds(h.sum / float64(h.n)) }
+func (h *histogram) stdDev() time.Duration {
+	m := h.sum / float64(h.n)
+	return seconds(math.Sqrt(math.Max(0, h.sumSquares/float64(h.n)-m*m)))
+}
+
+func (h *histogram) percentile(p float64) time.Duration {
+	rank := uint64(math.Ceil(p / 100 * float64(h.n)))
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank && c != 0 {
+			// Bucket values are approximate, but needn't be outside the range
+			// actually seen.
+			d := histogramValue(i)
+			if d < h.lo {
+				d = h.lo
+			}
+
+			if d > h.hi {
+				d = h.hi
+			}
+
+			return d
+		}
+	}
+
+	return h.hi
+}
+
+// within returns how many samples were at most d, counting all those in d's
+// bucket, so it's accurate to within about 1% of d.
+func (h *histogram) within(d time.Duration) (n int) {
+	for i, c := range h.counts {
+		if i > histogramBucket(d) {
+			break
+		}
+
+		n += int(c)
+	}
+
+	return
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	host TEXT NOT NULL,
+	started INTEGER NOT NULL,
+	duration_ns INTEGER NOT NULL,
+	samples INTEGER NOT NULL,
+	min_ns INTEGER NOT NULL,
+	p50_ns INTEGER NOT NULL,
+	p95_ns INTEGER NOT NULL,
+	p99_ns INTEGER NOT NULL,
+	max_ns INTEGER NOT NULL,
+	mean_ns INTEGER NOT NULL,
+	stddev_ns INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS runs_by_host ON runs (host, started);
+
+CREATE TABLE IF NOT EXISTS samples (
+	run_id INTEGER NOT NULL REFERENCES runs (id),
+	sent INTEGER NOT NULL,
+	rtt_ns INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS samples_by_run ON samples (run_id);
+
+CREATE TABLE IF NOT EXISTS histogram_buckets (
+	run_id INTEGER NOT NULL REFERENCES runs (id),
+	bucket INTEGER NOT NULL,
+	count INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS histogram_buckets_by_run ON histogram_buckets (run_id);
+
+CREATE TABLE IF NOT EXISTS events (
+	run_id INTEGER NOT NULL REFERENCES runs (id),
+	kind TEXT NOT NULL,
+	start INTEGER NOT NULL,
+	duration_ns INTEGER NOT NULL,
+	worst_ns INTEGER NOT NULL,
+	reason TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS events_by_run ON events (run_id);
+
+CREATE TABLE IF NOT EXISTS failed_runs (
+	host TEXT NOT NULL,
+	started INTEGER NOT NULL,
+	error TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS metadata (
+	run_id INTEGER NOT NULL REFERENCES runs (id),
+	name TEXT NOT NULL,
+	value TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS annotations (
+	run_id INTEGER NOT NULL REFERENCES runs (id),
+	time INTEGER NOT NULL,
+	text TEXT NOT NULL
+);
+`
+
+// openHistory opens the SQLite database at the given path, creating it and
+// its tables if necessary.
+func openHistory(path string) (db *sql.DB, err error) {
+	db, err = sql.Open("sqlite", path)
+	if err != nil {
+		return
+	}
+
+	if _, err = db.Exec(historySchema); err != nil {
+		db.Close()
+		db = nil
+		return
+	}
+
+	return
+}
+
+// recordRun appends a run's summary, metadata, samples, events, and
+// annotations to the database at the given path, along with the counts in
+// each bucket of a
+// histogram of its samples, so that runs can be merged into longer periods
+// exactly. Times are stored as nanoseconds since the Unix epoch, and durations
+// as nanoseconds. With --histogram there are no samples to store, but the
+// histogram is.
+func recordRun(path string, host string, started time.Time, elapsed time.Duration, r run) (err error) {
+	db, err := openHistory(path)
+	if err != nil {
+		return
+	}
+
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	d := r.distribution()
+	res, err := tx.Exec(
+		`INSERT INTO runs (host, started, duration_ns, samples, min_ns, p50_ns, p95_ns, p99_ns, max_ns, mean_ns, stddev_ns)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		host,
+		started.UnixNano(),
+		int64(elapsed),
+		d.count(),
+		int64(d.min()),
+		int64(d.percentile(50)),
+		int64(d.percentile(95)),
+		int64(d.percentile(99)),
+		int64(d.max()),
+		int64(d.mean()),
+		int64(d.stdDev()))
+	if err != nil {
+		return
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO samples (run_id, sent, rtt_ns) VALUES (?, ?, ?)`)
+	if err != nil {
+		return
+	}
+
+	defer stmt.Close()
+
+	for i, rtt := range r.samples {
+		if _, err = stmt.Exec(id, r.sent[i].UnixNano(), int64(rtt)); err != nil {
+			return
+		}
+	}
+
+	h := r.hist
+	if h == nil {
+		h = &histogram{}
+		for _, rtt := range r.samples {
+			h.record(rtt)
+		}
+	}
+
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+
+		_, err = tx.Exec(`INSERT INTO histogram_buckets (run_id, bucket, count) VALUES (?, ?, ?)`, id, i, c)
+		if err != nil {
+			return
+		}
+	}
+
+	// Store the metadata by the names it has in JSON summaries.
+	data, err := json.Marshal(r.meta)
+	if err != nil {
+		return
+	}
+
+	var meta map[string]interface{}
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return
+	}
+
+	for name, value := range meta {
+		_, err = tx.Exec(`INSERT INTO metadata (run_id, name, value) VALUES (?, ?, ?)`, id, name, fmt.Sprint(value))
+		if err != nil {
+			return
+		}
+	}
+
+	for _, e := range r.events {
+		if e.kind != "note" {
+			_, err = tx.Exec(
+				`INSERT INTO events (run_id, kind, start, duration_ns, worst_ns, reason) VALUES (?, ?, ?, ?, ?, ?)`,
+				id,
+				e.kind,
+				e.start.UnixNano(),
+				int64(e.duration),
+				int64(e.worst),
+				e.reason)
+			if err != nil {
+				return
+			}
+
+			continue
+		}
+
+		_, err = tx.Exec(`INSERT INTO annotations (run_id, time, text) VALUES (?, ?, ?)`, id, e.start.UnixNano(), e.reason)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// recordFailedRun notes in the database at the given path that a run of the
+// host, started at the given time, failed without collecting any samples.
+func recordFailedRun(path string, host string, started time.Time, runErr error) (err error) {
+	db, err := openHistory(path)
+	if err != nil {
+		return
+	}
+
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO failed_runs (host, started, error) VALUES (?, ?, ?)`, host, started.UnixNano(), runErr.Error())
+	return
+}
+
+// runHistory implements the history subcommand, which prints a table of the
+// runs recorded with --db for each host, oldest first, showing how latency has
+// trended.
+func runHistory(ctx context.Context, args []string) {
+	fs := newSubcommandFlagSet("history", []string{"db", "host"}, outputFlags)
+	limit := fs.Int("limit", 30, "The most recent runs to show per host.")
+	filterExpr := fs.String(
+		"filter",
+		"",
+		"If set, summarize only the stored samples matching this expression, e.g. "+
+			"'latency > 100ms && elapsed < 2m', where elapsed is the time since the run started.")
+	fs.Parse(args)
+
+	var filter sampleFilter
+	if *filterExpr != "" {
+		var err error
+		if filter, err = parseFilter(*filterExpr); err != nil {
+			fmt.Fprintf(os.Stderr, "--filter: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	db := openStoredHistory()
+	defer db.Close()
+
+	var err error
+	var hosts []string
+	if *host != "" {
+		hosts = []string{*host}
+	} else if hosts, err = historyHosts(ctx, db); err != nil {
+		log.Fatal(err)
+	}
+
+	for i, h := range hosts {
+		if i > 0 {
+			fmt.Printf("\n")
+		}
+
+		if err = printHostHistory(ctx, db, h, *limit, filter); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// openStoredHistory opens the database set by --db for a report, exiting if
+// it isn't set or doesn't exist.
+func openStoredHistory() *sql.DB {
+	if *dbPath == "" {
+		fmt.Fprintf(os.Stderr, "Must set --db.\n")
+		os.Exit(1)
+	}
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := openHistory(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db
+}
+
+func historyHosts(ctx context.Context, db *sql.DB) (hosts []string, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT host FROM runs ORDER BY host`)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var h string
+		if err = rows.Scan(&h); err != nil {
+			return
+		}
+
+		hosts = append(hosts, h)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// A historyRow is a run's summary as shown by the history subcommand.
+type historyRow struct {
+	id                   int64
+	started              int64
+	samples              int
+	p50, p95, p99, worst time.Duration
+}
+
+// printHostHistory prints the most recent runs for the host, with the change
+// in p50 since the previous run. If filter is non-nil, each run's statistics
+// are recomputed from just its stored samples that match it.
+func printHostHistory(ctx context.Context, db *sql.DB, h string, limit int, filter sampleFilter) (err error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT id, started, samples, p50_ns, p95_ns, p99_ns, max_ns FROM
+			(SELECT * FROM runs WHERE host = ? ORDER BY started DESC LIMIT ?)
+		ORDER BY started`,
+		h,
+		limit)
+	if err != nil {
+		return
+	}
+
+	var runs []historyRow
+	for rows.Next() {
+		var r historyRow
+		if err = rows.Scan(&r.id, &r.started, &r.samples, &r.p50, &r.p95, &r.p99, &r.worst); err != nil {
+			rows.Close()
+			return
+		}
+
+		runs = append(runs, r)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	fmt.Printf("%s:\n", h)
+	fmt.Printf("%-20s %8s %8s %10s %8s %8s %8s\n", "Started", "Samples", "p50", "Change", "p95", "p99", "Max")
+
+	var prev time.Duration
+	havePrev := false
+	for _, r := range runs {
+		started := time.Unix(0, r.started).Format("2006-01-02 15:04:05")
+		if filter != nil {
+			var matched []time.Duration
+			if matched, err = filteredSamples(ctx, db, r, filter); err != nil {
+				return
+			}
+
+			if len(matched) == 0 {
+				fmt.Printf("%-20s %8d %8s %10s %8s %8s %8s\n", started, 0, "-", "-", "-", "-", "-")
+				continue
+			}
+
+			r.samples = len(matched)
+			r.p50 = median(matched)
+			r.p95 = percentile(95, matched)
+			r.p99 = percentile(99, matched)
+			r.worst = max(matched)
+		}
+
+		delta := "-"
+		if havePrev {
+			delta = formatDelta(r.p50 - prev)
+		}
+
+		prev, havePrev = r.p50, true
+		fmt.Printf(
+			"%-20s %8d %8s %10s %8s %8s %8s\n",
+			started,
+			r.samples,
+			formatLatency(r.p50),
+			delta,
+			formatLatency(r.p95),
+			formatLatency(r.p99),
+			formatLatency(r.worst))
+	}
+
+	return
+}
+
+// filteredSamples returns the stored samples of the run that match the
+// filter.
+func filteredSamples(ctx context.Context, db *sql.DB, r historyRow, filter sampleFilter) (matched []time.Duration, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT sent, rtt_ns FROM samples WHERE run_id = ? ORDER BY sent`, r.id)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var sent int64
+		var rtt time.Duration
+		if err = rows.Scan(&sent, &rtt); err != nil {
+			return
+		}
+
+		if filter(filterVars{latency: rtt, elapsed: time.Duration(sent - r.started)}) {
+			matched = append(matched, rtt)
+		}
+	}
+
+	err = rows.Err()
+	return
+}
+
+// A storedRun is a run read back from --db, with its samples as a histogram.
+type storedRun struct {
+	id      int64
+	host    string
+	started time.Time
+	elapsed time.Duration
+
+	// Nil for runs recorded with --histogram before histograms were stored,
+	// for which there's nothing to merge.
+	hist *histogram
+}
+
+// storedRuns reads back the runs of the host, or of every host if it's
+// empty, that started in [since, until), oldest first. A zero time leaves
+// that end of the range open.
+func storedRuns(ctx context.Context, db *sql.DB, host string, since, until time.Time) (runs []storedRun, err error) {
+	query := `SELECT id, host, started, duration_ns, samples, min_ns, max_ns, mean_ns, stddev_ns FROM runs WHERE 1`
+	var args []interface{}
+	if host != "" {
+		query += ` AND host = ?`
+		args = append(args, host)
+	}
+
+	if !since.IsZero() {
+		query += ` AND started >= ?`
+		args = append(args, since.UnixNano())
+	}
+
+	if !until.IsZero() {
+		query += ` AND started < ?`
+		args = append(args, until.UnixNano())
+	}
+
+	rows, err := db.QueryContext(ctx, query+` ORDER BY started`, args...)
+	if err != nil {
+		return
+	}
+
+	type summary struct {
+		n                    int
+		lo, hi, mean, stdDev time.Duration
+	}
+
+	var summaries []summary
+	for rows.Next() {
+		var r storedRun
+		var started int64
+		var s summary
+		if err = rows.Scan(&r.id, &r.host, &started, &r.elapsed, &s.n, &s.lo, &s.hi, &s.mean, &s.stdDev); err != nil {
+			rows.Close()
+			return
+		}
+
+		r.started = time.Unix(0, started)
+		runs = append(runs, r)
+		summaries = append(summaries, s)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for i := range runs {
+		s := summaries[i]
+		if runs[i].hist, err = storedHistogram(ctx, db, runs[i].id); err != nil {
+			return
+		}
+
+		h := runs[i].hist
+		if h == nil || h.n != s.n {
+			runs[i].hist = nil
+			continue
+		}
+
+		// The summary's statistics are exact, unlike those the buckets would
+		// give.
+		mean, sd := s.mean.Seconds(), s.stdDev.Seconds()
+		h.lo, h.hi = s.lo, s.hi
+		h.sum = mean * float64(s.n)
+		h.sumSquares = float64(s.n) * (sd*sd + mean*mean)
+	}
+
+	return
+}
+
+// storedHistogram returns the histogram of the run's samples, read from its
+// stored buckets, or for runs recorded before those were stored, from its
+// samples. It returns nil if neither was stored.
+func storedHistogram(ctx context.Context, db *sql.DB, id int64) (h *histogram, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT bucket, count FROM histogram_buckets WHERE run_id = ?`, id)
+	if err != nil {
+		return
+	}
+
+	h = &histogram{}
+	for rows.Next() {
+		var bucket int
+		var count uint64
+		if err = rows.Scan(&bucket, &count); err != nil {
+			rows.Close()
+			return
+		}
+
+		for len(h.counts) <= bucket {
+			h.counts = append(h.counts, 0)
+		}
+
+		h.counts[bucket] += count
+		h.n += int(count)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil || h.n != 0 {
+		return
+	}
+
+	if rows, err = db.QueryContext(ctx, `SELECT rtt_ns FROM samples WHERE run_id = ?`, id); err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var rtt time.Duration
+		if err = rows.Scan(&rtt); err != nil {
+			return
+		}
+
+		h.record(rtt)
+	}
+
+	if err = rows.Err(); err == nil && h.n == 0 {
+		h = nil
+	}
+
+	return
+}
+
+// storedEvents returns the events and annotations stored for the run, in
+// time order. Runs recorded before events were stored have only their
+// annotations.
+func storedEvents(ctx context.Context, db *sql.DB, id int64) (events []event, err error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT kind, start, duration_ns, worst_ns, reason FROM events WHERE run_id = ?
+		UNION ALL SELECT 'note', time, 0, 0, text FROM annotations WHERE run_id = ?
+		ORDER BY 2`,
+		id,
+		id)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var e event
+		var start int64
+		if err = rows.Scan(&e.kind, &start, &e.duration, &e.worst, &e.reason); err != nil {
+			return
+		}
+
+		e.start = time.Unix(0, start)
+		events = append(events, e)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// A failedRun is a run that collected no samples, as recorded by
+// recordFailedRun.
+type failedRun struct {
+	host    string
+	started time.Time
+	err     string
+}
+
+// storedFailures returns the failed runs of the host, or of every host if
+// it's empty, that started in [since, until), oldest first.
+func storedFailures(ctx context.Context, db *sql.DB, host string, since, until time.Time) (failures []failedRun, err error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT host, started, error FROM failed_runs
+		WHERE (? = '' OR host = ?) AND started >= ? AND started < ?
+		ORDER BY started`,
+		host,
+		host,
+		since.UnixNano(),
+		until.UnixNano())
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var f failedRun
+		var started int64
+		if err = rows.Scan(&f.host, &started, &f.err); err != nil {
+			return
+		}
+
+		f.started = time.Unix(0, started)
+		failures = append(failures, f)
+	}
+
+	err = rows.Err()
+	return
+}
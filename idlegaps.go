@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// How many times to idle for each gap.
+	idleGapTrials = 3
+
+	// How many pings to send back to back before each gap, to bring the path
+	// back to a warm state and measure it.
+	idleGapWarmPings = 10
+)
+
+// parseIdleGaps parses a comma-separated list of durations for --idle-gaps.
+func parseIdleGaps(s string) (gaps []time.Duration, err error) {
+	for _, f := range strings.Split(s, ",") {
+		var d time.Duration
+		if d, err = time.ParseDuration(strings.TrimSpace(f)); err != nil {
+			return
+		}
+
+		if d <= 0 {
+			err = fmt.Errorf("gap %v isn't positive", d)
+			return
+		}
+
+		gaps = append(gaps, d)
+	}
+
+	return
+}
+
+// parseKeepaliveIntervals parses a comma-separated list of keepalive
+// intervals for --keepalive-intervals, where "off" is zero.
+func parseKeepaliveIntervals(s string) (intervals []time.Duration, err error) {
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "off" {
+			intervals = append(intervals, 0)
+			continue
+		}
+
+		var d time.Duration
+		if d, err = time.ParseDuration(f); err != nil {
+			return
+		}
+
+		if d <= 0 {
+			err = fmt.Errorf("interval %v isn't positive; use off for none", d)
+			return
+		}
+
+		intervals = append(intervals, d)
+	}
+
+	return
+}
+
+// idleGapSamples holds the pings sent by idleGapTrials on one connection:
+// those on a warm path, and for each gap the first after idling for it.
+type idleGapSamples struct {
+	warm  []time.Duration
+	first [][]time.Duration
+
+	// If the connection was lost by the first ping after idling, the gap it
+	// was lost after and why.
+	lostAfter time.Duration
+	lost      error
+}
+
+// runIdleGapTrials connects with the given options, then repeatedly sends a
+// burst of pings followed by each of the gaps in turn.
+func runIdleGapTrials(ctx context.Context, opts transportOptions, gaps []time.Duration) (r idleGapSamples, err error) {
+	t, err := newTransport(opts)
+	if err != nil {
+		return
+	}
+
+	if err = t.Dial(ctx); err != nil {
+		return
+	}
+
+	defer t.Close()
+
+	s, err := startEcho(ctx, t)
+	if err != nil {
+		return
+	}
+
+	defer s.Close()
+
+	payload := makePayload(*payloadSize)
+
+	// The first few pings probably incur some startup cost. Throw them away.
+	for i := 0; i < 3; i++ {
+		if _, err = runPing(payload, s, s); err != nil {
+			return
+		}
+	}
+
+	r.first = make([][]time.Duration, len(gaps))
+	for trial := 1; trial <= idleGapTrials; trial++ {
+		for i, gap := range gaps {
+			for j := 0; j < idleGapWarmPings; j++ {
+				var pt pingTimes
+				if pt, err = runPing(payload, s, s); err != nil {
+					return
+				}
+
+				r.warm = append(r.warm, pt.rtt())
+			}
+
+			fmt.Printf("Trial %d/%d: idling for %v...\n", trial, idleGapTrials, gap)
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			case <-time.After(gap):
+			}
+
+			// A middlebox that has forgotten the connection may drop it
+			// here. That's a result, not a failure to measure.
+			pt, pingErr := runPing(payload, s, s)
+			if pingErr != nil {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+					return
+				}
+
+				r.lostAfter, r.lost = gap, pingErr
+				return
+			}
+
+			r.first[i] = append(r.first[i], pt.rtt())
+		}
+	}
+
+	return
+}
+
+// measureIdleGaps measures the first ping after each of the given idle gaps,
+// separately from pings on a warm path, and prints a table showing the
+// penalty paid after each. Power saving, ARP expiry, and stateful middleboxes
+// all tend to show up as a penalty that grows with the gap.
+func measureIdleGaps(ctx context.Context, gaps []time.Duration) (err error) {
+	r, err := runIdleGapTrials(ctx, transportOptions{}, gaps)
+	if err != nil {
+		return
+	}
+
+	if r.lost != nil {
+		err = fmt.Errorf("after idling for %v: %w", r.lostAfter, r.lost)
+		return
+	}
+
+	warmP50 := median(r.warm)
+
+	fmt.Printf("\n")
+	fmt.Printf("Warm p50: %s\n", formatLatency(warmP50))
+	fmt.Printf("\n")
+	fmt.Printf("%10s %10s %10s %10s\n", "Idle gap", "First p50", "First max", "Penalty")
+	for i, gap := range gaps {
+		p50 := median(r.first[i])
+		fmt.Printf(
+			"%10v %10s %10s %10s\n",
+			gap,
+			formatLatency(p50),
+			formatLatency(max(r.first[i])),
+			formatDelta(p50-warmP50))
+	}
+
+	return
+}
+
+// compareKeepalives runs the idle gap trials on a fresh connection for each
+// keepalive interval, zero meaning none, and prints the penalty after each gap
+// with each. A penalty that keepalives remove, or a connection lost without
+// them, points to state expiring in a NAT or firewall, or a radio going to
+// sleep, on the path.
+func compareKeepalives(ctx context.Context, gaps, intervals []time.Duration) (err error) {
+	results := make([]idleGapSamples, len(intervals))
+	for i, interval := range intervals {
+		fmt.Printf("Keepalive %s:\n", keepaliveName(interval))
+		if results[i], err = runIdleGapTrials(ctx, transportOptions{serverAlive: interval}, gaps); err != nil {
+			err = fmt.Errorf("keepalive %s: %w", keepaliveName(interval), err)
+			return
+		}
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("Penalty of the first ping after idling, over the warm p50:\n")
+	fmt.Printf("%10s %10s", "Keepalive", "Warm p50")
+	for _, gap := range gaps {
+		fmt.Printf(" %10s", fmt.Sprintf("after %v", gap))
+	}
+
+	fmt.Printf("\n")
+	for i, r := range results {
+		warmP50 := median(r.warm)
+		fmt.Printf("%10s %10s", keepaliveName(intervals[i]), formatLatency(warmP50))
+		for j, gap := range gaps {
+			switch {
+			case r.lost != nil && gap == r.lostAfter:
+				fmt.Printf(" %10s", "lost")
+			case len(r.first[j]) > 0:
+				fmt.Printf(" %10s", formatDelta(median(r.first[j])-warmP50))
+			default:
+				fmt.Printf(" %10s", "-")
+			}
+		}
+
+		fmt.Printf("\n")
+	}
+
+	for i, r := range results {
+		if r.lost != nil {
+			fmt.Printf(
+				"\nWith keepalive %s, the connection was lost after idling for %v: %v\n",
+				keepaliveName(intervals[i]),
+				r.lostAfter,
+				r.lost)
+		}
+	}
+
+	return
+}
+
+// keepaliveName describes a keepalive interval for compareKeepalives.
+func keepaliveName(interval time.Duration) string {
+	if interval == 0 {
+		return "off"
+	}
+
+	return interval.String()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An incident is an event from a run that someone would want to see on a
+// dashboard: a latency spike, a timeout or bad reply that interrupted
+// measurement, or an annotation. Reconnects scheduled by --reconnect-every
+// aren't incidents.
+type incident struct {
+	Host  string    `json:"host"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// "latency" for spikes, whose peak is the worst sample, "availability"
+	// for timeouts and bad replies, or "annotation" for notes.
+	Metric string  `json:"metric"`
+	PeakMs float64 `json:"peak_ms,omitempty"`
+
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// incidents returns the run's incidents, in time order.
+func incidents(target string, events []event) (is []incident) {
+	for _, e := range events {
+		i := incident{
+			Host:   target,
+			Start:  e.start,
+			End:    e.start.Add(e.duration),
+			Kind:   e.kind,
+			Detail: e.reason,
+		}
+
+		switch e.kind {
+		case "spike":
+			i.Metric = "latency"
+			i.PeakMs = millis(e.worst)
+		case "timeout", "bad reply":
+			i.Metric = "availability"
+		case "note":
+			i.Metric = "annotation"
+		default:
+			continue
+		}
+
+		is = append(is, i)
+	}
+
+	return
+}
+
+// writeIncidents writes incidents to the file named by --incidents, as CSV if
+// its name ends in .csv and JSON otherwise.
+func writeIncidents(path string, is []incident) (err error) {
+	var b bytes.Buffer
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		w := csv.NewWriter(&b)
+		w.Write([]string{"host", "start", "end", "metric", "peak_ms", "kind", "detail"})
+		for _, i := range is {
+			w.Write([]string{
+				i.Host,
+				i.Start.Format(time.RFC3339Nano),
+				i.End.Format(time.RFC3339Nano),
+				i.Metric,
+				fmt.Sprintf("%.3f", i.PeakMs),
+				i.Kind,
+				i.Detail,
+			})
+		}
+
+		w.Flush()
+		if err = w.Error(); err != nil {
+			return
+		}
+	} else {
+		if is == nil {
+			is = []incident{}
+		}
+
+		var data []byte
+		if data, err = json.MarshalIndent(is, "", "  "); err != nil {
+			return
+		}
+
+		b.Write(append(data, '\n'))
+	}
+
+	err = os.WriteFile(path, b.Bytes(), 0644)
+	return
+}
+
+// grafanaAnnotation is the body of a request to Grafana's annotations API.
+type grafanaAnnotation struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd"`
+	Tags    []string `json:"tags"`
+	Text    string   `json:"text"`
+}
+
+// pushGrafanaAnnotations creates a region annotation for each incident via
+// the Grafana at --grafana-url, authenticating with the service account
+// token in GRAFANA_TOKEN if set.
+func pushGrafanaAnnotations(ctx context.Context, is []incident) (err error) {
+	url := strings.TrimSuffix(*grafanaURL, "/") + "/api/annotations"
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, i := range is {
+		text := fmt.Sprintf("SSH %s on %s", i.Kind, i.Host)
+		if i.PeakMs != 0 {
+			peak := time.Duration(i.PeakMs * float64(time.Millisecond))
+			text += ", peak " + strings.TrimSpace(formatLatency(peak))
+		}
+
+		if i.Detail != "" {
+			text += ": " + i.Detail
+		}
+
+		if i.Kind == "note" {
+			text = i.Detail
+		}
+
+		end := i.End
+		if !end.After(i.Start) {
+			end = i.Start.Add(time.Millisecond)
+		}
+
+		var body []byte
+		body, err = json.Marshal(grafanaAnnotation{
+			Time:    i.Start.UnixMilli(),
+			TimeEnd: end.UnixMilli(),
+			Tags:    []string{"ssh_ping", i.Metric, i.Kind, "host:" + i.Host},
+			Text:    text,
+		})
+		if err != nil {
+			return
+		}
+
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		if token := os.Getenv("GRAFANA_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		var resp *http.Response
+		if resp, err = client.Do(req); err != nil {
+			return
+		}
+
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+			return
+		}
+	}
+
+	return
+}
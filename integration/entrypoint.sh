@@ -0,0 +1,16 @@
+#!/bin/sh
+# Authorizes the key in $AUTHORIZED_KEY for root, then runs the server in the
+# foreground.
+set -eu
+
+echo "${AUTHORIZED_KEY}" > /root/.ssh/authorized_keys
+chmod 600 /root/.ssh/authorized_keys
+
+case "${SERVER}" in
+openssh)
+  exec /usr/sbin/sshd -D -e -o PermitRootLogin=prohibit-password
+  ;;
+dropbear)
+  exec /usr/sbin/dropbear -F -E -R -p 22
+  ;;
+esac
@@ -0,0 +1,93 @@
+#!/bin/sh
+# Runs ssh_ping against several releases of OpenSSH and dropbear in Docker,
+# with each transport, to catch regressions in how it talks to real servers.
+# Needs docker, ssh, ssh-agent, and go. Servers are given as SERVER:ALPINE
+# pairs, defaulting to a spread of releases:
+#
+#	integration/run.sh
+#	integration/run.sh openssh:3.20 dropbear:3.20
+set -eu
+
+cd "$(dirname "$0")/.."
+
+if [ $# -eq 0 ]; then
+  # OpenSSH 7.7, 8.3, 9.0, and 9.7; dropbear 2020.80 and 2024.84.
+  set -- openssh:3.8 openssh:3.12 openssh:3.16 openssh:3.20 dropbear:3.12 dropbear:3.20
+fi
+
+tmp=$(mktemp -d)
+containers=
+cleanup() {
+  for c in ${containers}; do
+    docker rm -f "${c}" > /dev/null
+  done
+
+  [ -z "${SSH_AGENT_PID:-}" ] || kill "${SSH_AGENT_PID}"
+  rm -rf "${tmp}"
+}
+trap cleanup EXIT
+
+go build -o "${tmp}/ssh_ping" .
+
+# Both transports authenticate with ssh-agent.
+ssh-keygen -q -t ed25519 -N '' -f "${tmp}/id"
+eval "$(ssh-agent -s)" > /dev/null
+ssh-add -q "${tmp}/id"
+
+failures=0
+
+# check runs ssh_ping with the given flags, reporting whether it collected
+# samples.
+check() {
+  name=$1
+  shift
+  if "${tmp}/ssh_ping" --duration 2s --strict-host-key-checking no --format ndjson "$@" \
+    > "${tmp}/out" 2> "${tmp}/err" && grep -q '"type":"summary"' "${tmp}/out"; then
+    echo "ok    ${name}"
+  else
+    echo "FAIL  ${name}"
+    sed 's/^/      /' "${tmp}/err"
+    failures=$((failures + 1))
+  fi
+}
+
+for server in "$@"; do
+  kind=${server%%:*}
+  alpine=${server#*:}
+  image="ssh_ping-integration:${kind}-${alpine}"
+
+  docker build -q -t "${image}" \
+    --build-arg "SERVER=${kind}" --build-arg "ALPINE=${alpine}" integration > /dev/null
+
+  c=$(docker run -d -p 127.0.0.1::22 -e "AUTHORIZED_KEY=$(cat "${tmp}/id.pub")" "${image}")
+  containers="${containers} ${c}"
+  port=$(docker port "${c}" 22 | head -n 1 | sed 's/.*://')
+
+  # Wait for the server to come up.
+  for _ in $(seq 50); do
+    if ssh-keyscan -p "${port}" 127.0.0.1 > /dev/null 2>&1; then
+      break
+    fi
+
+    sleep 0.2
+  done
+
+  check "${server} exec" --host "ssh://root@127.0.0.1:${port}"
+  check "${server} native" --transport native --host "root@127.0.0.1:${port}"
+  check "${server} native, reconnecting" \
+    --transport native --host "root@127.0.0.1:${port}" --reconnect-every 500ms
+  check "${server} native, streams" --transport native --host "root@127.0.0.1:${port}" --streams 4
+
+  # dropbear has no SFTP server of its own.
+  if [ "${kind}" = openssh ]; then
+    check "${server} native, sftp" --transport native --host "root@127.0.0.1:${port}" --echo sftp
+  fi
+
+  docker rm -f "${c}" > /dev/null
+  containers=$(echo "${containers}" | sed "s/ ${c}//")
+done
+
+if [ "${failures}" -ne 0 ]; then
+  echo "${failures} failed."
+  exit 1
+fi
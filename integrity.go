@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Pings large enough to hold it start with a header giving a sequence number
+// and a checksum of the rest of the ping, as eight hex digits each:
+//
+//	0000002a 1c291ca3 foo foo ...\n
+//
+// Shorter pings of at least three bytes, like the default of four, instead
+// start with as many of the low digits of the sequence number as fit, up to
+// five, in base 64, followed by a digit of checksum:
+//
+//	Aqd\n
+//
+// so that a reply can be matched to its ping and checked for corruption.
+const pingHeaderLen = 18
+
+// The digits of the compact header, which are safe to send through a
+// pseudo-terminal.
+const compactDigits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// compactSeqLen returns how many digits of sequence number the compact header
+// of a ping of the given length has, or zero if it has none.
+func compactSeqLen(n int) int {
+	k := n - 2
+	if k > 5 {
+		k = 5
+	}
+
+	if k < 1 {
+		return 0
+	}
+
+	return k
+}
+
+// errBadReply is returned when an echo doesn't match the ping that was sent,
+// e.g. because it was corrupted or the stream carried other output, such as a
+// shell banner.
+var errBadReply = errors.New("bad reply")
+
+// The sequence number of the last ping sent, across all streams.
+var lastPingSeq uint32
+
+// stampPing returns a copy of payload with a header giving it the next
+// sequence number, if there is room for one.
+func stampPing(payload []byte) []byte {
+	k := compactSeqLen(len(payload))
+	if k == 0 {
+		return payload
+	}
+
+	p := append([]byte(nil), payload...)
+	seq := atomic.AddUint32(&lastPingSeq, 1)
+	if len(p) < pingHeaderLen+1 {
+		for i := k - 1; i >= 0; i-- {
+			p[i] = compactDigits[seq%64]
+			seq /= 64
+		}
+
+		p[k] = compactDigits[compactChecksum(p, k)]
+		return p
+	}
+
+	copy(p, fmt.Sprintf("%08x ", seq))
+	copy(p[9:], fmt.Sprintf("%08x ", pingChecksum(p)))
+	return p
+}
+
+// pingChecksum returns the checksum of a ping, which covers everything but
+// the checksum itself.
+func pingChecksum(p []byte) uint32 {
+	h := crc32.NewIEEE()
+	h.Write(p[:9])
+	h.Write(p[pingHeaderLen:])
+	return h.Sum32()
+}
+
+// compactChecksum is like pingChecksum for a ping with a compact header with
+// k digits of sequence number, returning the value of the checksum digit.
+func compactChecksum(p []byte, k int) uint32 {
+	h := crc32.NewIEEE()
+	h.Write(p[:k])
+	h.Write(p[k+1:])
+	return h.Sum32() % 64
+}
+
+// checkReply returns an error wrapping errBadReply if the echo doesn't match
+// the ping, describing how it differs.
+func checkReply(ping, echo []byte) (err error) {
+	if bytes.Equal(ping, echo) {
+		return
+	}
+
+	want, _ := parsePingHeader(ping)
+	if got, ok := parsePingHeader(echo); ok && got != want {
+		err = fmt.Errorf("%w: got the echo of ping %d while waiting for ping %d", errBadReply, got, want)
+		return
+	}
+
+	if len(echo) > 40 {
+		echo = echo[:40]
+	}
+
+	err = fmt.Errorf("%w: unexpected data %q", errBadReply, echo)
+	return
+}
+
+// parsePingHeader returns the sequence number of a ping with an intact
+// header and checksum. For a compact header, that's only the low digits.
+func parsePingHeader(p []byte) (seq uint32, ok bool) {
+	if len(p) < pingHeaderLen+1 {
+		return parseCompactHeader(p)
+	}
+
+	if p[8] != ' ' || p[17] != ' ' {
+		return
+	}
+
+	s, err := strconv.ParseUint(string(p[:8]), 16, 32)
+	if err != nil {
+		return
+	}
+
+	sum, err := strconv.ParseUint(string(p[9:17]), 16, 32)
+	if err != nil || uint32(sum) != pingChecksum(p) {
+		return
+	}
+
+	seq, ok = uint32(s), true
+	return
+}
+
+func parseCompactHeader(p []byte) (seq uint32, ok bool) {
+	k := compactSeqLen(len(p))
+	if k == 0 {
+		return
+	}
+
+	for _, c := range p[:k] {
+		d := strings.IndexByte(compactDigits, c)
+		if d < 0 {
+			return
+		}
+
+		seq = seq*64 + uint32(d)
+	}
+
+	ok = p[k] == compactDigits[compactChecksum(p, k)]
+	return
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStampPing(t *testing.T) {
+	for _, size := range []int{3, 4, 8, 18, 19, 64} {
+		first := stampPing(makePayload(size))
+		second := stampPing(makePayload(size))
+		if len(first) != size || first[size-1] != '\n' {
+			t.Errorf("size %d: stamped ping %q", size, first)
+			continue
+		}
+
+		if err := checkReply(first, first); err != nil {
+			t.Errorf("size %d: intact echo: %v", size, err)
+		}
+
+		want, ok := parsePingHeader(first)
+		if !ok {
+			t.Errorf("size %d: no header in %q", size, first)
+			continue
+		}
+
+		got, _ := parsePingHeader(second)
+		if got != want+1 {
+			t.Errorf("size %d: sequence numbers %d then %d", size, want, got)
+		}
+
+		err := checkReply(first, second)
+		if !errors.Is(err, errBadReply) || !strings.Contains(err.Error(), "while waiting for ping") {
+			t.Errorf("size %d: reordered echo: %v", size, err)
+		}
+
+		corrupted := append([]byte(nil), first...)
+		corrupted[size-2] ^= 1
+		if _, ok := parsePingHeader(corrupted); ok {
+			t.Errorf("size %d: corrupted ping %q has an intact header", size, corrupted)
+		}
+	}
+}
+
+func TestStampPingTooShort(t *testing.T) {
+	for _, size := range []int{1, 2} {
+		p := makePayload(size)
+		if got := stampPing(p); string(got) != string(p) {
+			t.Errorf("size %d: stamped %q as %q", size, p, got)
+		}
+	}
+}
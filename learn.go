@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// The fewest stored runs from which --learn-thresholds will derive a
+// threshold.
+const learnMinRuns = 3
+
+// learnThresholds derives a threshold for each of the metrics from the
+// host's runs recorded in the --db database over the last --learn-window:
+// the metric computed over all of their samples, plus --learn-margin. If
+// there isn't enough history yet, it returns no thresholds and says so.
+func learnThresholds(ctx context.Context, target string, metrics []string) (ts []threshold, err error) {
+	if _, err = os.Stat(*dbPath); os.IsNotExist(err) {
+		err = nil
+		fmt.Fprintf(progressOutput, "No history in %s to learn thresholds from yet.\n", *dbPath)
+		return
+	}
+
+	db, err := openHistory(*dbPath)
+	if err != nil {
+		return
+	}
+
+	defer db.Close()
+
+	since := time.Now().Add(-*learnWindow)
+	var runs int
+	err = db.QueryRowContext(
+		ctx,
+		`SELECT COUNT(*) FROM runs WHERE host = ? AND started >= ?`,
+		target,
+		since.UnixNano()).Scan(&runs)
+	if err != nil {
+		return
+	}
+
+	if runs < learnMinRuns {
+		fmt.Fprintf(
+			progressOutput,
+			"Only %d runs of %s in the last %v; need %d to learn thresholds.\n",
+			runs,
+			target,
+			*learnWindow,
+			learnMinRuns)
+		return
+	}
+
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT rtt_ns FROM samples JOIN runs ON samples.run_id = runs.id
+		WHERE runs.host = ? AND runs.started >= ?`,
+		target,
+		since.UnixNano())
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	var samples sampleSet
+	for rows.Next() {
+		var rtt time.Duration
+		if err = rows.Scan(&rtt); err != nil {
+			return
+		}
+
+		samples = append(samples, rtt)
+	}
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if len(samples) == 0 {
+		fmt.Fprintf(progressOutput, "No stored samples of %s to learn thresholds from.\n", target)
+		return
+	}
+
+	var learned []string
+	for _, m := range metrics {
+		v := metricValue(m, samples)
+		t := threshold{metric: m, limit: time.Duration(float64(v) * (1 + *learnMargin)).Round(time.Microsecond)}
+		ts = append(ts, t)
+		learned = append(learned, t.String())
+	}
+
+	fmt.Fprintf(
+		progressOutput,
+		"Learned %s from %d runs over the last %v.\n",
+		strings.Join(learned, ", "),
+		runs,
+		*learnWindow)
+
+	return
+}
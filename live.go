@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// How often the live path comparison prints a row.
+const liveRefresh = time.Second
+
+// resolveBindAddress returns the local address to bind to for path, which is
+// either an IP address or the name of a network interface. For an interface,
+// the first address of the family selected by -4 or -6 is used, preferring
+// IPv4 if neither is set.
+func resolveBindAddress(path string) (addr string, err error) {
+	if ip := net.ParseIP(path); ip != nil {
+		addr = ip.String()
+		return
+	}
+
+	iface, err := net.InterfaceByName(path)
+	if err != nil {
+		return
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return
+	}
+
+	var v6 string
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		switch {
+		case ipNet.IP.To4() != nil && !*ipv6:
+			addr = ipNet.IP.String()
+			return
+
+		case ipNet.IP.To4() == nil && !*ipv4 && v6 == "":
+			v6 = ipNet.IP.String()
+		}
+	}
+
+	if v6 == "" {
+		err = fmt.Errorf("interface %s has no usable address", path)
+		return
+	}
+
+	addr = v6
+	return
+}
+
+// A pathSample is the result of one ping over one path in a live comparison.
+type pathSample struct {
+	path int
+	rtt  time.Duration
+	err  error
+}
+
+// pingOverPath repeatedly connects from the given local address and pings,
+// sending each result on samples until the context is cancelled. Failures are
+// reported and followed by a reconnection, so that paths can be toggled while
+// measuring.
+func pingOverPath(ctx context.Context, path int, bindAddress string, samples chan<- pathSample) {
+	payload := makePayload(*payloadSize)
+	for {
+		err := func() (err error) {
+			t, err := newTransport(transportOptions{bindAddress: bindAddress})
+			if err != nil {
+				return
+			}
+
+			if err = t.Dial(ctx); err != nil {
+				return
+			}
+
+			defer t.Close()
+
+			s, err := startEcho(ctx, t)
+			if err != nil {
+				return
+			}
+
+			defer s.Close()
+
+			// The first ping probably incurs some startup cost. Throw it away.
+			if _, err = runPing(payload, s, s); err != nil {
+				return
+			}
+
+			for ctx.Err() == nil {
+				var pt pingTimes
+				if pt, err = runPing(payload, s, s); err != nil {
+					return
+				}
+
+				select {
+				case samples <- pathSample{path: path, rtt: pt.rtt()}:
+				case <-ctx.Done():
+				}
+
+				if *interval > 0 {
+					select {
+					case <-time.After(*interval):
+					case <-ctx.Done():
+					}
+				}
+			}
+
+			return
+		}()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			select {
+			case samples <- pathSample{path: path, err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(liveRefresh):
+		}
+	}
+}
+
+// comparePathsLive measures the host over two local paths at once for the
+// length of --duration, printing a row each second with the latest results
+// for both side by side, followed by a summary.
+func comparePathsLive(ctx context.Context, paths []string) (err error) {
+	if len(paths) != 2 {
+		err = fmt.Errorf("--compare-paths needs exactly two paths, e.g. eth0,wlan0")
+		return
+	}
+
+	if *simulate != "" {
+		err = fmt.Errorf("--compare-paths can't be used with --simulate")
+		return
+	}
+
+	var addrs [2]string
+	for i, p := range paths {
+		if addrs[i], err = resolveBindAddress(p); err != nil {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	samples := make(chan pathSample)
+	for i := range addrs {
+		go pingOverPath(ctx, i, addrs[i], samples)
+	}
+
+	var header [2]string
+	for i, p := range paths {
+		header[i] = fmt.Sprintf("%s (%s)", p, addrs[i])
+	}
+
+	fmt.Printf("%-8s | %-34s | %-34s\n", "", header[0], header[1])
+	fmt.Printf("%-8s | %6s %8s %8s %9s | %6s %8s %8s %9s\n",
+		"Elapsed", "Pings", "p50", "p95", "", "Pings", "p50", "p95", "")
+
+	var window, total [2][]time.Duration
+	var failed [2]error
+	ticker := time.NewTicker(liveRefresh)
+	defer ticker.Stop()
+
+	start := time.Now()
+	deadline := time.After(*duration)
+	for {
+		select {
+		case s := <-samples:
+			if s.err != nil {
+				failed[s.path] = s.err
+				continue
+			}
+
+			window[s.path] = append(window[s.path], s.rtt)
+			total[s.path] = append(total[s.path], s.rtt)
+
+		case <-ticker.C:
+			fmt.Printf("%-8s", time.Since(start).Round(time.Second))
+			for i := range window {
+				fmt.Printf(" | %s", formatPathWindow(window[i], failed[i]))
+				window[i] = nil
+				failed[i] = nil
+			}
+
+			fmt.Printf("\n")
+
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+
+		case <-deadline:
+			fmt.Printf("\n")
+			fmt.Printf("%-34s %8s %8s %8s %8s\n", "Path", "Samples", "p50", "p95", "Max")
+			for i := range total {
+				if len(total[i]) == 0 {
+					fmt.Printf("%-34s %8d\n", header[i], 0)
+					continue
+				}
+
+				fmt.Printf(
+					"%-34s %8d %8s %8s %8s\n",
+					header[i],
+					len(total[i]),
+					formatLatency(median(total[i])),
+					formatLatency(percentile(95, total[i])),
+					formatLatency(max(total[i])))
+			}
+
+			if len(total[0]) != 0 && len(total[1]) != 0 {
+				fmt.Printf("\n")
+				fmt.Printf(
+					"p50 over %s: %s relative to %s\n",
+					paths[1],
+					formatDelta(median(total[1])-median(total[0])),
+					paths[0])
+			}
+
+			return
+		}
+	}
+}
+
+// formatPathWindow formats one path's results from a single refresh interval
+// as a fixed-width cell.
+func formatPathWindow(samples []time.Duration, err error) string {
+	if len(samples) == 0 {
+		status := "no pings"
+		if err != nil {
+			// Only the innermost error fits.
+			msg := err.Error()
+			status = "down:" + msg[strings.LastIndex(msg, ": ")+1:]
+		}
+
+		return fmt.Sprintf("%-34.34s", status)
+	}
+
+	note := ""
+	if err != nil {
+		note = "reconnect"
+	}
+
+	return fmt.Sprintf(
+		"%6d %8s %8s %9s",
+		len(samples),
+		formatLatency(median(samples)),
+		formatLatency(percentile(95, samples)),
+		note)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long to let a bulk transfer ramp up before measuring latency under
+// load.
+const loadRampUp = time.Second
+
+// measureUnderLoad measures latency on an idle connection, then again while
+// a bulk transfer saturates the same connection, and prints a comparison.
+func measureUnderLoad(ctx context.Context) (err error) {
+	if *simulate != "" {
+		err = fmt.Errorf("--under-load can't be used with --simulate")
+		return
+	}
+
+	t, err := newTransport(transportOptions{shared: true})
+	if err != nil {
+		return
+	}
+
+	if err = t.Dial(ctx); err != nil {
+		return
+	}
+
+	defer t.Close()
+
+	s, err := startEcho(ctx, t)
+	if err != nil {
+		return
+	}
+
+	defer s.Close()
+
+	payload := makePayload(*payloadSize)
+
+	// The first few pings probably incur some startup cost. Throw them away.
+	for i := 0; i < 3; i++ {
+		if _, err = runPing(payload, s, s); err != nil {
+			return
+		}
+	}
+
+	fmt.Printf("Measuring idle latency...\n")
+	var idle run
+	if err = collect(ctx, payload, s, *duration, &idle, nil, false); err != nil {
+		return
+	}
+
+	fmt.Printf("Measuring latency under load...\n")
+	bulk, err := t.NewStream(ctx, "cat > /dev/null")
+	if err != nil {
+		return
+	}
+
+	var transferred int64
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 32<<10)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			n, err := bulk.Write(buf)
+			atomic.AddInt64(&transferred, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-time.After(loadRampUp):
+	case <-ctx.Done():
+	}
+
+	var loaded run
+	before := atomic.LoadInt64(&transferred)
+	start := time.Now()
+	err = collect(ctx, payload, s, *duration, &loaded, nil, false)
+	elapsed := time.Since(start)
+	throughput := float64(atomic.LoadInt64(&transferred)-before) / elapsed.Seconds()
+
+	close(stop)
+	bulk.Close()
+	wg.Wait()
+
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("%-8s %8s %8s %8s %8s %8s\n", "", "Samples", "p50", "p95", "p99", "Max")
+	for _, row := range []struct {
+		name string
+		r    run
+	}{
+		{"Idle", idle},
+		{"Loaded", loaded},
+	} {
+		fmt.Printf(
+			"%-8s %8d %8s %8s %8s %8s\n",
+			row.name,
+			len(row.r.samples),
+			formatLatency(median(row.r.samples)),
+			formatLatency(percentile(95, row.r.samples)),
+			formatLatency(percentile(99, row.r.samples)),
+			formatLatency(max(row.r.samples)))
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf(
+		"Load adds %s at p50 and %s at p95, at %.1f Mbit/s of bulk transfer.\n",
+		formatDelta(median(loaded.samples)-median(idle.samples)),
+		formatDelta(percentile(95, loaded.samples)-percentile(95, idle.samples)),
+		throughput*8/1e6)
+
+	fmt.Printf("\n")
+	printTuning(median(idle.samples), throughput)
+
+	return
+}
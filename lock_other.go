@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package main
+
+import "os"
+
+// lockFile does nothing here. Appends of a single line are still written in
+// one go.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// makePayload returns a newline-terminated string of the given size to be
+// echoed back by the remote host.
+func makePayload(size int) []byte {
+	p := bytes.Repeat([]byte("foo "), size/4+1)[:size]
+	p[size-1] = '\n'
+	return p
+}
+
+// pingTimes records when a ping passed each point on its round trip.
+type pingTimes struct {
+	sent     time.Time
+	received time.Time
+
+	// If the remote echo agent is in use, the times at which it received the
+	// ping and sent the echo, according to the remote host's clock. Otherwise
+	// zero.
+	remoteReceived time.Time
+	remoteSent     time.Time
+}
+
+func (t pingTimes) rtt() time.Duration {
+	return t.received.Sub(t.sent)
+}
+
+func runPing(payload []byte, outgoing io.Writer, incoming io.Reader) (t pingTimes, err error) {
+	payload = stampPing(payload)
+	t.sent = time.Now()
+
+	// Write the payload.
+	_, err = outgoing.Write(payload)
+	if err != nil {
+		return
+	}
+
+	// Wait for it to be echoed back, along with the agent's response padding
+	// and timestamps if it is in use.
+	n := len(payload)
+	if *deployAgent {
+		n += *responseSize + agentTimestampsLen
+	}
+
+	buf := make([]byte, n)
+	_, err = io.ReadFull(incoming, buf)
+	if err != nil {
+		return
+	}
+
+	t.received = time.Now()
+	if err = checkReply(payload, buf[:len(payload)]); err != nil {
+		return
+	}
+
+	if *deployAgent {
+		t.remoteReceived, t.remoteSent, err = parseAgentTimestamps(buf[len(payload)+*responseSize:])
+	}
+
+	return
+}
+
+// newRand returns a source of randomness seeded according to --seed.
+func newRand() *rand.Rand {
+	s := *seed
+	if s == 0 {
+		s = time.Now().UnixNano()
+	}
+
+	return rand.New(rand.NewSource(s))
+}
+
+// Without --retries or --failover-gap, how many connections in a row may
+// time out without an echo before measurement gives up, rather than
+// reconnecting to a host that has stopped echoing for the rest of --duration.
+const maxTimeoutsInARow = 3
+
+// The command run on the remote host to echo pings back. Replaced by
+// --remote-command, or when the echo agent is deployed.
+var remoteEchoCommand = "cat"
+
+// startEcho starts an echo process over the supplied transport, using the
+// mechanism selected by --echo and injecting faults into the stream according
+// to --inject-faults.
+func startEcho(ctx context.Context, t transport) (s stream, err error) {
+	if echoMechanism == "sftp" {
+		s, err = startSFTPEcho(ctx, t)
+	} else {
+		s, err = t.NewStream(ctx, remoteEchoCommand)
+	}
+
+	if err != nil || *injectFaults == "" {
+		return
+	}
+
+	s = newFaultyEcho(ctx, injectedFaults, newFaultRand(), s)
+	return
+}
+
+// A run holds the results of a measurement.
+type run struct {
+	// Echo round trip times.
+	samples []time.Duration
+
+	// The time at which each sample was sent.
+	sent []time.Time
+
+	// If the remote echo agent is in use, the full timing of each sample.
+	times []pingTimes
+
+	// If running multiple streams, the samples from each.
+	perStream [][]time.Duration
+
+	// For each connection made, the time from starting it until the first
+	// echo came back, and when it was started.
+	setup        []time.Duration
+	setupStarted []time.Time
+
+	// For each connection made, the phases of its setup that could be timed:
+	// with the native transport, connecting, key exchange, and
+	// authentication, and then with either transport, opening the echo
+	// session and waiting for its first echo.
+	setupPhases [][]setupPhase
+
+	// With the native transport, how long each connection took to
+	// authenticate, and each echo session to open.
+	auth        []time.Duration
+	channelOpen []time.Duration
+
+	// If non-nil, samples are accumulated here instead of in samples, sent,
+	// times, and perStream, so that memory use doesn't grow with the length
+	// of the run.
+	hist *histogram
+
+	// How many of the samples were synthesized to correct for coordinated
+	// omission.
+	synthesized int
+
+	// Spikes, timeouts, and reconnects, in time order.
+	events []event
+
+	// Whether the last sample added was part of a spike.
+	inSpike bool
+
+	// With --failover-gap, when each connection failed or couldn't be made.
+	failures []time.Time
+
+	// With --retries, how many pings were retried on a new connection.
+	retried retryCounts
+
+	// With --adaptive-budget, what schedules the pings.
+	pacer *adaptivePacer
+
+	// What identifies the run. Until it's over, only what the native
+	// transport found out about the first connection.
+	meta runMetadata
+}
+
+// A setupPhase is part of setting up a connection.
+type setupPhase struct {
+	name       string
+	start, end time.Time
+}
+
+// add records a sample sent at the given time.
+func (r *run) add(sent time.Time, rtt time.Duration) {
+	r.noteSpike(sent, rtt)
+	if r.hist != nil {
+		r.hist.record(rtt)
+		return
+	}
+
+	r.samples = append(r.samples, rtt)
+	r.sent = append(r.sent, sent)
+}
+
+// distribution returns the distribution of the run's echo round trip times.
+func (r run) distribution() distribution {
+	if r.hist != nil {
+		return r.hist
+	}
+
+	return sampleSet(r.samples)
+}
+
+// phase returns the distribution of the named phase, one of phases, or of
+// echo round trip times if it's empty.
+func (r run) phase(name string) distribution {
+	switch name {
+	case "setup":
+		return sampleSet(r.setup)
+	case "auth":
+		return sampleSet(r.auth)
+	case "channel":
+		return sampleSet(r.channelOpen)
+	case "dwell":
+		dwell := make(sampleSet, 0, len(r.times))
+		for _, t := range r.times {
+			dwell = append(dwell, t.remoteSent.Sub(t.remoteReceived))
+		}
+
+		return dwell
+	}
+
+	return r.distribution()
+}
+
+// A sample is a single echo round trip, as passed to onSample callbacks.
+type sample struct {
+	// The index of the stream it was measured on.
+	stream int
+
+	times pingTimes
+
+	// Whether the echo was abandoned after --ping-timeout instead, in which
+	// case times span the timeout, and stream is unknown.
+	timedOut bool
+}
+
+// measure makes a connection with the supplied options and collects samples
+// for the length of time set by --duration. If --reconnect-every is set, the
+// connection is periodically torn down and re-established, and it is also
+// re-established if an echo takes longer than --ping-timeout, or with
+// --failover-gap or --retries if it fails. If the context is cancelled, measurement stops
+// and its error is returned.
+func measure(ctx context.Context, opts transportOptions) (r run, err error) {
+	r, err = measureStreaming(ctx, opts, nil)
+	return
+}
+
+// measureStreaming is like measure, but if onSample is non-nil it is also
+// called with each sample as soon as it is collected, e.g. for live output,
+// and with each timeout as it happens. With --streams, it may be called
+// concurrently.
+func measureStreaming(
+	ctx context.Context,
+	opts transportOptions,
+	onSample func(sample)) (r run, err error) {
+	payload := makePayload(*payloadSize)
+	r.samples = []time.Duration{}
+	if *useHistogram {
+		r.hist = &histogram{}
+	}
+
+	if adaptiveBudgetRate > 0 {
+		r.pacer = newAdaptivePacer(adaptiveBudgetRate, *payloadSize)
+	}
+
+	// Why the next connection, if not the first, is being made.
+	var reason string
+
+	// How many connections in a row have timed out without an echo.
+	var timeoutsInARow int
+
+	deadline := time.Now().Add(*duration)
+	for len(r.setup) == 0 || time.Now().Before(deadline) {
+		d := time.Until(deadline)
+		if *reconnectEvery > 0 && *reconnectEvery < d {
+			d = *reconnectEvery
+		}
+
+		connections := len(r.setup)
+		collected := r.distribution().count()
+		err = measureConnection(ctx, opts, payload, d, reason, &r, onSample)
+		if r.distribution().count() > collected {
+			r.retried.inARow = 0
+		}
+
+		if len(r.setup) > connections {
+			timeoutsInARow = 0
+		}
+
+		if errors.Is(err, errEchoTimeout) && ctx.Err() == nil {
+			// Without --retries, only reconnect once the host has shown it can
+			// echo at all, and only a few times in a row, or a host that has
+			// stopped echoing would be reconnected to for as long as the run
+			// lasts.
+			if *retries > 0 {
+				if err = r.retried.note(err); err != nil {
+					return
+				}
+			} else if len(r.setup) == 0 {
+				err = fmt.Errorf("first connection: no echo within %v", *pingTimeout)
+				return
+			} else if timeoutsInARow++; *failoverGap <= 0 && timeoutsInARow >= maxTimeoutsInARow {
+				err = fmt.Errorf("giving up after %d timeouts in a row: %w", timeoutsInARow, err)
+				return
+			}
+
+			now := time.Now()
+			r.events = append(r.events, event{
+				kind:     "timeout",
+				start:    now.Add(-*pingTimeout),
+				duration: *pingTimeout,
+			})
+
+			if onSample != nil {
+				onSample(sample{
+					times:    pingTimes{sent: now.Add(-*pingTimeout), received: now},
+					timedOut: true,
+				})
+			}
+
+			r.inSpike = false
+			reason = "after timeout"
+			err = nil
+			continue
+		}
+
+		// A stream that echoed something other than the ping can't be trusted
+		// to time the next one, so start afresh. If that happened before the
+		// connection got going, though, a new one would fare no better.
+		if errors.Is(err, errBadReply) && len(r.setup) > connections && ctx.Err() == nil {
+			r.events = append(r.events, event{
+				kind:   "bad reply",
+				start:  time.Now(),
+				reason: strings.TrimPrefix(err.Error(), errBadReply.Error()+": "),
+			})
+
+			r.inSpike = false
+			reason = "after bad reply"
+			err = nil
+			continue
+		}
+
+		// When testing failover, keep trying to reconnect for as long as the
+		// outage lasts. Only the first connection has to work.
+		if *failoverGap > 0 && err != nil && len(r.setup) > 0 && ctx.Err() == nil {
+			r.failures = append(r.failures, time.Now())
+			r.inSpike = false
+			reason = "after connection failure"
+			err = nil
+			select {
+			case <-time.After(failoverRetryDelay):
+			case <-ctx.Done():
+			}
+
+			continue
+		}
+
+		// With --retries, do the same for a limited number of failures in a
+		// row, waiting a little before each retry.
+		if *retries > 0 && err != nil && len(r.setup) > 0 && ctx.Err() == nil {
+			if err = r.retried.note(err); err != nil {
+				return
+			}
+
+			r.inSpike = false
+			reason = "after connection error"
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+			}
+
+			continue
+		}
+
+		reason = "scheduled by --reconnect-every"
+		if err != nil {
+			// Failures caused by cancellation are reported as such.
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+
+			return
+		}
+	}
+
+	return
+}
+
+// measureConnection connects and starts echo processes (one per stream set
+// by --streams), records the setup time, and then collects samples from them
+// concurrently for the given duration.
+func measureConnection(
+	ctx context.Context,
+	opts transportOptions,
+	payload []byte,
+	d time.Duration,
+	reason string,
+	r *run,
+	onSample func(sample)) (err error) {
+	// Keep-warm traffic must share the echo streams' connection to keep its
+	// state alive.
+	opts.shared = opts.shared || *streams > 1 || keepWarmPeriod > 0
+	t, err := newTransport(opts)
+	if err != nil {
+		return
+	}
+
+	// With --ping-timeout, a stalled connection is abandoned by cancelling
+	// the context it was made with.
+	ctx, abandon := context.WithCancel(ctx)
+	defer abandon()
+	var timedOut int32
+	var connectTimedOut int32
+	defer func() {
+		if err != nil && atomic.LoadInt32(&timedOut) != 0 {
+			err = errEchoTimeout
+		}
+
+		if err != nil && atomic.LoadInt32(&connectTimedOut) != 0 {
+			err = fmt.Errorf("no connection within %v", failoverConnectTimeout)
+		}
+	}()
+
+	// When testing failover, give up on a connection attempt swallowed by the
+	// outage and make another.
+	connectTimer := time.AfterFunc(failoverConnectTimeout, func() {
+		atomic.StoreInt32(&connectTimedOut, 1)
+		abandon()
+	})
+
+	if *failoverGap <= 0 {
+		connectTimer.Stop()
+	}
+
+	defer connectTimer.Stop()
+
+	start := time.Now()
+	if err = t.Dial(ctx); err != nil {
+		return
+	}
+
+	defer t.Close()
+
+	if nt, ok := t.(*nativeTransport); ok {
+		r.auth = append(r.auth, nt.auth)
+		if r.meta.ServerVersion == "" {
+			r.meta.connMetadata = nt.meta
+		}
+	}
+
+	var phases []setupPhase
+	if nt, ok := t.(*nativeTransport); ok {
+		phases = nt.phases
+	}
+
+	var ss []stream
+	defer func() {
+		for _, s := range ss {
+			s.Close()
+		}
+	}()
+
+	for i := 0; i < *streams; i++ {
+		var s stream
+		opened := time.Now()
+		s, err = startEcho(ctx, t)
+		if err != nil {
+			return
+		}
+
+		r.channelOpen = append(r.channelOpen, time.Since(opened))
+		if i == 0 {
+			phases = append(phases, setupPhase{"channel open", opened, time.Now()})
+		}
+
+		ss = append(ss, s)
+		if *pingTimeout > 0 {
+			s = timeoutStream{s, abandon, &timedOut}
+			ss[i] = s
+		}
+
+		// The first few pings probably incur some startup cost. Throw them
+		// away, noting when the first one came back.
+		for j := 0; j < 3; j++ {
+			if _, err = runPing(payload, s, s); err != nil {
+				return
+			}
+
+			if i == 0 && j == 0 {
+				setup := time.Since(start)
+				if reason != "" {
+					r.events = append(r.events, event{
+						kind:     "reconnect",
+						start:    start,
+						duration: setup,
+						reason:   reason,
+					})
+				}
+
+				r.setup = append(r.setup, setup)
+				r.setupStarted = append(r.setupStarted, start)
+				first := phases[len(phases)-1].end
+				r.setupPhases = append(r.setupPhases, append(phases, setupPhase{"first echo", first, start.Add(setup)}))
+				connectTimer.Stop()
+			}
+		}
+	}
+
+	// By now ssh has logged what it negotiated.
+	if et, ok := t.(*execTransport); ok && r.meta.ServerVersion == "" {
+		r.meta.connMetadata = et.metadata()
+	}
+
+	if keepWarmPeriod > 0 {
+		var stop func()
+		if stop, err = startKeepWarm(ctx, t); err != nil {
+			return
+		}
+
+		defer stop()
+	}
+
+	if len(ss) == 1 {
+		err = collect(ctx, payload, ss[0], d, r, streamCallback(onSample, 0), true)
+		return
+	}
+
+	results := make([]run, len(ss))
+	if r.hist != nil {
+		for i := range results {
+			results[i].hist = &histogram{}
+		}
+	}
+
+	errs := make([]error, len(ss))
+	var wg sync.WaitGroup
+	for i := range ss {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = collect(ctx, payload, ss[i], d, &results[i], streamCallback(onSample, i), false)
+		}(i)
+	}
+
+	wg.Wait()
+
+	// Keep what was collected even if a stream failed, in case the failure
+	// was a timeout and measurement is to continue on a new connection.
+	r.merge(results)
+	r.mergeEvents(results)
+	for i, e := range errs {
+		if e != nil {
+			err = fmt.Errorf("stream %d: %w", i, e)
+			return
+		}
+	}
+
+	return
+}
+
+// merge adds samples collected concurrently from several streams to the run,
+// keeping them in the order in which they were sent.
+func (r *run) merge(streams []run) {
+	for _, s := range streams {
+		r.synthesized += s.synthesized
+	}
+
+	if r.hist != nil {
+		for _, s := range streams {
+			r.hist.merge(s.hist)
+		}
+
+		return
+	}
+
+	if r.perStream == nil {
+		r.perStream = make([][]time.Duration, len(streams))
+	}
+
+	var all run
+	for i, s := range streams {
+		r.perStream[i] = append(r.perStream[i], s.samples...)
+		all.samples = append(all.samples, s.samples...)
+		all.sent = append(all.sent, s.sent...)
+		all.times = append(all.times, s.times...)
+	}
+
+	order := make([]int, len(all.samples))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.Slice(order, func(i, j int) bool { return all.sent[order[i]].Before(all.sent[order[j]]) })
+	for _, i := range order {
+		r.samples = append(r.samples, all.samples[i])
+		r.sent = append(r.sent, all.sent[i])
+		if all.times != nil {
+			r.times = append(r.times, all.times[i])
+		}
+	}
+}
+
+// startKeepWarm starts sending a byte over the connection every
+// keepWarmPeriod, on a session of its own, so that it never sits idle long
+// enough for NAT or firewall state to expire. The returned function stops it.
+func startKeepWarm(ctx context.Context, t transport) (stop func(), err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	s, err := t.NewStream(ctx, "cat > /dev/null")
+	if err != nil {
+		cancel()
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(keepWarmPeriod)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if _, err := s.Write([]byte{'\n'}); err != nil {
+				return
+			}
+		}
+	}()
+
+	stop = func() {
+		cancel()
+		<-done
+		s.Close()
+	}
+
+	return
+}
+
+// streamCallback adapts an onSample callback for use by collect on the given
+// stream.
+func streamCallback(onSample func(sample), stream int) func(pingTimes) {
+	if onSample == nil {
+		return nil
+	}
+
+	return func(t pingTimes) {
+		onSample(sample{stream: stream, times: t})
+	}
+}
+
+// Where to report progress while collecting samples.
+var progressOutput io.Writer = os.Stdout
+
+// collect runs pings for the given duration, back to back or paced according
+// to --interval, adding them to the supplied run and optionally reporting
+// progress along the way. If onSample is non-nil, it is called with each
+// sample. It stops early if the context is cancelled.
+func collect(
+	ctx context.Context,
+	payload []byte,
+	s stream,
+	duration time.Duration,
+	r *run,
+	onSample func(pingTimes),
+	progress bool) (err error) {
+	n := r.distribution().count()
+	start := time.Now()
+	for i := 1; time.Since(start) < duration; i++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		var t pingTimes
+		t, err = runPing(payload, s, s)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+
+			return
+		}
+
+		n++
+		r.add(t.sent, t.rtt())
+		if *deployAgent && r.hist == nil {
+			r.times = append(r.times, t)
+		}
+
+		if onSample != nil {
+			onSample(t)
+		}
+
+		if progress && n%100 == 0 {
+			fmt.Fprintln(progressOutput, n, "samples so far...")
+		}
+
+		if r.pacer != nil {
+			select {
+			case <-time.After(r.pacer.next(t)):
+			case <-ctx.Done():
+			}
+
+			continue
+		}
+
+		// Wait for the next ping's turn. If we've fallen behind, send it right
+		// away.
+		if *interval > 0 {
+			next := start.Add(time.Duration(i) * *interval)
+
+			// Pings due while waiting for this echo would have queued behind
+			// it. Rather than sending them late, record the latencies they
+			// would have seen, so that stalls aren't under-represented.
+			for *correctOmission && next.Before(t.received) {
+				r.add(next, t.received.Sub(next))
+				r.synthesized++
+				n++
+				i++
+				next = start.Add(time.Duration(i) * *interval)
+			}
+
+			select {
+			case <-time.After(time.Until(next)):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	return
+}
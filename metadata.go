@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connMetadata describes an SSH connection: where it went, the software at
+// each end, and the algorithms negotiated. Fields that couldn't be found out
+// are empty.
+type connMetadata struct {
+	RemoteAddress string `json:"remote_address,omitempty"`
+	ClientVersion string `json:"client_version,omitempty"`
+	ServerVersion string `json:"server_version,omitempty"`
+	KeyExchange   string `json:"kex,omitempty"`
+	HostKey       string `json:"host_key_algorithm,omitempty"`
+
+	// Client to server. With an AEAD cipher such as chacha20-poly1305, there
+	// is no separate MAC.
+	Cipher string `json:"cipher,omitempty"`
+	MAC    string `json:"mac,omitempty"`
+}
+
+// runMetadata identifies a run, so that archived results can be told apart
+// and compared meaningfully later.
+type runMetadata struct {
+	ToolVersion string    `json:"tool_version"`
+	LocalHost   string    `json:"local_host"`
+	Target      string    `json:"target"`
+	Transport   string    `json:"transport"`
+	Started     time.Time `json:"started"`
+	Ended       time.Time `json:"ended"`
+
+	connMetadata
+}
+
+// toolVersion returns the version of this program, with the revision it was
+// built from if known.
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	v := info.Main.Version
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			v += " (" + s.Value + ")"
+		}
+	}
+
+	return v
+}
+
+// newRunMetadata returns the metadata for a run of the target, without
+// anything about the connection.
+func newRunMetadata(target string, started, ended time.Time) runMetadata {
+	hostname, _ := os.Hostname()
+	transport := *transportKind
+	if *simulate != "" {
+		transport = "simulated"
+	}
+
+	return runMetadata{
+		ToolVersion: toolVersion(),
+		LocalHost:   hostname,
+		Target:      target,
+		Transport:   transport,
+		Started:     started,
+		Ended:       ended,
+	}
+}
+
+// printMetadata prints a run's metadata.
+func printMetadata(m runMetadata) {
+	fmt.Printf("Run:\n")
+	line := func(name, value string) {
+		if value != "" {
+			fmt.Printf("  %-15s %s\n", name+":", value)
+		}
+	}
+
+	line("Started", m.Started.Format(time.RFC3339))
+	line("Ended", m.Ended.Format(time.RFC3339))
+	line("Local host", m.LocalHost)
+	line("Target", m.Target)
+	line("Address", m.RemoteAddress)
+	line("Transport", m.Transport)
+	line("Client", m.ClientVersion)
+	line("Server", m.ServerVersion)
+	line("Key exchange", m.KeyExchange)
+	line("Host key", m.HostKey)
+	line("Cipher", m.Cipher)
+	line("MAC", m.MAC)
+	line("ssh_ping", m.ToolVersion)
+}
+
+// parseSSHDebug notes what a line logged by ssh -v says about the
+// connection, returning whether it was debugging output rather than something
+// ssh would have said anyway, like an error. ssh doesn't otherwise report what
+// it negotiated.
+func (m *connMetadata) parseSSHDebug(line string) (debug bool) {
+	line = strings.TrimSpace(line)
+
+	// Besides its debug lines, -v adds a few of its own.
+	for _, prefix := range sshVerbosePrefixes {
+		if strings.HasPrefix(line, prefix) {
+			debug = true
+		}
+	}
+
+	if !strings.HasPrefix(line, "debug") {
+		return
+	}
+
+	debug = true
+	line = strings.TrimPrefix(line, "debug1: ")
+	field := func(prefix string) (value string, ok bool) {
+		if !strings.HasPrefix(line, prefix) {
+			return
+		}
+
+		return strings.TrimPrefix(line, prefix), true
+	}
+
+	if v, ok := field("Local version string "); ok {
+		m.ClientVersion = v
+	} else if v, ok := field("Remote protocol version 2.0, remote software version "); ok {
+		m.ServerVersion = "SSH-2.0-" + v
+	} else if v, ok := field("kex: algorithm: "); ok {
+		m.KeyExchange = v
+	} else if v, ok := field("kex: host key algorithm: "); ok {
+		m.HostKey = v
+	} else if v, ok := field("kex: client->server cipher: "); ok {
+		// e.g. "chacha20-poly1305@openssh.com MAC: <implicit> compression: none"
+		f := strings.Fields(v)
+		if len(f) >= 3 {
+			m.Cipher = f[0]
+			if f[2] != "<implicit>" {
+				m.MAC = f[2]
+			}
+		}
+	} else if v, ok := field("Connecting to "); ok && m.RemoteAddress == "" {
+		// e.g. "example.com [192.0.2.1] port 22."
+		var name, ip, port string
+		if _, err := fmt.Sscanf(v, "%s [%s port %s", &name, &ip, &port); err == nil {
+			m.RemoteAddress = net.JoinHostPort(strings.TrimSuffix(ip, "]"), strings.TrimSuffix(port, "."))
+		}
+	}
+
+	return
+}
+
+// The lines other than debug lines that ssh -v logs, by how they start.
+var sshVerbosePrefixes = []string{
+	"OpenSSH_",
+	"Authenticated to ",
+	"Transferred: ",
+	"Bytes per second: ",
+}
+
+// sshLog is the stderr of an ssh run with -v. It notes what ssh says it
+// negotiated, and passes on everything else it says, such as errors, to out.
+// It is safe for concurrent use.
+type sshLog struct {
+	out io.Writer
+
+	mu      sync.Mutex
+	partial []byte
+	meta    connMetadata
+}
+
+func (l *sshLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := l.partial[:i+1]
+		if !l.meta.parseSSHDebug(string(line)) {
+			l.out.Write(line)
+		}
+
+		l.partial = l.partial[i+1:]
+	}
+
+	// Don't hold on to an endless line.
+	if len(l.partial) > tailBufferSize {
+		l.out.Write(l.partial)
+		l.partial = nil
+	}
+
+	return len(p), nil
+}
+
+// metadata returns what ssh has said about the connection so far.
+func (l *sshLog) metadata() connMetadata {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.meta
+}
+
+// kexRecorder wraps the connection an SSH handshake runs over, picking out
+// the version strings and key exchange init messages each side sends, which
+// are in the clear, so that the algorithms negotiated can be worked out.
+// x/crypto/ssh doesn't report them.
+type kexRecorder struct {
+	net.Conn
+
+	sent, received kexStream
+}
+
+func (r *kexRecorder) Read(p []byte) (n int, err error) {
+	n, err = r.Conn.Read(p)
+	r.received.write(p[:n])
+	return
+}
+
+func (r *kexRecorder) Write(p []byte) (n int, err error) {
+	n, err = r.Conn.Write(p)
+	r.sent.write(p[:n])
+	return
+}
+
+// The SSH message number of a key exchange init message.
+const msgKexInit = 20
+
+// Give up looking for a key exchange init message after this many bytes.
+const kexRecorderLimit = 64 << 10
+
+// kexStream accumulates one direction of a connection until the key exchange
+// init message has been seen.
+type kexStream struct {
+	buf  []byte
+	done bool
+
+	// The algorithm name lists from the message: key exchange, host key,
+	// then ciphers, MACs, and compression, client to server and back.
+	lists [][]string
+}
+
+func (s *kexStream) write(p []byte) {
+	if s.done {
+		return
+	}
+
+	s.buf = append(s.buf, p...)
+	if len(s.buf) > kexRecorderLimit {
+		s.done, s.buf = true, nil
+		return
+	}
+
+	// Skip the version line and any lines the server sends before it.
+	data := s.buf
+	for !bytes.HasPrefix(data, []byte("SSH-")) || bytes.IndexByte(data, '\n') < 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return
+		}
+
+		data = data[i+1:]
+	}
+
+	data = data[bytes.IndexByte(data, '\n')+1:]
+
+	// Then comes the first binary packet: its length, the padding length,
+	// and the payload.
+	if len(data) < 6 {
+		return
+	}
+
+	length := int(binary.BigEndian.Uint32(data))
+	if len(data) < 4+length {
+		return
+	}
+
+	s.done = true
+	s.buf = nil
+	if int(data[4]) >= length {
+		return
+	}
+
+	payload := data[5 : 4+length-int(data[4])]
+	if len(payload) < 17 || payload[0] != msgKexInit {
+		return
+	}
+
+	rest := payload[17:]
+	for i := 0; i < 8 && len(rest) >= 4; i++ {
+		n := int(binary.BigEndian.Uint32(rest))
+		if len(rest) < 4+n {
+			return
+		}
+
+		s.lists = append(s.lists, strings.Split(string(rest[4:4+n]), ","))
+		rest = rest[4+n:]
+	}
+}
+
+// negotiated returns the algorithms agreed for the connection: for each list,
+// the first of the client's choices that the server supports.
+func (r *kexRecorder) negotiated() (m connMetadata) {
+	client, server := r.sent.lists, r.received.lists
+	choose := func(i int) string {
+		if len(client) <= i || len(server) <= i {
+			return ""
+		}
+
+		for _, c := range client[i] {
+			for _, s := range server[i] {
+				if c == s {
+					return c
+				}
+			}
+		}
+
+		return ""
+	}
+
+	m.KeyExchange = choose(0)
+	m.HostKey = choose(1)
+	m.Cipher = choose(2)
+	if !strings.Contains(m.Cipher, "gcm") && !strings.Contains(m.Cipher, "poly1305") {
+		m.MAC = choose(4)
+	}
+
+	return
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSSHLog(t *testing.T) {
+	var out bytes.Buffer
+	l := &sshLog{out: &out}
+
+	// Written in pieces that don't line up with lines, as a pipe may deliver
+	// them.
+	logged := "OpenSSH_9.6p1, OpenSSL 3.0.13 30 Jan 2024\r\n" +
+		"debug1: Connecting to example.com [192.0.2.1] port 22.\r\n" +
+		"debug1: Local version string SSH-2.0-OpenSSH_9.6\r\n" +
+		"debug1: Remote protocol version 2.0, remote software version OpenSSH_8.9p1\r\n" +
+		"debug1: kex: algorithm: curve25519-sha256\r\n" +
+		"debug1: kex: host key algorithm: ssh-ed25519\r\n" +
+		"debug1: kex: client->server cipher: chacha20-poly1305@openssh.com MAC: <implicit> compression: none\r\n" +
+		"Warning: Permanently added 'example.com' (ED25519) to the list of known hosts.\r\n" +
+		"Authenticated to example.com ([192.0.2.1]:22) using \"publickey\".\r\n" +
+		"debug2: channel 0: read failed\r\n" +
+		"Connection to example.com closed by remote host.\r\n" +
+		"Transferred: sent 2780, received 2952 bytes, in 0.2 seconds\r\n" +
+		"Bytes per second: sent 13911.3, received 14772.0\r\n"
+
+	for i := 0; i < len(logged); i += 7 {
+		end := i + 7
+		if end > len(logged) {
+			end = len(logged)
+		}
+
+		l.Write([]byte(logged[i:end]))
+	}
+
+	want := connMetadata{
+		RemoteAddress: "192.0.2.1:22",
+		ClientVersion: "SSH-2.0-OpenSSH_9.6",
+		ServerVersion: "SSH-2.0-OpenSSH_8.9p1",
+		KeyExchange:   "curve25519-sha256",
+		HostKey:       "ssh-ed25519",
+		Cipher:        "chacha20-poly1305@openssh.com",
+	}
+
+	if got := l.metadata(); got != want {
+		t.Errorf("metadata() = %+v; want %+v", got, want)
+	}
+
+	wantOut := "Warning: Permanently added 'example.com' (ED25519) to the list of known hosts.\r\n" +
+		"Connection to example.com closed by remote host.\r\n"
+	if out.String() != wantOut {
+		t.Errorf("passed on %q; want %q", out.String(), wantOut)
+	}
+}
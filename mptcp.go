@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// mptcpUsage records how the connections made with --mptcp fared.
+type mptcpUsage struct {
+	mu sync.Mutex
+
+	// How many connections were made, and how many of them negotiated MPTCP
+	// rather than falling back to plain TCP.
+	conns     int
+	multipath int
+
+	// The most subflows seen on any connection, including the initial one.
+	maxSubflows int
+}
+
+var mptcpStats mptcpUsage
+
+// note records a connection's MPTCP state. It should be called just before
+// the connection is closed, when any extra subflows have been established.
+func (u *mptcpUsage) note(conn net.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.conns++
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if mp, err := tc.MultipathTCP(); err != nil || !mp {
+		return
+	}
+
+	u.multipath++
+	if n, err := mptcpSubflows(tc); err == nil && n > u.maxSubflows {
+		u.maxSubflows = n
+	}
+}
+
+// print prints a line describing MPTCP usage.
+func (u *mptcpUsage) print() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	switch {
+	case u.multipath == 0:
+		fmt.Printf("MPTCP: not negotiated; connections fell back to TCP.\n")
+	case u.maxSubflows == 0:
+		fmt.Printf("MPTCP: used by %d of %d connections.\n", u.multipath, u.conns)
+	default:
+		fmt.Printf(
+			"MPTCP: used by %d of %d connections, with up to %d subflows.\n",
+			u.multipath,
+			u.conns,
+			u.maxSubflows)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// From linux/mptcp.h.
+const mptcpInfo = 1
+
+// mptcpSubflows returns the number of subflows of an MPTCP connection,
+// including the initial one.
+func mptcpSubflows(tc *net.TCPConn) (n int, err error) {
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	// There's no typed getter for struct mptcp_info, whose first byte is the
+	// number of subflows beyond the initial one, so read it raw.
+	var info string
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptString(int(fd), unix.SOL_MPTCP, mptcpInfo)
+	})
+
+	if err == nil {
+		err = sockErr
+	}
+
+	if err != nil {
+		return
+	}
+
+	n = 1
+	if len(info) > 0 {
+		n += int(info[0])
+	}
+
+	return
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// mptcpSubflows isn't supported outside Linux.
+func mptcpSubflows(tc *net.TCPConn) (n int, err error) {
+	err = errors.New("MPTCP subflow information is only available on Linux")
+	return
+}
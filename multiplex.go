@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// The number of sessions to open for each mode when comparing
+	// multiplexed and cold connections.
+	multiplexSessions = 10
+
+	// How long to collect echo samples on each of those sessions.
+	multiplexSessionDuration = time.Second
+)
+
+// sessionResults holds the measurements from a series of sessions.
+type sessionResults struct {
+	// For each session, the time from starting ssh until the first echo came
+	// back.
+	open []time.Duration
+
+	// Echo round trip times from all sessions.
+	echo run
+}
+
+// measureSessions repeatedly opens a session over the supplied transport,
+// timing how long it takes for the first echo to come back and then
+// collecting echo samples for a short while.
+func measureSessions(ctx context.Context, t transport) (r sessionResults, err error) {
+	payload := makePayload(*payloadSize)
+	for i := 0; i < multiplexSessions; i++ {
+		start := time.Now()
+		s, err := startEcho(ctx, t)
+		if err != nil {
+			return r, err
+		}
+
+		if _, err = runPing(payload, s, s); err != nil {
+			s.Close()
+			return r, err
+		}
+
+		r.open = append(r.open, time.Since(start))
+
+		err = collect(ctx, payload, s, multiplexSessionDuration, &r.echo, nil, false)
+		s.Close()
+		if err != nil {
+			return r, err
+		}
+	}
+
+	return
+}
+
+// compareMultiplexingModes measures sessions opened as cold connections and
+// sessions multiplexed over an existing ControlMaster connection, then prints
+// a comparison.
+func compareMultiplexingModes(ctx context.Context) (err error) {
+	if *transportKind != "exec" {
+		err = fmt.Errorf("--compare-multiplexing requires the exec transport")
+		return
+	}
+
+	fmt.Printf("Measuring %d cold connections...\n", multiplexSessions)
+	t, err := newTransport(transportOptions{
+		sshArgs: []string{"-o", "ControlMaster=no", "-o", "ControlPath=none"},
+	})
+
+	if err != nil {
+		return
+	}
+
+	cold, err := measureSessions(ctx, t)
+	if err != nil {
+		err = fmt.Errorf("cold connections: %w", err)
+		return
+	}
+
+	fmt.Printf("Measuring %d multiplexed sessions...\n", multiplexSessions)
+	t, err = newTransport(transportOptions{shared: true})
+	if err != nil {
+		return
+	}
+
+	if err = t.Dial(ctx); err != nil {
+		return
+	}
+
+	defer t.Close()
+
+	mux, err := measureSessions(ctx, t)
+	if err != nil {
+		err = fmt.Errorf("multiplexed sessions: %w", err)
+		return
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf(
+		"%-12s %10s %10s %10s %10s\n",
+		"", "Open p50", "Open p95", "Echo p50", "Echo p95")
+
+	for _, row := range []struct {
+		name string
+		r    sessionResults
+	}{
+		{"Cold", cold},
+		{"Multiplexed", mux},
+	} {
+		fmt.Printf(
+			"%-12s %10s %10s %10s %10s\n",
+			row.name,
+			formatLatency(median(row.r.open)),
+			formatLatency(percentile(95, row.r.open)),
+			formatLatency(median(row.r.echo.samples)),
+			formatLatency(percentile(95, row.r.echo.samples)))
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf(
+		"Session open p50 when multiplexed: %s relative to cold.\n",
+		formatDelta(median(mux.open)-median(cold.open)))
+
+	return
+}
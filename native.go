@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// nativeTransport connects to the host with a built-in SSH client, running
+// each stream as a session on a single connection.
+type nativeTransport struct {
+	opts   transportOptions
+	conn   net.Conn
+	client *ssh.Client
+
+	// How long authentication took, from verifying the host key until the
+	// server accepted us.
+	auth time.Duration
+
+	// When each phase of making the connection began and ended.
+	phases []setupPhase
+
+	// What was negotiated with the server.
+	meta connMetadata
+
+	// Closed to stop sending keepalives, if they're being sent.
+	stopKeepalives chan struct{}
+}
+
+func (t *nativeTransport) Dial(ctx context.Context) (err error) {
+	username, addr := parseTarget(t.opts.host)
+
+	hostKeyCallback, hostKeyAlgorithms, err := newHostKeyCallback(addr)
+	if err != nil {
+		return
+	}
+
+	auth, closeAgent := authMethods()
+	defer closeAgent()
+
+	var verified time.Time
+
+	config := &ssh.ClientConfig{
+		User: username,
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) (err error) {
+			if err = hostKeyCallback(hostname, remote, key); err == nil {
+				noteHostKey(hostname, key)
+			}
+
+			verified = time.Now()
+			return
+		},
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           30 * time.Second,
+	}
+
+	config.Ciphers = t.opts.ciphers
+	config.MACs = t.opts.macs
+	config.KeyExchanges = t.opts.keyExchanges
+	if *constrained {
+		if config.KeyExchanges == nil {
+			config.KeyExchanges = constrainedKeyExchanges
+		}
+
+		if config.Ciphers == nil {
+			config.Ciphers = constrainedCiphers
+		}
+	}
+
+	direct := &net.Dialer{Timeout: config.Timeout, KeepAlive: *tcpKeepAlive}
+	direct.SetMultipathTCP(*useMPTCP)
+	if t.opts.bindAddress != "" {
+		direct.LocalAddr = &net.TCPAddr{IP: net.ParseIP(t.opts.bindAddress)}
+	}
+
+	if *bindDevice != "" {
+		direct.Control = bindToDevice(*bindDevice)
+	}
+
+	var base directDialer = direct
+	if *netns != "" {
+		// Racing IPv4 and IPv6 would create sockets on other threads, outside
+		// the namespace.
+		direct.FallbackDelay = -1
+		base = netnsDialer{direct, *netns}
+	}
+
+	dialer, err := proxyDialer(*proxyURL, base)
+	if err != nil {
+		return
+	}
+
+	// Host keys are checked against addr even when connecting to a specific
+	// address.
+	dialAddr := addr
+	if t.opts.address != "" {
+		_, port, _ := net.SplitHostPort(addr)
+		dialAddr = net.JoinHostPort(t.opts.address, port)
+	} else if *cacheTTL > 0 && *proxyURL == "" {
+		// Use the state cache to resolve the name. With a proxy, the proxy
+		// resolves it.
+		if dialAddr, err = cachedDialAddr(addr, t.opts.addressFamily); err != nil {
+			return
+		}
+	}
+
+	dialed := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp"+t.opts.addressFamily, dialAddr)
+	if err != nil {
+		return
+	}
+
+	connected := time.Now()
+
+	if err = applyTCPOptions(conn); err != nil {
+		conn.Close()
+		return
+	}
+
+	// The handshake doesn't take a context, so abort it by closing the
+	// connection.
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	// Nor does it time out by itself, and a server that stalls partway, as
+	// slow devices generating host keys on demand do, would hang it.
+	conn.SetDeadline(time.Now().Add(config.Timeout))
+	rec := &kexRecorder{Conn: conn}
+	c, chans, reqs, err := ssh.NewClientConn(rec, addr, config)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	t.auth = time.Since(verified)
+	t.phases = []setupPhase{
+		{"tcp connect", dialed, connected},
+		{"key exchange", connected, verified},
+		{"authentication", verified, verified.Add(t.auth)},
+	}
+
+	t.meta = rec.negotiated()
+	t.meta.ClientVersion = string(c.ClientVersion())
+	t.meta.ServerVersion = string(c.ServerVersion())
+	if *proxyURL == "" {
+		t.meta.RemoteAddress = conn.RemoteAddr().String()
+	}
+
+	t.conn = conn
+	t.client = ssh.NewClient(c, chans, reqs)
+	if t.opts.serverAlive > 0 {
+		t.stopKeepalives = make(chan struct{})
+		go t.sendKeepalives()
+	}
+
+	return
+}
+
+// sendKeepalives sends a keepalive request every opts.serverAlive, the way
+// OpenSSH does, until stopKeepalives is closed. The server's reply is waited
+// for, so a keepalive is a round trip like any other traffic.
+func (t *nativeTransport) sendKeepalives() {
+	ticker := time.NewTicker(t.opts.serverAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stopKeepalives:
+			return
+		case <-ticker.C:
+		}
+
+		if _, _, err := t.client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			return
+		}
+	}
+}
+
+func (t *nativeTransport) NewStream(ctx context.Context, command string) (s stream, err error) {
+	if !t.opts.pty {
+		s, err = t.start(ctx, func(session *ssh.Session) error { return session.Start(command) })
+		return
+	}
+
+	s, err = t.start(ctx, func(session *ssh.Session) (err error) {
+		if err = session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+			return
+		}
+
+		err = session.Start(ptyCommand(command, t.opts.raw))
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	if err = awaitPTYReady(s); err != nil {
+		return
+	}
+
+	s = ptyStream{s}
+	return
+}
+
+func (t *nativeTransport) NewSubsystem(ctx context.Context, name string) (s stream, err error) {
+	s, err = t.start(ctx, func(session *ssh.Session) error { return session.RequestSubsystem(name) })
+	return
+}
+
+// start opens a session, calling run to start whatever it is to run once its
+// pipes are set up.
+func (t *nativeTransport) start(ctx context.Context, run func(*ssh.Session) error) (s stream, err error) {
+	session, err := t.client.NewSession()
+	if err != nil {
+		return
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return
+	}
+
+	if err = run(session); err != nil {
+		session.Close()
+		return
+	}
+
+	ns := &nativeStream{session: session, stdin: stdin, stdout: stdout, closed: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-ns.closed:
+		}
+	}()
+
+	s = ns
+	return
+}
+
+func (t *nativeTransport) Close() error {
+	if t.stopKeepalives != nil {
+		close(t.stopKeepalives)
+	}
+
+	if *useMPTCP {
+		mptcpStats.note(t.conn)
+	}
+
+	return t.client.Close()
+}
+
+// nativeStream is connected to a session on the native client's connection.
+type nativeStream struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+
+	// Closed by Close, to stop watching for cancellation.
+	closed chan struct{}
+}
+
+func (s *nativeStream) Write(p []byte) (int, error) {
+	return s.stdin.Write(p)
+}
+
+func (s *nativeStream) Read(p []byte) (int, error) {
+	return s.stdout.Read(p)
+}
+
+func (s *nativeStream) CloseWrite() error {
+	return s.stdin.Close()
+}
+
+func (s *nativeStream) Close() (err error) {
+	close(s.closed)
+	s.stdin.Close()
+
+	// Give the remote command a chance to exit on its own, but don't wait
+	// forever for a connection that has stalled.
+	done := make(chan error, 1)
+	go func() { done <- s.session.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(teardownTimeout):
+		err = fmt.Errorf("remote command didn't exit within %v", teardownTimeout)
+	}
+
+	s.session.Close()
+	return
+}
+
+// parseTarget splits a target of the form [user@]host[:port] into a user name
+// and a network address, filling in defaults.
+func parseTarget(target string) (username, addr string) {
+	hostPort := target
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		username = target[:i]
+		hostPort = target[i+1:]
+	}
+
+	if username == "" {
+		if u, err := user.Current(); err == nil {
+			username = u.Username
+		}
+	}
+
+	if h, p, err := net.SplitHostPort(hostPort); err == nil {
+		addr = net.JoinHostPort(h, p)
+	} else {
+		addr = net.JoinHostPort(strings.Trim(hostPort, "[]"), "22")
+	}
+
+	return
+}
+
+// authMethods returns the ways to authenticate: with keys from ssh-agent if
+// it is running, and with any unencrypted default keys in ~/.ssh. The
+// returned function closes the connection to ssh-agent, and must be called
+// once authentication is done.
+func authMethods() (methods []ssh.AuthMethod, closeAgent func()) {
+	closeAgent = func() {}
+
+	var agentClient agent.ExtendedAgent
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			agentClient = agent.NewClient(conn)
+			closeAgent = func() { conn.Close() }
+		}
+	}
+
+	var fileSigners []ssh.Signer
+	if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			pem, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+			if err != nil {
+				continue
+			}
+
+			// Keys that need a passphrase are skipped; use ssh-agent for those.
+			if signer, err := ssh.ParsePrivateKey(pem); err == nil {
+				fileSigners = append(fileSigners, signer)
+			}
+		}
+	}
+
+	methods = append(methods, ssh.PublicKeysCallback(func() (signers []ssh.Signer, err error) {
+		if agentClient != nil {
+			signers, err = agentClient.Signers()
+			if err != nil {
+				return
+			}
+		}
+
+		signers = append(signers, fileSigners...)
+		return
+	}))
+
+	return
+}
+
+func knownHostsPath() (path string, err error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+
+	path = filepath.Join(home, ".ssh", "known_hosts")
+	return
+}
+
+// newHostKeyCallback returns a callback that verifies host keys against
+// ~/.ssh/known_hosts according to --strict-host-key-checking, recording the
+// keys of unknown hosts with accept-new. It also returns the host key
+// algorithms to ask the given address for.
+func newHostKeyCallback(addr string) (
+	cb ssh.HostKeyCallback,
+	algos []string,
+	err error) {
+	if *strictHostKeyChecking == "no" {
+		cb = ssh.InsecureIgnoreHostKey()
+		return
+	}
+
+	path, err := knownHostsPath()
+	if err != nil {
+		return
+	}
+
+	// knownhosts.New fails if the file doesn't exist, which is a perfectly
+	// normal state of affairs for a new user.
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	f.Close()
+
+	check, err := knownhosts.New(path)
+	if err != nil {
+		return
+	}
+
+	algos = knownHostKeyAlgorithms(check, addr)
+
+	cb = func(hostname string, remote net.Addr, key ssh.PublicKey) (err error) {
+		err = check(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return
+		}
+
+		if len(keyErr.Want) != 0 {
+			err = fmt.Errorf(
+				"host key for %s doesn't match %s; it may have been changed, or someone "+
+					"may be intercepting the connection",
+				hostname,
+				path)
+			return
+		}
+
+		if *strictHostKeyChecking != "accept-new" {
+			err = fmt.Errorf(
+				"no host key for %s in %s; set --strict-host-key-checking=accept-new to record it",
+				hostname,
+				path)
+			return
+		}
+
+		err = appendKnownHost(path, hostname, key)
+		return
+	}
+
+	return
+}
+
+func appendKnownHost(path string, hostname string, key ssh.PublicKey) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return
+}
+
+// knownHostKeyAlgorithms returns the host key algorithms to ask the server
+// for, based on the types of key recorded for it. Otherwise the server may
+// present a key of a type we don't know about, which would fail verification
+// despite there being a perfectly good key on file. Returns nil if no keys are
+// recorded, meaning any algorithm.
+func knownHostKeyAlgorithms(cb ssh.HostKeyCallback, addr string) (algos []string) {
+	// Probe with a key that can't match anything, so that the callback tells
+	// us what it would have accepted.
+	var keyErr *knownhosts.KeyError
+	err := cb(addr, &net.TCPAddr{IP: net.IPv4zero}, placeholderKey{})
+	if !errors.As(err, &keyErr) {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, k := range keyErr.Want {
+		t := k.Key.Type()
+		if seen[t] {
+			continue
+		}
+
+		seen[t] = true
+		if t == ssh.KeyAlgoRSA {
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+
+		algos = append(algos, t)
+	}
+
+	return
+}
+
+// placeholderKey is a public key that matches no real key.
+type placeholderKey struct{}
+
+func (placeholderKey) Type() string                                 { return "placeholder" }
+func (placeholderKey) Marshal() []byte                              { return []byte("placeholder") }
+func (placeholderKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("placeholder") }
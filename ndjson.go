@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// With --format=ndjson, each sample is written as a JSON object on its own
+// line as soon as it is collected, as is each timeout as it happens,
+// interleaved with any annotations, and followed at the end of the run by a
+// summary in the form written by --format=json, with a type of "summary".
+type ndjsonSample struct {
+	Type   string    `json:"type"`
+	Host   string    `json:"host"`
+	Seq    int       `json:"seq"`
+	Time   time.Time `json:"time"`
+	Stream int       `json:"stream"`
+	RTTMs  float64   `json:"rtt_ms"`
+
+	// "ok", or "timeout" for an echo abandoned after --ping-timeout, whose
+	// rtt_ms is the timeout.
+	Status string `json:"status"`
+}
+
+// An annotation made with --annotate or --annotate-socket, written as it
+// arrives.
+type ndjsonAnnotation struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+type ndjsonWriter struct {
+	mu   sync.Mutex
+	enc  *json.Encoder
+	host string
+	seq  int
+	err  error
+}
+
+// newNDJSONWriter returns a writer for the samples of a run of the given
+// host, which each is labelled with so that runs of several can be told
+// apart.
+func newNDJSONWriter(w io.Writer, host string) *ndjsonWriter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &ndjsonWriter{enc: enc, host: host}
+}
+
+func (w *ndjsonWriter) encode(v interface{}) {
+	if w.err == nil {
+		w.err = w.enc.Encode(v)
+	}
+}
+
+// writeSample writes a line for a sample or timeout. It is safe to call
+// concurrently. Errors are reported by finish.
+func (w *ndjsonWriter) writeSample(s sample) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := "ok"
+	if s.timedOut {
+		status = "timeout"
+	}
+
+	w.seq++
+	w.encode(ndjsonSample{
+		Type:   "sample",
+		Host:   w.host,
+		Seq:    w.seq,
+		Time:   s.times.sent,
+		Stream: s.stream,
+		RTTMs:  millis(s.times.rtt()),
+		Status: status,
+	})
+}
+
+// writeAnnotation writes a line for an annotation. It is safe to call
+// concurrently.
+func (w *ndjsonWriter) writeAnnotation(e event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.encode(ndjsonAnnotation{Type: "annotation", Time: e.start, Text: e.reason})
+}
+
+// writeWindows writes a line for each window's statistics.
+func (w *ndjsonWriter) writeWindows(stats []windowStats) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, s := range stats {
+		s.Type = "window"
+		w.encode(s)
+	}
+}
+
+// finish writes the run's summary.
+func (w *ndjsonWriter) finish(target string, r run, results []thresholdResult) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	summary := newJSONReport(newSummaryReport(target, r, results))
+	summary.Type = "summary"
+	w.encode(summary)
+	err = w.err
+	return
+}
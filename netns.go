@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// netnsPath returns the path of the named network namespace. A name with no
+// slash is looked up where ip netns keeps them.
+func netnsPath(name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+
+	return filepath.Join("/var/run/netns", name)
+}
+
+// netnsDialer makes connections from within the network namespace set by
+// --netns.
+type netnsDialer struct {
+	*net.Dialer
+	ns string
+}
+
+func (d netnsDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d netnsDialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	nsErr := inNetns(d.ns, func() {
+		conn, err = d.Dialer.DialContext(ctx, network, addr)
+	})
+
+	if nsErr != nil {
+		err = nsErr
+	}
+
+	return
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whether --netns and --bind-device are supported here.
+const netnsSupported = true
+
+// inNetns calls f on a thread that has joined the named network namespace,
+// so that sockets f creates belong to it.
+func inNetns(name string, f func()) (err error) {
+	path := netnsPath(name)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// The thread is never returned to the original namespace, so it's
+		// never unlocked either, and exits along with this goroutine.
+		runtime.LockOSThread()
+
+		var fd int
+		fd, err = unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			err = fmt.Errorf("network namespace %s: %w", name, err)
+			return
+		}
+
+		defer unix.Close(fd)
+
+		if err = unix.Setns(fd, unix.CLONE_NEWNET); err != nil {
+			err = fmt.Errorf("joining network namespace %s: %w", name, err)
+			return
+		}
+
+		f()
+	}()
+
+	<-done
+	return
+}
+
+// bindToDevice returns a net.Dialer Control function that binds sockets to
+// the given network interface, which may be a VRF, with SO_BINDTODEVICE.
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) (err error) {
+		controlErr := c.Control(func(fd uintptr) {
+			err = unix.BindToDevice(int(fd), device)
+		})
+
+		if controlErr != nil {
+			err = controlErr
+		}
+
+		if err != nil {
+			err = fmt.Errorf("binding to device %s: %w", device, err)
+		}
+
+		return
+	}
+}
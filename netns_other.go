@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Whether --netns and --bind-device are supported here.
+const netnsSupported = false
+
+// inNetns isn't supported outside Linux.
+func inNetns(name string, f func()) error {
+	return errors.New("network namespaces are only supported on Linux")
+}
+
+// bindToDevice isn't supported outside Linux.
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("binding to a device is only supported on Linux")
+	}
+}
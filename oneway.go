@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The number of windows a run is split into when estimating clock skew. The
+// lowest-delay sample in each window is used as a reference point.
+const clockWindows = 10
+
+// clockModel estimates the remote clock's offset from the local clock as a
+// linear function of local time.
+type clockModel struct {
+	t0     time.Time
+	offset time.Duration
+
+	// Skew of the remote clock, as a fraction of elapsed time.
+	skew float64
+}
+
+// offsetAt returns the estimated remote clock offset at the given local time.
+func (m clockModel) offsetAt(t time.Time) time.Duration {
+	return m.offset + time.Duration(m.skew*float64(t.Sub(m.t0)))
+}
+
+// ntpOffset returns the NTP-style clock offset estimate for one ping, which
+// is exact if the outbound and return trips took equal time.
+func ntpOffset(t pingTimes) time.Duration {
+	return (t.remoteReceived.Sub(t.sent) + t.remoteSent.Sub(t.received)) / 2
+}
+
+// networkDelay returns the time the ping spent in the network, excluding
+// time spent in the remote agent.
+func networkDelay(t pingTimes) time.Duration {
+	return t.rtt() - t.remoteSent.Sub(t.remoteReceived)
+}
+
+// estimateClock fits a clock model to the samples. As with NTP, the offset is
+// taken from the samples with the lowest network delay, since these are the
+// ones least likely to have been queued in one direction only. The run is
+// split into windows, and a line is fitted through the best sample of each to
+// account for skew. It fails if there are no samples.
+func estimateClock(times []pingTimes) (m clockModel, err error) {
+	if len(times) == 0 {
+		err = errors.New("no samples with remote timestamps")
+		return
+	}
+
+	m.t0 = times[0].sent
+
+	windows := clockWindows
+	if len(times) < windows {
+		windows = len(times)
+	}
+
+	var xs, ys []float64
+	for w := 0; w < windows; w++ {
+		window := times[w*len(times)/windows : (w+1)*len(times)/windows]
+		best := window[0]
+		for _, t := range window[1:] {
+			if networkDelay(t) < networkDelay(best) {
+				best = t
+			}
+		}
+
+		xs = append(xs, float64(best.sent.Sub(m.t0)))
+		ys = append(ys, float64(ntpOffset(best)))
+	}
+
+	// Least squares fit of offset against time.
+	var meanX, meanY float64
+	for i := range xs {
+		meanX += xs[i]
+		meanY += ys[i]
+	}
+
+	meanX /= float64(len(xs))
+	meanY /= float64(len(ys))
+
+	var cov, varX float64
+	for i := range xs {
+		cov += (xs[i] - meanX) * (ys[i] - meanY)
+		varX += (xs[i] - meanX) * (xs[i] - meanX)
+	}
+
+	if varX > 0 {
+		m.skew = cov / varX
+	}
+
+	m.offset = time.Duration(meanY - m.skew*meanX)
+	return
+}
+
+// printOneWayDelays prints the estimated delays of the pings' outbound and
+// return trips, labelled as given, after correcting for the remote clock's
+// offset and skew.
+func printOneWayDelays(times []pingTimes, outLabel, backLabel string) {
+	m, err := estimateClock(times)
+	if err != nil {
+		fmt.Printf("One-way delays: %v.\n", err)
+		return
+	}
+
+	up := make([]time.Duration, 0, len(times))
+	down := make([]time.Duration, 0, len(times))
+	for _, t := range times {
+		up = append(up, t.remoteReceived.Sub(t.sent)-m.offsetAt(t.sent))
+		down = append(down, t.received.Sub(t.remoteSent)+m.offsetAt(t.received))
+	}
+
+	fmt.Printf(
+		"Clock offset: %s (skew %+.1f ppm)\n",
+		m.offset.Round(time.Microsecond),
+		m.skew*1e6)
+
+	fmt.Printf("\n")
+	fmt.Printf("%-8s %10s %10s\n", "", outLabel, backLabel)
+	for _, p := range []float64{5, 50, 95} {
+		fmt.Printf(
+			"p%02.0f:     %10s %10s\n",
+			p,
+			formatLatency(percentile(p, up)),
+			formatLatency(percentile(p, down)))
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("One-way delays assume the fastest pings took equally long in each direction.\n")
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The upper bounds, in milliseconds, of the buckets of the latency histogram
+// exported over OTLP. The last bucket is unbounded.
+var otlpBucketBounds = []float64{0.5, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+// How many spans to send per OTLP request.
+const otlpSpanBatch = 1000
+
+// The structures below are the OTLP/HTTP JSON encoding of the parts of the
+// OpenTelemetry protocol that we use. 64-bit integers are encoded as strings,
+// and trace and span IDs as hex, as the encoding requires.
+
+type otlpKeyValue struct {
+	Key   string        `json:"key"`
+	Value otlpAnyString `json:"value"`
+}
+
+type otlpAnyString struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Unit        string        `json:"unit"`
+	Histogram   otlpHistogram `json:"histogram"`
+}
+
+type otlpHistogram struct {
+	DataPoints []otlpHistogramDataPoint `json:"dataPoints"`
+
+	// 2 means cumulative: each point reports every sample since its start
+	// time.
+	AggregationTemporality int `json:"aggregationTemporality"`
+}
+
+const otlpCumulative = 2
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	Min               float64        `json:"min"`
+	Max               float64        `json:"max"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+// OTLP span kind for a client.
+const otlpSpanKindClient = 3
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func otlpResourceFor(target string) otlpResource {
+	return otlpResource{Attributes: []otlpKeyValue{
+		{"service.name", otlpAnyString{"ssh_ping"}},
+		{"server.address", otlpAnyString{target}},
+	}}
+}
+
+// exportOTLP sends the run's latency histogram to the OTLP/HTTP endpoint set
+// by --otlp-endpoint and, with --otlp-traces, a trace with a span for each
+// connection's setup, with a child for each of its phases, and for each ping.
+func exportOTLP(ctx context.Context, target string, started time.Time, r run) (err error) {
+	if err = exportOTLPMetrics(ctx, target, started, r); err != nil {
+		return
+	}
+
+	if *otlpTraces {
+		err = exportOTLPTraces(ctx, target, started, r)
+	}
+
+	return
+}
+
+// An otlpSeries is the running total of the samples exported for a target,
+// from which each run's cumulative data point is made. Runs with --schedule
+// add to the same series; a new process starts a new one, which consumers
+// see as a reset, from its start time.
+type otlpSeries struct {
+	start    time.Time
+	counts   []int64
+	count    int
+	sum      float64
+	min, max time.Duration
+}
+
+var (
+	otlpSeriesMu       sync.Mutex
+	otlpSeriesByTarget = make(map[string]*otlpSeries)
+)
+
+// add adds the run's samples to the series, returning a copy of its new
+// totals.
+func (s *otlpSeries) add(started time.Time, r run) otlpSeries {
+	addCount := func(v time.Duration, n int64) {
+		i := 0
+		for i < len(otlpBucketBounds) && millis(v) > otlpBucketBounds[i] {
+			i++
+		}
+
+		s.counts[i] += n
+	}
+
+	if s.counts == nil {
+		s.start = started
+		s.counts = make([]int64, len(otlpBucketBounds)+1)
+	}
+
+	if r.hist != nil {
+		for i, c := range r.hist.counts {
+			if c != 0 {
+				addCount(histogramValue(i), int64(c))
+			}
+		}
+	} else {
+		for _, rtt := range r.samples {
+			addCount(rtt, 1)
+		}
+	}
+
+	d := r.distribution()
+	if s.count == 0 || d.min() < s.min {
+		s.min = d.min()
+	}
+
+	if s.count == 0 || d.max() > s.max {
+		s.max = d.max()
+	}
+
+	s.count += d.count()
+	s.sum += millis(d.mean()) * float64(d.count())
+
+	totals := *s
+	totals.counts = slices.Clone(s.counts)
+	return totals
+}
+
+func exportOTLPMetrics(ctx context.Context, target string, started time.Time, r run) (err error) {
+	otlpSeriesMu.Lock()
+	series := otlpSeriesByTarget[target]
+	if series == nil {
+		series = &otlpSeries{}
+		otlpSeriesByTarget[target] = series
+	}
+
+	totals := series.add(started, r)
+	otlpSeriesMu.Unlock()
+
+	var bucketCounts []string
+	for _, c := range totals.counts {
+		bucketCounts = append(bucketCounts, strconv.FormatInt(c, 10))
+	}
+
+	req := otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResourceFor(target),
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope: otlpScope{Name: "ssh_ping"},
+			Metrics: []otlpMetric{{
+				Name:        "ssh_ping.rtt",
+				Description: "Round trip time of pings echoed over SSH.",
+				Unit:        "ms",
+				Histogram: otlpHistogram{
+					AggregationTemporality: otlpCumulative,
+					DataPoints: []otlpHistogramDataPoint{{
+						Attributes: []otlpKeyValue{
+							{"server.address", otlpAnyString{target}},
+							{"ssh_ping.transport", otlpAnyString{*transportKind}},
+						},
+						StartTimeUnixNano: otlpTime(totals.start),
+						TimeUnixNano:      otlpTime(time.Now()),
+						Count:             strconv.Itoa(totals.count),
+						Sum:               totals.sum,
+						Min:               millis(totals.min),
+						Max:               millis(totals.max),
+						BucketCounts:      bucketCounts,
+						ExplicitBounds:    otlpBucketBounds,
+					}},
+				},
+			}},
+		}},
+	}}}
+
+	err = postOTLP(ctx, "/v1/metrics", req)
+	return
+}
+
+func exportOTLPTraces(ctx context.Context, target string, started time.Time, r run) (err error) {
+	traceID := otlpID(16)
+	root := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            otlpID(8),
+		Name:              "ssh_ping",
+		Kind:              otlpSpanKindClient,
+		StartTimeUnixNano: otlpTime(started),
+		EndTimeUnixNano:   otlpTime(time.Now()),
+		Attributes:        []otlpKeyValue{{"server.address", otlpAnyString{target}}},
+	}
+
+	spans := []otlpSpan{root}
+	child := func(parent otlpSpan, name string, start, end time.Time) otlpSpan {
+		return otlpSpan{
+			TraceID:           traceID,
+			SpanID:            otlpID(8),
+			ParentSpanID:      parent.SpanID,
+			Name:              name,
+			Kind:              otlpSpanKindClient,
+			StartTimeUnixNano: otlpTime(start),
+			EndTimeUnixNano:   otlpTime(end),
+		}
+	}
+
+	for i, d := range r.setup {
+		connect := child(root, "connect", r.setupStarted[i], r.setupStarted[i].Add(d))
+		spans = append(spans, connect)
+		for _, p := range r.setupPhases[i] {
+			spans = append(spans, child(connect, p.name, p.start, p.end))
+		}
+	}
+
+	for i, rtt := range r.samples {
+		spans = append(spans, child(root, "ping", r.sent[i], r.sent[i].Add(rtt)))
+	}
+
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > otlpSpanBatch {
+			n = otlpSpanBatch
+		}
+
+		req := otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResourceFor(target),
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "ssh_ping"},
+				Spans: spans[:n],
+			}},
+		}}}
+
+		if err = postOTLP(ctx, "/v1/traces", req); err != nil {
+			return
+		}
+
+		spans = spans[n:]
+	}
+
+	return
+}
+
+// postOTLP sends a request to the given path under --otlp-endpoint, with any
+// headers listed in OTEL_EXPORTER_OTLP_HEADERS (e.g. for authentication).
+func postOTLP(ctx context.Context, path string, body interface{}) (err error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+
+	url := strings.TrimSuffix(*otlpEndpoint, "/") + path
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if k, v, ok := strings.Cut(h, "="); ok {
+			req.Header.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+		}
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+		return
+	}
+
+	return
+}
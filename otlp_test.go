@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// otlpRecorder is an OTLP/HTTP endpoint that keeps what it receives.
+type otlpRecorder struct {
+	metrics []otlpMetricsRequest
+	traces  []otlpTracesRequest
+}
+
+func (o *otlpRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var err error
+	switch req.URL.Path {
+	case "/v1/metrics":
+		var m otlpMetricsRequest
+		err = json.NewDecoder(req.Body).Decode(&m)
+		o.metrics = append(o.metrics, m)
+	case "/v1/traces":
+		var t otlpTracesRequest
+		err = json.NewDecoder(req.Body).Decode(&t)
+		o.traces = append(o.traces, t)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func TestOTLPSetupPhases(t *testing.T) {
+	o := &otlpRecorder{}
+	srv := httptest.NewServer(o)
+	defer srv.Close()
+
+	setFlags(t, map[string]string{"simulate": "constant(1ms)", "otlp-endpoint": srv.URL, "otlp-traces": "true"})
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	r := run{
+		setup:        []time.Duration{40 * time.Millisecond},
+		setupStarted: []time.Time{start},
+		setupPhases: [][]setupPhase{{
+			{"tcp connect", at(0), at(10)},
+			{"key exchange", at(10), at(25)},
+			{"authentication", at(25), at(30)},
+			{"channel open", at(30), at(35)},
+			{"first echo", at(35), at(40)},
+		}},
+	}
+
+	r.add(at(50), time.Millisecond)
+	if err := exportOTLPTraces(context.Background(), "bastion", start, r); err != nil {
+		t.Fatalf("exportOTLPTraces: %v", err)
+	}
+
+	if len(o.traces) != 1 {
+		t.Fatalf("got %d trace requests; want 1", len(o.traces))
+	}
+
+	parents := make(map[string]string)
+	ids := make(map[string]string)
+	for _, s := range o.traces[0].ResourceSpans[0].ScopeSpans[0].Spans {
+		parents[s.Name] = s.ParentSpanID
+		ids[s.Name] = s.SpanID
+	}
+
+	for _, name := range []string{"tcp connect", "key exchange", "authentication", "channel open", "first echo"} {
+		if parents[name] == "" || parents[name] != ids["connect"] {
+			t.Errorf("span %q has parent %q; want the connect span, %q", name, parents[name], ids["connect"])
+		}
+	}
+
+	if parents["connect"] != ids["ssh_ping"] || parents["ping"] != ids["ssh_ping"] {
+		t.Errorf("connect and ping spans should be children of the root span")
+	}
+}
+
+func TestOTLPCumulative(t *testing.T) {
+	o := &otlpRecorder{}
+	srv := httptest.NewServer(o)
+	defer srv.Close()
+
+	setFlags(t, map[string]string{"simulate": "constant(1ms)", "otlp-endpoint": srv.URL})
+
+	first := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, rtt := range []time.Duration{3 * time.Millisecond, 30 * time.Millisecond} {
+		var r run
+		started := first.Add(time.Duration(i) * time.Minute)
+		for j := 0; j < 10; j++ {
+			r.add(started, rtt)
+		}
+
+		if err := exportOTLPMetrics(context.Background(), "cumulative.example.com", started, r); err != nil {
+			t.Fatalf("exportOTLPMetrics: %v", err)
+		}
+	}
+
+	if len(o.metrics) != 2 {
+		t.Fatalf("got %d metric requests; want 2", len(o.metrics))
+	}
+
+	h := o.metrics[1].ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Histogram
+	p := h.DataPoints[0]
+	if h.AggregationTemporality != otlpCumulative {
+		t.Errorf("temporality = %d; want cumulative", h.AggregationTemporality)
+	}
+
+	if p.Count != "20" || math.Abs(p.Sum-330) > 1e-3 || p.Min != 3 || p.Max != 30 {
+		t.Errorf("second point has count %s, sum %v, min %v, max %v; want both runs' 20 samples", p.Count, p.Sum, p.Min, p.Max)
+	}
+
+	if want := otlpTime(first); p.StartTimeUnixNano != want {
+		t.Errorf("second point starts at %s; want the first run's start, %s", p.StartTimeUnixNano, want)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// readHosts reads a list of hosts from a file, one per line. Blank lines and
+// lines starting with '#' are ignored.
+func readHosts(path string) (hosts []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hosts = append(hosts, line)
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// runPick implements the pick subcommand, which briefly measures each of a
+// list of hosts and prints only the one with the lowest value of the chosen
+// metric, so that it can be used in command substitution.
+func runPick(ctx context.Context, args []string) {
+	fs := newSubcommandFlagSet("pick", connectionFlags, pingFlags)
+	hostsFile := fs.String("hosts-file", "", "File listing candidate hosts, one per line.")
+	criteria := fs.String("criteria", "p95", "Metric to choose by: min, max, mean, stddev, or a percentile like p95.")
+	perHost := fs.Duration("per-host", 2*time.Second, "How long to measure each host for.")
+	sshConfig := fs.String(
+		"ssh-config",
+		"",
+		"If set, print an ssh_config snippet instead of the best host: a Host block with this "+
+			"pattern that uses the best host as its ProxyJump, preceded by the measured hosts in "+
+			"order of latency.")
+	fs.Parse(args)
+
+	if *hostsFile == "" {
+		fmt.Fprintf(os.Stderr, "Must set --hosts-file.\n")
+		os.Exit(1)
+	}
+
+	if !validMetric(*criteria) {
+		fmt.Fprintf(os.Stderr, "Unknown --criteria %q.\n", *criteria)
+		os.Exit(1)
+	}
+
+	hosts, err := readHosts(*hostsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(hosts) == 0 {
+		log.Fatalf("No hosts in %s", *hostsFile)
+	}
+
+	// The chosen host is the only thing on stdout.
+	progressOutput = os.Stderr
+	*duration = *perHost
+	*host = hosts[0]
+	checkFlags()
+
+	var measured []pickResult
+	for _, h := range hosts {
+		r, err := measure(ctx, transportOptions{host: h})
+		if err != nil {
+			log.Printf("%s: %v", h, err)
+			continue
+		}
+
+		v := metricValue(*criteria, r.distribution())
+		log.Printf("%s: %s %s", h, *criteria, formatLatency(v))
+		measured = append(measured, pickResult{h, v})
+	}
+
+	if len(measured) == 0 {
+		log.Fatal("No hosts were reachable.")
+	}
+
+	sort.SliceStable(measured, func(i, j int) bool {
+		return measured[i].value < measured[j].value
+	})
+
+	if *sshConfig != "" {
+		writeSSHConfig(os.Stdout, *sshConfig, *criteria, measured)
+		return
+	}
+
+	fmt.Println(measured[0].host)
+}
+
+// A pickResult is the chosen metric measured for one candidate host.
+type pickResult struct {
+	host  string
+	value time.Duration
+}
+
+// writeSSHConfig writes an ssh_config snippet that reaches hosts matching
+// pattern via the first of the supplied hosts, which must be ordered by
+// latency. The measurements are recorded in comments.
+func writeSSHConfig(w io.Writer, pattern string, criteria string, measured []pickResult) {
+	fmt.Fprintf(w, "# Generated by ssh_ping pick. Candidates by %s:\n", criteria)
+	for _, m := range measured {
+		fmt.Fprintf(w, "#   %-32s %s\n", m.host, formatLatency(m.value))
+	}
+
+	fmt.Fprintf(w, "Host %s\n", pattern)
+	fmt.Fprintf(w, "    ProxyJump %s\n", measured[0].host)
+}
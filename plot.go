@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	plotWidth  = 800
+	plotHeight = 400
+
+	// Space around the plot area for axis labels.
+	plotMarginLeft   = 60
+	plotMarginRight  = 20
+	plotMarginTop    = 20
+	plotMarginBottom = 40
+
+	// How many buckets to divide the run into for percentile bands.
+	plotBuckets = 60
+
+	// The most samples to draw individually; beyond this, evenly spaced
+	// samples are drawn so that the file stays a reasonable size.
+	plotMaxPoints = 5000
+)
+
+// writePlot writes an SVG chart of the run's samples over time to the given
+// file, with bands showing the p05–p95 range and a line showing p50.
+func writePlot(path string, r run) (err error) {
+	if len(r.samples) == 0 {
+		err = fmt.Errorf("no samples to plot")
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	writeSVGPlot(w, r)
+	err = w.Flush()
+	return
+}
+
+func writeSVGPlot(w io.Writer, r run) {
+	t0 := r.sent[0]
+	span := r.sent[len(r.sent)-1].Sub(t0)
+	if span <= 0 {
+		span = time.Second
+	}
+
+	yMax := niceCeiling(max(r.samples))
+
+	plotW := float64(plotWidth - plotMarginLeft - plotMarginRight)
+	plotH := float64(plotHeight - plotMarginTop - plotMarginBottom)
+	x := func(t time.Time) float64 {
+		return plotMarginLeft + plotW*float64(t.Sub(t0))/float64(span)
+	}
+
+	y := func(d time.Duration) float64 {
+		return plotMarginTop + plotH*(1-float64(d)/float64(yMax))
+	}
+
+	fmt.Fprintf(
+		w,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="11">`+"\n",
+		plotWidth,
+		plotHeight)
+	fmt.Fprintf(w, `<rect width="100%%" height="100%%" fill="white"/>`+"\n")
+
+	// Axes and gridlines.
+	for i := 0; i <= 5; i++ {
+		d := yMax * time.Duration(i) / 5
+		fmt.Fprintf(
+			w,
+			`<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/>`+"\n",
+			plotMarginLeft,
+			y(d),
+			plotWidth-plotMarginRight,
+			y(d))
+		fmt.Fprintf(
+			w,
+			`<text x="%d" y="%.1f" text-anchor="end" dominant-baseline="middle">%s</text>`+"\n",
+			plotMarginLeft-5,
+			y(d),
+			strings.TrimSpace(formatLatency(d)))
+	}
+
+	for i := 0; i <= 5; i++ {
+		t := t0.Add(span * time.Duration(i) / 5)
+		fmt.Fprintf(
+			w,
+			`<text x="%.1f" y="%d" text-anchor="middle">%v</text>`+"\n",
+			x(t),
+			plotHeight-plotMarginBottom+15,
+			t.Sub(t0).Round(100*time.Millisecond))
+	}
+
+	fmt.Fprintf(
+		w,
+		`<text x="%.1f" y="%d" text-anchor="middle">Elapsed (started %s)</text>`+"\n",
+		plotMarginLeft+plotW/2,
+		plotHeight-5,
+		t0.Format("2006-01-02 15:04:05"))
+
+	// Percentile bands.
+	width := span / plotBuckets
+	if width <= 0 {
+		width = time.Millisecond
+	}
+
+	var upper, lower, middle []string
+	for _, b := range splitBuckets(r, width) {
+		if len(b.samples) == 0 {
+			continue
+		}
+
+		mid := x(b.start.Add(width / 2))
+		upper = append(upper, fmt.Sprintf("%.1f,%.1f", mid, y(percentile(95, b.samples))))
+		lower = append([]string{fmt.Sprintf("%.1f,%.1f", mid, y(percentile(5, b.samples)))}, lower...)
+		middle = append(middle, fmt.Sprintf("%.1f,%.1f", mid, y(median(b.samples))))
+	}
+
+	fmt.Fprintf(
+		w,
+		`<polygon points="%s" fill="#9ecae1" fill-opacity="0.5"/>`+"\n",
+		strings.Join(append(upper, lower...), " "))
+
+	// Samples.
+	stride := (len(r.samples) + plotMaxPoints - 1) / plotMaxPoints
+	for i := 0; i < len(r.samples); i += stride {
+		fmt.Fprintf(
+			w,
+			`<circle cx="%.1f" cy="%.1f" r="1.2" fill="#555"/>`+"\n",
+			x(r.sent[i]),
+			y(r.samples[i]))
+	}
+
+	fmt.Fprintf(
+		w,
+		`<polyline points="%s" fill="none" stroke="#08519c" stroke-width="2"/>`+"\n",
+		strings.Join(middle, " "))
+
+	// Annotations, as labelled vertical lines.
+	for _, e := range r.events {
+		if e.kind != "note" || e.start.Before(t0) || e.start.After(t0.Add(span)) {
+			continue
+		}
+
+		fmt.Fprintf(
+			w,
+			`<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#d95f02" stroke-dasharray="4,3"/>`+"\n",
+			x(e.start),
+			plotMarginTop,
+			x(e.start),
+			plotHeight-plotMarginBottom)
+		fmt.Fprintf(
+			w,
+			`<text x="%.1f" y="%d" fill="#d95f02" transform="rotate(-90 %.1f %d)" text-anchor="end">%s</text>`+"\n",
+			x(e.start)-3,
+			plotMarginTop+4,
+			x(e.start)-3,
+			plotMarginTop+4,
+			html.EscapeString(e.reason))
+	}
+
+	// Legend.
+	fmt.Fprintf(
+		w,
+		`<text x="%d" y="%d">Shaded: p05–p95. Line: p50. Dots: samples.</text>`+"\n",
+		plotMarginLeft+5,
+		plotMarginTop+12)
+
+	fmt.Fprintf(w, "</svg>\n")
+}
+
+// niceCeiling rounds d up to 1, 2, or 5 times a power of ten milliseconds, for
+// use as the top of an axis.
+func niceCeiling(d time.Duration) time.Duration {
+	ms := float64(d) / float64(time.Millisecond)
+	if ms <= 0 {
+		return time.Millisecond
+	}
+
+	scale := math.Pow(10, math.Floor(math.Log10(ms)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if ms <= m*scale {
+			return time.Duration(m * scale * float64(time.Millisecond))
+		}
+	}
+
+	return d
+}
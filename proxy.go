@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy using the
+// CONNECT method.
+type httpConnectDialer struct {
+	proxyURL *url.URL
+	forward  proxy.Dialer
+}
+
+func newHTTPConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	return &httpConnectDialer{proxyURL: u, forward: forward}, nil
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
+	if cd, ok := d.forward.(proxy.ContextDialer); ok {
+		c, err = cd.DialContext(ctx, network, d.proxyURL.Host)
+	} else {
+		c, err = d.forward.Dial(network, d.proxyURL.Host)
+	}
+
+	if err != nil {
+		return
+	}
+
+	// Abort the CONNECT exchange if the context is cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if u := d.proxyURL.User; u != nil {
+		password, _ := u.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err = req.Write(c); err != nil {
+		c.Close()
+		return
+	}
+
+	// Read only the response header, leaving anything after it (e.g. the SSH
+	// banner) in the connection. bufio.Reader reads ahead, so feed it a byte at
+	// a time.
+	resp, err := http.ReadResponse(bufio.NewReader(byteReader{c}), req)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		err = fmt.Errorf("proxy CONNECT to %s: %s", addr, resp.Status)
+		return
+	}
+
+	if err = ctx.Err(); err != nil {
+		c.Close()
+		return
+	}
+
+	return
+}
+
+// byteReader reads from a connection at most one byte at a time.
+type byteReader struct {
+	c net.Conn
+}
+
+func (r byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+
+	return r.c.Read(p)
+}
+
+// directDialer makes connections without a proxy: a *net.Dialer, or a
+// netnsDialer.
+type directDialer interface {
+	proxy.Dialer
+	proxy.ContextDialer
+}
+
+// proxyDialer returns a dialer for the supplied proxy URL, e.g.
+// socks5://host:1080 or http://host:3128, that connects to the proxy with
+// direct. If the URL is empty, it returns direct itself.
+func proxyDialer(proxyURL string, direct directDialer) (d proxy.ContextDialer, err error) {
+	if proxyURL == "" {
+		d = direct
+		return
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return
+	}
+
+	pd, err := proxy.FromURL(u, direct)
+	if err != nil {
+		return
+	}
+
+	d, ok := pd.(proxy.ContextDialer)
+	if !ok {
+		err = fmt.Errorf("proxy %s doesn't support cancellation", proxyURL)
+	}
+
+	return
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Printed by the remote shell once the pseudo-terminal is set up, so that we
+// know pings sent from then on won't be mangled.
+const ptyReady = "ssh_ping ready"
+
+// The longest line a Linux terminal passes on whole in canonical mode. Each
+// ping is a line, so pings can't be longer.
+const ptyMaxLine = 4095
+
+// ptyCommand wraps a command to be run on a pseudo-terminal. The terminal
+// would otherwise echo pings itself on top of the command's echo, and turn
+// the newline ending each into CRLF. Unless raw is set, its line discipline
+// is otherwise left as it would be for an interactive session, so input
+// still reaches the command a line at a time. In raw mode, as full-screen
+// programs like editors use, it arrives a byte at a time.
+func ptyCommand(command string, raw bool) string {
+	modes := "-echo -opost"
+	if raw {
+		modes = "raw -echo"
+	}
+
+	return fmt.Sprintf("stty %s && printf '%s' && %s", modes, ptyReady, command)
+}
+
+// awaitPTYReady reads what the remote shell prints before running the
+// command given to ptyCommand, closing the stream if it isn't as expected.
+func awaitPTYReady(s stream) (err error) {
+	buf := make([]byte, len(ptyReady))
+	if _, err = io.ReadFull(s, buf); err == nil && string(buf) != ptyReady {
+		err = fmt.Errorf("setting up the terminal: got %q", buf)
+	}
+
+	if err != nil {
+		s.Close()
+	}
+
+	return
+}
+
+// ptyStream is a stream running on a pseudo-terminal.
+type ptyStream struct {
+	stream
+}
+
+// CloseWrite sends an end-of-file character, since closing the session's
+// input doesn't reach a command reading from a terminal.
+func (s ptyStream) CloseWrite() error {
+	s.stream.Write([]byte{0x04})
+	return s.stream.CloseWrite()
+}
+
+func (s ptyStream) Close() error {
+	s.CloseWrite()
+	return s.stream.Close()
+}
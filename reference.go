@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A sampleFile has samples written to it as they are collected, one per line
+// in the format accepted by time.ParseDuration, so that they survive an
+// interrupted run.
+type sampleFile struct {
+	mu  sync.Mutex
+	f   *os.File
+	err error
+}
+
+func createSampleFile(path string) (sf *sampleFile, err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+
+	sf = &sampleFile{f: f}
+	return
+}
+
+// write appends a sample to the file. It is safe to call concurrently. Errors
+// are reported by Close.
+func (sf *sampleFile) write(d time.Duration) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if sf.err == nil {
+		_, sf.err = fmt.Fprintln(sf.f, d)
+	}
+}
+
+func (sf *sampleFile) Close() (err error) {
+	err = sf.f.Close()
+	if sf.err != nil {
+		err = sf.err
+	}
+
+	return
+}
+
+// readSamples reads samples written to a sampleFile. Blank lines and lines
+// starting with '#' are ignored.
+func readSamples(path string) (samples []time.Duration, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var d time.Duration
+		d, err = time.ParseDuration(line)
+		if err != nil {
+			err = fmt.Errorf("%s:%d: %w", path, lineNum, err)
+			return
+		}
+
+		samples = append(samples, d)
+	}
+
+	err = scanner.Err()
+	if err == nil && len(samples) == 0 {
+		err = fmt.Errorf("%s: no samples", path)
+	}
+
+	return
+}
+
+// cdf returns the fraction of the sorted samples that are at most x.
+func cdf(sorted []time.Duration, x time.Duration) float64 {
+	n := sort.Search(len(sorted), func(i int) bool { return sorted[i] > x })
+	return float64(n) / float64(len(sorted))
+}
+
+// maxCDFDivergence returns the Kolmogorov–Smirnov statistic for the two
+// samples, i.e. the largest vertical distance between their empirical CDFs,
+// along with the latency at which it occurs. A positive distance means the
+// reference has more mass below that latency than the current run.
+func maxCDFDivergence(reference, current []time.Duration) (dist float64, at time.Duration) {
+	a := append([]time.Duration(nil), reference...)
+	b := append([]time.Duration(nil), current...)
+	sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+
+	for _, s := range [][]time.Duration{a, b} {
+		for _, x := range s {
+			d := cdf(a, x) - cdf(b, x)
+			if abs(d) > abs(dist) {
+				dist = d
+				at = x
+			}
+		}
+	}
+
+	return
+}
+
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
+
+// printReferenceComparison prints a comparison of the current run's samples
+// against a reference distribution, showing how far apart they are at a few
+// percentiles and where their CDFs diverge the most.
+func printReferenceComparison(reference, current []time.Duration) {
+	fmt.Printf("Compared to reference (%d samples):\n", len(reference))
+	fmt.Printf("\n")
+	fmt.Printf("%-8s %10s %10s %10s\n", "", "Reference", "Current", "Delta")
+	for _, p := range []float64{5, 25, 50, 75, 95, 99} {
+		r := percentile(p, reference)
+		c := percentile(p, current)
+		fmt.Printf(
+			"p%02.0f:     %10s %10s %10s\n",
+			p,
+			formatLatency(r),
+			formatLatency(c),
+			formatDelta(c-r))
+	}
+
+	fmt.Printf("\n")
+
+	dist, at := maxCDFDivergence(reference, current)
+	sorted := append([]time.Duration(nil), current...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	fmt.Printf(
+		"Max CDF divergence: %.1f%% at %s\n",
+		100*abs(dist),
+		strings.TrimSpace(formatLatency(at)))
+
+	fmt.Printf(
+		"Current samples above reference p95: %.1f%%\n",
+		100*(1-cdf(sorted, percentile(95, reference))))
+}
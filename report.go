@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A level says how a statistic in a summary report fared: against the
+// --threshold limiting it if there is one, and otherwise against --levels.
+type level int
+
+const (
+	levelNone level = iota
+	levelGood
+	levelWarn
+	levelBad
+)
+
+func (l level) String() string {
+	switch l {
+	case levelGood:
+		return "good"
+	case levelWarn:
+		return "warn"
+	case levelBad:
+		return "bad"
+	}
+
+	return ""
+}
+
+// The latencies, set by --levels, below which a statistic is good, and below
+// which it's only a warning.
+var (
+	warnLevel = 100 * time.Millisecond
+	badLevel  = 250 * time.Millisecond
+)
+
+// parseLevels parses --levels, like "100ms,250ms".
+func parseLevels(s string) (warn, bad time.Duration, err error) {
+	w, b, ok := strings.Cut(s, ",")
+	if !ok {
+		err = fmt.Errorf("%q should look like 100ms,250ms", s)
+		return
+	}
+
+	if warn, err = time.ParseDuration(strings.TrimSpace(w)); err != nil {
+		return
+	}
+
+	if bad, err = time.ParseDuration(strings.TrimSpace(b)); err != nil {
+		return
+	}
+
+	if warn <= 0 || bad <= warn {
+		err = fmt.Errorf("%q should be two increasing positive latencies", s)
+		return
+	}
+
+	return
+}
+
+// A reportStat is a row of a summary report.
+type reportStat struct {
+	// The metric, as named in a --threshold, and how to label it.
+	metric string
+	label  string
+
+	value time.Duration
+	level level
+}
+
+// A summaryReport is the model of a run's summary shared by the renderers
+// selected by --format, and by --bundle.
+type summaryReport struct {
+	target      string
+	samples     int
+	synthesized int
+	timeouts    int
+	retries     int
+
+	stats []reportStat
+
+	// The thresholds checked, and the run's metadata if it was recorded.
+	thresholds []thresholdResult
+	meta       *runMetadata
+}
+
+// newSummaryReport builds the summary report for a run, leveling each
+// statistic against the thresholds checked.
+func newSummaryReport(target string, r run, results []thresholdResult) (rep summaryReport) {
+	d := r.distribution()
+	rep = summaryReport{
+		target:      target,
+		samples:     d.count(),
+		synthesized: r.synthesized,
+		timeouts:    r.timeouts(),
+		retries:     r.retried.total(),
+		thresholds:  results,
+	}
+
+	if !r.meta.Started.IsZero() {
+		m := r.meta
+		rep.meta = &m
+	}
+
+	rows := []struct{ metric, label string }{
+		{"min", "Min"},
+		{"p05", "p05"},
+		{"p50", "p50"},
+		{"p95", "p95"},
+		{"p99", "p99"},
+		{"max", "Max"},
+		{"mean", "Mean"},
+		{"stddev", "Std. dev."},
+	}
+
+	for _, row := range rows {
+		v := metricValue(row.metric, d)
+		rep.stats = append(rep.stats, reportStat{
+			metric: row.metric,
+			label:  row.label,
+			value:  v,
+			level:  statLevel(row.metric, v, results),
+		})
+	}
+
+	return
+}
+
+// statLevel levels an echo round trip statistic against the worst verdict of
+// any thresholds on it, or failing that against --levels. The standard
+// deviation isn't a latency, so --levels doesn't apply to it.
+func statLevel(metric string, v time.Duration, results []thresholdResult) (l level) {
+	for _, res := range results {
+		if res.threshold.phase != "" || !sameMetric(res.threshold.metric, metric) {
+			continue
+		}
+
+		verdict := levelGood
+		switch {
+		case !res.passed():
+			verdict = levelBad
+		case float64(res.value) >= annotationWarnFraction*float64(res.threshold.limit):
+			verdict = levelWarn
+		}
+
+		if verdict > l {
+			l = verdict
+		}
+	}
+
+	if l != levelNone || metric == "stddev" {
+		return
+	}
+
+	switch {
+	case v < warnLevel:
+		l = levelGood
+	case v < badLevel:
+		l = levelWarn
+	default:
+		l = levelBad
+	}
+
+	return
+}
+
+// sameMetric reports whether two metric names accepted by validMetric name
+// the same statistic, e.g. p5 and p05.
+func sameMetric(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	if !strings.HasPrefix(a, "p") || !strings.HasPrefix(b, "p") {
+		return false
+	}
+
+	pa, errA := strconv.ParseFloat(a[1:], 64)
+	pb, errB := strconv.ParseFloat(b[1:], 64)
+	return errA == nil && errB == nil && pa == pb
+}
+
+// A reportRenderer writes a summary report in some format.
+type reportRenderer interface {
+	render(w io.Writer, rep summaryReport) error
+}
+
+// newReportRenderer returns the renderer for --format, coloring text output
+// if useColor says to.
+func newReportRenderer() reportRenderer {
+	switch *format {
+	case "json":
+		return jsonRenderer{}
+	case "csv":
+		return csvRenderer{}
+	}
+
+	return textRenderer{color: useColor()}
+}
+
+// useColor reports whether to color text output: when standard output is a
+// terminal, unless --no-color or the NO_COLOR convention say not to.
+func useColor() bool {
+	if *noColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// textRenderer writes the statistics as an aligned table, with ANSI colors
+// for their levels if color is set.
+type textRenderer struct {
+	color bool
+}
+
+// The ANSI escape sequences used for each level by textRenderer.
+var levelColors = map[level]string{
+	levelGood: "\x1b[32m",
+	levelWarn: "\x1b[33m",
+	levelBad:  "\x1b[1;31m",
+}
+
+const colorReset = "\x1b[0m"
+
+func (tr textRenderer) render(w io.Writer, rep summaryReport) (err error) {
+	if _, err = fmt.Fprintf(w, "%-10s %10s\n", "Statistic", "Value"); err != nil {
+		return
+	}
+
+	for _, s := range rep.stats {
+		// Pad before coloring, so that escape sequences don't upset the
+		// alignment.
+		value := fmt.Sprintf("%10s", formatLatency(s.value))
+		if c, ok := levelColors[s.level]; ok && tr.color {
+			value = c + value + colorReset
+		}
+
+		if _, err = fmt.Fprintf(w, "%-10s %s\n", s.label, value); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// jsonRenderer writes the report as a single JSON object.
+type jsonRenderer struct{}
+
+// A jsonReport is a summary report as written by --format=json, and as the
+// summary line of --format=ndjson and the summary.json of --bundle.
+type jsonReport struct {
+	Type        string           `json:"type,omitempty"`
+	Host        string           `json:"host"`
+	Samples     int              `json:"samples"`
+	Synthesized int              `json:"synthesized,omitempty"`
+	Timeouts    int              `json:"timeouts"`
+	Retries     int              `json:"retries,omitempty"`
+	Stats       []jsonReportStat `json:"stats"`
+
+	Thresholds []gateThreshold `json:"thresholds,omitempty"`
+	Metadata   *runMetadata    `json:"metadata,omitempty"`
+}
+
+type jsonReportStat struct {
+	Metric string  `json:"metric"`
+	Ms     float64 `json:"ms"`
+	Level  string  `json:"level,omitempty"`
+}
+
+// newJSONReport converts a summary report to the form in which it's encoded
+// as JSON.
+func newJSONReport(rep summaryReport) (out jsonReport) {
+	out = jsonReport{
+		Host:        rep.target,
+		Samples:     rep.samples,
+		Synthesized: rep.synthesized,
+		Timeouts:    rep.timeouts,
+		Retries:     rep.retries,
+		Metadata:    rep.meta,
+	}
+
+	for _, s := range rep.stats {
+		out.Stats = append(out.Stats, jsonReportStat{
+			Metric: s.metric,
+			Ms:     millis(s.value),
+			Level:  s.level.String(),
+		})
+	}
+
+	for _, res := range rep.thresholds {
+		out.Thresholds = append(out.Thresholds, gateThreshold{
+			Threshold: res.threshold.String(),
+			ValueMs:   millis(res.value),
+			Passed:    res.passed(),
+		})
+	}
+
+	return
+}
+
+func (jsonRenderer) render(w io.Writer, rep summaryReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(newJSONReport(rep))
+}
+
+// csvRenderer writes the report as CSV, with a row per statistic.
+type csvRenderer struct{}
+
+func (csvRenderer) render(w io.Writer, rep summaryReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"host", "samples", "timeouts", "retries", "metric", "ms", "level"})
+	for _, s := range rep.stats {
+		cw.Write([]string{
+			rep.target,
+			strconv.Itoa(rep.samples),
+			strconv.Itoa(rep.timeouts),
+			strconv.Itoa(rep.retries),
+			s.metric,
+			strconv.FormatFloat(millis(s.value), 'f', 3, 64),
+			s.level.String(),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
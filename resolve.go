@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// resolveOverrides is a flag.Value mapping host names to the addresses to
+// use for them, accumulated from repeated --resolve flags.
+type resolveOverrides map[string]net.IP
+
+func (o *resolveOverrides) String() string {
+	var parts []string
+	for name, ip := range *o {
+		parts = append(parts, name+":"+ip.String())
+	}
+
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (o *resolveOverrides) Set(s string) (err error) {
+	name, addr, ok := strings.Cut(s, ":")
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	if !ok || name == "" || ip == nil {
+		err = fmt.Errorf("%q isn't of the form host:address", s)
+		return
+	}
+
+	if *o == nil {
+		*o = make(resolveOverrides)
+	}
+
+	(*o)[name] = ip
+	return
+}
+
+// pinnedAddress returns the address set for the given host name with
+// --resolve, if any.
+func pinnedAddress(name string) (ip net.IP, ok bool) {
+	ip, ok = resolve[name]
+	return
+}
+
+// applyResolve returns the options with the connection pinned to the
+// address set with --resolve for the host, if any. The host's own name is
+// still used for host key checks. The override may be keyed on either the
+// host as given or the name ssh resolves it to.
+func applyResolve(opts transportOptions) (transportOptions, error) {
+	if len(resolve) == 0 || opts.address != "" {
+		return opts, nil
+	}
+
+	hostname, port, err := sshEndpoint(opts.host)
+	if err != nil {
+		return opts, err
+	}
+
+	ip, ok := pinnedAddress(hostname)
+	if !ok {
+		ip, ok = pinnedAddress(opts.host)
+	}
+
+	if !ok {
+		return opts, nil
+	}
+
+	pinned := addressOptions(ip, hostname, port)
+	opts.address = pinned.address
+	opts.sshArgs = append(append([]string(nil), opts.sshArgs...), pinned.sshArgs...)
+	return opts, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// With --retries, the --ping-timeout used if none is set, so that a ping lost
+// on the way is retried rather than waited on forever.
+const retryPingTimeout = 5 * time.Second
+
+// With --retries, how long to wait before reconnecting after a connection
+// fails, so that a link that's down isn't hammered with attempts.
+const retryDelay = time.Second
+
+// retryCounts tallies the pings retried on a new connection with --retries.
+type retryCounts struct {
+	afterTimeout int
+	afterError   int
+
+	// How many retries have been made since an echo last arrived, and the
+	// most there have been in a row.
+	inARow    int
+	maxInARow int
+}
+
+// total returns how many retries were made.
+func (c retryCounts) total() int {
+	return c.afterTimeout + c.afterError
+}
+
+// note records a retry made because of the given error, returning an error
+// instead if that would be more than --retries in a row.
+func (c *retryCounts) note(cause error) (err error) {
+	if c.inARow >= *retries {
+		err = fmt.Errorf("giving up after %d retries in a row: %w", c.inARow, cause)
+		return
+	}
+
+	if errors.Is(cause, errEchoTimeout) {
+		c.afterTimeout++
+	} else {
+		c.afterError++
+	}
+
+	c.inARow++
+	if c.inARow > c.maxInARow {
+		c.maxInARow = c.inARow
+	}
+
+	return
+}
+
+// print prints a line breaking down the retries, if there were any.
+func (c retryCounts) print() {
+	if c.total() == 0 {
+		return
+	}
+
+	fmt.Printf(
+		"Retried %d pings (%d after timeouts, %d after connection errors), at most %d in a row.\n",
+		c.total(),
+		c.afterTimeout,
+		c.afterError,
+		c.maxInARow)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// With --reverse, the deployed agent is run with --ping to send pings for
+// this machine to echo for --duration. It then writes this line, followed by
+// a line for each ping giving the times at which it was sent and its echo
+// received according to the remote clock, and the times at which it was
+// received and echoed according to this machine's.
+const reverseResultsHeader = "ssh_ping reverse results"
+
+// measureReverse runs the agent deployed at the given path with --ping
+// over the supplied connection, echoing its pings as the agent would, and
+// returns the times it recorded. In them, sent and received are according to
+// the remote clock, and remoteReceived and remoteSent according to this
+// machine's.
+func measureReverse(ctx context.Context, t transport, agentPath string) (times []pingTimes, err error) {
+	s, err := t.NewStream(ctx, fmt.Sprintf(
+		"%s --ping --duration=%v --payload-size=%d --interval=%v",
+		agentPath,
+		*duration,
+		*payloadSize,
+		*interval))
+
+	if err != nil {
+		return
+	}
+
+	defer s.Close()
+
+	r := bufio.NewReader(s)
+	for {
+		var line []byte
+		line, err = r.ReadBytes('\n')
+		received := time.Now()
+		if err != nil {
+			err = fmt.Errorf("echoing the remote host's pings: %w", err)
+			return
+		}
+
+		if string(bytes.TrimSpace(line)) == reverseResultsHeader {
+			break
+		}
+
+		var echo bytes.Buffer
+		writeAgentEcho(&echo, line, nil, received)
+		if _, err = s.Write(echo.Bytes()); err != nil {
+			return
+		}
+	}
+
+	s.CloseWrite()
+	for {
+		var line []byte
+		line, err = r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		var ns [4]int64
+		if _, err = fmt.Sscanf(string(line), "%d %d %d %d", &ns[0], &ns[1], &ns[2], &ns[3]); err != nil {
+			err = fmt.Errorf("malformed reverse result %q: %w", line, err)
+			return
+		}
+
+		times = append(times, pingTimes{
+			sent:           time.Unix(0, ns[0]),
+			received:       time.Unix(0, ns[1]),
+			remoteReceived: time.Unix(0, ns[2]),
+			remoteSent:     time.Unix(0, ns[3]),
+		})
+	}
+}
+
+// printReverse prints the round trip times of pings sent from the remote
+// host, and the one-way delays estimated from them. These are from the
+// remote host's point of view, so its outbound trip is downstream.
+func printReverse(times []pingTimes) {
+	if len(times) == 0 {
+		return
+	}
+
+	rtts := make([]time.Duration, 0, len(times))
+	for _, t := range times {
+		rtts = append(rtts, t.rtt())
+	}
+
+	fmt.Printf("Reverse (%d pings sent from the remote host):\n", len(times))
+	fmt.Printf("p50:      %s\n", formatLatency(median(rtts)))
+	fmt.Printf("p95:      %s\n", formatLatency(percentile(95, rtts)))
+	fmt.Printf("Max:      %s\n", formatLatency(max(rtts)))
+	fmt.Printf("\n")
+	printOneWayDelays(times, "Downstream", "Upstream")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// The fraction of samples dropped from each end for the trimmed mean.
+const trimFraction = 0.1
+
+// How many resamples bootstrapMedianCI draws.
+const bootstrapResamples = 1000
+
+// sortedCopy returns the samples in increasing order, leaving s alone.
+func sortedCopy(s []time.Duration) []time.Duration {
+	sorted := append([]time.Duration(nil), s...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// trimmedMean returns the mean of the samples after dropping the given
+// fraction of them from each end, so that a few outliers can't drag it
+// around the way they do the mean.
+func trimmedMean(fraction float64, s []time.Duration) time.Duration {
+	sorted := sortedCopy(s)
+	k := int(fraction * float64(len(sorted)))
+	return mean(sorted[k : len(sorted)-k])
+}
+
+// medianAbsDeviation returns the median of the samples' distances from their
+// median: a measure of spread that, unlike the standard deviation, isn't
+// dominated by outliers.
+func medianAbsDeviation(s []time.Duration) time.Duration {
+	m := median(s)
+	deviations := make([]time.Duration, len(s))
+	for i, d := range s {
+		deviations[i] = d - m
+		if deviations[i] < 0 {
+			deviations[i] = -deviations[i]
+		}
+	}
+
+	return median(deviations)
+}
+
+// bootstrapMedianCI returns a 95% confidence interval for the median of the
+// population the samples were drawn from, by taking the median of many
+// resamples with replacement. This says how much the median would be expected
+// to move between runs from sampling alone.
+func bootstrapMedianCI(s []time.Duration) (low, high time.Duration) {
+	sorted := sortedCopy(s)
+	n := len(sorted)
+	rnd := newRand()
+
+	// A resample is a multiset of indices into the sorted samples, so its
+	// median is the sample at the index with n/2 of the others below it.
+	// Counting the indices finds that without sorting each resample.
+	counts := make([]int, n)
+	medians := make([]time.Duration, bootstrapResamples)
+	for i := range medians {
+		for j := range counts {
+			counts[j] = 0
+		}
+
+		for j := 0; j < n; j++ {
+			counts[rnd.Intn(n)]++
+		}
+
+		seen := 0
+		for j, c := range counts {
+			seen += c
+			if seen > n/2 {
+				medians[i] = sorted[j]
+				break
+			}
+		}
+	}
+
+	sort.Slice(medians, func(i, j int) bool { return medians[i] < medians[j] })
+	low = medians[int(0.025*bootstrapResamples)]
+	high = medians[int(0.975*bootstrapResamples)-1]
+	return
+}
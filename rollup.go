@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// A rollupPeriod is a host's runs that started in a day, week, or month,
+// with their samples merged into one histogram. Percentiles over the period
+// come from the merged histogram, not from the runs' own percentiles, which
+// can't be combined: the average of each run's p95 isn't the p95 of their
+// samples, and is usually well below it when a few runs were slow.
+type rollupPeriod struct {
+	host  string
+	start time.Time
+	runs  int
+	hist  histogram
+}
+
+// periodStart returns the start, in local time, of the day, week (starting
+// on Monday), or month containing t.
+func periodStart(t time.Time, period string) time.Time {
+	t = t.Local()
+	y, m, d := t.Date()
+	switch period {
+	case "week":
+		d -= (int(t.Weekday()) + 6) % 7
+	case "month":
+		d = 1
+	}
+
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// rollUp merges the runs into periods, ordered by host and then by start.
+// Runs without a histogram are skipped.
+func rollUp(runs []storedRun, period string) (periods []*rollupPeriod) {
+	type key struct {
+		host  string
+		start time.Time
+	}
+
+	byKey := make(map[key]*rollupPeriod)
+	for _, r := range runs {
+		if r.hist == nil {
+			continue
+		}
+
+		k := key{r.host, periodStart(r.started, period)}
+		p := byKey[k]
+		if p == nil {
+			p = &rollupPeriod{host: k.host, start: k.start}
+			byKey[k] = p
+			periods = append(periods, p)
+		}
+
+		p.runs++
+		p.hist.merge(r.hist)
+	}
+
+	sort.Slice(periods, func(i, j int) bool {
+		if periods[i].host != periods[j].host {
+			return periods[i].host < periods[j].host
+		}
+
+		return periods[i].start.Before(periods[j].start)
+	})
+
+	return
+}
+
+// parseReportDate parses a date like 2006-01-02, in local time, as given to
+// --since and --until. An empty string gives the zero time.
+func parseReportDate(name, s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "--%s should be a date like 2006-01-02.\n", name)
+		os.Exit(1)
+	}
+
+	return t
+}
+
+// runRollup implements the report rollup subcommand, which summarizes the
+// runs stored with --db by day, week, or month.
+func runRollup(ctx context.Context, args []string) {
+	fs := newSubcommandFlagSet("rollup", []string{"db", "host"}, outputFlags)
+	period := fs.String("period", "week", "The period to summarize by: day, week (starting on Monday), or month.")
+	since := fs.String("since", "", "If set, only summarize runs that started on or after this date, like 2006-01-02.")
+	until := fs.String("until", "", "If set, only summarize runs that started before this date, like 2006-01-02.")
+	fs.Parse(args)
+
+	switch *period {
+	case "day", "week", "month":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown --period %q; want day, week, or month.\n", *period)
+		os.Exit(1)
+	}
+
+	db := openStoredHistory()
+	defer db.Close()
+
+	runs, err := storedRuns(ctx, db, *host, parseReportDate("since", *since), parseReportDate("until", *until))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var skipped int
+	for _, r := range runs {
+		if r.hist == nil {
+			skipped++
+		}
+	}
+
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Skipping %d runs stored with neither samples nor a histogram.\n", skipped)
+	}
+
+	printRollup(rollUp(runs, *period), *period)
+}
+
+func printRollup(periods []*rollupPeriod, period string) {
+	layout := "2006-01-02"
+	if period == "month" {
+		layout = "2006-01"
+	}
+
+	for i, p := range periods {
+		if i == 0 || p.host != periods[i-1].host {
+			if i > 0 {
+				fmt.Printf("\n")
+			}
+
+			fmt.Printf("%s:\n", p.host)
+			fmt.Printf("%-12s %6s %8s %8s %8s %8s %8s\n", "Period", "Runs", "Samples", "p50", "p95", "p99", "Max")
+		}
+
+		fmt.Printf(
+			"%-12s %6d %8d %8s %8s %8s %8s\n",
+			p.start.Format(layout),
+			p.runs,
+			p.hist.count(),
+			formatLatency(p.hist.percentile(50)),
+			formatLatency(p.hist.percentile(95)),
+			formatLatency(p.hist.percentile(99)),
+			formatLatency(p.hist.max()))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRollup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.db")
+
+	// A Wednesday, and the Monday after it.
+	wednesday := time.Date(2026, 10, 7, 2, 0, 0, 0, time.Local)
+	monday := time.Date(2026, 10, 12, 2, 0, 0, 0, time.Local)
+
+	record := func(started time.Time, r run) {
+		t.Helper()
+		if err := recordRun(path, "bastion", started, time.Minute, r); err != nil {
+			t.Fatalf("recordRun: %v", err)
+		}
+	}
+
+	// Two fast runs and a slow one. A fifteenth of the week's samples are
+	// slow, so its p95 is slow too, though the average of the runs' p95s
+	// isn't.
+	for day := 0; day < 3; day++ {
+		var r run
+		for i := 0; i < 100; i++ {
+			rtt := 10 * time.Millisecond
+			if day == 2 && i < 20 {
+				rtt = 500 * time.Millisecond
+			}
+
+			r.add(wednesday.Add(time.Duration(i)*time.Second), rtt)
+		}
+
+		record(wednesday.AddDate(0, 0, day), r)
+	}
+
+	// And one made with --histogram the next week.
+	r := run{hist: &histogram{}}
+	for i := 0; i < 50; i++ {
+		r.add(monday, 20*time.Millisecond)
+	}
+
+	record(monday, r)
+
+	db, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	runs, err := storedRuns(context.Background(), db, "", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("storedRuns: %v", err)
+	}
+
+	periods := rollUp(runs, "week")
+	if len(periods) != 2 {
+		t.Fatalf("got %d weeks; want 2", len(periods))
+	}
+
+	week := periods[0]
+	if !week.start.Equal(time.Date(2026, 10, 5, 0, 0, 0, 0, time.Local)) || week.runs != 3 || week.hist.count() != 300 {
+		t.Errorf("first week starts %v with %d runs and %d samples; want Monday 5 October, 3, and 300", week.start, week.runs, week.hist.count())
+	}
+
+	if got, want := week.hist.percentile(95), histogramValue(histogramBucket(500*time.Millisecond)); got != want {
+		t.Errorf("first week p95 = %v; want %v", got, want)
+	}
+
+	if got := week.hist.max(); got != 500*time.Millisecond {
+		t.Errorf("first week max = %v; want 500ms", got)
+	}
+
+	if got := week.hist.mean(); got < 42*time.Millisecond || got > 43*time.Millisecond {
+		t.Errorf("first week mean = %v; want about 42.7ms", got)
+	}
+
+	if week := periods[1]; week.runs != 1 || week.hist.count() != 50 {
+		t.Errorf("second week has %d runs and %d samples; want 1 and 50", week.runs, week.hist.count())
+	}
+
+	if months := rollUp(runs, "month"); len(months) != 1 || months[0].runs != 4 {
+		t.Errorf("got %d months; want 1 with all 4 runs", len(months))
+	}
+
+	runs, err = storedRuns(context.Background(), db, "bastion", monday, time.Time{})
+	if err != nil || len(runs) != 1 {
+		t.Errorf("storedRuns since %v = %d runs, %v; want 1", monday, len(runs), err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With --schedule, when to measure.
+var measurementSchedule cronSchedule
+
+// A cronSchedule is a schedule in the five-field format of crontab(5):
+// minute, hour, day of month, month, and day of week. Each field is a set of
+// the values it matches, as a bit mask.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day of month and day of week fields were *. If neither
+	// was, a day matching either matches, as in cron.
+	domAny, dowAny bool
+}
+
+// Shorthands for common schedules.
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron parses a schedule like "*/5 * * * *" or "0 9-17 * * 1-5".
+func parseCron(spec string) (s cronSchedule, err error) {
+	if full, ok := cronShorthands[spec]; ok {
+		spec = full
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		err = fmt.Errorf("%q: want five fields: minute, hour, day of month, month, and day of week", spec)
+		return
+	}
+
+	ranges := []struct {
+		name        string
+		first, last int
+		set         *uint64
+	}{
+		{"minute", 0, 59, &s.minute},
+		{"hour", 0, 23, &s.hour},
+		{"day of month", 1, 31, &s.dom},
+		{"month", 1, 12, &s.month},
+		{"day of week", 0, 7, &s.dow},
+	}
+
+	for i, r := range ranges {
+		if *r.set, err = parseCronField(fields[i], r.first, r.last); err != nil {
+			err = fmt.Errorf("%s: %w", r.name, err)
+			return
+		}
+	}
+
+	// Sunday is either 0 or 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+	return
+}
+
+// parseCronField parses a comma-separated list of values, ranges like 1-5,
+// or *, each optionally with a step like /10, returning the set of values it
+// matches.
+func parseCronField(field string, first, last int) (set uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		expr, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				err = fmt.Errorf("bad step in %q", part)
+				return
+			}
+		}
+
+		lo, hi := first, last
+		if expr != "*" {
+			loStr, hiStr, isRange := strings.Cut(expr, "-")
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				err = fmt.Errorf("bad value in %q", part)
+				return
+			}
+
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					err = fmt.Errorf("bad value in %q", part)
+					return
+				}
+			} else if hasStep {
+				hi = last
+			}
+		}
+
+		if lo < first || hi > last || lo > hi {
+			err = fmt.Errorf("%q is outside %d-%d", part, first, last)
+			return
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+
+	return
+}
+
+// matchesDay reports whether the schedule runs on the day of t.
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<t.Weekday()) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+
+	return dom || dow
+}
+
+// next returns the first time after t at which the schedule fires, or the
+// zero time if it never does, like on the 31st of February.
+func (s cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// runScheduled measures for --duration each time --schedule fires, until
+// interrupted. A measurement that fails is logged, and doesn't stop later
+// ones: the host may be back by then. With --listen, the status server runs
+// meanwhile, and with --daily-report, the report for the day so far is written
+// when stopped.
+func runScheduled(ctx context.Context) {
+	if monitorStatus != nil {
+		l, err := net.Listen("tcp", *listenAddr)
+		if err != nil {
+			log.Fatalf("--listen: %v", err)
+		}
+
+		go serveStatus(ctx, l, monitorStatus)
+	}
+
+	for {
+		next := measurementSchedule.next(time.Now())
+		fmt.Fprintf(os.Stderr, "Next measurement at %s.\n", next.Format("2006-01-02 15:04"))
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			if dailyReports != nil {
+				if err := dailyReports.flush(); err != nil {
+					log.Printf("--daily-report: %v", err)
+				}
+			}
+
+			return
+		}
+
+		if *format == "text" {
+			fmt.Printf("\n=== %s\n\n", next.Format("2006-01-02 15:04"))
+		}
+
+		if _, err := measureAndReport(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Measurement at %s: %v", next.Format("15:04"), err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// A segment is a run of consecutive samples with similar latency.
+type segment struct {
+	// Indices of the first sample and one past the last.
+	start, end int
+}
+
+// findSegments splits the samples into regimes of distinct latency using
+// binary segmentation: a segment is split at the point that most reduces the
+// squared error of log latency about each part's mean, as long as the
+// reduction is large compared to the noise. Adjacent segments whose medians
+// are within 20% of each other are then merged, so that only material shifts
+// are reported.
+func findSegments(samples []time.Duration) (segments []segment) {
+	n := len(samples)
+	if n == 0 {
+		return
+	}
+
+	// Work with log latency, so that spikes don't dominate and shifts are
+	// judged relative to the base latency.
+	logs := make([]float64, n)
+	for i, s := range samples {
+		logs[i] = math.Log(math.Max(float64(s), 1))
+	}
+
+	// Prefix sums of values and squares, for O(1) segment costs.
+	sum := make([]float64, n+1)
+	sumSq := make([]float64, n+1)
+	for i, x := range logs {
+		sum[i+1] = sum[i] + x
+		sumSq[i+1] = sumSq[i] + x*x
+	}
+
+	cost := func(a, b int) float64 {
+		s := sum[b] - sum[a]
+		return sumSq[b] - sumSq[a] - s*s/float64(b-a)
+	}
+
+	minSize := n / 100
+	if minSize < 10 {
+		minSize = 10
+	}
+
+	penalty := 3 * noiseVariance(logs) * math.Log(float64(n))
+
+	var split func(a, b int)
+	split = func(a, b int) {
+		best, bestGain := -1, penalty
+		for i := a + minSize; i <= b-minSize; i++ {
+			if gain := cost(a, b) - cost(a, i) - cost(i, b); gain > bestGain {
+				best, bestGain = i, gain
+			}
+		}
+
+		if best < 0 {
+			segments = append(segments, segment{a, b})
+			return
+		}
+
+		split(a, best)
+		split(best, b)
+	}
+
+	split(0, n)
+
+	// Merge neighbours that aren't materially different.
+	merged := segments[:1]
+	for _, s := range segments[1:] {
+		last := &merged[len(merged)-1]
+		a := median(samples[last.start:last.end])
+		b := median(samples[s.start:s.end])
+		if math.Abs(float64(a-b)) <= 0.2*float64(a) {
+			last.end = s.end
+			continue
+		}
+
+		merged = append(merged, s)
+	}
+
+	segments = merged
+	return
+}
+
+// noiseVariance estimates the variance of the noise in a series robustly,
+// from the median absolute difference between consecutive values. Unlike the
+// series' overall variance this isn't inflated by shifts in level.
+func noiseVariance(xs []float64) float64 {
+	if len(xs) < 2 {
+		return 0
+	}
+
+	diffs := make([]float64, 0, len(xs)-1)
+	for i := 1; i < len(xs); i++ {
+		diffs = append(diffs, math.Abs(xs[i]-xs[i-1]))
+	}
+
+	sort.Float64s(diffs)
+
+	// For normal noise, consecutive differences have twice the variance, and
+	// their median absolute value is 0.6745 standard deviations.
+	sigma := diffs[len(diffs)/2] / 0.6745 / math.Sqrt2
+	return sigma * sigma
+}
+
+// printSegments prints the latency regimes found in a run, with times
+// relative to the first sample.
+func printSegments(r run) {
+	segments := findSegments(r.samples)
+	if len(segments) == 0 {
+		return
+	}
+
+	t0 := r.sent[0]
+	elapsed := func(i int) time.Duration {
+		if i == len(r.sent) {
+			return r.sent[i-1].Sub(t0).Round(time.Second)
+		}
+
+		return r.sent[i].Sub(t0).Round(time.Second)
+	}
+
+	fmt.Printf("Latency regimes:\n")
+	for _, s := range segments {
+		samples := r.samples[s.start:s.end]
+		fmt.Printf(
+			"  %-18s ~%s (p95 %s, %d samples)\n",
+			fmt.Sprintf("%v–%v:", elapsed(s.start), elapsed(s.end)),
+			formatLatency(median(samples)),
+			formatLatency(percentile(95, samples)),
+			len(samples))
+	}
+}
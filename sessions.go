@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How many pings to time on the first session each time another is opened.
+const sessionProbePings = 20
+
+// probeSessionLimits opens up to limit concurrent sessions over a single
+// connection, reporting how long each took to open and how echo latency on
+// the first session changes as more are opened, until the server refuses
+// one. This shows the effect of the server's MaxSessions. It then opens
+// increasing numbers of connections at once, showing the effect of
+// MaxStartups on connection setup.
+func probeSessionLimits(ctx context.Context, limit int) (err error) {
+	t, err := newTransport(transportOptions{shared: true})
+	if err != nil {
+		return
+	}
+
+	if err = t.Dial(ctx); err != nil {
+		return
+	}
+
+	defer t.Close()
+
+	var ss []stream
+	defer func() {
+		for _, s := range ss {
+			s.Close()
+		}
+	}()
+
+	payload := makePayload(*payloadSize)
+
+	fmt.Printf("Sessions over one connection:\n")
+	fmt.Printf("%8s %10s %10s\n", "Session", "Open", "Echo p50")
+	for i := 1; i <= limit; i++ {
+		start := time.Now()
+		var s stream
+		s, err = startEcho(ctx, t)
+		if err == nil {
+			_, err = runPing(payload, s, s)
+			if err != nil {
+				s.Close()
+			}
+		}
+
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+
+		if err != nil {
+			fmt.Printf("%8d refused: %v\n", i, err)
+			fmt.Printf("\n")
+			fmt.Printf("The server allows %d concurrent sessions per connection.\n", i-1)
+			err = nil
+			break
+		}
+
+		open := time.Since(start)
+		ss = append(ss, s)
+
+		// Measure the effect on the first session of having this many open.
+		var r run
+		for j := 0; j < sessionProbePings; j++ {
+			var pt pingTimes
+			if pt, err = runPing(payload, ss[0], ss[0]); err != nil {
+				return
+			}
+
+			r.samples = append(r.samples, pt.rtt())
+		}
+
+		fmt.Printf("%8d %10s %10s\n", i, formatLatency(open), formatLatency(median(r.samples)))
+		if i == limit {
+			fmt.Printf("\n")
+			fmt.Printf("The server allowed all %d sessions.\n", limit)
+		}
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("Simultaneous new connections:\n")
+	fmt.Printf("%8s %10s %10s %8s\n", "Count", "Setup p50", "Setup max", "Failed")
+	for n := 1; n <= limit; n *= 2 {
+		setup, failed := dialConcurrently(ctx, n)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+
+		if len(setup) == 0 {
+			fmt.Printf("%8d %10s %10s %8d\n", n, "-", "-", failed)
+			continue
+		}
+
+		fmt.Printf(
+			"%8d %10s %10s %8d\n",
+			n,
+			formatLatency(median(setup)),
+			formatLatency(max(setup)),
+			failed)
+	}
+
+	return
+}
+
+// dialConcurrently makes n connections at once, each running a single echo,
+// and returns the time each successful one took to echo for the first time
+// along with the number that failed.
+func dialConcurrently(ctx context.Context, n int) (setup []time.Duration, failed int) {
+	payload := makePayload(*payloadSize)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := func() (err error) {
+				t, err := newTransport(transportOptions{})
+				if err != nil {
+					return
+				}
+
+				if err = t.Dial(ctx); err != nil {
+					return
+				}
+
+				defer t.Close()
+
+				s, err := startEcho(ctx, t)
+				if err != nil {
+					return
+				}
+
+				defer s.Close()
+
+				_, err = runPing(payload, s, s)
+				return
+			}()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+				return
+			}
+
+			setup = append(setup, time.Since(start))
+		}()
+	}
+
+	wg.Wait()
+	return
+}
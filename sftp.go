@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// SFTP packet types we use, from draft-ietf-secsh-filexfer-02 (version 3).
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpRealpath = 16
+	sftpStatus   = 101
+	sftpName     = 104
+)
+
+// The largest SFTP response we're prepared to read. REALPATH responses are
+// small; anything bigger means we're not talking to an SFTP server.
+const sftpMaxPacket = 64 << 10
+
+// sftpEcho is a stream that pings using SFTP rather than cat, for servers
+// whose forced command or restricted shell won't run cat but that still offer
+// the sftp subsystem. Each write sends a REALPATH request for ".", and the
+// payload is echoed locally once the matching response arrives, so that
+// callers see the same stream of bytes as from cat.
+//
+// The payload itself doesn't cross the network, so --payload-size has no
+// effect on the size of the packets sent.
+type sftpEcho struct {
+	s stream
+
+	mu     sync.Mutex
+	nextID uint32
+
+	// Requests sent but not yet answered, in order.
+	pending []sftpRequest
+
+	// Payload bytes whose response has arrived but that haven't been read.
+	buf []byte
+}
+
+type sftpRequest struct {
+	id      uint32
+	payload []byte
+}
+
+// startSFTPEcho starts the sftp subsystem over the transport and performs the
+// SFTP version handshake.
+func startSFTPEcho(ctx context.Context, t transport) (e *sftpEcho, err error) {
+	s, err := t.NewSubsystem(ctx, "sftp")
+	if err != nil {
+		return
+	}
+
+	var init []byte
+	init = binary.BigEndian.AppendUint32(init, 3)
+	if err = writeSFTPPacket(s, sftpInit, init); err != nil {
+		s.Close()
+		return
+	}
+
+	typ, _, err := readSFTPPacket(s)
+	if err == nil && typ != sftpVersion {
+		err = fmt.Errorf("unexpected SFTP packet type %d in handshake", typ)
+	}
+
+	if err != nil {
+		s.Close()
+		err = fmt.Errorf("sftp: %w", err)
+		return
+	}
+
+	e = &sftpEcho{s: s}
+	return
+}
+
+func writeSFTPPacket(w io.Writer, typ byte, body []byte) (err error) {
+	var p []byte
+	p = binary.BigEndian.AppendUint32(p, uint32(1+len(body)))
+	p = append(p, typ)
+	p = append(p, body...)
+	_, err = w.Write(p)
+	return
+}
+
+func readSFTPPacket(r io.Reader) (typ byte, body []byte, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+
+	n := binary.BigEndian.Uint32(header[:4])
+	if n < 1 || n > sftpMaxPacket {
+		err = fmt.Errorf("bad SFTP packet length %d", n)
+		return
+	}
+
+	typ = header[4]
+	body = make([]byte, n-1)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+func (e *sftpEcho) Write(p []byte) (n int, err error) {
+	e.mu.Lock()
+	id := e.nextID
+	e.nextID++
+	e.pending = append(e.pending, sftpRequest{id, append([]byte(nil), p...)})
+	e.mu.Unlock()
+
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, id)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = append(body, '.')
+	if err = writeSFTPPacket(e.s, sftpRealpath, body); err != nil {
+		return
+	}
+
+	n = len(p)
+	return
+}
+
+func (e *sftpEcho) Read(p []byte) (n int, err error) {
+	if len(e.buf) == 0 {
+		var typ byte
+		var body []byte
+		typ, body, err = readSFTPPacket(e.s)
+		if err != nil {
+			return
+		}
+
+		if (typ != sftpName && typ != sftpStatus) || len(body) < 4 {
+			err = fmt.Errorf("unexpected SFTP packet type %d", typ)
+			return
+		}
+
+		id := binary.BigEndian.Uint32(body)
+		e.mu.Lock()
+		if len(e.pending) == 0 || e.pending[0].id != id {
+			e.mu.Unlock()
+			err = fmt.Errorf("unexpected SFTP response ID %d", id)
+			return
+		}
+
+		e.buf = e.pending[0].payload
+		e.pending = e.pending[1:]
+		e.mu.Unlock()
+	}
+
+	n = copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return
+}
+
+func (e *sftpEcho) CloseWrite() error {
+	return e.s.CloseWrite()
+}
+
+func (e *sftpEcho) Close() error {
+	return e.s.Close()
+}
+
+// How long resolveEchoMechanism waits for each mechanism to echo a ping.
+const echoProbeTimeout = 10 * time.Second
+
+// The mechanism used to echo pings: "cat" or "sftp". Set from --echo, or by
+// resolveEchoMechanism for --echo=auto.
+var echoMechanism = "cat"
+
+// resolveEchoMechanism sets echoMechanism according to --echo. For auto, it
+// connects to the host and tries pings with cat (or --remote-command),
+// falling back to SFTP if they don't come back intact, as happens with a forced command or a
+// restricted shell.
+func resolveEchoMechanism(ctx context.Context, opts transportOptions) (err error) {
+	if *echoMode != "auto" {
+		echoMechanism = *echoMode
+		return
+	}
+
+	t, err := newTransport(opts)
+	if err != nil {
+		return
+	}
+
+	if err = t.Dial(ctx); err != nil {
+		return
+	}
+
+	defer t.Close()
+
+	catErr := probeEcho(ctx, func(ctx context.Context) (stream, error) {
+		return t.NewStream(ctx, remoteEchoCommand)
+	})
+
+	if catErr == nil {
+		echoMechanism = "cat"
+		return
+	}
+
+	sftpErr := probeEcho(ctx, func(ctx context.Context) (stream, error) {
+		return startSFTPEcho(ctx, t)
+	})
+
+	if sftpErr == nil {
+		echoMechanism = "sftp"
+		return
+	}
+
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+
+	err = fmt.Errorf("no echo mechanism works; cat: %v; sftp: %v", catErr, sftpErr)
+	return
+}
+
+// probeEcho starts a stream and checks that it echoes pings.
+func probeEcho(ctx context.Context, start func(context.Context) (stream, error)) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, echoProbeTimeout)
+	defer cancel()
+
+	s, err := start(ctx)
+	if err != nil {
+		return
+	}
+
+	// Don't wait forever for a server that accepts the ping and says nothing.
+	// Streams can't be closed twice, so whichever comes first closes it.
+	var closeOnce sync.Once
+	closeStream := func() { closeOnce.Do(func() { s.Close() }) }
+	defer closeStream()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeStream()
+		case <-done:
+		}
+	}()
+
+	// Send real pings, so that anything about them the echo can't cope with
+	// is caught here rather than partway through a run.
+	payload := makePayload(*payloadSize)
+	for i := 0; i < 2; i++ {
+		if _, err = runPing(payload, s, s); err != nil {
+			if ctx.Err() != nil {
+				err = fmt.Errorf("no echo within %v", echoProbeTimeout)
+			}
+
+			return
+		}
+	}
+
+	return
+}
+
+// checkRemoteCommand checks that the command set by --remote-command echoes
+// pings intact, so that a run with one that doesn't fails up front with a
+// clear error.
+func checkRemoteCommand(ctx context.Context, opts transportOptions) (err error) {
+	t, err := newTransport(opts)
+	if err != nil {
+		return
+	}
+
+	if err = t.Dial(ctx); err != nil {
+		return
+	}
+
+	defer t.Close()
+
+	err = probeEcho(ctx, func(ctx context.Context) (stream, error) {
+		return t.NewStream(ctx, remoteEchoCommand)
+	})
+
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	return
+}
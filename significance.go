@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The significance level at which a difference is reported as significant,
+// and the corresponding two-sided normal quantile for confidence intervals.
+const (
+	significanceLevel = 0.05
+	significanceZ     = 1.959964
+)
+
+// The most samples from each side used to compute the median difference,
+// whose cost grows with the product of the two sample counts.
+const maxPairwiseSamples = 2000
+
+// A significance is the result of comparing two sets of samples with a
+// Mann–Whitney U test.
+type significance struct {
+	u float64
+	p float64
+
+	// The Hodges–Lehmann estimate of the median difference (second minus
+	// first) and its confidence interval.
+	shift, low, high time.Duration
+}
+
+func (s significance) significant() bool {
+	return s.p < significanceLevel
+}
+
+// String describes the result in a sentence.
+func (s significance) String() string {
+	verdict := "not statistically significant"
+	if s.significant() {
+		verdict = "statistically significant"
+	}
+
+	return fmt.Sprintf(
+		"Median difference %s (95%% CI %s to %s); %s (Mann-Whitney U=%.0f, p=%.3g).",
+		strings.TrimSpace(formatDelta(s.shift)),
+		strings.TrimSpace(formatDelta(s.low)),
+		strings.TrimSpace(formatDelta(s.high)),
+		verdict,
+		s.u,
+		s.p)
+}
+
+// mannWhitney compares two sets of samples, which must both be non-empty,
+// using the normal approximation to the U statistic with a correction for
+// ties.
+func mannWhitney(a, b []time.Duration) (s significance) {
+	type ranked struct {
+		v     time.Duration
+		first bool
+	}
+
+	all := make([]ranked, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, ranked{v, true})
+	}
+
+	for _, v := range b {
+		all = append(all, ranked{v, false})
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	// Sum the ranks of the first set, giving tied values their average rank.
+	var rankSum, tieTerm float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].first {
+				rankSum += rank
+			}
+		}
+
+		t := float64(j - i)
+		tieTerm += t*t*t - t
+		i = j
+	}
+
+	n1, n2 := float64(len(a)), float64(len(b))
+	n := n1 + n2
+	s.u = rankSum - n1*(n1+1)/2
+
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - tieTerm/(n*(n-1)))
+	if variance > 0 {
+		z := (math.Abs(s.u-mean) - 0.5) / math.Sqrt(variance)
+		if z < 0 {
+			z = 0
+		}
+
+		s.p = math.Erfc(z / math.Sqrt2)
+	} else {
+		s.p = 1
+	}
+
+	s.shift, s.low, s.high = medianDifference(a, b)
+	return
+}
+
+// medianDifference returns the Hodges–Lehmann estimate of how much larger b
+// is than a, the median of all pairwise differences, with a confidence
+// interval for it. Large sets are thinned evenly first.
+func medianDifference(a, b []time.Duration) (shift, low, high time.Duration) {
+	a, b = thin(a, maxPairwiseSamples), thin(b, maxPairwiseSamples)
+	diffs := make([]time.Duration, 0, len(a)*len(b))
+	for _, x := range a {
+		for _, y := range b {
+			diffs = append(diffs, y-x)
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i] < diffs[j] })
+
+	m := len(diffs)
+	shift = diffs[m/2]
+	if m%2 == 0 {
+		shift = (diffs[m/2-1] + diffs[m/2]) / 2
+	}
+
+	n1, n2 := float64(len(a)), float64(len(b))
+	k := int(math.Floor(n1*n2/2 - significanceZ*math.Sqrt(n1*n2*(n1+n2+1)/12)))
+	if k < 0 {
+		k = 0
+	}
+
+	low, high = diffs[k], diffs[m-1-k]
+	return
+}
+
+// thin returns at most n of the samples, evenly spaced.
+func thin(samples []time.Duration, n int) []time.Duration {
+	if len(samples) <= n {
+		return samples
+	}
+
+	out := make([]time.Duration, n)
+	for i := range out {
+		out[i] = samples[i*len(samples)/n]
+	}
+
+	return out
+}
+
+// compareHosts measures two hosts for the length of --duration, alternating
+// pings between them so that both see the same conditions on the local end,
+// and reports whether the difference in latency is statistically
+// significant.
+func compareHosts(ctx context.Context, hosts []string) (err error) {
+	if len(hosts) != 2 {
+		err = fmt.Errorf("--compare-hosts needs exactly two hosts, e.g. a.example.com,b.example.com")
+		return
+	}
+
+	payload := makePayload(*payloadSize)
+	var ss [2]stream
+	for i, h := range hosts {
+		var t transport
+		if t, err = newTransport(transportOptions{host: h}); err != nil {
+			return
+		}
+
+		if err = t.Dial(ctx); err != nil {
+			err = fmt.Errorf("%s: %w", h, err)
+			return
+		}
+
+		defer t.Close()
+
+		if ss[i], err = startEcho(ctx, t); err != nil {
+			err = fmt.Errorf("%s: %w", h, err)
+			return
+		}
+
+		defer ss[i].Close()
+
+		// The first few pings probably incur some startup cost. Throw them
+		// away.
+		for j := 0; j < 3; j++ {
+			if _, err = runPing(payload, ss[i], ss[i]); err != nil {
+				err = fmt.Errorf("%s: %w", h, err)
+				return
+			}
+		}
+	}
+
+	fmt.Printf("Measuring %s and %s alternately...\n", hosts[0], hosts[1])
+	var samples [2][]time.Duration
+	start := time.Now()
+	for i := 1; time.Since(start) < *duration; i++ {
+		for j, s := range ss {
+			var pt pingTimes
+			if pt, err = runPing(payload, s, s); err != nil {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				}
+
+				err = fmt.Errorf("%s: %w", hosts[j], err)
+				return
+			}
+
+			samples[j] = append(samples[j], pt.rtt())
+		}
+
+		if *interval > 0 {
+			select {
+			case <-time.After(time.Until(start.Add(time.Duration(i) * *interval))):
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+	}
+
+	fmt.Printf("\n")
+	printSignificance(hosts[0], hosts[1], samples[0], samples[1])
+	return
+}
+
+// printSignificance prints a table of the two sets of samples and how they
+// differ.
+func printSignificance(nameA, nameB string, a, b []time.Duration) {
+	width := len(nameA)
+	if len(nameB) > width {
+		width = len(nameB)
+	}
+
+	fmt.Printf("%-*s %8s %8s %8s %8s\n", width, "", "Samples", "p50", "p95", "p99")
+	for _, row := range []struct {
+		name    string
+		samples []time.Duration
+	}{
+		{nameA, a},
+		{nameB, b},
+	} {
+		fmt.Printf(
+			"%-*s %8d %8s %8s %8s\n",
+			width,
+			row.name,
+			len(row.samples),
+			formatLatency(median(row.samples)),
+			formatLatency(percentile(95, row.samples)),
+			formatLatency(percentile(99, row.samples)))
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("%s vs %s: %v\n", nameB, nameA, mannWhitney(a, b))
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A latencyModel generates synthetic round-trip latencies.
+type latencyModel []latencyTerm
+
+// A latencyTerm contributes to each synthetic latency. The latency of a
+// simulated ping is the sum of all terms.
+type latencyTerm func(r *rand.Rand) time.Duration
+
+// parseLatencyModel parses a description of a latency distribution like
+//
+//	normal(20ms,5ms)+spikes(1%,300ms)
+//
+// The supported terms are:
+//
+//	constant(d)          Always d.
+//	normal(mean,stddev)  Normally distributed, clamped at zero.
+//	uniform(lo,hi)       Uniformly distributed in [lo, hi).
+//	spikes(p%,d)         d with probability p, otherwise zero.
+//	loss(p%,rto)         Packet loss with probability p, with each loss costing
+//	                     a retransmission timeout that starts at rto and
+//	                     doubles, up to 60s, as in TCP.
+func parseLatencyModel(s string) (m latencyModel, err error) {
+	terms, err := parseTerms(s)
+	if err != nil {
+		return
+	}
+
+	for _, term := range terms {
+		var t latencyTerm
+		t, err = parseLatencyTerm(term.name, term.args)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", term, err)
+			return
+		}
+
+		m = append(m, t)
+	}
+
+	return
+}
+
+// A term is one element of a '+'-separated list like "normal(20ms,5ms)".
+type term struct {
+	name string
+	args []string
+}
+
+func (t term) String() string {
+	return fmt.Sprintf("%s(%s)", t.name, strings.Join(t.args, ","))
+}
+
+func parseTerms(s string) (terms []term, err error) {
+	for _, t := range strings.Split(s, "+") {
+		t = strings.TrimSpace(t)
+
+		open := strings.Index(t, "(")
+		if open < 0 || !strings.HasSuffix(t, ")") {
+			err = fmt.Errorf("malformed term %q", t)
+			return
+		}
+
+		args := strings.Split(t[open+1:len(t)-1], ",")
+		for i := range args {
+			args[i] = strings.TrimSpace(args[i])
+		}
+
+		terms = append(terms, term{name: t[:open], args: args})
+	}
+
+	return
+}
+
+// parsePercent parses a probability written like "1.5%".
+func parsePercent(s string) (p float64, err error) {
+	if !strings.HasSuffix(s, "%") {
+		err = fmt.Errorf("%q is not a percentage", s)
+		return
+	}
+
+	if p, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64); err != nil {
+		return
+	}
+
+	if p < 0 || p > 100 {
+		err = fmt.Errorf("%q is not from 0%% to 100%%", s)
+		return
+	}
+
+	p /= 100
+	return
+}
+
+// The most a simulated retransmission timeout grows to, as in TCP.
+const maxSimulatedRTO = 60 * time.Second
+
+func parseLatencyTerm(name string, args []string) (t latencyTerm, err error) {
+	wantArgs := map[string]int{
+		"constant": 1,
+		"normal":   2,
+		"uniform":  2,
+		"spikes":   2,
+		"loss":     2,
+	}
+
+	n, ok := wantArgs[name]
+	if !ok {
+		err = fmt.Errorf("unknown term %q", name)
+		return
+	}
+
+	if len(args) != n {
+		err = fmt.Errorf("want %d arguments, got %d", n, len(args))
+		return
+	}
+
+	// Every term's last argument is a duration.
+	last, err := time.ParseDuration(args[n-1])
+	if err != nil {
+		return
+	}
+
+	switch name {
+	case "constant":
+		t = func(r *rand.Rand) time.Duration { return last }
+
+	case "normal":
+		var mean time.Duration
+		mean, err = time.ParseDuration(args[0])
+		if err != nil {
+			return
+		}
+
+		t = func(r *rand.Rand) time.Duration {
+			d := mean + time.Duration(r.NormFloat64()*float64(last))
+			if d < 0 {
+				d = 0
+			}
+
+			return d
+		}
+
+	case "uniform":
+		var lo time.Duration
+		lo, err = time.ParseDuration(args[0])
+		if err != nil {
+			return
+		}
+
+		if last <= lo {
+			err = fmt.Errorf("empty range")
+			return
+		}
+
+		t = func(r *rand.Rand) time.Duration {
+			return lo + time.Duration(r.Int63n(int64(last-lo)))
+		}
+
+	case "spikes":
+		var p float64
+		p, err = parsePercent(args[0])
+		if err != nil {
+			return
+		}
+
+		t = func(r *rand.Rand) time.Duration {
+			if r.Float64() < p {
+				return last
+			}
+
+			return 0
+		}
+
+	case "loss":
+		var p float64
+		p, err = parsePercent(args[0])
+		if err != nil {
+			return
+		}
+
+		if p >= 1 {
+			err = fmt.Errorf("loss must be less than 100%%")
+			return
+		}
+
+		t = func(r *rand.Rand) (d time.Duration) {
+			for rto := last; r.Float64() < p; rto *= 2 {
+				if rto > maxSimulatedRTO {
+					rto = maxSimulatedRTO
+				}
+
+				d += rto
+			}
+
+			return
+		}
+	}
+
+	return
+}
+
+// sample returns a synthetic latency drawn from the model.
+func (m latencyModel) sample(r *rand.Rand) (d time.Duration) {
+	for _, t := range m {
+		d += t(r)
+	}
+
+	return
+}
+
+// simulatedEcho stands in for a remote echo process. Data written to it can
+// be read back after a delay drawn from a latency model. Once its context is
+// cancelled, reads and writes fail.
+type simulatedEcho struct {
+	ctx   context.Context
+	model latencyModel
+	rand  *rand.Rand
+
+	// The time at which the most recent write will be echoed. Echoes are
+	// delivered in order, like on a real stream.
+	lastDue time.Time
+
+	pending chan simulatedReply
+	r       *io.PipeReader
+	w       *io.PipeWriter
+
+	// Held while sending to pending, and set when it's closed, whether by
+	// CloseWrite or Close.
+	mu          sync.Mutex
+	writeClosed bool
+}
+
+type simulatedReply struct {
+	data []byte
+	due  time.Time
+}
+
+func newSimulatedEcho(ctx context.Context, m latencyModel, r *rand.Rand) (e *simulatedEcho) {
+	pr, pw := io.Pipe()
+	e = &simulatedEcho{
+		ctx:     ctx,
+		model:   m,
+		rand:    r,
+		pending: make(chan simulatedReply, 1024),
+		r:       pr,
+		w:       pw,
+	}
+
+	go e.deliver()
+	return
+}
+
+func (e *simulatedEcho) deliver() {
+	for {
+		var reply simulatedReply
+		var ok bool
+		select {
+		case reply, ok = <-e.pending:
+		case <-e.ctx.Done():
+		}
+
+		if !ok {
+			break
+		}
+
+		select {
+		case <-time.After(time.Until(reply.due)):
+		case <-e.ctx.Done():
+		}
+
+		if e.ctx.Err() != nil {
+			break
+		}
+
+		if _, err := e.w.Write(reply.data); err != nil {
+			return
+		}
+	}
+
+	e.w.CloseWithError(e.ctx.Err())
+}
+
+func (e *simulatedEcho) Write(p []byte) (n int, err error) {
+	// Don't leave it to the select below, which may find room in pending.
+	if err = e.ctx.Err(); err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.writeClosed {
+		err = io.ErrClosedPipe
+		return
+	}
+
+	due := time.Now().Add(e.model.sample(e.rand))
+	if due.Before(e.lastDue) {
+		due = e.lastDue
+	}
+
+	e.lastDue = due
+	select {
+	case e.pending <- simulatedReply{data: append([]byte(nil), p...), due: due}:
+	case <-e.ctx.Done():
+		err = e.ctx.Err()
+		return
+	}
+
+	n = len(p)
+	return
+}
+
+func (e *simulatedEcho) Read(p []byte) (n int, err error) {
+	return e.r.Read(p)
+}
+
+func (e *simulatedEcho) CloseWrite() (err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.writeClosed {
+		e.writeClosed = true
+		close(e.pending)
+	}
+
+	return
+}
+
+func (e *simulatedEcho) Close() (err error) {
+	e.CloseWrite()
+
+	// Unblock delivery of any echoes that nobody will read.
+	e.r.Close()
+	return
+}
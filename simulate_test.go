@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLatencyModel(t *testing.T) {
+	cases := []struct {
+		model string
+
+		// The range every sample must fall in, or a substring of the error
+		// expected.
+		min, max time.Duration
+		wantErr  string
+	}{
+		{model: "constant(20ms)", min: 20 * time.Millisecond, max: 20 * time.Millisecond},
+		{model: "uniform(10ms,20ms)", min: 10 * time.Millisecond, max: 20 * time.Millisecond},
+		{model: "normal(20ms,5ms)", min: 0, max: time.Second},
+		{model: "spikes(100%,300ms)", min: 300 * time.Millisecond, max: 300 * time.Millisecond},
+		{model: "spikes(0%,300ms)", min: 0, max: 0},
+		{model: "loss(0%,200ms)", min: 0, max: 0},
+		{model: " constant(5ms) + spikes(100%, 10ms) ", min: 15 * time.Millisecond, max: 15 * time.Millisecond},
+		{model: "constant(5ms)+uniform(1ms,2ms)", min: 6 * time.Millisecond, max: 7 * time.Millisecond},
+
+		{model: "", wantErr: "malformed term"},
+		{model: "constant", wantErr: "malformed term"},
+		{model: "gamma(1ms)", wantErr: "unknown term"},
+		{model: "normal(20ms)", wantErr: "want 2 arguments"},
+		{model: "constant(20)", wantErr: "missing unit"},
+		{model: "uniform(20ms,10ms)", wantErr: "empty range"},
+		{model: "spikes(1,300ms)", wantErr: "not a percentage"},
+		{model: "loss(100%,200ms)", wantErr: "less than 100%"},
+		{model: "spikes(-1%,300ms)", wantErr: "not from 0% to 100%"},
+		{model: "spikes(101%,300ms)", wantErr: "not from 0% to 100%"},
+	}
+
+	for _, c := range cases {
+		m, err := parseLatencyModel(c.model)
+		if c.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("%q: error %v; want one containing %q", c.model, err, c.wantErr)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", c.model, err)
+			continue
+		}
+
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 1000; i++ {
+			if d := m.sample(r); d < c.min || d > c.max {
+				t.Errorf("%q: sampled %v; want %v to %v", c.model, d, c.min, c.max)
+				break
+			}
+		}
+	}
+}
+
+func TestLossTerm(t *testing.T) {
+	m, err := parseLatencyModel("loss(50%,100ms)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each loss doubles the retransmission timeout, so every sample is 0,
+	// 100ms, 100ms+200ms, 100ms+200ms+400ms, and so on.
+	r := rand.New(rand.NewSource(1))
+	lost := 0
+	for i := 0; i < 1000; i++ {
+		d := m.sample(r)
+		if n := d/(100*time.Millisecond) + 1; d%(100*time.Millisecond) != 0 || n&(n-1) != 0 {
+			t.Fatalf("sampled %v; want a sum of doubling timeouts", d)
+		}
+
+		if d != 0 {
+			lost++
+		}
+	}
+
+	if lost < 400 || lost > 600 {
+		t.Errorf("%d of 1000 pings lost; want about half", lost)
+	}
+
+	// Near-certain loss costs a lot, but the timeout stops doubling at 60s
+	// rather than overflowing.
+	m, err = parseLatencyModel("loss(99.99%,1s)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if d := m.sample(r); d < 0 {
+			t.Fatalf("sampled %v; want a positive duration", d)
+		}
+	}
+}
+
+func TestSimulatedEcho(t *testing.T) {
+	m, err := parseLatencyModel("uniform(10ms,30ms)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := newSimulatedEcho(context.Background(), m, rand.New(rand.NewSource(1)))
+	defer e.Close()
+
+	// Echoes arrive in the order written, however their latencies are drawn,
+	// and no sooner than the least latency.
+	lines := []string{"a\n", "b\n", "c\n", "d\n", "e\n"}
+	start := time.Now()
+	for _, l := range lines {
+		if _, err := io.WriteString(e, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := bufio.NewReader(e)
+	for _, want := range lines {
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Errorf("echoed %q; want %q", got, want)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("echoed after %v; want at least 10ms", elapsed)
+	}
+
+	// Once the write side is closed, the echoes end, and writes fail.
+	e.CloseWrite()
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("read after CloseWrite succeeded")
+	}
+
+	if _, err := io.WriteString(e, "f\n"); err != io.ErrClosedPipe {
+		t.Errorf("write after CloseWrite: %v; want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestSimulatedEchoCancelled(t *testing.T) {
+	m, err := parseLatencyModel("constant(1h)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e := newSimulatedEcho(ctx, m, rand.New(rand.NewSource(1)))
+	defer e.Close()
+
+	if _, err := io.WriteString(e, "ping\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := e.Read(make([]byte, 5)); err != context.Canceled {
+		t.Errorf("read after cancellation: %v; want %v", err, context.Canceled)
+	}
+
+	if _, err := io.WriteString(e, "ping\n"); err != context.Canceled {
+		t.Errorf("write after cancellation: %v; want %v", err, context.Canceled)
+	}
+}
+
+// The measurement loop, run against simulatedTransport.
+func TestMeasureSimulated(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures for several seconds")
+	}
+
+	saved := progressOutput
+	progressOutput = io.Discard
+	defer func() { progressOutput = saved }()
+
+	cases := []struct {
+		name  string
+		flags map[string]string
+		check func(t *testing.T, r run)
+	}{
+		{
+			name:  "delay",
+			flags: map[string]string{"simulate": "constant(20ms)"},
+			check: func(t *testing.T, r run) {
+				d := r.distribution()
+				if d.count() < 10 {
+					t.Errorf("collected %d samples; want at least 10", d.count())
+				}
+
+				if min, max := d.min(), d.max(); min < 20*time.Millisecond || max > 40*time.Millisecond {
+					t.Errorf("samples from %v to %v; want a little over 20ms", min, max)
+				}
+			},
+		},
+		{
+			name:  "loss",
+			flags: map[string]string{"simulate": "constant(1ms)+loss(20%,50ms)"},
+			check: func(t *testing.T, r run) {
+				d := r.distribution()
+				if d.min() > 10*time.Millisecond {
+					t.Errorf("least latency %v; want some pings delivered without loss", d.min())
+				}
+
+				if d.max() < 50*time.Millisecond {
+					t.Errorf("greatest latency %v; want some pings retransmitted", d.max())
+				}
+			},
+		},
+		{
+			name:  "timeouts",
+			flags: map[string]string{"simulate": "constant(1ms)+spikes(20%,500ms)", "ping-timeout": "100ms"},
+			check: func(t *testing.T, r run) {
+				if r.timeouts() == 0 {
+					t.Error("no timeouts recorded")
+				}
+
+				if len(r.setup) < 2 {
+					t.Errorf("made %d connections; want a reconnection after each timeout", len(r.setup))
+				}
+
+				if max := r.distribution().max(); max >= 100*time.Millisecond {
+					t.Errorf("sample of %v despite --ping-timeout=100ms", max)
+				}
+			},
+		},
+		{
+			name:  "reconnect",
+			flags: map[string]string{"simulate": "constant(1ms)", "reconnect-every": "300ms"},
+			check: func(t *testing.T, r run) {
+				if len(r.setup) < 3 {
+					t.Errorf("made %d connections; want at least 3", len(r.setup))
+				}
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			flags := map[string]string{"duration": "1s", "seed": "1"}
+			for name, value := range c.flags {
+				flags[name] = value
+			}
+
+			setFlags(t, flags)
+			r, err := measure(context.Background(), transportOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.check(t, r)
+		})
+	}
+}
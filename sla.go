@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// An slaHost is what the runs of a host stored with --db show about it over
+// a billing period.
+type slaHost struct {
+	host string
+
+	// Runs that collected samples, and those that failed without any.
+	runs   int
+	failed int
+
+	// The answered pings, and those that timed out.
+	hist histogram
+	lost int
+
+	incidents []incident
+}
+
+// slaTargets are what report sla judges each host against.
+type slaTargets struct {
+	// The percentage of pings that should be answered.
+	availability float64
+
+	// The percentage of answered pings that should take at most latency.
+	latencyShare float64
+	latency      time.Duration
+}
+
+// availability returns the percentage of the host's pings that were
+// answered, or false if none were sent.
+func (h *slaHost) availability() (float64, bool) {
+	sent := h.hist.count() + h.lost
+	if sent == 0 {
+		return 0, false
+	}
+
+	return 100 * float64(h.hist.count()) / float64(sent), true
+}
+
+// attainment returns the percentage of the host's answered pings that took
+// at most d, or false if none were answered.
+func (h *slaHost) attainment(d time.Duration) (float64, bool) {
+	if h.hist.count() == 0 {
+		return 0, false
+	}
+
+	return 100 * float64(h.hist.within(d)) / float64(h.hist.count()), true
+}
+
+// slaHosts reads what happened to the host, or to every host if it's empty,
+// in runs that started in [since, until).
+func slaHosts(ctx context.Context, db *sql.DB, host string, since, until time.Time) (hosts []*slaHost, err error) {
+	byHost := make(map[string]*slaHost)
+	get := func(name string) *slaHost {
+		h := byHost[name]
+		if h == nil {
+			h = &slaHost{host: name}
+			byHost[name] = h
+			hosts = append(hosts, h)
+		}
+
+		return h
+	}
+
+	runs, err := storedRuns(ctx, db, host, since, until)
+	if err != nil {
+		return
+	}
+
+	for _, r := range runs {
+		h := get(r.host)
+		h.runs++
+		if r.hist != nil {
+			h.hist.merge(r.hist)
+		}
+
+		var events []event
+		if events, err = storedEvents(ctx, db, r.id); err != nil {
+			return
+		}
+
+		for _, e := range events {
+			if e.kind == "timeout" {
+				h.lost++
+			}
+		}
+
+		h.incidents = append(h.incidents, incidents(r.host, events)...)
+	}
+
+	failures, err := storedFailures(ctx, db, host, since, until)
+	if err != nil {
+		return
+	}
+
+	for _, f := range failures {
+		h := get(f.host)
+		h.failed++
+		h.incidents = append(h.incidents, incident{
+			Host:   f.host,
+			Start:  f.started,
+			End:    f.started,
+			Metric: "availability",
+			Kind:   "failed run",
+			Detail: f.err,
+		})
+	}
+
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].host < hosts[j].host })
+	for _, h := range hosts {
+		sort.SliceStable(h.incidents, func(i, j int) bool { return h.incidents[i].Start.Before(h.incidents[j].Start) })
+	}
+
+	return
+}
+
+// writeSLAReport writes a Markdown report of each host's availability,
+// latency, and incidents over [since, until), judged against the targets.
+func writeSLAReport(w io.Writer, hosts []*slaHost, since, until time.Time, targets slaTargets) {
+	const day = "2006-01-02"
+	fmt.Fprintf(w, "# SLA report: %s to %s\n", since.Format(day), until.AddDate(0, 0, -1).Format(day))
+	if len(hosts) == 0 {
+		fmt.Fprintf(w, "\nNo runs were recorded in this period.\n")
+	}
+
+	verdict := func(got, want float64) string {
+		if got >= want {
+			return "Met"
+		}
+
+		return "Missed"
+	}
+
+	for _, h := range hosts {
+		fmt.Fprintf(w, "\n## %s\n\n", h.host)
+		fmt.Fprintf(w, "| Objective | Measured | Target | |\n")
+		fmt.Fprintf(w, "|---|---|---|---|\n")
+
+		if a, ok := h.availability(); ok {
+			fmt.Fprintf(
+				w,
+				"| Availability | %.3f%% (%d of %d pings lost) | %g%% | %s |\n",
+				a,
+				h.lost,
+				h.hist.count()+h.lost,
+				targets.availability,
+				verdict(a, targets.availability))
+		} else {
+			fmt.Fprintf(w, "| Availability | no pings sent | %g%% | |\n", targets.availability)
+		}
+
+		if a, ok := h.attainment(targets.latency); ok {
+			fmt.Fprintf(
+				w,
+				"| Pings within %v | %.3f%% | %g%% | %s |\n",
+				targets.latency,
+				a,
+				targets.latencyShare,
+				verdict(a, targets.latencyShare))
+		} else {
+			fmt.Fprintf(w, "| Pings within %v | no pings answered | %g%% | |\n", targets.latency, targets.latencyShare)
+		}
+
+		fmt.Fprintf(w, "\n%d runs", h.runs)
+		if h.failed > 0 {
+			fmt.Fprintf(w, ", and %d that failed without collecting samples", h.failed)
+		}
+
+		fmt.Fprintf(w, ".")
+		if h.hist.count() > 0 {
+			fmt.Fprintf(
+				w,
+				" Round trip times: p50 %v, p95 %v, p99 %v, max %v.",
+				h.hist.percentile(50).Round(10*time.Microsecond),
+				h.hist.percentile(95).Round(10*time.Microsecond),
+				h.hist.percentile(99).Round(10*time.Microsecond),
+				h.hist.max().Round(10*time.Microsecond))
+		}
+
+		fmt.Fprintf(w, "\n\n### Incidents\n\n")
+		if len(h.incidents) == 0 {
+			fmt.Fprintf(w, "None.\n")
+		}
+
+		const clock = "2006-01-02 15:04:05 MST"
+		for _, i := range h.incidents {
+			fmt.Fprintf(w, "- %s", i.Start.Local().Format(clock))
+			if i.End.After(i.Start) {
+				fmt.Fprintf(w, " to %s", i.End.Local().Format(clock))
+			}
+
+			fmt.Fprintf(w, ": %s", i.Kind)
+			if i.PeakMs != 0 {
+				fmt.Fprintf(w, ", peaking at %v", time.Duration(i.PeakMs*float64(time.Millisecond)).Round(10*time.Microsecond))
+			}
+
+			if i.Detail != "" {
+				fmt.Fprintf(w, " (%s)", i.Detail)
+			}
+
+			fmt.Fprintf(w, "\n")
+		}
+	}
+}
+
+// runSLA implements the report sla subcommand, which reports each host's
+// availability, latency SLO attainment, and incidents over a billing period
+// from the runs stored with --db, in Markdown.
+func runSLA(ctx context.Context, args []string) {
+	fs := newSubcommandFlagSet("sla", []string{"db", "host"})
+	since := fs.String("since", "", "The first day of the billing period, like 2006-01-02. The default is the first of last month.")
+	until := fs.String("until", "", "The day after the billing period ends, like 2006-01-02. The default is the first of this month.")
+	var targets slaTargets
+	fs.Float64Var(&targets.availability, "availability", 99.9, "The percentage of pings that should be answered.")
+	fs.DurationVar(&targets.latency, "latency", 100*time.Millisecond, "The round trip time that pings should take at most.")
+	fs.Float64Var(&targets.latencyShare, "latency-share", 99, "The percentage of answered pings that should take at most --latency.")
+	fs.Parse(args)
+
+	now := time.Now()
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	start, end := thisMonth.AddDate(0, -1, 0), thisMonth
+	if *since != "" {
+		start = parseReportDate("since", *since)
+	}
+
+	if *until != "" {
+		end = parseReportDate("until", *until)
+	}
+
+	if !end.After(start) {
+		fmt.Fprintf(os.Stderr, "--until must be after --since.\n")
+		os.Exit(1)
+	}
+
+	db := openStoredHistory()
+	defer db.Close()
+
+	hosts, err := slaHosts(ctx, db, *host, start, end)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	writeSLAReport(os.Stdout, hosts, start, end, targets)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLAReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.db")
+	since := time.Date(2026, 9, 1, 0, 0, 0, 0, time.Local)
+	until := since.AddDate(0, 1, 0)
+	started := since.Add(2 * time.Hour)
+
+	// 996 answered pings, 10 of them slow, and 4 timeouts.
+	var r run
+	for i := 0; i < 996; i++ {
+		rtt := 20 * time.Millisecond
+		if i < 10 {
+			rtt = 300 * time.Millisecond
+		}
+
+		r.add(started.Add(time.Duration(i)*time.Second), rtt)
+	}
+
+	for i := 0; i < 4; i++ {
+		r.events = append(r.events, event{kind: "timeout", start: started.Add(time.Duration(i) * time.Minute), duration: time.Second})
+	}
+
+	if err := recordRun(path, "bastion", started, time.Hour, r); err != nil {
+		t.Fatalf("recordRun: %v", err)
+	}
+
+	if err := recordFailedRun(path, "bastion", started.AddDate(0, 0, 1), errors.New("connection refused")); err != nil {
+		t.Fatalf("recordFailedRun: %v", err)
+	}
+
+	// Outside the period.
+	if err := recordRun(path, "bastion", until, time.Hour, r); err != nil {
+		t.Fatalf("recordRun: %v", err)
+	}
+
+	db, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	hosts, err := slaHosts(context.Background(), db, "", since, until)
+	if err != nil {
+		t.Fatalf("slaHosts: %v", err)
+	}
+
+	if len(hosts) != 1 {
+		t.Fatalf("got %d hosts; want 1", len(hosts))
+	}
+
+	h := hosts[0]
+	if h.runs != 1 || h.failed != 1 || h.lost != 4 || len(h.incidents) != 5 {
+		t.Errorf("got %d runs, %d failed, %d lost pings, and %d incidents; want 1, 1, 4, and 5", h.runs, h.failed, h.lost, len(h.incidents))
+	}
+
+	if got, _ := h.availability(); got != 99.6 {
+		t.Errorf("availability = %v; want 99.6", got)
+	}
+
+	if got, _ := h.attainment(100 * time.Millisecond); got != 100*986.0/996 {
+		t.Errorf("attainment = %v; want %v", got, 100*986.0/996)
+	}
+
+	var b strings.Builder
+	writeSLAReport(&b, hosts, since, until, slaTargets{availability: 99.9, latency: 100 * time.Millisecond, latencyShare: 99})
+	for _, want := range []string{
+		"# SLA report: 2026-09-01 to 2026-09-30",
+		"| Availability | 99.600% (4 of 1000 pings lost) | 99.9% | Missed |",
+		"| Pings within 100ms | 98.996% | 99% | Missed |",
+		"failed run (connection refused)",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("report doesn't contain %q:\n%s", want, b.String())
+		}
+	}
+}
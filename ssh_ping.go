@@ -6,146 +6,1559 @@
 //
 // This will make an SSH connection, then repeatedly send data to be echoed
 // back to the client, measuring statistics about how long echoing takes. Stats
-// are collected for five seconds and then printed to stdout.
+// are collected for five seconds (or as set by --duration) and then printed to
+// stdout.
 package main
 
 import (
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
-
-	"github.com/montanaflynn/stats"
 )
 
 var host = flag.String("host", "", "Host to connect to over SSH.")
 
-func formatMillis(d time.Duration) string {
-	return fmt.Sprintf("%4.1f ms", float64(d.Round(100*time.Microsecond))/float64(time.Millisecond))
+var transportKind = flag.String(
+	"transport",
+	"exec",
+	"How to connect: exec to run the ssh command, or native to use a built-in SSH client. "+
+		"The native client doesn't read ~/.ssh/config; it authenticates with ssh-agent and "+
+		"unencrypted keys in ~/.ssh.")
+
+var strictHostKeyChecking = flag.String(
+	"strict-host-key-checking",
+	"yes",
+	"How to verify the host's key against ~/.ssh/known_hosts: yes, no, or accept-new. "+
+		"With accept-new, keys for previously unknown hosts are recorded. The default of yes "+
+		"is for --transport=native only: --transport=exec passes -o StrictHostKeyChecking "+
+		"to ssh only when this is set explicitly, and otherwise leaves it to ssh's own "+
+		"configuration.")
+
+var interactive = flag.Bool(
+	"interactive",
+	false,
+	"With --transport=exec, let ssh prompt on the terminal for passwords and passphrases. "+
+		"Otherwise it runs in batch mode, failing at once rather than waiting for input.")
+
+var useMPTCP = flag.Bool(
+	"mptcp",
+	false,
+	"With --transport=native, connect with Multipath TCP where the OS supports it, "+
+		"falling back to TCP otherwise, and report how many subflows were used.")
+
+var constrained = flag.Bool(
+	"constrained",
+	false,
+	"Tune for embedded devices and routers running dropbear and BusyBox: offer the older "+
+		"key exchanges, ciphers, and host key types they may be limited to, and reconnect "+
+		"after 10s without an echo (unless --ping-timeout is set) rather than waiting forever.")
+
+var sshProgram = flag.String(
+	"ssh-command",
+	"",
+	"With --transport=exec, the SSH client to run, e.g. C:\\tools\\plink.exe. Either "+
+		"OpenSSH's ssh or PuTTY's plink. By default, ssh on the PATH, or on Windows the "+
+		"OpenSSH client that ships with it, or failing that plink.")
+
+var proxyURL = flag.String(
+	"proxy",
+	"",
+	"Connect through a proxy, e.g. socks5://host:1080 or http://host:3128 (using CONNECT). "+
+		"Requires --transport=native.")
+
+var tcpNoDelay = flag.Bool(
+	"tcp-nodelay",
+	true,
+	"With --transport=native, set TCP_NODELAY, disabling Nagle's algorithm.")
+
+var tos = flag.Int(
+	"tos",
+	0,
+	"With --transport=native, set the IP type of service byte (IPv6 traffic class) of "+
+		"the connection to this value, e.g. 0xb8. Zero leaves it alone.")
+
+var dscp = flag.String(
+	"dscp",
+	"",
+	"With --transport=native, mark the connection with this DSCP codepoint, as a number "+
+		"or a name like EF, AF41, or CS1. An alternative to --tos.")
+
+var tcpKeepAlive = flag.Duration(
+	"tcp-keepalive",
+	defaultTCPKeepAlive,
+	"With --transport=native, send TCP keepalives this often on an idle connection. "+
+		"Negative disables them.")
+
+var netns = flag.String(
+	"netns",
+	"",
+	"On Linux, connect from within this network namespace, as named by ip netns or given "+
+		"as a path like /proc/PID/ns/net. Names are still resolved in the current namespace. "+
+		"With --transport=exec, ssh is run with nsenter.")
+
+var bindDevice = flag.String(
+	"bind-device",
+	"",
+	"On Linux, bind connections to this network interface or VRF with SO_BINDTODEVICE. "+
+		"Requires --transport=native.")
+
+var ipv4 = flag.Bool("4", false, "Connect only over IPv4.")
+
+var ipv6 = flag.Bool("6", false, "Connect only over IPv6.")
+
+var compareAF = flag.Bool(
+	"compare-af",
+	false,
+	"Resolve both IPv4 and IPv6 addresses for the host, measure over each, "+
+		"and print a comparison table.")
+
+var perAddress = flag.Bool(
+	"per-address",
+	false,
+	"Measure each of the addresses the host name resolves to in turn, and report "+
+		"stats for each, flagging slow ones. Also reports the name an alias leads to.")
+
+var compareHostsFlag = flag.String(
+	"compare-hosts",
+	"",
+	"Two hosts to compare, e.g. a.example.com,b.example.com. If set, alternate pings "+
+		"between them for --duration and report whether the difference in latency is "+
+		"statistically significant.")
+
+var comparePaths = flag.String(
+	"compare-paths",
+	"",
+	"Two local interfaces or addresses to connect from, e.g. eth0,wlan0. If set, measure "+
+		"over both at once, printing their latency side by side each second, to compare "+
+		"paths while toggling them.")
+
+var cacheTTL = flag.Duration(
+	"cache-ttl",
+	0,
+	"If set, cache resolved addresses in a state file in the user's cache directory, "+
+		"reusing them for this long, and warn when a host's addresses or (with "+
+		"--transport=native) host key change between runs.")
+
+var duration = flag.Duration(
+	"duration",
+	5*time.Second,
+	"How long to collect samples for.")
+
+var interval = flag.Duration(
+	"interval",
+	0,
+	"If set, send a ping this often rather than back to back.")
+
+var correctOmission = flag.Bool(
+	"correct-coordinated-omission",
+	false,
+	"With --interval, when an echo takes longer than the interval, count the pings that "+
+		"would have been sent meanwhile as having waited for it, instead of sending them "+
+		"late. This stops stalls from making high percentiles look better than they are.")
+
+var adaptiveBudget = flag.String(
+	"adaptive-budget",
+	"",
+	"A bandwidth like 200B/s or 10KB/m. If set, instead of a fixed --interval, send pings "+
+		"more often while latency is volatile and less often while it's calm, using no more "+
+		"than this bandwidth over time, for long runs on slow links.")
+
+var keepWarm = flag.String(
+	"keep-warm",
+	"",
+	"A rate like 1/s or 6/m. If set, send a byte at this rate on a separate session over "+
+		"the same connection, so that a path with NAT or firewall state kept alive can be "+
+		"compared with one left idle between --interval pings.")
+
+// The period between keep-warm bytes, parsed from --keep-warm.
+var keepWarmPeriod time.Duration
+
+var echoMode = flag.String(
+	"echo",
+	"cat",
+	"How pings are echoed: cat, running cat on the host; sftp, timing SFTP requests, for "+
+		"servers with a forced command or restricted shell that still allow SFTP; or auto, "+
+		"trying cat and falling back to sftp.")
+
+var remoteCommand = flag.String(
+	"remote-command",
+	"",
+	"A command to run on the host to echo pings instead of cat, e.g. the path to an echo "+
+		"program for a server with a restricted shell. It must copy its input to its output "+
+		"unbuffered; this is checked before measuring.")
+
+var reconnectEvery = flag.Duration(
+	"reconnect-every",
+	0,
+	"If set, tear down and re-establish the connection this often, "+
+		"reporting connection setup time separately from echo RTT.")
+
+var bucketWidth = flag.Duration(
+	"bucket",
+	0,
+	"If set, also print statistics for each interval of this length over the course of "+
+		"the run, e.g. 10s, to show how latency evolved.")
+
+var configPath = flag.String(
+	"config",
+	"",
+	"A YAML file listing targets to measure in turn, each with its own options such as "+
+		"port, jump host, interval, and thresholds. See the README for the format.")
+
+var otlpEndpoint = flag.String(
+	"otlp-endpoint",
+	"",
+	"If set, export the latency histogram as an OpenTelemetry metric to this OTLP/HTTP "+
+		"endpoint, e.g. http://localhost:4318. Headers such as credentials are read from "+
+		"OTEL_EXPORTER_OTLP_HEADERS.")
+
+var otlpTraces = flag.Bool(
+	"otlp-traces",
+	false,
+	"With --otlp-endpoint, also export a trace with a span for each connection's setup, "+
+		"with a child for each phase of it, and for each ping.")
+
+var dbPath = flag.String(
+	"db",
+	"",
+	"If set, append this run's summary, samples, and events, or its failure, to the SQLite "+
+		"database in this file, for the report subcommand to report on.")
+
+var incidentsOut = flag.String(
+	"incidents",
+	"",
+	"If set, write the run's incidents (latency spikes, timeouts, and bad replies) to this "+
+		"file, as CSV if it ends in .csv and JSON otherwise.")
+
+var grafanaURL = flag.String(
+	"grafana-url",
+	"",
+	"If set, push the run's incidents to this Grafana's annotations API, e.g. "+
+		"https://grafana.example.com, authenticating with the token in GRAFANA_TOKEN.")
+
+var learnMetrics = flag.String(
+	"learn-thresholds",
+	"",
+	"Metrics like p95,p99 for which to add thresholds learned from this host's runs in "+
+		"--db: the metric over --learn-window, plus --learn-margin.")
+
+var learnWindow = flag.Duration(
+	"learn-window",
+	14*24*time.Hour,
+	"How far back --learn-thresholds looks.")
+
+var learnMargin = flag.Float64(
+	"learn-margin",
+	0.2,
+	"How far above the learned value a --learn-thresholds threshold is, as a fraction.")
+
+var plotOut = flag.String(
+	"plot",
+	"",
+	"If set, write an SVG chart of samples over time, with percentile bands, to this file.")
+
+var bundleOut = flag.String(
+	"bundle",
+	"",
+	"If set, write a .tar.gz archive of the run to this file: its summary, samples, "+
+		"events, flags, environment, and plot, for sharing or reproducing it.")
+
+var spikeThreshold = flag.Duration(
+	"spike-threshold",
+	time.Second,
+	"Samples taking at least this long are reported as spikes in the event timeline "+
+		"printed after the summary, with consecutive ones merged. Zero disables this.")
+
+var pingTimeout = flag.Duration(
+	"ping-timeout",
+	0,
+	"If set, abandon the connection and reconnect if no echo arrives for this long, "+
+		"reporting a timeout in the event timeline. Unless --retries or --failover-gap "+
+		"is set, the run fails if the first connection times out, or if three in a row "+
+		"do without an echo.")
+
+var failoverGap = flag.Duration(
+	"failover-gap",
+	0,
+	"If set, test failover: ping continuously, reconnect as soon as the connection "+
+		"breaks and for as long as it takes, and report each gap of at least this long "+
+		"in which no echo arrived, with how recovery happened. Sets --ping-timeout to 1s "+
+		"if it isn't set.")
+
+var retries = flag.Int(
+	"retries",
+	0,
+	"If set, when an echo times out or the connection fails, retry on a new connection "+
+		"up to this many times in a row rather than ending the run, and break down the "+
+		"retries in the summary. Sets --ping-timeout to 5s if it isn't set. For the gate "+
+		"subcommand, also how many times to try connecting, 10 if it isn't set.")
+
+var streams = flag.Int(
+	"streams",
+	1,
+	"Number of echo sessions to run concurrently over a single connection.")
+
+var ciphers = flag.String(
+	"compare-ciphers",
+	"",
+	"Comma-separated list of ciphers (e.g. aes128-gcm@openssh.com,chacha20-poly1305@openssh.com). "+
+		"If set, measure once with each and print a comparison table.")
+
+var compareMACsFlag = flag.String(
+	"compare-macs",
+	"",
+	"Comma-separated list of MACs (e.g. hmac-sha2-256-etm@openssh.com,hmac-sha2-512-etm@openssh.com). "+
+		"If set, measure once with each and print a comparison table. Each is measured with "+
+		"the "+macComparisonCipher+" cipher, since AEAD ciphers don't use a MAC.")
+
+var compareKexFlag = flag.String(
+	"compare-kex",
+	"",
+	"Comma-separated list of key exchange algorithms (e.g. curve25519-sha256,ecdh-sha2-nistp256). "+
+		"If set, measure once with each and print comparison tables of echo round trip time "+
+		"and of connection setup, with a sample of the latter per connection; see --reconnect-every.")
+
+var compareCompression = flag.Bool(
+	"compare-compression",
+	false,
+	"Measure with and without SSH compression and print a comparison table.")
+
+var comparePTY = flag.Bool(
+	"compare-pty",
+	false,
+	"Measure with and without a pseudo-terminal allocated for the echo, as interactive "+
+		"sessions have, and print a comparison table.")
+
+var payloadSize = flag.Int(
+	"payload-size",
+	4,
+	"Number of bytes to send in each ping. Echoes are checked against what was sent, and "+
+		"pings of 3 bytes or more also carry a sequence number and checksum, so that a "+
+		"reordered echo can be told from a corrupted one. Below 19 bytes, the sequence "+
+		"number is truncated to what fits.")
+
+var compareMultiplexing = flag.Bool(
+	"compare-multiplexing",
+	false,
+	"Compare opening sessions over an existing ControlMaster connection with "+
+		"opening cold connections, reporting session open latency and echo RTT for each.")
+
+var probeSessions = flag.Int(
+	"probe-sessions",
+	0,
+	"If set, open up to this many concurrent sessions over one connection, reporting "+
+		"when the server refuses more (its MaxSessions) and how latency is affected, "+
+		"then open increasing numbers of connections at once to show the effect of MaxStartups.")
+
+var idleGaps = flag.String(
+	"idle-gaps",
+	"",
+	"A comma-separated list of durations like 1s,10s,60s. If set, leave the connection "+
+		"idle for each in turn and measure the first ping afterwards separately, showing "+
+		"the penalty paid after idling.")
+
+var keepaliveIntervals = flag.String(
+	"keepalive-intervals",
+	"",
+	"With --idle-gaps, a comma-separated list of SSH keepalive intervals like off,15s,60s. "+
+		"Run the idle gaps on a fresh connection with each, as ServerAliveInterval would, "+
+		"to see whether keepalives avoid the penalty after idling or a lost connection.")
+
+var underLoad = flag.Bool(
+	"under-load",
+	false,
+	"Measure latency on an idle connection and then while a bulk transfer saturates it, "+
+		"each for --duration, and compare the two. Also prints the bandwidth-delay product "+
+		"and suggested buffer tuning.")
+
+var simulate = flag.String(
+	"simulate",
+	"",
+	"If set, don't connect to a host. Instead simulate pings with latencies "+
+		"drawn from this model, e.g. 'normal(20ms,5ms)+spikes(1%,300ms)'.")
+
+var injectFaults = flag.String(
+	"inject-faults",
+	"",
+	"Faults to inject into the stream to the echo process for resilience testing, "+
+		"e.g. 'delay(10%,50ms)+drop(1%)+disconnect(30s)'. Dropped pings are never "+
+		"echoed, so drop sets --ping-timeout to 5s if it isn't set.")
+
+var seed = flag.Int64(
+	"seed",
+	0,
+	"Seed for --simulate and --inject-faults, for reproducible runs. "+
+		"If zero, a seed is chosen based on the time.")
+
+var deployAgent = flag.Bool(
+	"deploy-agent",
+	false,
+	"Copy a small echo agent to the remote host and use it instead of cat to echo "+
+		"pings, so that remote timestamps are available. The agent is built for the "+
+		"remote host's OS and architecture, which needs Go on the PATH the first time "+
+		"for each. The copy is removed afterward.")
+
+var responseSize = flag.Int(
+	"response-size",
+	0,
+	"With --deploy-agent, have the agent follow each echo with this many extra bytes, "+
+		"to model small commands with large output.")
+
+var reverse = flag.Bool(
+	"reverse",
+	false,
+	"Also measure from the remote host back: over the connection used to deploy the "+
+		"agent, have it send pings for this machine to echo, and report their round trip "+
+		"times and one-way delays alongside those of pings sent from here, to reveal "+
+		"asymmetric routing. Implies --deploy-agent.")
+
+var baseline = flag.String(
+	"baseline",
+	"",
+	"If set to tcp or icmp, concurrently measure the raw network RTT to the host with TCP "+
+		"connections to the SSH port or with the ping command, and report SSH's overhead.")
+
+var useHistogram = flag.Bool(
+	"histogram",
+	false,
+	"Accumulate samples in a histogram rather than keeping each one, so that memory use "+
+		"stays constant on long runs. Percentiles are then accurate to within about 1%. "+
+		"Can't be used with --segments, --deploy-agent, or --reference.")
+
+var segments = flag.Bool(
+	"segments",
+	false,
+	"Detect changes in latency during the run and report each distinct regime.")
+
+var resolve resolveOverrides
+
+var thresholds thresholdList
+
+func init() {
+	flag.Var(
+		&resolve,
+		"resolve",
+		"Connect to the given address for a host, like host:192.0.2.1, while still checking "+
+			"its key under its own name. May be repeated.")
+
+	flag.Var(
+		&thresholds,
+		"threshold",
+		"A limit like p95<80ms on min, max, mean, stddev, or a percentile. May be repeated. "+
+			"The exit status is non-zero if any threshold is breached. Prefix the metric with "+
+			"setup:, auth:, channel:, or dwell: to limit that phase instead of echo round trip "+
+			"time, e.g. auth:p95<200ms; auth and channel need --transport=native, and dwell "+
+			"needs --deploy-agent.")
 }
 
-func toFloatSeconds(s []time.Duration) []float64 {
-	result := make([]float64, 0, len(s))
-	for _, d := range s {
-		result = append(result, float64(d)/float64(time.Second))
+var format = flag.String(
+	"format",
+	"text",
+	"Output format: text; github for text plus GitHub Actions annotations for breached "+
+		"(or nearly breached) thresholds; junit for a JUnit XML report with a test case "+
+		"per --threshold; ndjson for a JSON object per sample or timeout as it happens, then "+
+		"one for the summary; json for the summary as a JSON object; or csv for it as a "+
+		"CSV row per statistic.")
+
+var units = flag.String(
+	"units",
+	"auto",
+	"The unit to show latencies in: ms, us, s, or auto for whichever suits each, so that "+
+		"sub-millisecond latencies on a LAN aren't all shown as 0.x ms. Machine-readable "+
+		"output is always in milliseconds, to the microsecond.")
+
+var noColor = flag.Bool(
+	"no-color",
+	false,
+	"Don't color the summary's statistics by level, as is done when standard output is "+
+		"a terminal and NO_COLOR isn't set.")
+
+var levels = flag.String(
+	"levels",
+	"",
+	"Two latencies like 100ms,250ms: statistics below the first are good, below the "+
+		"second a warning, and otherwise bad, as shown by color and in --format=json and "+
+		"csv. A --threshold on a statistic overrides them. Defaults to 100ms,250ms.")
+
+var annotate = flag.Bool(
+	"annotate",
+	false,
+	"Read annotations like \"switched to 5GHz now\" from standard input during the run, "+
+		"one per line. Each is timestamped and included in the event timeline and in "+
+		"--format=ndjson, --incidents, --grafana-url, --db, --plot, and --bundle.")
+
+var annotateSocket = flag.String(
+	"annotate-socket",
+	"",
+	"If set, listen on a Unix socket at this path for annotations during the run, one "+
+		"per line, as with --annotate.")
+
+var schedule = flag.String(
+	"schedule",
+	"",
+	"A schedule in crontab format, like '*/5 * * * *', or @hourly or @daily. If set, run "+
+		"until stopped, measuring for --duration each time it fires rather than "+
+		"continuously, and adding each result to --db, --otlp-endpoint, or the output.")
+
+var listenAddr = flag.String(
+	"listen",
+	"",
+	"With --schedule, serve a status page showing each host's latest latency on this "+
+		"address, like :8080, along with a JSON API: /api/hosts, /api/hosts/HOST/stats, and "+
+		"/api/hosts/HOST/samples?since=TIME.")
+
+var statsWindows = flag.String(
+	"windows",
+	"",
+	"With --schedule, a comma-separated list of windows over which to keep statistics "+
+		"for each host across runs: sliding:D for the last D, tumbling:D for the last "+
+		"complete period of length D aligned to the clock, and decay:D for all samples, "+
+		"weighted by half for each D since they were sent. E.g. "+
+		"sliding:1m,tumbling:10m,decay:5m. Each is printed after the summary, written as a "+
+		"\"window\" line with --format=ndjson, and served by --listen.")
+
+var dailyReportDir = flag.String(
+	"daily-report",
+	"",
+	"With --schedule, a directory to which to write a report for each day, as "+
+		"ssh_ping-DATE.json and ssh_ping-DATE.html, giving each host's percentiles and "+
+		"timeouts for each hour, and its incidents. It's written after midnight, and for "+
+		"the day so far when stopped.")
+
+var mode = flag.String(
+	"mode",
+	"echo",
+	"What to measure: echo, sending pings back to back or per --interval; typing, "+
+		"sending single keystrokes at a human pace over a pseudo-terminal in raw mode, as "+
+		"an editor receives them, and comparing how long they take to echo with echo's pings; "+
+		"or session-startup, repeatedly connecting, running true, and disconnecting for "+
+		"--duration, reporting how long until each command finished: the cost paid by "+
+		"scripts that run ssh once per command. Modes other than echo can't be combined "+
+		"with other ways of measuring, like --compare-ciphers or --under-load.")
+
+var advise = flag.Bool(
+	"advise",
+	false,
+	"After the summary, say how the latency, jitter, and loss measured are expected to feel "+
+		"for common workloads: an interactive shell, vim, port-forwarded RDP, and scp.")
+
+var adviseTransferGB = flag.Float64(
+	"advise-transfer-gb",
+	1,
+	"The size in GB of the scp transfer that --advise estimates the time for.")
+
+var appendOut = flag.String(
+	"append",
+	"",
+	"If set, append a line summarizing the run to this file, like 'time=... host=\"example.com\" "+
+		"samples=294 p50_ms=13.012 p95_ms=21.104 max_ms=26.017 loss=0.000'. The file is locked "+
+		"while writing, so runs for several hosts can share it.")
+
+var samplesOut = flag.String(
+	"samples-out",
+	"",
+	"If set, write each sample to this file, one per line, as it is collected.")
+
+var reference = flag.String(
+	"reference",
+	"",
+	"A file of samples written by --samples-out (e.g. from a known-good network) "+
+		"to compare this run's distribution against.")
+
+func printSummary(r run, rep summaryReport) {
+	d := r.distribution()
+	if r.synthesized > 0 {
+		fmt.Printf(
+			"Collected %d samples, %d of them synthesized to correct for coordinated omission.\n",
+			d.count(),
+			r.synthesized)
+	} else {
+		fmt.Printf("Collected %d samples.\n", d.count())
 	}
 
-	return result
-}
+	r.retried.print()
 
-func computeDurationStat(compute func(stats.Float64Data) (float64, error), s []time.Duration) time.Duration {
-	seconds, err := compute(toFloatSeconds(s))
-	if err != nil {
-		log.Fatal(err)
+	if *responseSize > 0 {
+		fmt.Printf("Each ping was answered with %d bytes more than it sent.\n", *responseSize)
 	}
 
-	return time.Duration(seconds * float64(time.Second))
-}
+	if *echoMode != "cat" {
+		fmt.Printf("Echoed by %s.\n", echoMechanism)
+	}
 
-func min(s []time.Duration) time.Duration {
-	return computeDurationStat(stats.Min, s)
-}
+	if *useMPTCP {
+		mptcpStats.print()
+	}
+
+	if r.pacer != nil {
+		r.pacer.print()
+	}
+
+	if tcpOptionsSet() {
+		fmt.Printf("TCP options: %s.\n", describeTCPOptions())
+	}
+
+	fmt.Printf("\n")
+	textRenderer{color: useColor()}.render(os.Stdout, rep)
+
+	// Robust statistics need the samples themselves, which a histogram
+	// doesn't keep.
+	if r.hist == nil && len(r.samples) > 1 {
+		low, high := bootstrapMedianCI(r.samples)
+		fmt.Printf("\n")
+		fmt.Printf("Trimmed mean (%.0f%%): %s\n", 100*trimFraction, formatLatency(trimmedMean(trimFraction, r.samples)))
+		fmt.Printf("Median abs. dev.:   %s\n", formatLatency(medianAbsDeviation(r.samples)))
+		fmt.Printf("p50 95%% CI:         %s to %s\n", strings.TrimSpace(formatLatency(low)), strings.TrimSpace(formatLatency(high)))
+	}
+
+	if len(r.perStream) > 1 {
+		fmt.Printf("\n")
+		fmt.Printf("%-8s %8s %8s %8s %8s\n", "Stream", "Samples", "p50", "p95", "Max")
+		for i, s := range r.perStream {
+			fmt.Printf(
+				"%-8d %8d %8s %8s %8s\n",
+				i,
+				len(s),
+				formatLatency(median(s)),
+				formatLatency(percentile(95, s)),
+				formatLatency(max(s)))
+		}
+	}
 
-func median(s []time.Duration) time.Duration {
-	return computeDurationStat(stats.Median, s)
+	if *reconnectEvery > 0 {
+		fmt.Printf("\n")
+		fmt.Printf("Connection setup (%d connections):\n", len(r.setup))
+		fmt.Printf("Min:      %s\n", formatLatency(min(r.setup)))
+		fmt.Printf("p50:      %s\n", formatLatency(median(r.setup)))
+		fmt.Printf("Max:      %s\n", formatLatency(max(r.setup)))
+	}
 }
 
-func percentile(percent float64, s []time.Duration) time.Duration {
-	return computeDurationStat(func(data stats.Float64Data) (float64, error) { return stats.Percentile(data, percent) }, s)
+// checkFlags validates flags shared by all modes, exiting with an error
+// message if they are bad.
+func checkFlags() {
+	if *host == "" && *simulate == "" && *configPath == "" && *compareHostsFlag == "" {
+		fmt.Fprintf(os.Stderr, "Must set --host.\n")
+		os.Exit(1)
+	}
+
+	if *reverse {
+		if *format != "text" && *format != "github" {
+			fmt.Fprintf(os.Stderr, "--reverse is only reported with --format=text or github.\n")
+			os.Exit(1)
+		}
+
+		*deployAgent = true
+	}
+
+	switch *strictHostKeyChecking {
+	case "yes", "no", "accept-new":
+	default:
+		fmt.Fprintf(os.Stderr, "--strict-host-key-checking must be yes, no, or accept-new.\n")
+		os.Exit(1)
+	}
+
+	if *proxyURL != "" && *transportKind != "native" {
+		fmt.Fprintf(os.Stderr, "--proxy requires --transport=native.\n")
+		os.Exit(1)
+	}
+
+	if *transportKind == "exec" && *simulate == "" {
+		var err error
+		if execClient, err = locateSSHClient(*sshProgram); err != nil {
+			fmt.Fprintf(os.Stderr, "--ssh-command: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *ipv4 && *ipv6 {
+		fmt.Fprintf(os.Stderr, "-4 and -6 can't be used together.\n")
+		os.Exit(1)
+	}
+
+	if *duration <= 0 {
+		fmt.Fprintf(os.Stderr, "--duration must be positive.\n")
+		os.Exit(1)
+	}
+
+	switch *format {
+	case "text", "github":
+	case "junit", "ndjson", "json", "csv":
+		progressOutput = os.Stderr
+	default:
+		fmt.Fprintf(os.Stderr, "--format must be text, github, junit, ndjson, json, or csv.\n")
+		os.Exit(1)
+	}
+
+	switch *units {
+	case "ms", "us", "s", "auto":
+	default:
+		fmt.Fprintf(os.Stderr, "--units must be ms, us, s, or auto.\n")
+		os.Exit(1)
+	}
+
+	switch *baseline {
+	case "", "tcp", "icmp":
+	default:
+		fmt.Fprintf(os.Stderr, "--baseline must be tcp or icmp.\n")
+		os.Exit(1)
+	}
+
+	if *streams < 1 {
+		fmt.Fprintf(os.Stderr, "--streams must be positive.\n")
+		os.Exit(1)
+	}
+
+	if *correctOmission && (*interval <= 0 || *deployAgent) {
+		fmt.Fprintf(os.Stderr, "--correct-coordinated-omission needs --interval, and can't be used with --deploy-agent.\n")
+		os.Exit(1)
+	}
+
+	if *schedule != "" {
+		var err error
+		if measurementSchedule, err = parseCron(*schedule); err != nil {
+			fmt.Fprintf(os.Stderr, "--schedule: %v\n", err)
+			os.Exit(1)
+		}
+
+		if measurementSchedule.next(time.Now()).IsZero() {
+			fmt.Fprintf(os.Stderr, "--schedule: %q never fires.\n", *schedule)
+			os.Exit(1)
+		}
+
+		if *format == "junit" || *format == "csv" || *annotate {
+			fmt.Fprintf(os.Stderr, "--schedule can't be used with --format=junit, --format=csv, or --annotate.\n")
+			os.Exit(1)
+		}
+	}
+
+	if *listenAddr != "" {
+		if *schedule == "" {
+			fmt.Fprintf(os.Stderr, "--listen needs --schedule, or the monitor subcommand.\n")
+			os.Exit(1)
+		}
+
+		monitorStatus = newStatusStore()
+	}
+
+	if *statsWindows != "" {
+		if *schedule == "" {
+			fmt.Fprintf(os.Stderr, "--windows needs --schedule, or the monitor subcommand.\n")
+			os.Exit(1)
+		}
+
+		var err error
+		if windowSpecs, err = parseWindows(*statsWindows); err != nil {
+			fmt.Fprintf(os.Stderr, "--windows: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *dailyReportDir != "" {
+		if *schedule == "" {
+			fmt.Fprintf(os.Stderr, "--daily-report needs --schedule, or the monitor subcommand.\n")
+			os.Exit(1)
+		}
+
+		if fi, err := os.Stat(*dailyReportDir); err != nil || !fi.IsDir() {
+			fmt.Fprintf(os.Stderr, "--daily-report: %q isn't a directory.\n", *dailyReportDir)
+			os.Exit(1)
+		}
+
+		dailyReports = newDailyDigests(*dailyReportDir)
+	}
+
+	if *configPath != "" {
+		if *deployAgent || *baseline != "" || *annotate || *format == "junit" || *format == "csv" {
+			fmt.Fprintf(
+				os.Stderr,
+				"--config can't be used with --deploy-agent, --reverse, --baseline, --annotate, --format=junit, or --format=csv.\n")
+			os.Exit(1)
+		}
+	}
+
+	switch *mode {
+	case "echo", "typing", "session-startup":
+	default:
+		fmt.Fprintf(os.Stderr, "--mode must be echo, typing, or session-startup.\n")
+		os.Exit(1)
+	}
+
+	if set := measurementModes(); len(set) > 1 {
+		fmt.Fprintf(os.Stderr, "Only one of %s can be used at a time.\n", strings.Join(set, ", "))
+		os.Exit(1)
+	}
+
+	if *mode == "typing" && (*deployAgent || *echoMode == "sftp") {
+		fmt.Fprintf(os.Stderr, "--mode=typing can't be used with --deploy-agent or --echo=sftp.\n")
+		os.Exit(1)
+	}
+
+	if *adviseTransferGB <= 0 {
+		fmt.Fprintf(os.Stderr, "--advise-transfer-gb must be positive.\n")
+		os.Exit(1)
+	}
+
+	if *adaptiveBudget != "" {
+		if *interval > 0 || *streams > 1 {
+			fmt.Fprintf(os.Stderr, "--adaptive-budget can't be used with --interval or --streams.\n")
+			os.Exit(1)
+		}
+
+		var err error
+		if adaptiveBudgetRate, err = parseBandwidth(*adaptiveBudget); err != nil {
+			fmt.Fprintf(os.Stderr, "--adaptive-budget: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if (*netns != "" || *bindDevice != "") && !netnsSupported {
+		fmt.Fprintf(os.Stderr, "--netns and --bind-device are only supported on Linux.\n")
+		os.Exit(1)
+	}
+
+	if *bindDevice != "" && *transportKind != "native" {
+		fmt.Fprintf(os.Stderr, "--bind-device requires --transport=native.\n")
+		os.Exit(1)
+	}
+
+	for _, t := range thresholds {
+		if reason := phaseUnavailable(t.phase); reason != "" {
+			fmt.Fprintf(os.Stderr, "--threshold %s %s.\n", t, reason)
+			os.Exit(1)
+		}
+	}
+
+	if *comparePTY && *payloadSize > ptyMaxLine {
+		fmt.Fprintf(os.Stderr, "--compare-pty needs a --payload-size of at most %d.\n", ptyMaxLine)
+		os.Exit(1)
+	}
+
+	if *constrained {
+		if *pingTimeout == 0 {
+			*pingTimeout = constrainedPingTimeout
+		}
+	}
+
+	if *failoverGap > 0 {
+		if *useHistogram {
+			fmt.Fprintf(os.Stderr, "--failover-gap can't be used with --histogram.\n")
+			os.Exit(1)
+		}
+
+		if *interval >= *failoverGap {
+			fmt.Fprintf(os.Stderr, "--failover-gap must be longer than --interval.\n")
+			os.Exit(1)
+		}
+
+		if *pingTimeout == 0 {
+			*pingTimeout = failoverPingTimeout
+		}
+	}
+
+	if *levels != "" {
+		var err error
+		if warnLevel, badLevel, err = parseLevels(*levels); err != nil {
+			fmt.Fprintf(os.Stderr, "--levels: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *retries > 0 {
+		if *failoverGap > 0 {
+			fmt.Fprintf(os.Stderr, "--retries can't be used with --failover-gap, which already retries for as long as it takes.\n")
+			os.Exit(1)
+		}
+
+		if *pingTimeout == 0 {
+			*pingTimeout = retryPingTimeout
+		}
+	}
+
+	if *keepaliveIntervals != "" && *idleGaps == "" {
+		fmt.Fprintf(os.Stderr, "--keepalive-intervals requires --idle-gaps.\n")
+		os.Exit(1)
+	}
+
+	if *otlpTraces && *otlpEndpoint == "" {
+		fmt.Fprintf(os.Stderr, "--otlp-traces requires --otlp-endpoint.\n")
+		os.Exit(1)
+	}
+
+	if *otlpTraces && *useHistogram {
+		fmt.Fprintf(os.Stderr, "--otlp-traces can't be used with --histogram.\n")
+		os.Exit(1)
+	}
+
+	if *remoteCommand != "" {
+		if *deployAgent || *echoMode == "sftp" {
+			fmt.Fprintf(os.Stderr, "--remote-command can't be used with --deploy-agent or --echo=sftp.\n")
+			os.Exit(1)
+		}
+
+		remoteEchoCommand = *remoteCommand
+	}
+
+	switch *echoMode {
+	case "cat", "sftp", "auto":
+	default:
+		fmt.Fprintf(os.Stderr, "--echo must be cat, sftp, or auto.\n")
+		os.Exit(1)
+	}
+
+	if *deployAgent && *simulate != "" {
+		fmt.Fprintf(os.Stderr, "--deploy-agent can't be used with --simulate.\n")
+		os.Exit(1)
+	}
+
+	if *responseSize < 0 || (*responseSize > 0 && !*deployAgent) {
+		fmt.Fprintf(os.Stderr, "--response-size must be non-negative, and needs --deploy-agent.\n")
+		os.Exit(1)
+	}
+
+	if *useMPTCP && (*transportKind != "native" || *proxyURL != "" || *simulate != "") {
+		fmt.Fprintf(os.Stderr, "--mptcp needs --transport=native, and can't be used with --proxy or --simulate.\n")
+		os.Exit(1)
+	}
+
+	if *learnMetrics != "" {
+		if *dbPath == "" {
+			fmt.Fprintf(os.Stderr, "--learn-thresholds requires --db.\n")
+			os.Exit(1)
+		}
+
+		for _, m := range strings.Split(*learnMetrics, ",") {
+			if !validMetric(m) {
+				fmt.Fprintf(os.Stderr, "--learn-thresholds: unknown metric %q.\n", m)
+				os.Exit(1)
+			}
+		}
+
+		if *learnMargin < 0 {
+			fmt.Fprintf(os.Stderr, "--learn-margin must be non-negative.\n")
+			os.Exit(1)
+		}
+	}
+
+	if *echoMode != "cat" && (*deployAgent || *simulate != "") {
+		fmt.Fprintf(os.Stderr, "--echo can't be used with --deploy-agent or --simulate.\n")
+		os.Exit(1)
+	}
+
+	if *tos != 0 && *dscp != "" {
+		fmt.Fprintf(os.Stderr, "Set only one of --tos and --dscp.\n")
+		os.Exit(1)
+	}
+
+	if *tos < 0 || *tos > 255 {
+		fmt.Fprintf(os.Stderr, "--tos must be from 0 to 255.\n")
+		os.Exit(1)
+	}
+
+	tcpTOS = *tos
+	if *dscp != "" {
+		d, err := parseDSCP(*dscp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--dscp: %v\n", err)
+			os.Exit(1)
+		}
+
+		tcpTOS = d << 2
+	}
+
+	if tcpOptionsSet() && *transportKind != "native" {
+		fmt.Fprintf(os.Stderr, "--tcp-nodelay, --tos, --dscp, and --tcp-keepalive require --transport=native.\n")
+		os.Exit(1)
+	}
+
+	if *injectFaults != "" {
+		var err error
+		if injectedFaults, err = parseFaultPlan(*injectFaults); err != nil {
+			fmt.Fprintf(os.Stderr, "--inject-faults: %v\n", err)
+			os.Exit(1)
+		}
+
+		faultSeeds = newRand()
+		if injectedFaults.dropProb > 0 && *pingTimeout == 0 {
+			*pingTimeout = dropPingTimeout
+		}
+	}
+
+	if *keepWarm != "" {
+		var err error
+		if keepWarmPeriod, err = parseRate(*keepWarm); err != nil {
+			fmt.Fprintf(os.Stderr, "--keep-warm: %v\n", err)
+			os.Exit(1)
+		}
+
+		if *simulate != "" {
+			fmt.Fprintf(os.Stderr, "--keep-warm can't be used with --simulate.\n")
+			os.Exit(1)
+		}
+	}
+
+	if *useHistogram && (*segments || *deployAgent || *reference != "" || *bucketWidth > 0 || *plotOut != "" || *bundleOut != "") {
+		fmt.Fprintf(
+			os.Stderr,
+			"--histogram can't be used with --segments, --deploy-agent, --reference, --bucket, --plot, or --bundle.\n")
+		os.Exit(1)
+	}
+
+	if *payloadSize < 1 {
+		fmt.Fprintf(os.Stderr, "--payload-size must be positive.\n")
+		os.Exit(1)
+	}
 }
 
-func max(s []time.Duration) time.Duration {
-	return computeDurationStat(stats.Max, s)
+// interruptibleContext returns a context that is cancelled when the process
+// receives SIGINT or SIGTERM. A second signal kills the process as usual.
+func interruptibleContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	return ctx
 }
 
-func mean(s []time.Duration) time.Duration {
-	return computeDurationStat(stats.Mean, s)
+func main() {
+	flag.Usage = usage
+	ctx := interruptibleContext()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "run":
+			runRun(ctx, os.Args[2:])
+			return
+		case "compare":
+			runCompare(ctx, os.Args[2:])
+			return
+		case "monitor":
+			runMonitor(ctx, os.Args[2:])
+			return
+		case "gate":
+			runGate(ctx, os.Args[2:])
+			return
+		case "pick":
+			runPick(ctx, os.Args[2:])
+			return
+		case "survey":
+			runSurvey(ctx, os.Args[2:])
+			return
+		case "scan":
+			runScan(ctx, os.Args[2:])
+			return
+		case "report":
+			runReport(ctx, os.Args[2:])
+			return
+		case "generate-dashboard":
+			runGenerateDashboard(os.Args[2:])
+			return
+
+		// Older spellings of report's subcommands.
+		case "history":
+			runHistory(ctx, os.Args[2:])
+			return
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Parse()
+	runMeasurement(ctx)
 }
 
-func stdDev(s []time.Duration) time.Duration {
-	return computeDurationStat(stats.StandardDeviation, s)
+// measurementModes returns the flags that are set of those selecting how
+// measureAndReport measures, of which only one may be.
+func measurementModes() (set []string) {
+	modes := []struct {
+		flag string
+		set  bool
+	}{
+		{"--config", *configPath != ""},
+		{"--compare-ciphers", *ciphers != ""},
+		{"--compare-macs", *compareMACsFlag != ""},
+		{"--compare-kex", *compareKexFlag != ""},
+		{"--compare-paths", *comparePaths != ""},
+		{"--compare-hosts", *compareHostsFlag != ""},
+		{"--per-address", *perAddress},
+		{"--compare-af", *compareAF},
+		{"--compare-multiplexing", *compareMultiplexing},
+		{"--probe-sessions", *probeSessions > 0},
+		{"--under-load", *underLoad},
+		{"--idle-gaps", *idleGaps != ""},
+		{"--compare-compression", *compareCompression},
+		{"--compare-pty", *comparePTY},
+		{"--mode=" + *mode, *mode != "echo"},
+	}
+
+	for _, m := range modes {
+		if m.set {
+			set = append(set, m.flag)
+		}
+	}
+
+	return
 }
 
-func runPing(outgoing io.Writer, incoming io.Reader) (d time.Duration, err error) {
-	start := time.Now()
+// measureAndReport runs the mode selected by flags and prints its results,
+// returning whether any threshold was breached. Errors are returned rather
+// than being fatal so that the remote agent is always cleaned up.
+func measureAndReport(ctx context.Context) (thresholdsBreached bool, err error) {
+	if *configPath != "" {
+		thresholdsBreached, err = measureFleet(ctx, *configPath)
+		return
+	}
 
-	// Write a magic string.
-	_, err = io.Copy(outgoing, bytes.NewBufferString("foo\n"))
-	if err != nil {
+	// With --deploy-agent, the connection it was deployed over and where to.
+	var agentConn transport
+	var agentPath string
+	if *deployAgent {
+		// This connection is used to clean up the agent, which must happen
+		// even if measurement is interrupted, so it isn't cancelled with ctx.
+		var t transport
+		t, err = newTransport(transportOptions{})
+		if err != nil {
+			return
+		}
+
+		if err = t.Dial(context.Background()); err != nil {
+			return
+		}
+
+		defer t.Close()
+
+		var path string
+		path, err = deployRemoteAgent(ctx, t)
+		if err != nil {
+			return
+		}
+
+		defer func() {
+			if err := cleanUpRemoteAgent(context.Background(), t, path); err != nil {
+				log.Printf("Removing remote agent: %v", err)
+			}
+		}()
+
+		remoteEchoCommand = fmt.Sprintf("%s --response-size=%d", path, *responseSize)
+		agentConn, agentPath = t, path
+	}
+
+	if err = prepareEcho(ctx, transportOptions{}); err != nil {
 		return
 	}
 
-	// Wait for it to be echoed back.
-	buf := make([]byte, 4)
-	_, err = io.ReadFull(incoming, buf)
-	if err != nil {
+	switch {
+	case *ciphers != "":
+		err = compareCiphers(ctx, strings.Split(*ciphers, ","))
+		return
+
+	case *compareMACsFlag != "":
+		err = compareMACs(ctx, strings.Split(*compareMACsFlag, ","))
+		return
+
+	case *compareKexFlag != "":
+		err = compareKeyExchanges(ctx, strings.Split(*compareKexFlag, ","))
+		return
+
+	case *comparePaths != "":
+		err = comparePathsLive(ctx, strings.Split(*comparePaths, ","))
+		return
+
+	case *compareHostsFlag != "":
+		err = compareHosts(ctx, strings.Split(*compareHostsFlag, ","))
+		return
+
+	case *perAddress:
+		err = measurePerAddress(ctx)
+		return
+
+	case *compareAF:
+		err = compareAddressFamilies(ctx)
+		return
+
+	case *compareMultiplexing:
+		err = compareMultiplexingModes(ctx)
+		return
+
+	case *mode == "session-startup":
+		err = measureSessionStartup(ctx)
+		return
+
+	case *probeSessions > 0:
+		err = probeSessionLimits(ctx, *probeSessions)
+		return
+
+	case *underLoad:
+		err = measureUnderLoad(ctx)
+		return
+
+	case *idleGaps != "":
+		var gaps []time.Duration
+		if gaps, err = parseIdleGaps(*idleGaps); err != nil {
+			err = fmt.Errorf("--idle-gaps: %w", err)
+			return
+		}
+
+		if *keepaliveIntervals == "" {
+			err = measureIdleGaps(ctx, gaps)
+			return
+		}
+
+		var intervals []time.Duration
+		if intervals, err = parseKeepaliveIntervals(*keepaliveIntervals); err != nil {
+			err = fmt.Errorf("--keepalive-intervals: %w", err)
+			return
+		}
+
+		err = compareKeepalives(ctx, gaps, intervals)
+		return
+
+	case *compareCompression:
+		err = compareVariants(ctx, "Compression", []variant{
+			{"off", transportOptions{sshArgs: []string{"-o", "Compression=no"}}},
+			{"on", transportOptions{sshArgs: []string{"-o", "Compression=yes"}}},
+		})
+		return
+
+	case *mode == "typing":
+		err = measureTyping(ctx)
 		return
+
+	case *comparePTY:
+		err = compareVariants(ctx, "PTY", []variant{
+			{"off", transportOptions{}},
+			{"on", transportOptions{pty: true}},
+		})
+		return
+	}
+
+	target := *host
+	if *simulate != "" {
+		target = "simulated"
 	}
 
-	d = time.Since(start)
+	_, results, err := measureTarget(ctx, target, transportOptions{}, nil, agentConn, agentPath)
+	thresholdsBreached = anyBreached(results)
 	return
 }
 
-func main() {
-	flag.Parse()
+// prepareEcho checks that --remote-command echoes, and resolves --echo=auto,
+// on the host the options connect to.
+func prepareEcho(ctx context.Context, opts transportOptions) (err error) {
+	if *remoteCommand != "" && *echoMode == "cat" {
+		if err = checkRemoteCommand(ctx, opts); err != nil {
+			err = fmt.Errorf("--remote-command %q: %w", *remoteCommand, err)
+			return
+		}
+	}
 
-	if *host == "" {
-		fmt.Fprintf(os.Stderr, "Must set --host.\n")
-		os.Exit(1)
+	if err = resolveEchoMechanism(ctx, opts); err != nil {
+		err = fmt.Errorf("--echo: %w", err)
+		return
 	}
 
-	// Start an ssh command that echoes whatever we write to it.
-	cmd := exec.Command("ssh", *host, "--", "cat")
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.Fatal(err)
+	return
+}
+
+// measureTarget measures echoes on the host the options connect to, labelled
+// as target, then adds the results to the sinks selected by flags and
+// reports them in --format. They are checked against --threshold and any
+// extra thresholds given. With --reverse, agentConn and agentPath are where
+// the echo agent was deployed.
+func measureTarget(
+	ctx context.Context,
+	target string,
+	opts transportOptions,
+	extra []threshold,
+	agentConn transport,
+	agentPath string) (r run, results []thresholdResult, err error) {
+	if monitorStatus != nil {
+		defer func() { monitorStatus.record(target, r, results, err) }()
+	}
+
+	// Learn thresholds before this run is recorded, so that it's judged only
+	// against earlier ones. They're relearned for each run with --schedule,
+	// so are kept apart from --threshold.
+	runThresholds := append(slices.Clone(thresholds), extra...)
+	if *learnMetrics != "" {
+		var learned []threshold
+		if learned, err = learnThresholds(ctx, target, strings.Split(*learnMetrics, ",")); err != nil {
+			err = fmt.Errorf("--learn-thresholds: %w", err)
+			return
+		}
+
+		runThresholds = append(runThresholds, learned...)
+	}
+
+	// Read the reference distribution up front, so that we don't spend time
+	// measuring if the file is bad.
+	var referenceSamples []time.Duration
+	if *reference != "" {
+		referenceSamples, err = readSamples(*reference)
+		if err != nil {
+			return
+		}
+	}
+
+	type baselineResult struct {
+		desc    string
+		samples []time.Duration
+		err     error
 	}
 
-	stdout, err := cmd.StdoutPipe()
+	baselineCtx, stopBaseline := context.WithCancel(ctx)
+	defer stopBaseline()
+
+	baselineDone := make(chan baselineResult, 1)
+	if *baseline != "" {
+		go func() {
+			var b baselineResult
+			b.desc, b.samples, b.err = runBaseline(baselineCtx, *baseline)
+			baselineDone <- b
+		}()
+	}
+
+	var onSample func(sample)
+	if *samplesOut != "" {
+		var sf *sampleFile
+		sf, err = createSampleFile(*samplesOut)
+		if err != nil {
+			return
+		}
+
+		defer func() {
+			if closeErr := sf.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+
+		onSample = func(s sample) {
+			if !s.timedOut {
+				sf.write(s.times.rtt())
+			}
+		}
+	}
+
+	var ndjson *ndjsonWriter
+	if *format == "ndjson" {
+		ndjson = newNDJSONWriter(os.Stdout, target)
+		if prev := onSample; prev != nil {
+			onSample = func(s sample) {
+				prev(s)
+				ndjson.writeSample(s)
+			}
+		} else {
+			onSample = ndjson.writeSample
+		}
+	}
+
+	var onNote func(event)
+	if ndjson != nil {
+		onNote = ndjson.writeAnnotation
+	}
+
+	notes, err := startAnnotations(onNote)
 	if err != nil {
-		log.Fatal(err)
+		return
 	}
 
-	err = cmd.Start()
+	start := time.Now()
+	r, err = measureStreaming(ctx, opts, onSample)
+	annotated := notes.stop()
+
+	// There are no statistics, one-way delays, or anything else to report.
+	if err == nil && r.distribution().count() == 0 {
+		err = fmt.Errorf("no samples collected in %v", *duration)
+	}
+
+	// Record the failure, for the availability that report sla computes.
 	if err != nil {
-		log.Fatal(err)
+		if *dbPath != "" && ctx.Err() == nil {
+			if dbErr := recordFailedRun(*dbPath, target, start, err); dbErr != nil {
+				err = fmt.Errorf("%w (--db: %v)", err, dbErr)
+			}
+		}
+
+		return
 	}
 
-	defer stdin.Close()
+	r.mergeEvents([]run{{events: annotated}})
+
+	elapsed := time.Since(start)
+	meta := newRunMetadata(target, start, start.Add(elapsed))
+	meta.connMetadata = r.meta.connMetadata
+
+	r.meta = meta
 
-	// The first few pings probably incur some startup cost. Throw them away.
-	for i := 0; i < 3; i++ {
-		if _, err := runPing(stdin, stdout); err != nil {
-			log.Fatal(err)
+	var windowed []windowStats
+	if windowSpecs != nil {
+		windowed = updateWindows(target, r)
+	}
+
+	if dailyReports != nil {
+		if err = dailyReports.record(target, r); err != nil {
+			err = fmt.Errorf("--daily-report: %w", err)
+			return
 		}
 	}
 
-	// Collect samples for 5 seconds.
-	samples := []time.Duration{}
-	for start := time.Now(); time.Since(start) < 5*time.Second; {
-		sample, err := runPing(stdin, stdout)
-		if err != nil {
-			log.Fatal(err)
+	var baselineRes baselineResult
+	if *baseline != "" {
+		stopBaseline()
+		baselineRes = <-baselineDone
+		if baselineRes.err != nil {
+			err = fmt.Errorf("baseline: %w", baselineRes.err)
+			return
 		}
+	}
 
-		samples = append(samples, sample)
-		if len(samples)%100 == 0 {
-			fmt.Println(len(samples), "samples so far...")
+	var reverseTimes []pingTimes
+	if *reverse {
+		if reverseTimes, err = measureReverse(ctx, agentConn, agentPath); err != nil {
+			err = fmt.Errorf("--reverse: %w", err)
+			return
 		}
 	}
 
-	fmt.Printf("Collected %d samples.\n", len(samples))
-	fmt.Printf("\n")
-	fmt.Printf("Min:      %s\n", formatMillis(min(samples)))
-	fmt.Printf("p05:      %s\n", formatMillis(percentile(5, samples)))
-	fmt.Printf("p50:      %s\n", formatMillis(median(samples)))
-	fmt.Printf("p95:      %s\n", formatMillis(percentile(95, samples)))
-	fmt.Printf("Max:      %s\n", formatMillis(max(samples)))
+	results = checkThresholds(runThresholds, r)
+	if *appendOut != "" {
+		if err = appendSummary(*appendOut, target, start, r); err != nil {
+			err = fmt.Errorf("--append: %w", err)
+			return
+		}
+	}
+
+	if *dbPath != "" {
+		if err = recordRun(*dbPath, target, start, elapsed, r); err != nil {
+			err = fmt.Errorf("--db: %w", err)
+			return
+		}
+	}
+
+	if *otlpEndpoint != "" {
+		if err = exportOTLP(ctx, target, start, r); err != nil {
+			err = fmt.Errorf("--otlp-endpoint: %w", err)
+			return
+		}
+	}
+
+	if *incidentsOut != "" || *grafanaURL != "" {
+		is := incidents(target, r.events)
+		if *incidentsOut != "" {
+			if err = writeIncidents(*incidentsOut, is); err != nil {
+				err = fmt.Errorf("--incidents: %w", err)
+				return
+			}
+		}
+
+		if *grafanaURL != "" {
+			if err = pushGrafanaAnnotations(ctx, is); err != nil {
+				err = fmt.Errorf("--grafana-url: %w", err)
+				return
+			}
+		}
+	}
+
+	if *bundleOut != "" {
+		if err = writeBundle(ctx, *bundleOut, target, start, r, results); err != nil {
+			err = fmt.Errorf("--bundle: %w", err)
+			return
+		}
+	}
+
+	if *format == "junit" {
+		err = writeJUnit(os.Stdout, target, elapsed, results)
+		return
+	}
+
+	if ndjson != nil {
+		ndjson.writeWindows(windowed)
+		err = ndjson.finish(target, r, results)
+		return
+	}
+
+	if *format == "json" || *format == "csv" {
+		err = newReportRenderer().render(os.Stdout, newSummaryReport(target, r, results))
+		return
+	}
+
+	printSummary(r, newSummaryReport(target, r, results))
+	printEvents(r.events)
+
+	if windowed != nil {
+		fmt.Printf("\n")
+		printWindows(windowed)
+	}
+
+	if *failoverGap > 0 {
+		fmt.Printf("\n")
+		printGaps(r, *failoverGap, start, start.Add(elapsed))
+	}
+
+	if *segments {
+		fmt.Printf("\n")
+		printSegments(r)
+	}
+
+	if *bucketWidth > 0 {
+		fmt.Printf("\n")
+		printBuckets(r)
+	}
+
+	if *deployAgent {
+		fmt.Printf("\n")
+		printRemoteProcessing(r.times)
+		fmt.Printf("\n")
+		printOneWayDelays(r.times, "Upstream", "Downstream")
+	}
+
+	if *reverse {
+		fmt.Printf("\n")
+		printReverse(reverseTimes)
+	}
+
+	if *baseline != "" {
+		fmt.Printf("\n")
+		printBaseline(baselineRes.desc, baselineRes.samples, r.distribution())
+	}
+
+	if referenceSamples != nil {
+		fmt.Printf("\n")
+		printReferenceComparison(referenceSamples, r.samples)
+	}
+
+	if *advise {
+		fmt.Printf("\n")
+		printAdvice(r)
+	}
+
+	if len(results) != 0 {
+		fmt.Printf("\n")
+		printThresholds(results)
+	}
+
 	fmt.Printf("\n")
-	fmt.Printf("Mean:     %s\n", formatMillis(mean(samples)))
-	fmt.Printf("Std. dev: %s\n", formatMillis(stdDev(samples)))
+	printMetadata(r.meta)
+
+	if *format == "github" {
+		writeGitHubAnnotations(os.Stdout, target, results)
+	}
+
+	if *plotOut != "" {
+		if err = writePlot(*plotOut, r); err != nil {
+			err = fmt.Errorf("--plot: %w", err)
+			return
+		}
+	}
+
+	return
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// An sshClient is a program the exec transport can run to connect: OpenSSH's
+// ssh, or PuTTY's plink, whose options differ.
+type sshClient struct {
+	path  string
+	plink bool
+}
+
+// The client used by the exec transport, as found by locateSSHClient.
+var execClient = sshClient{path: "ssh"}
+
+// locateSSHClient finds the program named by --ssh-command, or if name is
+// empty, ssh on the PATH, falling back to where the platform usually keeps an
+// SSH client: on Windows, the OpenSSH that ships with it, then plink.
+func locateSSHClient(name string) (c sshClient, err error) {
+	candidates := []string{name}
+	if name == "" {
+		candidates = append([]string{"ssh"}, sshClientFallbacks()...)
+	}
+
+	for _, candidate := range candidates {
+		var path string
+		if path, err = exec.LookPath(candidate); err == nil {
+			c = sshClient{path: path, plink: isPlink(path)}
+			return
+		}
+	}
+
+	if name == "" {
+		err = fmt.Errorf("can't find ssh; set --ssh-command to its path")
+	}
+
+	return
+}
+
+// isPlink reports whether the program at path is PuTTY's plink.
+func isPlink(path string) bool {
+	base := strings.ToLower(filepath.Base(path))
+	return strings.TrimSuffix(base, ".exe") == "plink"
+}
+
+// multiplexes reports whether the client can share a connection between
+// sessions with a ControlMaster. plink can't, and nor can the OpenSSH that
+// ships with Windows.
+func (c sshClient) multiplexes() bool {
+	return !c.plink && runtime.GOOS != "windows"
+}
+
+// translatesNewlines reports whether echoes read from the client may have
+// had the newline ending each turned into CRLF, as Windows consoles and
+// PuTTY may do.
+func (c sshClient) translatesNewlines() bool {
+	return c.plink || runtime.GOOS == "windows"
+}
+
+// plinkCommand is like sshCommand, but runs plink, translating the OpenSSH
+// options that it has equivalents for and failing on those it doesn't. Host
+// keys are checked against PuTTY's cache, so --strict-host-key-checking has
+// no effect.
+func plinkCommand(ctx context.Context, host string, sshArgs []string, remote ...string) (cmd *exec.Cmd, err error) {
+	args := []string{"-ssh"}
+	if !*interactive {
+		args = append(args, "-batch")
+	}
+
+	pty := false
+	for i := 0; i < len(sshArgs); i++ {
+		switch a := sshArgs[i]; a {
+		case "-4", "-6", "-s", "-C":
+			args = append(args, a)
+
+		case "-tt":
+			args = append(args, "-t")
+			pty = true
+
+		case "-o":
+			if i+1 == len(sshArgs) {
+				err = fmt.Errorf("-o needs an option")
+				return
+			}
+
+			i++
+			switch o := sshArgs[i]; o {
+			case "Compression=yes":
+				args = append(args, "-C")
+			case "Compression=no", "ControlMaster=no", "ControlPath=none":
+			default:
+				err = fmt.Errorf("plink has no equivalent of -o %s", o)
+				return
+			}
+
+		default:
+			err = fmt.Errorf("plink has no equivalent of %s", a)
+			return
+		}
+	}
+
+	if !pty {
+		args = append(args, "-T")
+	}
+
+	args = append(args, host)
+	args = append(args, remote...)
+
+	cmd = exec.CommandContext(ctx, execClient.path, args...)
+	cancelGracefully(cmd)
+	return
+}
+
+// crlfStream is a stream that turns CRLF back into LF in what it reads, for
+// clients that translate newlines. It's only used for the text echo, whose
+// pings never contain a carriage return, so only ones that were added are
+// dropped.
+type crlfStream struct {
+	stream
+
+	// Bytes translated but not yet returned, whether a carriage return was
+	// read last and held back to see what follows it, and the error from the
+	// last read of the underlying stream.
+	pending []byte
+	cr      bool
+	err     error
+}
+
+func (s *crlfStream) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return
+	}
+
+	for len(s.pending) == 0 && s.err == nil {
+		raw := make([]byte, len(p))
+		var m int
+		m, s.err = s.stream.Read(raw)
+		for _, b := range raw[:m] {
+			if s.cr && b != '\n' {
+				s.pending = append(s.pending, '\r')
+			}
+
+			s.cr = b == '\r'
+			if !s.cr {
+				s.pending = append(s.pending, b)
+			}
+		}
+
+		if s.err != nil && s.cr {
+			s.pending = append(s.pending, '\r')
+			s.cr = false
+		}
+	}
+
+	n = copy(p, s.pending)
+	s.pending = s.pending[n:]
+	if len(s.pending) == 0 {
+		err = s.err
+	}
+
+	return
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// sshClientFallbacks returns where to look for an SSH client if ssh isn't on
+// the PATH: plink, for those who only have PuTTY.
+func sshClientFallbacks() []string {
+	return []string{"plink"}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// A chunkStream is a stream whose reads return each of its chunks in turn,
+// and then io.EOF.
+type chunkStream struct {
+	chunks []string
+}
+
+func (s *chunkStream) Read(p []byte) (n int, err error) {
+	if len(s.chunks) == 0 {
+		err = io.EOF
+		return
+	}
+
+	n = copy(p, s.chunks[0])
+	if s.chunks[0] = s.chunks[0][n:]; s.chunks[0] == "" {
+		s.chunks = s.chunks[1:]
+	}
+
+	return
+}
+
+func (s *chunkStream) Write(p []byte) (int, error) { return len(p), nil }
+func (s *chunkStream) CloseWrite() error           { return nil }
+func (s *chunkStream) Close() error                { return nil }
+
+func TestCRLFStreamRead(t *testing.T) {
+	cases := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"empty", nil, ""},
+		{"no CR", []string{"foo\nbar\n"}, "foo\nbar\n"},
+		{"CRLF", []string{"foo\r\nbar\r\n"}, "foo\nbar\n"},
+		{"CR split from LF", []string{"foo\r", "\nbar\r\n"}, "foo\nbar\n"},
+		{"CR split from other byte", []string{"foo\r", "bar\n"}, "foo\rbar\n"},
+		{"lone CR", []string{"a\rb\n"}, "a\rb\n"},
+		{"CR CR LF", []string{"a\r\r\n"}, "a\r\n"},
+		{"CR at EOF", []string{"foo\r"}, "foo\r"},
+		{"CR per read", []string{"\r", "\n", "\r", "\n"}, "\n\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &crlfStream{stream: &chunkStream{chunks: append([]string(nil), c.chunks...)}}
+			got, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != c.want {
+				t.Errorf("read %q; want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCRLFStreamReadSmallBuffer(t *testing.T) {
+	s := &crlfStream{stream: &chunkStream{chunks: []string{"ab\r\ncd\r", "\n"}}}
+	var got []byte
+	p := make([]byte, 1)
+	for {
+		n, err := s.Read(p)
+		got = append(got, p[:n]...)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := "ab\ncd\n"; string(got) != want {
+		t.Errorf("read %q; want %q", got, want)
+	}
+}
+
+func TestPlinkCommand(t *testing.T) {
+	savedClient, savedInteractive := execClient, *interactive
+	defer func() { execClient, *interactive = savedClient, savedInteractive }()
+	execClient = sshClient{path: "plink", plink: true}
+
+	cases := []struct {
+		name        string
+		interactive bool
+		sshArgs     []string
+
+		// The arguments expected, or a substring of the error expected.
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "none",
+			want: []string{"plink", "-ssh", "-batch", "-T", "host", "cat"},
+		},
+		{
+			name:        "interactive",
+			interactive: true,
+			want:        []string{"plink", "-ssh", "-T", "host", "cat"},
+		},
+		{
+			name:    "passed through",
+			sshArgs: []string{"-4", "-C"},
+			want:    []string{"plink", "-ssh", "-batch", "-4", "-C", "-T", "host", "cat"},
+		},
+		{
+			name:    "pty",
+			sshArgs: []string{"-tt"},
+			want:    []string{"plink", "-ssh", "-batch", "-t", "host", "cat"},
+		},
+		{
+			name:    "compression option",
+			sshArgs: []string{"-o", "Compression=yes"},
+			want:    []string{"plink", "-ssh", "-batch", "-C", "-T", "host", "cat"},
+		},
+		{
+			name:    "ignored options",
+			sshArgs: []string{"-o", "Compression=no", "-o", "ControlMaster=no", "-o", "ControlPath=none"},
+			want:    []string{"plink", "-ssh", "-batch", "-T", "host", "cat"},
+		},
+		{
+			name:    "untranslatable option",
+			sshArgs: []string{"-o", "ServerAliveInterval=5"},
+			wantErr: "no equivalent of -o ServerAliveInterval=5",
+		},
+		{
+			name:    "missing option",
+			sshArgs: []string{"-o"},
+			wantErr: "-o needs an option",
+		},
+		{
+			name:    "untranslatable flag",
+			sshArgs: []string{"-A"},
+			wantErr: "no equivalent of -A",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			*interactive = c.interactive
+			cmd, err := plinkCommand(context.Background(), "host", c.sshArgs, "cat")
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Errorf("error %v; want one containing %q", err, c.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(cmd.Args, c.want) {
+				t.Errorf("args %q; want %q", cmd.Args, c.want)
+			}
+		})
+	}
+}
+
+// TestExecCRLFTranslation runs the exec transport with a stand-in for plink
+// that echoes its input, checking that the text echo has CRLF translated
+// back while the sftp subsystem's binary packets pass through intact.
+func TestExecCRLFTranslation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand-in for plink is a shell script")
+	}
+
+	plink := filepath.Join(t.TempDir(), "plink")
+	if err := os.WriteFile(plink, []byte("#!/bin/sh\nexec cat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	savedClient := execClient
+	defer func() { execClient = savedClient }()
+	execClient = sshClient{path: plink, plink: true}
+
+	roundTrip := func(s stream, err error, sent []byte) []byte {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer s.Close()
+		if _, err := s.Write(sent); err != nil {
+			t.Fatal(err)
+		}
+
+		s.CloseWrite()
+		got, err := io.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return got
+	}
+
+	ctx := context.Background()
+	tr := &execTransport{opts: transportOptions{host: "host"}}
+
+	// A REALPATH request whose ID, 3338, is CRLF in big-endian.
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, 3338)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = append(body, '.')
+
+	var packet bytes.Buffer
+	writeSFTPPacket(&packet, sftpRealpath, body)
+	if !bytes.Contains(packet.Bytes(), []byte("\r\n")) {
+		t.Fatalf("packet %q doesn't contain CRLF", packet.Bytes())
+	}
+
+	s, err := tr.NewSubsystem(ctx, "sftp")
+	if got := roundTrip(s, err, packet.Bytes()); !bytes.Equal(got, packet.Bytes()) {
+		t.Errorf("sftp subsystem echoed %q; want %q", got, packet.Bytes())
+	}
+
+	s, err = tr.NewStream(ctx, remoteEchoCommand)
+	if got := roundTrip(s, err, []byte("ping\r\n")); string(got) != "ping\n" {
+		t.Errorf("text echo read %q; want %q", got, "ping\n")
+	}
+}
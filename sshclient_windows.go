@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// sshClientFallbacks returns where to look for an SSH client if ssh isn't on
+// the PATH: the OpenSSH client that ships with Windows, which the PATH may not
+// include, then PuTTY's plink, on the PATH or where its installer puts it.
+func sshClientFallbacks() []string {
+	return []string{
+		filepath.Join(os.Getenv("SystemRoot"), "System32", "OpenSSH", "ssh.exe"),
+		"plink",
+		filepath.Join(os.Getenv("ProgramFiles"), "PuTTY", "plink.exe"),
+	}
+}
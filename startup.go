@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The command run with --mode=session-startup, chosen to cost as little as
+// possible itself.
+const startupCommand = "true"
+
+// measureSessionStartup repeatedly connects, runs a trivial command, and
+// disconnects for --duration, printing the distribution of the time until
+// the command finished. This is the latency felt by scripts that run ssh once
+// per command, which echo round trips on a warm session leave out. With the
+// exec transport, it includes anything ~/.ssh/config sets up, such as a
+// ControlMaster.
+func measureSessionStartup(ctx context.Context) (err error) {
+	var r run
+	deadline := time.Now().Add(*duration)
+	for i := 1; len(r.samples) == 0 || time.Now().Before(deadline); i++ {
+		start := time.Now()
+		if err = runStartupCommand(ctx); err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+
+			return
+		}
+
+		r.add(start, time.Since(start))
+		if i%10 == 0 {
+			fmt.Fprintln(progressOutput, i, "sessions so far...")
+		}
+
+		if *interval > 0 {
+			select {
+			case <-time.After(time.Until(start.Add(*interval))):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	d := r.distribution()
+	fmt.Printf("Ran %q in %d new sessions.\n", startupCommand, d.count())
+	fmt.Printf("\n")
+	fmt.Printf("Min:      %s\n", formatLatency(d.min()))
+	fmt.Printf("p50:      %s\n", formatLatency(d.percentile(50)))
+	fmt.Printf("p95:      %s\n", formatLatency(d.percentile(95)))
+	fmt.Printf("Max:      %s\n", formatLatency(d.max()))
+	fmt.Printf("\n")
+	fmt.Printf("Mean:     %s\n", formatLatency(d.mean()))
+	fmt.Printf("Std. dev: %s\n", formatLatency(d.stdDev()))
+	printEvents(r.events)
+	return
+}
+
+// runStartupCommand makes a new connection, runs startupCommand over it, and
+// closes it.
+func runStartupCommand(ctx context.Context) (err error) {
+	t, err := newTransport(transportOptions{})
+	if err != nil {
+		return
+	}
+
+	if err = t.Dial(ctx); err != nil {
+		return
+	}
+
+	defer t.Close()
+
+	_, err = runCommand(ctx, t, startupCommand, nil)
+	return
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/montanaflynn/stats"
+)
+
+// formatLatency formats a duration in the unit set by --units, padded to a
+// width of at least seven, e.g. " 13.0 ms". With --units=auto, durations under
+// a millisecond are shown in microseconds, and those of ten seconds or more in
+// seconds. Units are written in ASCII, and numbers with a decimal point
+// whatever the locale, so that output can be read back by scripts.
+func formatLatency(d time.Duration) string {
+	unit := *units
+	if unit == "auto" {
+		abs := d
+		if abs < 0 {
+			abs = -abs
+		}
+
+		switch {
+		case abs > 0 && abs < time.Millisecond:
+			unit = "us"
+		case abs >= 10*time.Second:
+			unit = "s"
+		default:
+			unit = "ms"
+		}
+	}
+
+	switch unit {
+	case "us":
+		return fmt.Sprintf("%4.0f us", float64(d.Round(time.Microsecond))/float64(time.Microsecond))
+	case "s":
+		return fmt.Sprintf("%4.2f s", float64(d.Round(10*time.Millisecond))/float64(time.Second))
+	}
+
+	return fmt.Sprintf("%4.1f ms", float64(d.Round(100*time.Microsecond))/float64(time.Millisecond))
+}
+
+// formatDelta formats a difference between two durations with an explicit
+// sign, e.g. "+1.2 ms".
+func formatDelta(d time.Duration) string {
+	sign := "+"
+	if d < 0 {
+		sign = "-"
+		d = -d
+	}
+
+	return sign + strings.TrimSpace(formatLatency(d))
+}
+
+func toFloatSeconds(s []time.Duration) []float64 {
+	result := make([]float64, 0, len(s))
+	for _, d := range s {
+		result = append(result, float64(d)/float64(time.Second))
+	}
+
+	return result
+}
+
+func computeDurationStat(compute func(stats.Float64Data) (float64, error), s []time.Duration) time.Duration {
+	seconds, err := compute(toFloatSeconds(s))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func min(s []time.Duration) time.Duration {
+	return computeDurationStat(stats.Min, s)
+}
+
+func median(s []time.Duration) time.Duration {
+	return computeDurationStat(stats.Median, s)
+}
+
+// percentile returns the given percentile of the samples, or their minimum
+// if there are too few to interpolate it, as for p05 of fewer than 20.
+func percentile(percent float64, s []time.Duration) time.Duration {
+	if float64(len(s))*percent/100 < 1 {
+		return min(s)
+	}
+
+	return computeDurationStat(func(data stats.Float64Data) (float64, error) { return stats.Percentile(data, percent) }, s)
+}
+
+func max(s []time.Duration) time.Duration {
+	return computeDurationStat(stats.Max, s)
+}
+
+func mean(s []time.Duration) time.Duration {
+	return computeDurationStat(stats.Mean, s)
+}
+
+func stdDev(s []time.Duration) time.Duration {
+	return computeDurationStat(stats.StandardDeviation, s)
+}
+
+// parseRate parses a rate like "1/s", "6/m", or "10/h", returning the period
+// between events.
+func parseRate(s string) (period time.Duration, err error) {
+	count, unit, ok := strings.Cut(s, "/")
+	n, parseErr := strconv.ParseFloat(count, 64)
+	if !ok || parseErr != nil || n <= 0 {
+		err = fmt.Errorf("%q isn't a rate like 1/s", s)
+		return
+	}
+
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		err = fmt.Errorf("%q: unit must be s, m, or h", s)
+		return
+	}
+
+	period = time.Duration(float64(per) / n)
+	return
+}
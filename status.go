@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many of each host's most recent samples the status server keeps, for
+// /api/hosts/{host}/samples.
+const statusSampleLimit = 10000
+
+// monitorStatus collects the results of each run made with --schedule, for
+// the status server started by --listen. It's nil if --listen isn't set.
+var monitorStatus *statusStore
+
+// A statusStore is what the status server knows about the hosts measured so
+// far: their latest results, and their recent samples.
+type statusStore struct {
+	mu    sync.Mutex
+	hosts map[string]*hostStatus
+
+	// Hosts in the order they were first measured.
+	order []string
+}
+
+type hostStatus struct {
+	host    string
+	lastRun time.Time
+	err     error
+
+	// The summary of the last run that collected samples, if any.
+	latest *jsonReport
+
+	// Oldest first.
+	samples []statusSample
+}
+
+// A statusSample is a sample as served by /api/hosts/{host}/samples.
+type statusSample struct {
+	Sent time.Time `json:"sent"`
+	Ms   float64   `json:"ms"`
+}
+
+func newStatusStore() *statusStore {
+	return &statusStore{hosts: make(map[string]*hostStatus)}
+}
+
+// record notes the result of a run of the target that has just finished,
+// successfully or not.
+func (s *statusStore) record(target string, r run, results []thresholdResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.hosts[target]
+	if h == nil {
+		h = &hostStatus{host: target}
+		s.hosts[target] = h
+		s.order = append(s.order, target)
+	}
+
+	h.lastRun = time.Now()
+	h.err = err
+	if r.distribution().count() == 0 {
+		return
+	}
+
+	rep := newJSONReport(newSummaryReport(target, r, results))
+	h.latest = &rep
+
+	// With --histogram, there are no individual samples to keep.
+	for i, rtt := range r.samples {
+		h.samples = append(h.samples, statusSample{Sent: r.sent[i], Ms: millis(rtt)})
+	}
+
+	if n := len(h.samples); n > statusSampleLimit {
+		h.samples = append([]statusSample(nil), h.samples[n-statusSampleLimit:]...)
+	}
+}
+
+// A hostSummary is a host's entry in /api/hosts and on the status page.
+type hostSummary struct {
+	Host    string    `json:"host"`
+	LastRun time.Time `json:"last_run"`
+	Error   string    `json:"error,omitempty"`
+
+	// From the last run that collected samples.
+	Samples  int     `json:"samples"`
+	Timeouts int     `json:"timeouts"`
+	P50Ms    float64 `json:"p50_ms"`
+	P95Ms    float64 `json:"p95_ms"`
+	MaxMs    float64 `json:"max_ms"`
+	Level    string  `json:"level,omitempty"`
+}
+
+func (h *hostStatus) summary() (sum hostSummary) {
+	sum = hostSummary{Host: h.host, LastRun: h.lastRun}
+	if h.err != nil {
+		sum.Error = h.err.Error()
+	}
+
+	if h.latest == nil {
+		return
+	}
+
+	sum.Samples = h.latest.Samples
+	sum.Timeouts = h.latest.Timeouts
+	for _, st := range h.latest.Stats {
+		switch st.Metric {
+		case "p50":
+			sum.P50Ms = st.Ms
+		case "p95":
+			sum.P95Ms = st.Ms
+			sum.Level = st.Level
+		case "max":
+			sum.MaxMs = st.Ms
+		}
+	}
+
+	return
+}
+
+func (s *statusStore) summaries() (sums []hostSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, host := range s.order {
+		sums = append(sums, s.hosts[host].summary())
+	}
+
+	return
+}
+
+// serveStatus serves the status page and API on --listen until the context
+// is cancelled.
+func serveStatus(ctx context.Context, l net.Listener, s *statusStore) {
+	srv := &http.Server{Handler: s}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		log.Printf("--listen: %v", err)
+	}
+}
+
+// ServeHTTP serves:
+//
+//	/                              a status page showing each host's latest p50 and p95
+//	/api/hosts                     the same as JSON
+//	/api/hosts/{host}/stats        the host's latest summary, as --format=json reports it,
+//	                               and its --windows
+//	/api/hosts/{host}/samples      its recent samples, those sent after ?since= if set
+func (s *statusStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Only GET is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := req.URL.Path
+	switch {
+	case path == "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		statusTemplate.Execute(w, s.summaries())
+		return
+
+	case path == "/api/hosts":
+		writeJSON(w, s.summaries())
+		return
+	}
+
+	host, what, ok := strings.Cut(strings.TrimPrefix(path, "/api/hosts/"), "/")
+	if !ok || !strings.HasPrefix(path, "/api/hosts/") {
+		http.NotFound(w, req)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.hosts[host]
+	if h == nil {
+		http.Error(w, "No such host has been measured.", http.StatusNotFound)
+		return
+	}
+
+	switch what {
+	case "stats":
+		stats := struct {
+			hostSummary
+			Latest  *jsonReport   `json:"latest,omitempty"`
+			Windows []windowStats `json:"windows,omitempty"`
+		}{h.summary(), h.latest, currentWindows(host, time.Now())}
+
+		writeJSON(w, stats)
+
+	case "samples":
+		var since time.Time
+		if v := req.URL.Query().Get("since"); v != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "since should be an RFC 3339 time, like 2006-01-02T15:04:05Z.", http.StatusBadRequest)
+				return
+			}
+		}
+
+		samples := []statusSample{}
+		for _, smp := range h.samples {
+			if smp.Sent.After(since) {
+				samples = append(samples, smp)
+			}
+		}
+
+		writeJSON(w, samples)
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ms": func(ms float64) string {
+		return strings.TrimSpace(formatLatency(time.Duration(ms * float64(time.Millisecond))))
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>ssh_ping status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 1em; text-align: right; border-bottom: 1px solid #ddd; }
+th:first-child, td:first-child { text-align: left; }
+.good { color: #2a7d2a; }
+.warn { color: #b58900; }
+.bad, .error { color: #c0392b; }
+</style>
+</head>
+<body>
+<h1>ssh_ping status</h1>
+{{if .}}
+<table>
+<tr><th>Host</th><th>p50</th><th>p95</th><th>Max</th><th>Samples</th><th>Timeouts</th><th>Last run</th><th></th></tr>
+{{range .}}
+<tr>
+<td><a href="/api/hosts/{{.Host}}/stats">{{.Host}}</a></td>
+{{if .Samples}}<td>{{ms .P50Ms}}</td><td class="{{.Level}}">{{ms .P95Ms}}</td><td>{{ms .MaxMs}}</td>{{else}}<td></td><td></td><td></td>{{end}}
+<td>{{.Samples}}</td><td>{{.Timeouts}}</td>
+<td>{{.LastRun.Format "2006-01-02 15:04:05"}}</td>
+<td class="error">{{.Error}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No measurements yet.</p>
+{{end}}
+</body>
+</html>
+`))
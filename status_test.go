@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusServer(t *testing.T) {
+	s := newStatusStore()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	var r run
+	for i := 0; i < 100; i++ {
+		r.add(start.Add(time.Duration(i)*time.Second), time.Duration(i+1)*time.Millisecond)
+	}
+
+	s.record("bastion", r, nil, nil)
+	s.record("down", run{}, nil, errors.New("connection refused"))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	var hosts []hostSummary
+	if err := json.NewDecoder(get("/api/hosts").Body).Decode(&hosts); err != nil {
+		t.Fatalf("/api/hosts: %v", err)
+	}
+
+	if len(hosts) != 2 || hosts[0].Host != "bastion" || hosts[1].Host != "down" {
+		t.Fatalf("/api/hosts = %+v; want bastion, then down", hosts)
+	}
+
+	if got := hosts[0]; got.Samples != 100 || got.P50Ms != 50 || got.MaxMs != 100 {
+		t.Errorf("bastion = %+v; want 100 samples with p50 50 ms and max 100 ms", got)
+	}
+
+	if got := hosts[1]; got.Error != "connection refused" || got.Samples != 0 {
+		t.Errorf("down = %+v; want an error and no samples", got)
+	}
+
+	var stats struct{ Latest *jsonReport }
+	if err := json.NewDecoder(get("/api/hosts/bastion/stats").Body).Decode(&stats); err != nil {
+		t.Fatalf("/api/hosts/bastion/stats: %v", err)
+	}
+
+	if stats.Latest == nil || stats.Latest.Samples != 100 {
+		t.Errorf("latest = %+v; want a summary of 100 samples", stats.Latest)
+	}
+
+	var samples []statusSample
+	since := start.Add(89 * time.Second).Format(time.RFC3339)
+	if err := json.NewDecoder(get("/api/hosts/bastion/samples?since=" + since).Body).Decode(&samples); err != nil {
+		t.Fatalf("/api/hosts/bastion/samples: %v", err)
+	}
+
+	if len(samples) != 10 || samples[0].Ms != 91 {
+		t.Errorf("samples since %s = %+v; want the last 10", since, samples)
+	}
+
+	if w := get("/api/hosts/bastion/samples?since=yesterday"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad since: status %d; want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if w := get("/api/hosts/elsewhere/stats"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown host: status %d; want %d", w.Code, http.StatusNotFound)
+	}
+
+	if body := get("/").Body.String(); !strings.Contains(body, "bastion") || !strings.Contains(body, "connection refused") {
+		t.Errorf("status page doesn't show both hosts:\n%s", body)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// surveyReport is written as JSON by the survey subcommand.
+type surveyReport struct {
+	Started  time.Time      `json:"started"`
+	PerHost  string         `json:"per_host"`
+	Criteria string         `json:"criteria"`
+	Hosts    []surveyResult `json:"hosts"`
+}
+
+type surveyResult struct {
+	Host string `json:"host"`
+
+	// The host's position when ordered by the criteria, from 1, or zero if
+	// it couldn't be measured.
+	Rank int `json:"rank,omitempty"`
+
+	Samples int     `json:"samples,omitempty"`
+	ValueMs float64 `json:"value_ms,omitempty"`
+	P50Ms   float64 `json:"p50_ms,omitempty"`
+	P95Ms   float64 `json:"p95_ms,omitempty"`
+	P99Ms   float64 `json:"p99_ms,omitempty"`
+	MaxMs   float64 `json:"max_ms,omitempty"`
+	Error   string  `json:"error,omitempty"`
+
+	d     distribution
+	value time.Duration
+}
+
+// runSurvey implements the survey subcommand, which briefly measures many
+// hosts concurrently for a snapshot of a fleet, printing them ranked by the
+// chosen metric and writing the results as JSON.
+func runSurvey(ctx context.Context, args []string) {
+	fs := newSubcommandFlagSet("survey", connectionFlags, pingFlags, outputFlags)
+	hostsFile := fs.String("hosts-file", "", "File listing hosts to survey, one per line.")
+	criteria := fs.String("criteria", "p95", "Metric to rank by: min, max, mean, stddev, or a percentile like p95.")
+	perHost := fs.Duration("per-host", 10*time.Second, "How long to measure each host for.")
+	maxConcurrent := fs.Int("max-concurrent", 30, "How many hosts to measure at once.")
+	jsonOut := fs.String("json", "survey.json", "File to write the results to as JSON. Empty to skip.")
+	fs.Parse(args)
+
+	hosts := prepareSurvey(*hostsFile, *criteria, *perHost, "--max-concurrent", *maxConcurrent)
+
+	report := surveyReport{
+		Started:  time.Now(),
+		PerHost:  perHost.String(),
+		Criteria: *criteria,
+		Hosts:    surveyHosts(ctx, hosts, *criteria, *maxConcurrent),
+	}
+
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Interrupted.\n")
+		os.Exit(130)
+	}
+
+	printSurvey(report)
+
+	if *jsonOut != "" {
+		if err := writeSurveyJSON(*jsonOut, report); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("\nWrote %s.\n", *jsonOut)
+	}
+}
+
+// runScan implements the scan subcommand, a quick health sweep of a fleet.
+// It's like survey with shorter measurements, but prints the results to
+// standard output, as JSON with --format=json, and exits with status 1 if any
+// host was unreachable.
+func runScan(ctx context.Context, args []string) {
+	fs := newSubcommandFlagSet("scan", []string{"format"}, connectionFlags, pingFlags, outputFlags)
+	hostsFile := fs.String("hosts-file", "", "File listing hosts to scan, one per line.")
+	criteria := fs.String("criteria", "p95", "Metric to sort by: min, max, mean, stddev, or a percentile like p95.")
+	perHost := fs.Duration("per-host", 2*time.Second, "How long to measure each host for.")
+	concurrency := fs.Int("concurrency", 20, "How many hosts to measure at once.")
+	fs.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "scan supports --format=text or json.\n")
+		os.Exit(1)
+	}
+
+	hosts := prepareSurvey(*hostsFile, *criteria, *perHost, "--concurrency", *concurrency)
+	report := surveyReport{
+		Started:  time.Now(),
+		PerHost:  perHost.String(),
+		Criteria: *criteria,
+		Hosts:    surveyHosts(ctx, hosts, *criteria, *concurrency),
+	}
+
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Interrupted.\n")
+		os.Exit(130)
+	}
+
+	if *format == "json" {
+		if err := encodeSurveyJSON(os.Stdout, report); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		printSurvey(report)
+	}
+
+	for _, r := range report.Hosts {
+		if r.Error != "" {
+			os.Exit(1)
+		}
+	}
+}
+
+// prepareSurvey validates the flags shared by survey and scan, reads the
+// hosts to measure, and sets the top-level flags for measuring each of them,
+// exiting with an error message if anything is wrong. concurrencyFlag names
+// the flag that set concurrency.
+func prepareSurvey(
+	hostsFile string,
+	criteria string,
+	perHost time.Duration,
+	concurrencyFlag string,
+	concurrency int) (hosts []string) {
+	if hostsFile == "" {
+		fmt.Fprintf(os.Stderr, "Must set --hosts-file.\n")
+		os.Exit(1)
+	}
+
+	if !validMetric(criteria) {
+		fmt.Fprintf(os.Stderr, "Unknown --criteria %q.\n", criteria)
+		os.Exit(1)
+	}
+
+	if concurrency < 1 {
+		fmt.Fprintf(os.Stderr, "%s must be positive.\n", concurrencyFlag)
+		os.Exit(1)
+	}
+
+	hosts, err := readHosts(hostsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(hosts) == 0 {
+		log.Fatalf("No hosts in %s", hostsFile)
+	}
+
+	*duration = perHost
+	*host = hosts[0]
+	checkFlags()
+
+	// Progress from concurrent measurements would be interleaved noise. This
+	// must follow checkFlags, which sends it to stderr for some formats.
+	progressOutput = io.Discard
+
+	return
+}
+
+// surveyHosts measures the hosts, up to maxConcurrent at a time, and returns
+// the results ranked by the criteria, followed by hosts that couldn't be
+// measured.
+func surveyHosts(ctx context.Context, hosts []string, criteria string, maxConcurrent int) (results []surveyResult) {
+	results = make([]surveyResult, len(hosts))
+	sem := make(chan struct{}, maxConcurrent)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			defer func() { <-sem }()
+
+			res := surveyResult{Host: h}
+			r, err := measure(ctx, transportOptions{host: h})
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				d := r.distribution()
+				res.d = d
+				res.value = metricValue(criteria, d)
+				res.Samples = d.count()
+				res.ValueMs = millis(res.value)
+				res.P50Ms = millis(d.percentile(50))
+				res.P95Ms = millis(d.percentile(95))
+				res.P99Ms = millis(d.percentile(99))
+				res.MaxMs = millis(d.max())
+			}
+
+			results[i] = res
+
+			mu.Lock()
+			done++
+			fmt.Fprintf(os.Stderr, "Surveyed %d of %d hosts.\r", done, len(hosts))
+			mu.Unlock()
+		}(i, h)
+	}
+
+	wg.Wait()
+	fmt.Fprintf(os.Stderr, "\n")
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if (a.Error == "") != (b.Error == "") {
+			return a.Error == ""
+		}
+
+		return a.value < b.value
+	})
+
+	for i := range results {
+		if results[i].Error == "" {
+			results[i].Rank = i + 1
+		}
+	}
+
+	return
+}
+
+func printSurvey(report surveyReport) {
+	reached := 0
+	for _, r := range report.Hosts {
+		if r.Error == "" {
+			reached++
+		}
+	}
+
+	fmt.Printf(
+		"Surveyed %d hosts for %s each; %d reachable, %d unreachable. Ranked by %s.\n\n",
+		len(report.Hosts),
+		report.PerHost,
+		reached,
+		len(report.Hosts)-reached,
+		report.Criteria)
+
+	fmt.Printf("%4s  %-32s %8s %8s %8s %8s %8s\n", "Rank", "Host", "Samples", "p50", "p95", "p99", "Max")
+	for _, r := range report.Hosts {
+		if r.Error != "" {
+			fmt.Printf("%4s  %-32s UNREACHABLE: %s\n", "-", r.Host, r.Error)
+			continue
+		}
+
+		fmt.Printf(
+			"%4d  %-32s %8d %8s %8s %8s %8s\n",
+			r.Rank,
+			r.Host,
+			r.Samples,
+			formatLatency(r.d.percentile(50)),
+			formatLatency(r.d.percentile(95)),
+			formatLatency(r.d.percentile(99)),
+			formatLatency(r.d.max()))
+	}
+}
+
+func writeSurveyJSON(path string, report surveyReport) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	err = encodeSurveyJSON(f, report)
+	return
+}
+
+// encodeSurveyJSON writes the report as indented JSON.
+func encodeSurveyJSON(w io.Writer, report surveyReport) (err error) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return
+}
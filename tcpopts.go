@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	netipv4 "golang.org/x/net/ipv4"
+	netipv6 "golang.org/x/net/ipv6"
+)
+
+// The IP type of service byte set by --tos or --dscp, or zero to leave it
+// alone.
+var tcpTOS int
+
+// parseDSCP parses a DSCP codepoint given as a number from 0 to 63 or by
+// name, e.g. EF, AF41, or CS1.
+func parseDSCP(s string) (dscp int, err error) {
+	name := strings.ToUpper(s)
+	switch {
+	case name == "EF":
+		dscp = 46
+		return
+
+	case strings.HasPrefix(name, "CS") && len(name) == 3:
+		class := int(name[2] - '0')
+		if class >= 0 && class <= 7 {
+			dscp = 8 * class
+			return
+		}
+
+	case strings.HasPrefix(name, "AF") && len(name) == 4:
+		class, drop := int(name[2]-'0'), int(name[3]-'0')
+		if class >= 1 && class <= 4 && drop >= 1 && drop <= 3 {
+			dscp = 8*class + 2*drop
+			return
+		}
+
+	default:
+		if dscp, err = strconv.Atoi(s); err == nil && dscp >= 0 && dscp <= 63 {
+			return
+		}
+	}
+
+	err = fmt.Errorf("%q isn't a DSCP value from 0 to 63 or a name like EF, AF41, or CS1", s)
+	return
+}
+
+// applyTCPOptions sets the options chosen by --tcp-nodelay, --tos, and
+// --dscp on a connection made by the native transport. Keepalives are set
+// by the dialer.
+func applyTCPOptions(conn net.Conn) (err error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		if *tcpNoDelay && tcpTOS == 0 {
+			return
+		}
+
+		err = fmt.Errorf("can't set TCP options on a %T", conn)
+		return
+	}
+
+	if err = tc.SetNoDelay(*tcpNoDelay); err != nil {
+		return
+	}
+
+	if tcpTOS == 0 {
+		return
+	}
+
+	if addr, ok := tc.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		err = netipv6.NewConn(tc).SetTrafficClass(tcpTOS)
+	} else {
+		err = netipv4.NewConn(tc).SetTOS(tcpTOS)
+	}
+
+	if err != nil {
+		err = fmt.Errorf("setting TOS: %w", err)
+	}
+
+	return
+}
+
+// describeTCPOptions describes the TCP options in effect for the native
+// transport, e.g. "TCP_NODELAY on, TOS 0xb8 (DSCP 46), keepalive every 15s".
+func describeTCPOptions() string {
+	parts := []string{"TCP_NODELAY off"}
+	if *tcpNoDelay {
+		parts[0] = "TCP_NODELAY on"
+	}
+
+	if tcpTOS != 0 {
+		parts = append(parts, fmt.Sprintf("TOS %#02x (DSCP %d)", tcpTOS, tcpTOS>>2))
+	}
+
+	if *tcpKeepAlive < 0 {
+		parts = append(parts, "keepalive off")
+	} else {
+		parts = append(parts, fmt.Sprintf("keepalive every %v", *tcpKeepAlive))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// tcpOptionsSet reports whether any of the TCP options differ from their
+// defaults.
+func tcpOptionsSet() bool {
+	return !*tcpNoDelay || tcpTOS != 0 || *tcpKeepAlive != defaultTCPKeepAlive
+}
+
+// The keepalive interval Go uses by default.
+const defaultTCPKeepAlive = 15 * time.Second
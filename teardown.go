@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// How long to wait for an ssh process or session to finish once told to,
+// before giving up on it.
+const teardownTimeout = 5 * time.Second
+
+// waitOrKill waits for a process to exit, as signalled by the channel being
+// closed, killing it if that takes longer than teardownTimeout.
+func waitOrKill(cmd *exec.Cmd, exited <-chan struct{}) {
+	select {
+	case <-exited:
+		return
+	case <-time.After(teardownTimeout):
+	}
+
+	cmd.Process.Kill()
+	<-exited
+}
+
+// cancelGracefully arranges for a command started with a context to be asked
+// to exit with SIGTERM when the context is cancelled, rather than killed at
+// once, so that ssh can close its connection cleanly. It's killed if it
+// hasn't exited within teardownTimeout, or at once where signals other than
+// kill aren't supported, as on Windows.
+func cancelGracefully(cmd *exec.Cmd) {
+	cmd.Cancel = func() error {
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			return cmd.Process.Kill()
+		}
+
+		return nil
+	}
+
+	cmd.WaitDelay = teardownTimeout
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServerOptions shape the network a testServer pretends to be behind.
+type testServerOptions struct {
+	// How long each echo is held, and by how much more or less at random.
+	// Echoes are never reordered.
+	delay  time.Duration
+	jitter time.Duration
+
+	// The fraction of what's written to a session that is never echoed, as
+	// if lost on a path that never delivered it.
+	dropRate float64
+
+	// How many writes to each session are always echoed before any may be
+	// dropped, so that every connection gets going.
+	spared int
+}
+
+// testServer is an in-process SSH server for TestEndToEnd. It accepts any
+// client without authentication, and runs every command as cat, echoing
+// what's written to it after the delay set by its options.
+type testServer struct {
+	opts     testServerOptions
+	config   *ssh.ServerConfig
+	listener net.Listener
+
+	mu    sync.Mutex
+	rnd   *mathrand.Rand
+	conns []net.Conn
+}
+
+// startTestServer starts a test server listening on a free port on the
+// loopback interface.
+func startTestServer(opts testServerOptions) (s *testServer, err error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+
+	s = &testServer{
+		opts:     opts,
+		config:   config,
+		listener: l,
+		rnd:      newRand(),
+	}
+
+	go s.serve()
+	return
+}
+
+// addr returns the address the server is listening on.
+func (s *testServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// connections returns how many connections the server has accepted.
+func (s *testServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Close stops the server, closing the connections it accepted.
+func (s *testServer) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+
+	return err
+}
+
+func (s *testServer) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+
+		go s.serveConn(c)
+	}
+}
+
+func (s *testServer) serveConn(c net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(c, s.config)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+
+		go s.serveSession(ch, reqs)
+	}
+}
+
+func (s *testServer) serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			req.Reply(true, nil)
+			go s.echo(ch)
+
+		case "env", "pty-req":
+			req.Reply(true, nil)
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// echo copies what's written to the session back to it, delaying or dropping
+// each write according to the server's options, until the client closes its
+// side.
+func (s *testServer) echo(ch ssh.Channel) {
+	type chunk struct {
+		due  time.Time
+		data []byte
+	}
+
+	chunks := make(chan chunk, 1024)
+	go func() {
+		defer close(chunks)
+		var last time.Time
+		var writes int
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := ch.Read(buf)
+			if n > 0 {
+				writes++
+				if delay, drop := s.fate(writes > s.opts.spared); !drop {
+					due := time.Now().Add(delay)
+					if due.Before(last) {
+						due = last
+					}
+
+					last = due
+					chunks <- chunk{due, append([]byte(nil), buf[:n]...)}
+				}
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Keep draining after a failed write, so that the reader isn't blocked.
+	var err error
+	for c := range chunks {
+		if err == nil {
+			time.Sleep(time.Until(c.due))
+			_, err = ch.Write(c.data)
+		}
+	}
+
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+	ch.Close()
+}
+
+// fate decides how long to hold a write before echoing it, or whether to drop
+// it if it may be dropped.
+func (s *testServer) fate(droppable bool) (delay time.Duration, drop bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rnd.Float64() < s.opts.dropRate && droppable {
+		drop = true
+		return
+	}
+
+	delay = s.opts.delay + time.Duration((2*s.rnd.Float64()-1)*float64(s.opts.jitter))
+	if delay < 0 {
+		delay = 0
+	}
+
+	return
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A threshold is a limit on a statistic of the samples, e.g. "p95<80ms", or
+// of one phase of making connections and echoing, e.g. "auth:p95<200ms".
+type threshold struct {
+	// The phase measured, one of phases, or empty for echo round trip time.
+	phase string
+
+	metric string
+	limit  time.Duration
+}
+
+// The phases that thresholds may be set on besides echo round trip time:
+//
+//	setup     from starting to connect until the first echo
+//	auth      from verifying the host key until logged in
+//	channel   opening a session and starting the echo command in it
+//	dwell     the echo agent's time between reading a ping and echoing it
+var phases = map[string]bool{
+	"setup":   true,
+	"auth":    true,
+	"channel": true,
+	"dwell":   true,
+}
+
+// name returns the statistic the threshold limits, e.g. "p95" or
+// "auth:p95".
+func (t threshold) name() string {
+	if t.phase == "" {
+		return t.metric
+	}
+
+	return t.phase + ":" + t.metric
+}
+
+func (t threshold) String() string {
+	return fmt.Sprintf("%s<%v", t.name(), t.limit)
+}
+
+// value computes the threshold's metric for the run.
+func (t threshold) value(r run) time.Duration {
+	return metricValue(t.metric, r.phase(t.phase))
+}
+
+// phaseUnavailable returns why the named phase can't be measured with the
+// flags set, or the empty string if it can.
+func phaseUnavailable(phase string) string {
+	switch phase {
+	case "auth", "channel":
+		if *transportKind != "native" || *simulate != "" {
+			return "needs --transport=native"
+		}
+
+	case "dwell":
+		if !*deployAgent || *useHistogram {
+			return "needs --deploy-agent, and can't be used with --histogram"
+		}
+	}
+
+	return ""
+}
+
+// validMetric reports whether m is a metric understood by metricValue: min,
+// max, mean, stddev, or a percentile like p50 or p99.9.
+func validMetric(m string) bool {
+	switch m {
+	case "min", "max", "mean", "stddev":
+		return true
+	}
+
+	if !strings.HasPrefix(m, "p") {
+		return false
+	}
+
+	p, err := strconv.ParseFloat(m[1:], 64)
+	return err == nil && p > 0 && p <= 100
+}
+
+// metricValue computes the named metric for the supplied samples.
+func metricValue(m string, d distribution) time.Duration {
+	switch m {
+	case "min":
+		return d.min()
+	case "max":
+		return d.max()
+	case "mean":
+		return d.mean()
+	case "stddev":
+		return d.stdDev()
+	}
+
+	// Validated by validMetric.
+	p, _ := strconv.ParseFloat(m[1:], 64)
+	return d.percentile(p)
+}
+
+// parseThreshold parses a threshold like "p95<80ms" or "auth:p95<200ms". The
+// metric may be min, max, mean, stddev, or a percentile like p50 or p99.9,
+// and the phase, if any, one of phases.
+func parseThreshold(s string) (t threshold, err error) {
+	metric, limit, ok := strings.Cut(s, "<")
+	if !ok {
+		err = fmt.Errorf("threshold %q should look like p95<80ms", s)
+		return
+	}
+
+	metric = strings.TrimSpace(metric)
+	if phase, m, ok := strings.Cut(metric, ":"); ok {
+		t.phase = strings.TrimSpace(phase)
+		metric = strings.TrimSpace(m)
+		if !phases[t.phase] {
+			err = fmt.Errorf("threshold %q: unknown phase %q", s, t.phase)
+			return
+		}
+	}
+
+	t.metric = metric
+	if !validMetric(t.metric) {
+		err = fmt.Errorf("threshold %q: unknown metric %q", s, t.metric)
+		return
+	}
+
+	t.limit, err = time.ParseDuration(strings.TrimSpace(limit))
+	if err != nil {
+		err = fmt.Errorf("threshold %q: %w", s, err)
+		return
+	}
+
+	return
+}
+
+// thresholdList is a flag.Value accumulating thresholds from repeated flags.
+type thresholdList []threshold
+
+func (l *thresholdList) String() string {
+	var parts []string
+	for _, t := range *l {
+		parts = append(parts, t.String())
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (l *thresholdList) Set(s string) (err error) {
+	t, err := parseThreshold(s)
+	if err != nil {
+		return
+	}
+
+	*l = append(*l, t)
+	return
+}
+
+// A thresholdResult records how the samples fared against a threshold.
+type thresholdResult struct {
+	threshold threshold
+	value     time.Duration
+}
+
+func (r thresholdResult) passed() bool {
+	return r.value < r.threshold.limit
+}
+
+// anyBreached reports whether any of the thresholds checked was breached.
+func anyBreached(results []thresholdResult) bool {
+	for _, r := range results {
+		if !r.passed() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkThresholds(ts []threshold, r run) (results []thresholdResult) {
+	for _, t := range ts {
+		results = append(results, thresholdResult{t, t.value(r)})
+	}
+
+	return
+}
+
+func printThresholds(results []thresholdResult) {
+	fmt.Printf("Thresholds:\n")
+	for _, r := range results {
+		verdict := "PASS"
+		if !r.passed() {
+			verdict = "FAIL"
+		}
+
+		fmt.Printf(
+			"  %s  %-16s (measured %s)\n",
+			verdict,
+			r.threshold,
+			strings.TrimSpace(formatLatency(r.value)))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// GitHub Actions
+////////////////////////////////////////////////////////////////////////
+
+// How close to its limit a metric may come before a warning annotation is
+// emitted, as a fraction of the limit.
+const annotationWarnFraction = 0.9
+
+// escapeWorkflowData escapes a message for use in a GitHub Actions workflow
+// command.
+func escapeWorkflowData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeWorkflowProperty escapes a property value, such as a title, for use
+// in a GitHub Actions workflow command.
+func escapeWorkflowProperty(s string) string {
+	return strings.NewReplacer(":", "%3A", ",", "%2C").Replace(escapeWorkflowData(s))
+}
+
+// writeGitHubAnnotations writes a GitHub Actions workflow command for each
+// threshold that was breached (an error) or nearly breached (a warning).
+func writeGitHubAnnotations(w io.Writer, target string, results []thresholdResult) {
+	for _, r := range results {
+		level := ""
+		switch {
+		case !r.passed():
+			level = "error"
+		case float64(r.value) >= annotationWarnFraction*float64(r.threshold.limit):
+			level = "warning"
+		default:
+			continue
+		}
+
+		fmt.Fprintf(
+			w,
+			"::%s title=ssh_ping %s::%s\n",
+			level,
+			escapeWorkflowProperty(target),
+			escapeWorkflowData(fmt.Sprintf(
+				"%s was %s (threshold %s)",
+				r.threshold.name(),
+				strings.TrimSpace(formatLatency(r.value)),
+				r.threshold)))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// JUnit XML
+////////////////////////////////////////////////////////////////////////
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the threshold results as a JUnit XML report, with one
+// test case per threshold.
+func writeJUnit(w io.Writer, target string, elapsed time.Duration, results []thresholdResult) (err error) {
+	suite := junitTestSuite{
+		Name:  "ssh_ping",
+		Tests: len(results),
+		Time:  fmt.Sprintf("%.3f", elapsed.Seconds()),
+	}
+
+	for _, r := range results {
+		measured := fmt.Sprintf("%s: %s", r.threshold.name(), strings.TrimSpace(formatLatency(r.value)))
+		c := junitTestCase{
+			Name:      r.threshold.String(),
+			ClassName: "ssh_ping." + target,
+			SystemOut: measured,
+		}
+
+		if !r.passed() {
+			suite.Failures++
+			c.Failure = &junitFailure{
+				Message: fmt.Sprintf("%s is not below %v", measured, r.threshold.limit),
+				Text:    measured,
+			}
+		}
+
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	if _, err = io.WriteString(w, xml.Header); err != nil {
+		return
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err = enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return
+	}
+
+	_, err = io.WriteString(w, "\n")
+	return
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A transport provides streams to commands run on the remote host.
+type transport interface {
+	// Dial connects to the host. It must be called before NewStream. Cancelling
+	// the context aborts the attempt, and for the exec transport also tears
+	// down any ControlMaster it starts.
+	Dial(ctx context.Context) error
+
+	// NewStream starts the given command on the host, returning a stream
+	// connected to its stdin and stdout. If the context is cancelled, the
+	// stream is torn down, unblocking any reads and writes.
+	NewStream(ctx context.Context, command string) (stream, error)
+
+	// NewSubsystem is like NewStream, but starts the named subsystem, such as
+	// sftp, rather than a command.
+	NewSubsystem(ctx context.Context, name string) (stream, error)
+
+	// Close tears down the connection to the host.
+	Close() error
+}
+
+// A stream is connected to the stdin and stdout of a remote command.
+type stream interface {
+	io.Writer
+	io.Reader
+
+	// CloseWrite closes the command's stdin, leaving its stdout open.
+	CloseWrite() error
+
+	// Close closes the command's stdin and waits for it to exit.
+	Close() error
+}
+
+// transportOptions adjust how a transport connects to the host.
+type transportOptions struct {
+	// The host to connect to. Defaults to --host.
+	host string
+
+	// Extra options to pass to ssh. Only supported by the exec transport.
+	sshArgs []string
+
+	// If non-empty, the ciphers, MACs, and key exchange algorithms that may
+	// be used.
+	ciphers      []string
+	macs         []string
+	keyExchanges []string
+
+	// "4" or "6" to connect only over IPv4 or IPv6. Defaults to the choice
+	// made by -4 or -6.
+	addressFamily string
+
+	// If set, the local address to connect from.
+	bindAddress string
+
+	// If set, the IP address to connect to instead of resolving the host's
+	// name. Only supported by the native transport; for the exec transport,
+	// use sshArgs to set HostName.
+	address string
+
+	// Whether streams must share a single connection. The native transport
+	// always does this; the exec transport does it with a ControlMaster.
+	shared bool
+
+	// Whether to run commands on a pseudo-terminal, as interactive sessions
+	// do, and whether to put it in raw mode.
+	pty bool
+	raw bool
+
+	// If positive, how often to send an SSH keepalive to the server, as
+	// OpenSSH's ServerAliveInterval does.
+	serverAlive time.Duration
+}
+
+// newTransport returns a transport of the kind selected by --transport, or a
+// simulated one if --simulate is set.
+func newTransport(opts transportOptions) (t transport, err error) {
+	if opts.host == "" {
+		opts.host = *host
+	}
+
+	if opts.addressFamily == "" {
+		opts.addressFamily = addressFamily()
+	}
+
+	if *simulate == "" {
+		if opts, err = applyResolve(opts); err != nil {
+			return
+		}
+	}
+
+	if *simulate != "" {
+		var m latencyModel
+		m, err = parseLatencyModel(*simulate)
+		if err != nil {
+			err = fmt.Errorf("--simulate: %w", err)
+			return
+		}
+
+		t = &simulatedTransport{model: m}
+		return
+	}
+
+	switch *transportKind {
+	case "exec":
+		t = &execTransport{opts: opts}
+
+	case "native":
+		if len(opts.sshArgs) != 0 {
+			err = fmt.Errorf("not supported by the native transport: %s", strings.Join(opts.sshArgs, " "))
+			return
+		}
+
+		t = &nativeTransport{opts: opts}
+
+	default:
+		err = fmt.Errorf("unknown transport %q", *transportKind)
+	}
+
+	return
+}
+
+// runCommand runs a command to completion over the supplied transport,
+// feeding it the given input and returning its output.
+func runCommand(ctx context.Context, t transport, command string, input io.Reader) (output []byte, err error) {
+	s, err := t.NewStream(ctx, command)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		if input != nil {
+			io.Copy(s, input)
+		}
+
+		s.CloseWrite()
+	}()
+
+	output, err = io.ReadAll(s)
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// exec
+////////////////////////////////////////////////////////////////////////
+
+// execTransport runs the OpenSSH ssh command once for each stream. If the
+// streams are to share a connection, it first starts a ControlMaster for them
+// to be multiplexed over.
+type execTransport struct {
+	opts transportOptions
+
+	// The ControlMaster process, a channel closed when it exits, and the
+	// directory containing its socket, if any.
+	master       *exec.Cmd
+	masterExited chan struct{}
+	masterDir    string
+
+	// What the ssh that made the connection, the ControlMaster or else the
+	// first stream's, logged about it with -v. Nil with plink.
+	log *sshLog
+}
+
+// metadata returns what ssh has said about the connection it made.
+func (t *execTransport) metadata() (m connMetadata) {
+	if t.log != nil {
+		m = t.log.metadata()
+	}
+
+	return
+}
+
+// verbose returns a log for an ssh connecting to the host to write to, and
+// the options to make it log, if it's the ssh that makes the connection whose
+// metadata is reported. Its output other than logging goes to out.
+func (t *execTransport) verbose(out io.Writer) (w io.Writer, args []string) {
+	w = out
+	if t.log != nil || execClient.plink {
+		return
+	}
+
+	t.log = &sshLog{out: out}
+	w, args = t.log, []string{"-v"}
+	return
+}
+
+func (t *execTransport) args() (args []string) {
+	if t.opts.addressFamily != "" {
+		args = append(args, "-"+t.opts.addressFamily)
+	}
+
+	if t.opts.bindAddress != "" {
+		args = append(args, "-b", t.opts.bindAddress)
+	}
+
+	if len(t.opts.ciphers) != 0 {
+		args = append(args, "-c", strings.Join(t.opts.ciphers, ","))
+	}
+
+	// ssh uses the first value given for an option, so these take precedence
+	// over --constrained's.
+	if len(t.opts.macs) != 0 {
+		args = append(args, "-o", "MACs="+strings.Join(t.opts.macs, ","))
+	}
+
+	if len(t.opts.keyExchanges) != 0 {
+		args = append(args, "-o", "KexAlgorithms="+strings.Join(t.opts.keyExchanges, ","))
+	}
+
+	if *constrained {
+		args = append(args, constrainedSSHArgs...)
+	}
+
+	if t.opts.serverAlive > 0 {
+		// ssh only takes whole seconds.
+		secs := int((t.opts.serverAlive + time.Second - 1) / time.Second)
+		args = append(args, "-o", fmt.Sprintf("ServerAliveInterval=%d", secs))
+	}
+
+	args = append(args, t.opts.sshArgs...)
+	return
+}
+
+func (t *execTransport) controlPath() string {
+	return filepath.Join(t.masterDir, "control")
+}
+
+func (t *execTransport) Dial(ctx context.Context) (err error) {
+	if !t.opts.shared {
+		return
+	}
+
+	if !execClient.multiplexes() {
+		err = fmt.Errorf("%s can't share a connection between sessions; use --transport=native", filepath.Base(execClient.path))
+		return
+	}
+
+	t.masterDir, err = os.MkdirTemp("", "ssh_ping")
+	if err != nil {
+		return
+	}
+
+	stderr, verbose := t.verbose(os.Stderr)
+	t.master, t.masterExited, err = startControlMaster(ctx, t.opts.host, t.controlPath(), append(t.args(), verbose...), stderr)
+	if err != nil {
+		os.RemoveAll(t.masterDir)
+		return
+	}
+
+	return
+}
+
+func (t *execTransport) NewStream(ctx context.Context, command string) (s stream, err error) {
+	// Only the text echo's newlines can be translated back: pings never
+	// contain a carriage return, but the agent's timestamps, and the output of
+	// other commands, may.
+	crlf := execClient.translatesNewlines() && command == remoteEchoCommand && !*deployAgent
+	if !t.opts.pty {
+		s, err = t.start(ctx, nil, command, crlf)
+		return
+	}
+
+	if s, err = t.start(ctx, []string{"-tt"}, ptyCommand(command, t.opts.raw), crlf); err != nil {
+		return
+	}
+
+	if err = awaitPTYReady(s); err != nil {
+		return
+	}
+
+	s = ptyStream{s}
+	return
+}
+
+// NewSubsystem never translates newlines: subsystems like sftp speak binary
+// protocols, whose lengths and request IDs may contain CRLF.
+func (t *execTransport) NewSubsystem(ctx context.Context, name string) (s stream, err error) {
+	s, err = t.start(ctx, []string{"-s"}, name, false)
+	return
+}
+
+// start runs ssh with the given extra options and remote command, returning
+// a stream connected to it, which turns CRLF back into LF if crlf is set.
+func (t *execTransport) start(ctx context.Context, extraArgs []string, remote string, crlf bool) (s stream, err error) {
+	stderr := &tailBuffer{}
+	sshStderr, verbose := t.verbose(stderr)
+	args := append(append(t.args(), verbose...), extraArgs...)
+	if t.master != nil {
+		args = append(args, "-o", "ControlMaster=no", "-o", "ControlPath="+t.controlPath())
+	}
+
+	var cmd *exec.Cmd
+	if execClient.plink {
+		if cmd, err = plinkCommand(ctx, t.opts.host, args, remote); err != nil {
+			return
+		}
+	} else {
+		cmd = sshCommand(ctx, t.opts.host, args, remote)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+
+	// ssh's stdout is our own pipe rather than one from cmd.StdoutPipe, so
+	// that ssh can be waited for without discarding output not yet read.
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+
+	cmd.Stdout = w
+	cmd.Stderr = sshStderr
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		stdout.Close()
+		return
+	}
+
+	es := &execStream{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+		exited: make(chan struct{}),
+	}
+
+	go func() {
+		es.exitErr = cmd.Wait()
+		close(es.exited)
+	}()
+
+	s = es
+	if crlf {
+		s = &crlfStream{stream: es}
+	}
+
+	return
+}
+
+func (t *execTransport) Close() error {
+	if t.master != nil {
+		// Ask the master to exit, so that it closes the connection cleanly,
+		// before resorting to killing it.
+		ctx, cancel := context.WithTimeout(context.Background(), teardownTimeout)
+		exit := exec.CommandContext(ctx, execClient.path, "-o", "ControlPath="+t.controlPath(), "-O", "exit", t.opts.host)
+		exit.Run()
+		cancel()
+		waitOrKill(t.master, t.masterExited)
+		os.RemoveAll(t.masterDir)
+		t.master = nil
+	}
+
+	return nil
+}
+
+// startControlMaster starts a background ssh process acting as a
+// ControlMaster for the host, listening on the given socket and writing its
+// stderr to the supplied writer, and waits for it to become ready. The
+// process is told to exit if the context is cancelled, and killed if it
+// doesn't. The returned channel is closed when it exits.
+func startControlMaster(
+	ctx context.Context,
+	host string,
+	socket string,
+	extraArgs []string,
+	stderr io.Writer) (cmd *exec.Cmd, exited chan struct{}, err error) {
+	args := append([]string{
+		"-o", "ControlMaster=yes",
+		"-o", "ControlPath=" + socket,
+		"-N",
+	}, extraArgs...)
+
+	cmd = sshCommand(ctx, host, args)
+	cmd.Stderr = stderr
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	var exitErr error
+	exited = make(chan struct{})
+	go func() {
+		exitErr = cmd.Wait()
+		close(exited)
+	}()
+
+	for {
+		check := exec.CommandContext(ctx, execClient.path, "-o", "ControlPath="+socket, "-O", "check", host)
+		if check.Run() == nil {
+			return
+		}
+
+		select {
+		case <-exited:
+			err = fmt.Errorf("ControlMaster exited before becoming ready: %v", exitErr)
+			return
+
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// sshCommand returns a command that runs the supplied remote command on the
+// host, passing ssh the supplied extra options. ssh is told to exit if the
+// context is cancelled, and killed if it doesn't.
+func sshCommand(ctx context.Context, host string, extraArgs []string, remote ...string) *exec.Cmd {
+	// Host key verification is left to ssh itself, which consults
+	// ~/.ssh/known_hosts and records new keys when told to accept them. Unless
+	// told otherwise, it's as strict as the user's ssh configuration says.
+	var args []string
+	if flagWasSet("strict-host-key-checking") {
+		args = append(args, "-o", "StrictHostKeyChecking="+*strictHostKeyChecking)
+	}
+
+	if !*interactive {
+		args = append(args, "-o", "BatchMode=yes")
+	}
+
+	args = append(args, extraArgs...)
+	args = append(args, host, "--")
+	args = append(args, remote...)
+
+	var cmd *exec.Cmd
+	if *netns != "" {
+		// A thread that joined the namespace would have to outlive ssh, or
+		// its death signal would kill it, so leave this to nsenter.
+		cmd = exec.CommandContext(ctx, "nsenter", append([]string{"--net=" + netnsPath(*netns), execClient.path}, args...)...)
+	} else {
+		cmd = exec.CommandContext(ctx, execClient.path, args...)
+	}
+
+	cancelGracefully(cmd)
+	setDeathSignal(cmd)
+	return cmd
+}
+
+// execStream is connected to the stdin and stdout pipes of an ssh process.
+// Errors from the pipes are annotated with what ssh said on stderr, since
+// the pipes themselves only say that ssh went away.
+type execStream struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *os.File
+	stderr *tailBuffer
+
+	// Closed when ssh exits, after exitErr is set.
+	exited  chan struct{}
+	exitErr error
+}
+
+func (s *execStream) Write(p []byte) (n int, err error) {
+	n, err = s.stdin.Write(p)
+	if err != nil {
+		err = s.explain(err)
+	}
+
+	return
+}
+
+func (s *execStream) Read(p []byte) (n int, err error) {
+	n, err = s.stdout.Read(p)
+	if err != nil {
+		err = s.explain(err)
+	}
+
+	return
+}
+
+// How long explain waits for ssh to exit after a pipe fails, so that its
+// exit status and last words are available.
+const sshExitGrace = time.Second
+
+// explain adds ssh's exit status and stderr to an error from one of its
+// pipes. A clean EOF from an ssh that exited successfully is left alone.
+func (s *execStream) explain(err error) error {
+	select {
+	case <-s.exited:
+	case <-time.After(sshExitGrace):
+	}
+
+	var status error
+	select {
+	case <-s.exited:
+		status = s.exitErr
+	default:
+	}
+
+	if err == io.EOF && status == nil {
+		return err
+	}
+
+	msg := s.stderr.lastLines(3)
+	switch {
+	case status != nil && msg != "":
+		return fmt.Errorf("%w (ssh %v: %s)", err, status, msg)
+	case status != nil:
+		return fmt.Errorf("%w (ssh %v)", err, status)
+	case msg != "":
+		return fmt.Errorf("%w (ssh: %s)", err, msg)
+	}
+
+	return err
+}
+
+func (s *execStream) CloseWrite() error {
+	return s.stdin.Close()
+}
+
+func (s *execStream) Close() (err error) {
+	// The stdin pipe may already have been closed by CloseWrite, in which case
+	// closing it again fails harmlessly.
+	s.stdin.Close()
+	waitOrKill(s.cmd, s.exited)
+	s.stdout.Close()
+
+	err = s.exitErr
+	if msg := s.stderr.lastLines(3); err != nil && msg != "" {
+		err = fmt.Errorf("%w: %s", err, msg)
+	}
+
+	return
+}
+
+// The most of ssh's stderr that tailBuffer keeps.
+const tailBufferSize = 4 << 10
+
+// tailBuffer is an io.Writer that keeps the last few kilobytes written to it.
+// It is safe for concurrent use.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > tailBufferSize {
+		b.buf = b.buf[len(b.buf)-tailBufferSize:]
+	}
+
+	return len(p), nil
+}
+
+// lastLines returns up to n of the last non-empty lines written, joined with
+// semicolons.
+func (b *tailBuffer) lastLines(n int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var lines []string
+	for _, l := range strings.Split(string(b.buf), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return strings.Join(lines, "; ")
+}
+
+////////////////////////////////////////////////////////////////////////
+// simulated
+////////////////////////////////////////////////////////////////////////
+
+// simulatedTransport provides simulated echo streams, regardless of the
+// command requested.
+type simulatedTransport struct {
+	model latencyModel
+}
+
+func (t *simulatedTransport) Dial(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (t *simulatedTransport) NewStream(ctx context.Context, command string) (stream, error) {
+	return newSimulatedEcho(ctx, t.model, newRand()), nil
+}
+
+func (t *simulatedTransport) NewSubsystem(ctx context.Context, name string) (stream, error) {
+	return nil, fmt.Errorf("subsystems aren't simulated")
+}
+
+func (t *simulatedTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The SSH channel window that OpenSSH and golang.org/x/crypto/ssh advertise
+// by default. A single channel can't have more than this in flight, so it
+// caps throughput at window/RTT however fast the path is.
+const sshChannelWindow = 2 << 20
+
+// If throughput is at least this fraction of what a window allows, the
+// window is probably what's limiting it.
+const windowLimitedFraction = 0.8
+
+// printTuning prints the bandwidth-delay product of a path with the given
+// round trip time and measured throughput (in bytes per second), and the
+// buffer sizes needed to fill it, noting which are likely limiting the
+// throughput measured. Only buffers that look too small are suggested.
+func printTuning(rtt time.Duration, throughput float64) {
+	bdp := throughput * rtt.Seconds()
+	fmt.Printf(
+		"Bandwidth-delay product: %s (%.1f Mbit/s × %s).\n",
+		formatBytes(bdp),
+		throughput*8/1e6,
+		strings.TrimSpace(formatLatency(rtt)))
+
+	limited := false
+	check := func(name string, window float64) {
+		limit := window / rtt.Seconds()
+		fmt.Printf(
+			"%s of %s allows at most %.1f Mbit/s at this RTT",
+			name,
+			formatBytes(window),
+			limit*8/1e6)
+
+		if throughput >= windowLimitedFraction*limit {
+			limited = true
+			fmt.Printf("; this is likely limiting throughput.\n")
+		} else {
+			fmt.Printf(".\n")
+		}
+	}
+
+	check("The SSH channel window", sshChannelWindow)
+	wmem, wmemErr := readTCPBufferMax("/proc/sys/net/ipv4/tcp_wmem")
+	if wmemErr == nil {
+		check("The local TCP send buffer maximum (net.ipv4.tcp_wmem)", wmem)
+	}
+
+	if !limited {
+		fmt.Printf("The windows don't seem to be the bottleneck at the throughput measured.\n")
+	}
+
+	// Buffers want headroom over the BDP, since the RTT rises under load.
+	want := 2 * bdp
+	if wmemErr == nil && wmem >= want && want <= sshChannelWindow {
+		return
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("Suggested tuning for this path:\n")
+	if wmemErr != nil || wmem < want {
+		fmt.Printf("  TCP buffers of at least %s at both ends, e.g. on Linux:\n", formatBytes(want))
+		fmt.Printf("    sysctl -w net.ipv4.tcp_rmem='4096 131072 %d'\n", int64(want))
+		fmt.Printf("    sysctl -w net.ipv4.tcp_wmem='4096 16384 %d'\n", int64(want))
+	}
+
+	if want > sshChannelWindow {
+		fmt.Printf(
+			"  An SSH channel window of at least %s, which stock OpenSSH doesn't allow; use\n"+
+				"  several connections in parallel, or an SSH implementation with a larger window.\n",
+			formatBytes(want))
+	}
+}
+
+// readTCPBufferMax reads the maximum from a Linux TCP buffer sysctl like
+// tcp_wmem, which holds minimum, default, and maximum sizes.
+func readTCPBufferMax(path string) (max float64, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		err = fmt.Errorf("%s: unexpected contents %q", path, data)
+		return
+	}
+
+	max, err = strconv.ParseFloat(fields[2], 64)
+	return
+}
+
+// formatBytes formats a byte count with a binary unit.
+func formatBytes(n float64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", n/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", n/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", n/(1<<10))
+	}
+
+	return fmt.Sprintf("%.0f B", n)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// The text typed by --mode=typing, a keystroke at a time.
+const typingText = "the quick brown fox jumps over the lazy dog "
+
+// The typical pause between keystrokes, about that of someone typing 80
+// words per minute, and how much it varies, as the standard deviation of its
+// logarithm.
+const (
+	typingMedianGap = 150 * time.Millisecond
+	typingSpread    = 0.4
+)
+
+// How often a typist stops to think, and for about how long.
+const (
+	typingPauseChance = 0.05
+	typingPause       = time.Second
+)
+
+// Keystrokes echoed within this long feel instantaneous.
+const perceptibleDelay = 100 * time.Millisecond
+
+// typingGap returns a pause between keystrokes like a person's: usually near
+// typingMedianGap, with the occasional longer pause.
+func typingGap(rnd *rand.Rand) time.Duration {
+	if rnd.Float64() < typingPauseChance {
+		return typingPause/2 + time.Duration(rnd.Int63n(int64(typingPause)))
+	}
+
+	return time.Duration(float64(typingMedianGap) * math.Exp(typingSpread*rnd.NormFloat64()))
+}
+
+// measureKeystrokes types typingText over and over for --duration, on a
+// pseudo-terminal in raw mode as an editor would have, and records how long
+// each keystroke takes to be echoed.
+func measureKeystrokes(ctx context.Context) (r run, err error) {
+	t, err := newTransport(transportOptions{pty: true, raw: true})
+	if err != nil {
+		return
+	}
+
+	if err = t.Dial(ctx); err != nil {
+		return
+	}
+
+	defer t.Close()
+
+	s, err := startEcho(ctx, t)
+	if err != nil {
+		return
+	}
+
+	defer s.Close()
+
+	rnd := newRand()
+	deadline := time.Now().Add(*duration)
+	for i := 0; time.Now().Before(deadline); i++ {
+		select {
+		case <-time.After(typingGap(rnd)):
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+
+		var pt pingTimes
+		if pt, err = runPing([]byte{typingText[i%len(typingText)]}, s, s); err != nil {
+			return
+		}
+
+		r.add(pt.sent, pt.rtt())
+	}
+
+	return
+}
+
+// measureTyping measures echoes of pings sent back to back and of keystrokes
+// typed at a human pace, and compares the two.
+func measureTyping(ctx context.Context) (err error) {
+	fmt.Printf("Measuring echo...\n")
+	echo, err := measure(ctx, transportOptions{})
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("Measuring typing...\n")
+	typing, err := measureKeystrokes(ctx)
+	if err != nil {
+		err = fmt.Errorf("typing: %w", err)
+		return
+	}
+
+	fmt.Printf("\n")
+	printComparison("Mode", []string{"echo", "typing"}, []distribution{echo.distribution(), typing.distribution()})
+
+	if len(typing.samples) == 0 {
+		return
+	}
+
+	perceptible := 0
+	for _, rtt := range typing.samples {
+		if rtt >= perceptibleDelay {
+			perceptible++
+		}
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf(
+		"Keystrokes echoed within %s: %.1f%%\n",
+		strings.TrimSpace(formatLatency(perceptibleDelay)),
+		100*(1-float64(perceptible)/float64(len(typing.samples))))
+
+	printEvents(typing.events)
+	return
+}
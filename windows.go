@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The windows set by --windows, over which statistics are kept for each host
+// measured with --schedule, in the order given.
+var windowSpecs []windowSpec
+
+// A windowSpec is a window as named in --windows, like "sliding:1m".
+type windowSpec struct {
+	// As given.
+	name string
+
+	// sliding, tumbling, or decay.
+	kind  string
+	width time.Duration
+}
+
+// parseWindows parses --windows, like "sliding:1m,tumbling:10m,decay:5m".
+func parseWindows(s string) (specs []windowSpec, err error) {
+	for _, w := range strings.Split(s, ",") {
+		w = strings.TrimSpace(w)
+		kind, width, ok := strings.Cut(w, ":")
+		if !ok {
+			err = fmt.Errorf("window %q should look like sliding:1m", w)
+			return
+		}
+
+		switch kind {
+		case "sliding", "tumbling", "decay":
+		default:
+			err = fmt.Errorf("window %q: unknown kind %q; want sliding, tumbling, or decay", w, kind)
+			return
+		}
+
+		spec := windowSpec{name: w, kind: kind}
+		if spec.width, err = time.ParseDuration(width); err != nil {
+			err = fmt.Errorf("window %q: %w", w, err)
+			return
+		}
+
+		if spec.width < time.Second {
+			err = fmt.Errorf("window %q: should be at least a second", w)
+			return
+		}
+
+		specs = append(specs, spec)
+	}
+
+	return
+}
+
+// A statsWindow accumulates the samples of a host that fall within a window.
+// Samples are recorded after each run, so needn't be recorded in time order.
+type statsWindow interface {
+	record(t time.Time, rtt time.Duration)
+
+	// mergeHistogram records the samples of a run made with --histogram,
+	// which ended at the given time.
+	mergeHistogram(t time.Time, h *histogram)
+
+	stats(now time.Time) windowStats
+}
+
+func (s windowSpec) newWindow() statsWindow {
+	switch s.kind {
+	case "sliding":
+		return &slidingWindow{slot: s.width / slidingSlots}
+	case "tumbling":
+		return &tumblingWindow{width: s.width}
+	}
+
+	return &decayedWindow{halfLife: s.width}
+}
+
+// windowStats are a window's statistics as exported by --format=ndjson and the
+// status server.
+type windowStats struct {
+	Type   string    `json:"type,omitempty"`
+	Host   string    `json:"host,omitempty"`
+	Window string    `json:"window"`
+	End    time.Time `json:"end"`
+
+	// Unset for decay windows, which have no start.
+	Start *time.Time `json:"start,omitempty"`
+
+	// For decay windows, the total weight of the samples.
+	Samples float64 `json:"samples"`
+
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P95Ms  float64 `json:"p95_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+}
+
+func newWindowStats(start, end time.Time, d distribution) (ws windowStats) {
+	ws = windowStats{Start: &start, End: end, Samples: float64(d.count())}
+	if d.count() == 0 {
+		return
+	}
+
+	ws.MeanMs = millis(d.mean())
+	ws.P50Ms = millis(d.percentile(50))
+	ws.P95Ms = millis(d.percentile(95))
+	ws.P99Ms = millis(d.percentile(99))
+	return
+}
+
+// How many slots a sliding window is divided into. It covers the samples in
+// the last that many slots, so its width is accurate to within one.
+const slidingSlots = 60
+
+// A slidingWindow covers the most recent samples, up to its width ago.
+type slidingWindow struct {
+	slot  time.Duration
+	slots [slidingSlots]struct {
+		index int64
+		h     histogram
+	}
+}
+
+func (w *slidingWindow) at(t time.Time) *histogram {
+	i := t.UnixNano() / int64(w.slot)
+	s := &w.slots[i%slidingSlots]
+	if s.index != i {
+		if s.index > i {
+			return nil
+		}
+
+		s.index = i
+		s.h = histogram{}
+	}
+
+	return &s.h
+}
+
+func (w *slidingWindow) record(t time.Time, rtt time.Duration) {
+	if h := w.at(t); h != nil {
+		h.record(rtt)
+	}
+}
+
+func (w *slidingWindow) mergeHistogram(t time.Time, h *histogram) {
+	if s := w.at(t); s != nil {
+		s.merge(h)
+	}
+}
+
+func (w *slidingWindow) stats(now time.Time) windowStats {
+	last := now.UnixNano() / int64(w.slot)
+	var h histogram
+	for _, s := range w.slots {
+		if s.index > last-slidingSlots && s.index <= last {
+			h.merge(&s.h)
+		}
+	}
+
+	first := time.Unix(0, (last-slidingSlots+1)*int64(w.slot))
+	return newWindowStats(first, now, &h)
+}
+
+// A tumblingWindow divides time into consecutive periods of its width,
+// aligned to the clock, and covers the last one to have ended.
+type tumblingWindow struct {
+	width time.Duration
+
+	// The period in progress and the one before it, numbered from the epoch.
+	current, previous int64
+	cur, prev         histogram
+}
+
+func (w *tumblingWindow) advance(t time.Time) {
+	i := t.UnixNano() / int64(w.width)
+	switch {
+	case i == w.current:
+	case i == w.current+1:
+		w.previous, w.prev = w.current, w.cur
+		w.current, w.cur = i, histogram{}
+	case i > w.current:
+		w.previous, w.prev = i-1, histogram{}
+		w.current, w.cur = i, histogram{}
+	}
+}
+
+func (w *tumblingWindow) at(t time.Time) *histogram {
+	w.advance(t)
+	switch t.UnixNano() / int64(w.width) {
+	case w.current:
+		return &w.cur
+	case w.previous:
+		return &w.prev
+	}
+
+	return nil
+}
+
+func (w *tumblingWindow) record(t time.Time, rtt time.Duration) {
+	if h := w.at(t); h != nil {
+		h.record(rtt)
+	}
+}
+
+func (w *tumblingWindow) mergeHistogram(t time.Time, h *histogram) {
+	if p := w.at(t); p != nil {
+		p.merge(h)
+	}
+}
+
+func (w *tumblingWindow) stats(now time.Time) windowStats {
+	w.advance(now)
+	start := time.Unix(0, w.previous*int64(w.width))
+	return newWindowStats(start, start.Add(w.width), &w.prev)
+}
+
+// A decayedWindow covers every sample, weighted by half for each half-life
+// that has passed since it was sent.
+type decayedWindow struct {
+	halfLife time.Duration
+
+	// As of last, the total weight of the samples in each histogram bucket,
+	// and of their round trip times in seconds.
+	last    time.Time
+	weights []float64
+	total   float64
+	sum     float64
+}
+
+// weight returns the weight, as of w.last, of a sample sent at t, first
+// decaying those already recorded if t is later.
+func (w *decayedWindow) weight(t time.Time) float64 {
+	if t.After(w.last) {
+		f := math.Exp2(-float64(t.Sub(w.last)) / float64(w.halfLife))
+		for i := range w.weights {
+			w.weights[i] *= f
+		}
+
+		w.total *= f
+		w.sum *= f
+		w.last = t
+	}
+
+	return math.Exp2(-float64(w.last.Sub(t)) / float64(w.halfLife))
+}
+
+func (w *decayedWindow) add(i int, weight, seconds float64) {
+	for len(w.weights) <= i {
+		w.weights = append(w.weights, 0)
+	}
+
+	w.weights[i] += weight
+	w.total += weight
+	w.sum += weight * seconds
+}
+
+func (w *decayedWindow) record(t time.Time, rtt time.Duration) {
+	w.add(histogramBucket(rtt), w.weight(t), rtt.Seconds())
+}
+
+func (w *decayedWindow) mergeHistogram(t time.Time, h *histogram) {
+	if h.n == 0 {
+		return
+	}
+
+	// The total is spread across buckets in proportion to their counts,
+	// which keeps the mean exact.
+	weight := w.weight(t)
+	mean := h.sum / float64(h.n)
+	for i, c := range h.counts {
+		if c != 0 {
+			w.add(i, weight*float64(c), mean)
+		}
+	}
+}
+
+func (w *decayedWindow) percentile(p float64) time.Duration {
+	rank := p / 100 * w.total
+	var seen float64
+	for i, c := range w.weights {
+		seen += c
+		if seen >= rank && c != 0 {
+			return histogramValue(i)
+		}
+	}
+
+	return histogramValue(len(w.weights) - 1)
+}
+
+func (w *decayedWindow) stats(now time.Time) (ws windowStats) {
+	w.weight(now)
+	ws = windowStats{End: now, Samples: w.total}
+	if w.total == 0 {
+		return
+	}
+
+	ws.MeanMs = 1000 * w.sum / w.total
+	ws.P50Ms = millis(w.percentile(50))
+	ws.P95Ms = millis(w.percentile(95))
+	ws.P99Ms = millis(w.percentile(99))
+	return
+}
+
+var (
+	hostWindowsMu sync.Mutex
+	hostWindows   = make(map[string][]statsWindow)
+)
+
+// updateWindows records a run of the target in its windows, and returns their
+// statistics as of the end of the run.
+func updateWindows(target string, r run) []windowStats {
+	hostWindowsMu.Lock()
+	defer hostWindowsMu.Unlock()
+
+	ws := hostWindows[target]
+	if ws == nil {
+		for _, spec := range windowSpecs {
+			ws = append(ws, spec.newWindow())
+		}
+
+		hostWindows[target] = ws
+	}
+
+	for _, w := range ws {
+		if r.hist != nil {
+			w.mergeHistogram(r.meta.Ended, r.hist)
+			continue
+		}
+
+		for i, rtt := range r.samples {
+			w.record(r.sent[i], rtt)
+		}
+	}
+
+	return windowStatsLocked(target, r.meta.Ended)
+}
+
+// currentWindows returns the statistics of the target's windows as of now.
+func currentWindows(target string, now time.Time) []windowStats {
+	hostWindowsMu.Lock()
+	defer hostWindowsMu.Unlock()
+	return windowStatsLocked(target, now)
+}
+
+func windowStatsLocked(target string, now time.Time) (stats []windowStats) {
+	for i, w := range hostWindows[target] {
+		s := w.stats(now)
+		s.Host = target
+		s.Window = windowSpecs[i].name
+		stats = append(stats, s)
+	}
+
+	return
+}
+
+// printWindows prints the statistics of each window.
+func printWindows(stats []windowStats) {
+	fmt.Printf("%-16s %8s %8s %8s %8s %8s\n", "Window", "Samples", "Mean", "p50", "p95", "p99")
+	for _, s := range stats {
+		if s.Samples == 0 {
+			fmt.Printf("%-16s %8d %8s %8s %8s %8s\n", s.Window, 0, "-", "-", "-", "-")
+			continue
+		}
+
+		ms := func(v float64) string { return formatLatency(time.Duration(v * float64(time.Millisecond))) }
+		fmt.Printf(
+			"%-16s %8.0f %8s %8s %8s %8s\n",
+			s.Window,
+			s.Samples,
+			ms(s.MeanMs),
+			ms(s.P50Ms),
+			ms(s.P95Ms),
+			ms(s.P99Ms))
+	}
+}
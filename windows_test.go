@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseWindows(t *testing.T) {
+	specs, err := parseWindows("sliding:1m, tumbling:10m,decay:5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []windowSpec{
+		{"sliding:1m", "sliding", time.Minute},
+		{"tumbling:10m", "tumbling", 10 * time.Minute},
+		{"decay:5m", "decay", 5 * time.Minute},
+	}
+
+	if len(specs) != len(want) {
+		t.Fatalf("parseWindows = %+v; want %+v", specs, want)
+	}
+
+	for i := range want {
+		if specs[i] != want[i] {
+			t.Errorf("window %d = %+v; want %+v", i, specs[i], want[i])
+		}
+	}
+
+	for _, bad := range []string{"sliding", "hopping:1m", "sliding:soon", "decay:10ms"} {
+		if _, err := parseWindows(bad); err == nil {
+			t.Errorf("parseWindows(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestWindows(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// A sample of 10 ms each second for ten minutes, then one of 100 ms each
+	// second for a minute.
+	record := func(w statsWindow) windowStats {
+		for i := 0; i < 660; i++ {
+			rtt := 10 * time.Millisecond
+			if i >= 600 {
+				rtt = 100 * time.Millisecond
+			}
+
+			w.record(start.Add(time.Duration(i)*time.Second), rtt)
+		}
+
+		return w.stats(start.Add(660 * time.Second))
+	}
+
+	if s := record(windowSpec{kind: "sliding", width: time.Minute}.newWindow()); s.Samples < 59 || s.Samples > 61 || s.P50Ms != 100 {
+		t.Errorf("sliding:1m = %+v; want the last minute's 100 ms samples", s)
+	}
+
+	if s := record(windowSpec{kind: "tumbling", width: 10 * time.Minute}.newWindow()); s.Samples != 600 || s.P99Ms != 10 ||
+		!s.Start.Equal(start) {
+		t.Errorf("tumbling:10m = %+v; want the first ten minutes' 10 ms samples", s)
+	}
+
+	// After a minute with a half-life of a minute, the last minute has about
+	// as much weight as the ten before it.
+	s := record(windowSpec{kind: "decay", width: time.Minute}.newWindow())
+	if s.Start != nil || math.Abs(s.MeanMs-55) > 2 {
+		t.Errorf("decay:1m = %+v; want a mean of about 55 ms", s)
+	}
+
+	if s.P95Ms < 99 || s.P95Ms > 101 {
+		t.Errorf("decay:1m p95 = %v ms; want about 100 ms", s.P95Ms)
+	}
+}